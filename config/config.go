@@ -1,8 +1,11 @@
 package config
 
 import (
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // Config holds application configuration
@@ -21,9 +24,21 @@ type Config struct {
 	MsgQueueConsumerName string
 	MsgQueueProducerName string
 
+	// Topics consumers subscribe to; empty means just MsgQueueTopic
+	MsgQueueSubscribeTopics []string
+
+	// MessageFormat selects the telemetry.Serializer for records on the
+	// queue: json (default) or protobuf
+	MessageFormat string
+
 	// CSV Streaming configuration
 	CSVPath    string
 	CSVDelayMs int
+	CSVDryRun  bool // validate the CSV without publishing
+	// CSVDelimiter separates fields; 0 keeps encoding/csv's comma
+	CSVDelimiter rune
+	// CSVLazyQuotes accepts quotes in unquoted fields and unescaped quotes in quoted ones
+	CSVLazyQuotes bool
 
 	// Server configuration
 	Port string
@@ -46,9 +61,16 @@ func Load() Config {
 		MsgQueueConsumerName: getEnv("MSG_QUEUE_CONSUMER_NAME", "collector"),
 		MsgQueueProducerName: getEnv("MSG_QUEUE_PRODUCER_NAME", "streamer"),
 
+		MsgQueueSubscribeTopics: getEnvList("MSG_QUEUE_SUBSCRIBE_TOPICS"),
+
+		MessageFormat: getEnv("MESSAGE_FORMAT", "json"),
+
 		// CSV Streaming defaults
-		CSVPath:    getEnv("CSV_PATH", "/data/dcgm_metrics_20250718_134233.csv"),
-		CSVDelayMs: getEnvInt("CSV_DELAY_MS", 1000),
+		CSVPath:       getEnv("CSV_PATH", "/data/dcgm_metrics_20250718_134233.csv"),
+		CSVDelayMs:    getEnvInt("CSV_DELAY_MS", 1000),
+		CSVDryRun:     getEnv("CSV_DRY_RUN", "false") == "true",
+		CSVDelimiter:  getEnvDelimiter("CSV_DELIMITER", ','),
+		CSVLazyQuotes: getEnv("CSV_LAZY_QUOTES", "false") == "true",
 
 		// Server defaults
 		Port: getEnv("PORT", "8080"),
@@ -74,3 +96,33 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvList gets a comma-separated environment variable as a list, skipping empty items
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvDelimiter gets a single-rune CSV delimiter from an environment variable.
+// "\t" and "tab" stand for a tab, which is awkward to pass through most tooling.
+// Values encoding/csv can't split on fall back to the default.
+func getEnvDelimiter(key string, defaultValue rune) rune {
+	value := os.Getenv(key)
+	switch value {
+	case "":
+		return defaultValue
+	case `\t`, "tab":
+		return '\t'
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		log.Printf("Invalid %s value '%s', using default: %q", key, value, defaultValue)
+		return defaultValue
+	}
+	return r
+}
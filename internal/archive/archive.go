@@ -0,0 +1,309 @@
+// Package archive batches raw telemetry messages into gzip files and uploads
+// them to object storage for long-term retention and reprocessing.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBytes          = 64 << 20
+	defaultMaxAge            = 5 * time.Minute
+	defaultMaxPendingUploads = 8
+	defaultMaxRetries        = 3
+	defaultRetryBackoff      = time.Second
+	defaultTimeout           = time.Minute
+	defaultName              = "collector"
+)
+
+// ErrClosed is returned by Write after Close
+var ErrClosed = errors.New("archive writer is closed")
+
+// Record is one archived message. Files hold one JSON record per line; Body
+// is the message exactly as it was consumed, base64-encoded like any []byte.
+type Record struct {
+	ID         string    `json:"id,omitempty"`
+	Topic      string    `json:"topic"`
+	ReceivedAt time.Time `json:"received_at"`
+	Body       []byte    `json:"body"`
+}
+
+// Store is where archive files are uploaded
+type Store interface {
+	// Put stores body under key, replacing any object already there
+	Put(ctx context.Context, key string, body []byte) error
+}
+
+// Options configures a Writer. Zero values take the defaults.
+type Options struct {
+	// Prefix starts every object key, e.g. "telemetry/raw"
+	Prefix string
+	// Name tells apart the files of writers sharing a prefix, such as the
+	// collector replicas' hostnames
+	Name string
+	// MaxBytes rotates a file once it holds this many uncompressed bytes
+	MaxBytes int
+	// MaxAge rotates a file this long after its first record
+	MaxAge time.Duration
+	// MaxPendingUploads is how many rotated files wait for the uploader
+	// before further files are dropped, so a slow store never blocks Write
+	MaxPendingUploads int
+	// MaxRetries is how many times a failed upload is retried; a negative
+	// value turns retries off
+	MaxRetries int
+	// RetryBackoff is the pause before the first retry; it doubles after each
+	RetryBackoff time.Duration
+	// Timeout bounds each upload attempt
+	Timeout time.Duration
+	// OnError is called with every file that was dropped or could not be
+	// uploaded after its retries. It may run while Write holds the writer's
+	// lock, so it must not write to the Writer.
+	OnError func(error)
+	// OnUpload is called after each file is stored
+	OnUpload func(key string, records int, size int)
+}
+
+// Writer appends records to a gzip file in memory and, once the file is big
+// or old enough, hands it to a background uploader under a new object key.
+// Write never waits for an upload.
+type Writer struct {
+	store Store
+	opts  Options
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	records int
+	size    int
+	opened  time.Time
+	seq     int
+	closed  bool
+
+	uploads   chan file
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// file is a finished archive file waiting for upload
+type file struct {
+	key     string
+	body    []byte
+	records int
+}
+
+// NewWriter returns a Writer uploading to store
+func NewWriter(store Store, opts Options) *Writer {
+	return newWriter(store, opts, time.Now)
+}
+
+func newWriter(store Store, opts Options, now func() time.Time) *Writer {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultMaxBytes
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultMaxAge
+	}
+	if opts.MaxPendingUploads <= 0 {
+		opts.MaxPendingUploads = defaultMaxPendingUploads
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Name == "" {
+		opts.Name = defaultName
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+
+	w := &Writer{
+		store:   store,
+		opts:    opts,
+		now:     now,
+		uploads: make(chan file, opts.MaxPendingUploads),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.upload()
+	go w.rotateOnAge()
+	return w
+}
+
+// Write appends record to the current file, rotating it once it reaches
+// MaxBytes
+func (w *Writer) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.gz == nil {
+		w.buf.Reset()
+		w.gz = gzip.NewWriter(&w.buf)
+		w.opened = w.now()
+	}
+	if _, err := w.gz.Write(line); err != nil {
+		return err
+	}
+	w.records++
+	w.size += len(line)
+	if w.size >= w.opts.MaxBytes {
+		w.enqueue(w.rotate())
+	}
+	return nil
+}
+
+// Flush rotates the current file, if it holds any records, without waiting
+// for its upload
+func (w *Writer) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed && w.gz != nil {
+		w.enqueue(w.rotate())
+	}
+}
+
+// Close rotates the current file and waits until it and every file before
+// it have been uploaded or given up on. Later writes return ErrClosed.
+func (w *Writer) Close() {
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		var last *file
+		if w.gz != nil {
+			f := w.rotate()
+			last = &f
+		}
+		w.mu.Unlock()
+
+		close(w.stop)
+		if last != nil {
+			// Nothing else sends once closed is set, and the uploader
+			// drains the queue, so this waits at most for one upload
+			w.uploads <- *last
+		}
+		close(w.uploads)
+		<-w.done
+	})
+}
+
+// rotate finishes the current file and names it. Callers hold mu.
+func (w *Writer) rotate() file {
+	w.gz.Close()
+	w.seq++
+	f := file{
+		key:     w.key(w.opened, w.seq),
+		body:    append([]byte(nil), w.buf.Bytes()...),
+		records: w.records,
+	}
+	w.gz = nil
+	w.buf.Reset()
+	w.records = 0
+	w.size = 0
+	return f
+}
+
+// key names a file opened at t as <prefix>/YYYY/MM/DD/HH/<name>-<time>-<seq>.ndjson.gz,
+// so files sort by time within each hour and replicas never overwrite each
+// other
+func (w *Writer) key(t time.Time, seq int) string {
+	t = t.UTC()
+	key := fmt.Sprintf("%s/%s-%s-%06d.ndjson.gz", t.Format("2006/01/02/15"), w.opts.Name, t.Format("20060102T150405.000Z"), seq)
+	if w.opts.Prefix != "" {
+		key = w.opts.Prefix + "/" + key
+	}
+	return key
+}
+
+// enqueue hands f to the uploader, dropping it if the uploader has fallen
+// MaxPendingUploads files behind. Callers hold mu and have checked closed.
+func (w *Writer) enqueue(f file) {
+	select {
+	case w.uploads <- f:
+	default:
+		w.report(fmt.Errorf("archive upload queue full, dropped %s with %d records", f.key, f.records))
+	}
+}
+
+// rotateOnAge rotates the current file once it is MaxAge old, until Close
+func (w *Writer) rotateOnAge() {
+	interval := w.opts.MaxAge / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if !w.closed && w.gz != nil && w.now().Sub(w.opened) >= w.opts.MaxAge {
+				w.enqueue(w.rotate())
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// upload stores files in the order they were rotated, until Close
+func (w *Writer) upload() {
+	defer close(w.done)
+	for f := range w.uploads {
+		w.put(f)
+	}
+}
+
+// put stores f, retrying failures, and reports a file that couldn't be
+// stored to OnError
+func (w *Writer) put(f file) {
+	backoff := w.opts.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), w.opts.Timeout)
+		err = w.store.Put(ctx, f.key, f.body)
+		cancel()
+		if err == nil {
+			if w.opts.OnUpload != nil {
+				w.opts.OnUpload(f.key, f.records, len(f.body))
+			}
+			return
+		}
+		if attempt >= w.opts.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	w.report(fmt.Errorf("archive upload of %s with %d records failed: %w", f.key, f.records, err))
+}
+
+func (w *Writer) report(err error) {
+	if w.opts.OnError != nil {
+		w.opts.OnError(err)
+	}
+}
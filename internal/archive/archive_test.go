@@ -0,0 +1,241 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory object store
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// failures is how many Puts fail before they start succeeding
+	failures int
+	attempts int
+	// block, if set, holds every Put until it is closed
+	block chan struct{}
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, body []byte) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("store unavailable")
+	}
+	s.objects[key] = body
+	return nil
+}
+
+func (s *memStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readRecords gunzips an archive file and decodes its records
+func readRecords(t *testing.T, body []byte) []Record {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Archive file is not gzip: %v", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Failed to gunzip archive file: %v", err)
+	}
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Bad archive line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func record(i int) Record {
+	return Record{
+		ID:         fmt.Sprintf("id-%d", i),
+		Topic:      "telemetry",
+		ReceivedAt: time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC),
+		Body:       []byte(fmt.Sprintf(`["2024-01-15T10:30:00Z","gpu_util","%d"]`, i)),
+	}
+}
+
+func TestWriterRotatesOnSize(t *testing.T) {
+	store := newMemStore()
+	size := len(mustLine(t, record(0)))
+	opened := time.Date(2024, 1, 15, 10, 30, 5, 0, time.UTC)
+	w := newWriter(store, Options{Prefix: "/raw/", Name: "collector-0", MaxBytes: 2 * size, MaxAge: time.Hour},
+		func() time.Time { return opened })
+
+	for i := 0; i < 5; i++ {
+		if err := w.Write(record(i)); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	w.Close()
+
+	expected := []string{
+		"raw/2024/01/15/10/collector-0-20240115T103005.000Z-000001.ndjson.gz",
+		"raw/2024/01/15/10/collector-0-20240115T103005.000Z-000002.ndjson.gz",
+		"raw/2024/01/15/10/collector-0-20240115T103005.000Z-000003.ndjson.gz",
+	}
+	keys := store.keys()
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected keys %v, got %v", expected, keys)
+	}
+	// Two full files, then the remainder written on Close
+	next := 0
+	for i, key := range keys {
+		records := readRecords(t, store.objects[key])
+		want := 2
+		if i == 2 {
+			want = 1
+		}
+		if len(records) != want {
+			t.Fatalf("Expected %d records in %s, got %d", want, key, len(records))
+		}
+		for _, r := range records {
+			if !bytes.Equal(r.Body, record(next).Body) || r.ID != record(next).ID || r.Topic != "telemetry" {
+				t.Errorf("Expected record %d in %s, got %+v", next, key, r)
+			}
+			next++
+		}
+	}
+
+	if err := w.Write(record(5)); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestWriterRotatesOnAge(t *testing.T) {
+	store := newMemStore()
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 15, 23, 59, 59, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	uploaded := make(chan string, 1)
+	w := newWriter(store, Options{MaxAge: 40 * time.Millisecond, OnUpload: func(key string, records, size int) {
+		uploaded <- key
+	}}, clock)
+	defer w.Close()
+
+	if err := w.Write(record(0)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case key := <-uploaded:
+		t.Fatalf("Expected no upload before the file is MaxAge old, got %s", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	now = now.Add(time.Minute)
+	mu.Unlock()
+	select {
+	case key := <-uploaded:
+		// Named for the hour the file was opened in
+		if expected := "2024/01/15/23/collector-20240115T235959.000Z-000001.ndjson.gz"; key != expected {
+			t.Errorf("Expected key %s, got %s", expected, key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the file to be uploaded once it was MaxAge old")
+	}
+}
+
+func TestWriterRetriesUploads(t *testing.T) {
+	store := newMemStore()
+	store.failures = 2
+	var errs []error
+	w := NewWriter(store, Options{RetryBackoff: time.Millisecond, OnError: func(err error) { errs = append(errs, err) }})
+	w.Write(record(0))
+	w.Close()
+	if store.attempts != 3 || len(store.keys()) != 1 || len(errs) != 0 {
+		t.Errorf("Expected the third attempt to succeed, got %d attempts, keys %v, errors %v", store.attempts, store.keys(), errs)
+	}
+
+	store = newMemStore()
+	store.failures = 10
+	errs = nil
+	w = NewWriter(store, Options{MaxRetries: -1, OnError: func(err error) { errs = append(errs, err) }})
+	w.Write(record(0))
+	w.Close()
+	if store.attempts != 1 || len(errs) != 1 {
+		t.Errorf("Expected one failed attempt reported, got %d attempts and errors %v", store.attempts, errs)
+	}
+}
+
+func TestWriterDoesNotBlockOnUpload(t *testing.T) {
+	store := newMemStore()
+	store.block = make(chan struct{})
+	var mu sync.Mutex
+	var dropped int
+	w := NewWriter(store, Options{MaxBytes: 1, MaxPendingUploads: 2, OnError: func(err error) {
+		mu.Lock()
+		dropped++
+		mu.Unlock()
+	}})
+
+	// Every write fills a file; with the uploader stuck on the first, two
+	// wait and the rest are dropped instead of holding up Write
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			w.Write(record(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked on a stuck upload")
+	}
+
+	close(store.block)
+	w.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if uploaded := len(store.keys()); uploaded+dropped != 10 || uploaded < 2 || uploaded > 3 {
+		t.Errorf("Expected 2-3 files uploaded and the rest dropped, got %d uploaded and %d dropped", uploaded, dropped)
+	}
+}
+
+func mustLine(t *testing.T, r Record) []byte {
+	t.Helper()
+	line, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(line, '\n')
+}
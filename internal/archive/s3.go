@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// S3Options configures an S3Store
+type S3Options struct {
+	// Endpoint is the store's base URL, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://minio:9000. Objects are addressed path-style, as
+	// <Endpoint>/<Bucket>/<key>, which every S3-compatible store accepts.
+	Endpoint string
+	Bucket   string
+	// Region signs requests; most S3-compatible stores accept us-east-1
+	Region string
+	// AccessKeyID and SecretAccessKey sign requests with AWS Signature
+	// Version 4; requests are sent unsigned when AccessKeyID is empty
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Store uploads objects to an S3-compatible endpoint with PUT Object
+type S3Store struct {
+	opts   S3Options
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3Store returns a Store uploading to opts.Bucket at opts.Endpoint
+func NewS3Store(opts S3Options) *S3Store {
+	opts.Endpoint = strings.TrimRight(opts.Endpoint, "/")
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	return &S3Store{opts: opts, client: &http.Client{}, now: time.Now}
+}
+
+// Put uploads body as the object key
+func (s *S3Store) Put(ctx context.Context, key string, body []byte) error {
+	path := "/" + uriEncode(s.opts.Bucket, false) + "/" + uriEncode(key, true)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.opts.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	if s.opts.AccessKeyID != "" {
+		s.sign(req, body)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("object store returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// sign adds AWS Signature Version 4 headers to req, covering the host, the
+// payload hash and the request time
+func (s *S3Store) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretAccessKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes s the way Signature Version 4 expects: every
+// byte but A-Z, a-z, 0-9, '-', '.', '_', '~' and, in keys, '/'
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
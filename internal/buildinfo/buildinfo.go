@@ -0,0 +1,48 @@
+// Package buildinfo reports which build of a service is running. The
+// variables are set at link time, for example:
+//
+//	go build -ldflags "-X github.com/example/telemetry/internal/buildinfo.Version=v1.2.0 \
+//	  -X github.com/example/telemetry/internal/buildinfo.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/example/telemetry/internal/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Set with -ldflags -X; unset values keep these defaults
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Info is the build information served by /version
+type Info struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information for service
+func Get(service string) Info {
+	return Info{
+		Service:   service,
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// Handler serves the build information as JSON
+func Handler(service string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get(service))
+	}
+}
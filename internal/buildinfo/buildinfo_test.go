@@ -0,0 +1,45 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// setBuildVars overrides the link-time variables for the duration of a test
+func setBuildVars(t *testing.T, version, commit, buildTime string) {
+	t.Helper()
+	oldVersion, oldCommit, oldBuildTime := Version, Commit, BuildTime
+	Version, Commit, BuildTime = version, commit, buildTime
+	t.Cleanup(func() { Version, Commit, BuildTime = oldVersion, oldCommit, oldBuildTime })
+}
+
+func TestHandler(t *testing.T) {
+	setBuildVars(t, "v1.4.2", "3f9c2ab", "2025-07-18T20:42:34Z")
+
+	w := httptest.NewRecorder()
+	Handler("api-service")(w, httptest.NewRequest("GET", "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+
+	var info Info
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := Info{
+		Service:   "api-service",
+		Version:   "v1.4.2",
+		Commit:    "3f9c2ab",
+		BuildTime: "2025-07-18T20:42:34Z",
+		GoVersion: runtime.Version(),
+	}
+	if info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+}
@@ -2,24 +2,83 @@ package consistenthash
 
 import (
 	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
 	"sort"
+	"sync"
 )
 
+// Hasher maps a key to a position on the ring. Only the top 32 bits are used.
+type Hasher func(key string) uint64
+
+// FNV-1a 64-bit parameters
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// FNV1a is the default hasher: fast and non-cryptographic. The FNV-1a hash is
+// passed through a 64-bit finalizer so that keys differing only in their last
+// characters, like virtual node names, still land far apart on the ring.
+func FNV1a(key string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= fnvPrime64
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// SHA512 hashes with truncated SHA-512, which rings used before the hasher was
+// pluggable. Use it to keep existing partition placement.
+func SHA512(key string) uint64 {
+	h := sha512.Sum512([]byte(key))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// RingEntry is a single virtual node position on the hash ring
+type RingEntry struct {
+	Hash   uint32 `json:"hash"`
+	Broker string `json:"broker"`
+}
+
 // ConsistentHash implements a consistent hashing ring with virtual nodes
 type ConsistentHash struct {
 	ring         map[uint32]string // hash -> broker
 	sortedHashes []uint32
 	brokers      []string
 	virtualNodes int // Number of virtual nodes per broker
+	hasher       Hasher
+
+	// distribution caches GetPartitionDistribution for distPartitions
+	// partitions until the ring is rebuilt. Callers may share the ring
+	// between readers, so the cache has its own lock.
+	distMu         sync.Mutex
+	distribution   map[string][]int
+	distPartitions int
 }
 
-// NewConsistentHash creates a new consistent hash ring
+// NewConsistentHash creates a new consistent hash ring using the FNV1a hasher
 func NewConsistentHash(brokers []string, virtualNodes int) *ConsistentHash {
+	return NewConsistentHashWithHasher(brokers, virtualNodes, nil)
+}
+
+// NewConsistentHashWithHasher creates a new consistent hash ring that places
+// virtual nodes and keys with hasher, or FNV1a if hasher is nil
+func NewConsistentHashWithHasher(brokers []string, virtualNodes int, hasher func(string) uint64) *ConsistentHash {
+	if hasher == nil {
+		hasher = FNV1a
+	}
 	ch := &ConsistentHash{
 		ring:         make(map[uint32]string),
 		brokers:      make([]string, len(brokers)),
 		virtualNodes: virtualNodes,
+		hasher:       hasher,
 	}
 	copy(ch.brokers, brokers)
 	ch.buildRing()
@@ -45,12 +104,15 @@ func (ch *ConsistentHash) buildRing() {
 	sort.Slice(ch.sortedHashes, func(i, j int) bool {
 		return ch.sortedHashes[i] < ch.sortedHashes[j]
 	})
+
+	ch.distMu.Lock()
+	ch.distribution = nil
+	ch.distMu.Unlock()
 }
 
-// hash computes SHA512 hash and returns first 4 bytes as uint32
+// hash returns the ring position of key: the top 32 bits of its hash
 func (ch *ConsistentHash) hash(key string) uint32 {
-	h := sha512.Sum512([]byte(key))
-	return uint32(h[0])<<24 | uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3])
+	return uint32(ch.hasher(key) >> 32)
 }
 
 // GetBroker returns the broker responsible for the given partition
@@ -152,13 +214,40 @@ func (ch *ConsistentHash) GetBrokers() []string {
 	return result
 }
 
+// ExportRing returns the virtual node positions in ring order with their owning brokers
+func (ch *ConsistentHash) ExportRing() []RingEntry {
+	entries := make([]RingEntry, len(ch.sortedHashes))
+	for i, hash := range ch.sortedHashes {
+		entries[i] = RingEntry{Hash: hash, Broker: ch.ring[hash]}
+	}
+	return entries
+}
+
 // GetBrokerCount returns the number of brokers
 func (ch *ConsistentHash) GetBrokerCount() int {
 	return len(ch.brokers)
 }
 
-// GetPartitionDistribution returns how partitions are distributed across brokers
+// GetPartitionDistribution returns how partitions are distributed across brokers.
+// The result is cached until a broker is added or removed; callers get a copy.
 func (ch *ConsistentHash) GetPartitionDistribution(maxPartitions int) map[string][]int {
+	ch.distMu.Lock()
+	defer ch.distMu.Unlock()
+
+	if ch.distribution == nil || ch.distPartitions != maxPartitions {
+		ch.distribution = ch.computePartitionDistribution(maxPartitions)
+		ch.distPartitions = maxPartitions
+	}
+
+	distribution := make(map[string][]int, len(ch.distribution))
+	for broker, partitions := range ch.distribution {
+		distribution[broker] = append([]int(nil), partitions...)
+	}
+	return distribution
+}
+
+// computePartitionDistribution looks up the broker of every partition
+func (ch *ConsistentHash) computePartitionDistribution(maxPartitions int) map[string][]int {
 	distribution := make(map[string][]int)
 
 	for i := 0; i < maxPartitions; i++ {
@@ -0,0 +1,195 @@
+package consistenthash
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExportRing(t *testing.T) {
+	brokers := []string{"http://broker-0:8080", "http://broker-1:8080", "http://broker-2:8080"}
+	ch := NewConsistentHash(brokers, 10)
+
+	entries := ch.ExportRing()
+	if len(entries) != len(brokers)*10 {
+		t.Fatalf("Expected %d ring entries, got %d", len(brokers)*10, len(entries))
+	}
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash }) {
+		t.Errorf("Expected ring entries sorted by hash")
+	}
+
+	perBroker := make(map[string]int)
+	for _, e := range entries {
+		perBroker[e.Broker]++
+	}
+	for _, b := range brokers {
+		if perBroker[b] != 10 {
+			t.Errorf("Expected 10 virtual nodes for %s, got %d", b, perBroker[b])
+		}
+	}
+
+	// The owner of a partition is the first ring entry at or after its hash
+	for partition := 0; partition < 16; partition++ {
+		hash := ch.hash(fmt.Sprintf("partition-%d", partition))
+		owner := entries[0].Broker
+		for _, e := range entries {
+			if e.Hash >= hash {
+				owner = e.Broker
+				break
+			}
+		}
+		if got := ch.GetBroker(partition); got != owner {
+			t.Errorf("Partition %d: GetBroker returned %s, exported ring says %s", partition, got, owner)
+		}
+	}
+
+	// The export is a copy; changing it must not affect routing
+	entries[0].Broker = "mutated"
+	if ch.ExportRing()[0].Broker == "mutated" {
+		t.Errorf("Expected ExportRing to return a copy")
+	}
+}
+
+// brokerNames returns n broker endpoints named like the proxy's
+func brokerNames(n int) []string {
+	brokers := make([]string, n)
+	for i := range brokers {
+		brokers[i] = fmt.Sprintf("http://msg-queue-%d.msg-queue:8080", i)
+	}
+	return brokers
+}
+
+func TestDefaultHasherDistribution(t *testing.T) {
+	const keys = 30000
+	for _, n := range []int{3, 5, 8} {
+		t.Run(fmt.Sprintf("%d brokers", n), func(t *testing.T) {
+			ch := NewConsistentHash(brokerNames(n), 150)
+
+			counts := make(map[string]int)
+			for i := 0; i < keys; i++ {
+				counts[ch.GetBrokerByTopicPartition(fmt.Sprintf("topic-%d", i%50), i/50)]++
+			}
+			if len(counts) != n {
+				t.Fatalf("Expected keys on all %d brokers, got %d", n, len(counts))
+			}
+			// 150 virtual nodes keep every broker within 20% of an even share
+			mean := float64(keys) / float64(n)
+			for broker, count := range counts {
+				if dev := (float64(count) - mean) / mean; dev > 0.2 || dev < -0.2 {
+					t.Errorf("%s got %d keys, %.0f%% off the mean of %.0f", broker, count, dev*100, mean)
+				}
+			}
+		})
+	}
+}
+
+func TestSHA512HasherKeepsPlacement(t *testing.T) {
+	ch := NewConsistentHashWithHasher(brokerNames(3), 150, SHA512)
+
+	// Positions must match the original truncated SHA-512 so partitions stay put
+	for _, key := range []string{"partition-0", "telemetry-partition-7", "http://msg-queue-0.msg-queue:8080:42"} {
+		h := sha512.Sum512([]byte(key))
+		expected := uint32(h[0])<<24 | uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3])
+		if got := ch.hash(key); got != expected {
+			t.Errorf("%s: expected position %d, got %d", key, expected, got)
+		}
+	}
+}
+
+func TestCustomHasher(t *testing.T) {
+	var calls int
+	hasher := func(key string) uint64 {
+		calls++
+		return FNV1a(key)
+	}
+	ch := NewConsistentHashWithHasher(brokerNames(2), 10, hasher)
+	if calls != 20 {
+		t.Errorf("Expected the hasher to place all 20 virtual nodes, got %d calls", calls)
+	}
+	ch.GetBroker(3)
+	if calls != 21 {
+		t.Errorf("Expected the hasher to be used for lookups, got %d calls", calls)
+	}
+}
+
+func TestPartitionDistributionCacheInvalidation(t *testing.T) {
+	brokers := brokerNames(3)
+	ch := NewConsistentHash(brokers[:2], 50)
+	const partitions = 64
+
+	// check compares the distribution against a lookup of every partition
+	check := func(step string, brokers int) {
+		t.Helper()
+		distribution := ch.GetPartitionDistribution(partitions)
+		if want := ch.computePartitionDistribution(partitions); !reflect.DeepEqual(distribution, want) {
+			t.Fatalf("%s: stale distribution %v, want %v", step, distribution, want)
+		}
+		if len(distribution) > brokers {
+			t.Fatalf("%s: expected at most %d brokers in the distribution, got %d", step, brokers, len(distribution))
+		}
+	}
+
+	check("initial", 2)
+
+	// Mutating the returned map doesn't touch the cache
+	distribution := ch.GetPartitionDistribution(partitions)
+	for broker := range distribution {
+		distribution[broker][0] = -1
+		delete(distribution, broker)
+	}
+	check("after mutating a result", 2)
+
+	ch.AddBroker(brokers[2])
+	check("after AddBroker", 3)
+	if _, ok := ch.GetPartitionDistribution(partitions)[brokers[2]]; !ok {
+		t.Error("Expected the added broker to own partitions")
+	}
+
+	ch.RemoveBroker(brokers[0])
+	check("after RemoveBroker", 2)
+	if _, ok := ch.GetPartitionDistribution(partitions)[brokers[0]]; ok {
+		t.Error("Expected the removed broker to own no partitions")
+	}
+
+	// A different partition count isn't served from the cache
+	if got := ch.GetPartitionDistribution(8); !reflect.DeepEqual(got, ch.computePartitionDistribution(8)) {
+		t.Errorf("Expected the distribution of 8 partitions, got %v", got)
+	}
+}
+
+func BenchmarkGetPartitionDistribution(b *testing.B) {
+	ch := NewConsistentHash(brokerNames(5), 150)
+	const partitions = 1024
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ch.computePartitionDistribution(partitions)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		ch.GetPartitionDistribution(partitions)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ch.GetPartitionDistribution(partitions)
+		}
+	})
+}
+
+func BenchmarkBuildRing(b *testing.B) {
+	hashers := []struct {
+		name   string
+		hasher Hasher
+	}{
+		{"fnv1a", FNV1a},
+		{"sha512", SHA512},
+	}
+	brokers := brokerNames(5)
+	for _, h := range hashers {
+		b.Run(h.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				NewConsistentHashWithHasher(brokers, 150, h.hasher)
+			}
+		})
+	}
+}
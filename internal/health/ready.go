@@ -0,0 +1,39 @@
+package health
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tracks whether a service has finished initializing its
+// dependencies. It backs the /ready endpoint, which Kubernetes uses to decide
+// whether to route traffic, while /health stays a plain liveness check.
+type Readiness struct {
+	ready int32
+}
+
+// SetReady marks the service as ready or not ready
+func (r *Readiness) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&r.ready, v)
+}
+
+// Ready reports whether the service is ready
+func (r *Readiness) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// Handler serves 200 once the service is ready and 503 before that
+func (r *Readiness) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !r.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	}
+}
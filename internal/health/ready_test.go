@@ -0,0 +1,32 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	var r Readiness
+	handler := r.Handler()
+
+	check := func(expected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/ready", nil))
+		if w.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, w.Code)
+		}
+	}
+
+	check(http.StatusServiceUnavailable)
+
+	r.SetReady(true)
+	if !r.Ready() {
+		t.Error("Expected Ready to be true after SetReady(true)")
+	}
+	check(http.StatusOK)
+
+	r.SetReady(false)
+	check(http.StatusServiceUnavailable)
+}
@@ -3,6 +3,7 @@ package influx
 
 import (
 	"context"
+	"errors"
 	"time"
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -15,18 +16,68 @@ type InfluxWriter struct {
 	client influxdb2.Client
 	org    string
 	bucket string
+	// retention bounds how far back open-ended queries scan; 0 scans all history
+	retention time.Duration
+	// recentWindows are the lookbacks QueryRecentTelemetry tries, shortest first
+	recentWindows []time.Duration
+
+	// writeAPI is created once and shared by every write; it is safe for
+	// concurrent use
+	writeAPI api.WriteAPIBlocking
+	// asyncAPI buffers points and writes them in batches in the background;
+	// nil unless the writer was created with NewAsyncInfluxWriter
+	asyncAPI api.WriteAPI
+}
+
+// AsyncOptions configures an InfluxWriter that writes in the background
+type AsyncOptions struct {
+	// BatchSize is how many points are sent in one request
+	BatchSize uint
+	// FlushInterval is the longest a point waits in the buffer
+	FlushInterval time.Duration
+	// OnError is called with every failed batch write, from a background
+	// goroutine; retryable failures are retried by the client afterwards
+	OnError func(error)
 }
 
 func NewInfluxWriter(url, token, org, bucket string) *InfluxWriter {
 	client := influxdb2.NewClient(url, token)
-	return &InfluxWriter{client: client, org: org, bucket: bucket}
+	return &InfluxWriter{client: client, org: org, bucket: bucket, retention: getRetention(), recentWindows: getRecentWindows(), writeAPI: client.WriteAPIBlocking(org, bucket)}
+}
+
+// NewAsyncInfluxWriter returns a writer whose WriteTelemetry only buffers the
+// point and returns; batches are written in the background and failures are
+// reported through opts.OnError rather than to the caller. Flush or Close
+// sends whatever is still buffered.
+func NewAsyncInfluxWriter(url, token, org, bucket string, opts AsyncOptions) *InfluxWriter {
+	options := influxdb2.DefaultOptions()
+	if opts.BatchSize > 0 {
+		options.SetBatchSize(opts.BatchSize)
+	}
+	if opts.FlushInterval > 0 {
+		options.SetFlushInterval(uint(opts.FlushInterval / time.Millisecond))
+	}
+	client := influxdb2.NewClientWithOptions(url, token, options)
+	iw := &InfluxWriter{client: client, org: org, bucket: bucket, retention: getRetention(), recentWindows: getRecentWindows(), writeAPI: client.WriteAPIBlocking(org, bucket)}
+	iw.asyncAPI = client.WriteAPI(org, bucket)
+	if opts.OnError != nil {
+		// The channel is closed by client.Close, which ends the goroutine
+		errs := iw.asyncAPI.Errors()
+		go func() {
+			for err := range errs {
+				opts.OnError(err)
+			}
+		}()
+	}
+	return iw
 }
 
 func (iw *InfluxWriter) WriteTelemetry(record telemetry.TelemetryRecord) error {
 	fmt.Printf("Writing to InfluxDB: device=%s, metric=%s, value=%f, time=%s\n", record.DeviceID, record.Metric, record.Value, record.Time.Format(time.RFC3339))
-	writeAPI := iw.client.WriteAPIBlocking(iw.org, iw.bucket)
 	p := influxdb2.NewPoint(
 		record.Metric,
+		// Tag names are independent of TelemetryRecord's JSON names; modelName
+		// and Hostname stay as they are so existing series and queries match
 		map[string]string{
 			"device_id": record.DeviceID,
 			"gpu_id": record.GPUID,
@@ -37,28 +88,71 @@ func (iw *InfluxWriter) WriteTelemetry(record telemetry.TelemetryRecord) error {
 			"pod": record.Pod,
 			"namespace": record.Namespace,
 			"labels_raw": record.LabelsRaw,
+			"driver_version": record.DriverVersion,
 		},
 		map[string]interface{}{
 			"value": record.Value,
 		},
 		record.Time, // This is the point's official timestamp
 	)
-	return writeAPI.WritePoint(context.Background(), p)
+	if iw.asyncAPI != nil {
+		iw.asyncAPI.WritePoint(p)
+		return nil
+	}
+	return iw.writeAPI.WritePoint(context.Background(), p)
+}
+
+// Flush sends any points buffered by an async writer and waits for them; it
+// does nothing for a blocking writer
+func (iw *InfluxWriter) Flush() {
+	if iw.asyncAPI != nil {
+		iw.asyncAPI.Flush()
+	}
 }
 
 func (iw *InfluxWriter) Close() {
 	iw.client.Close()
 }
 
-// QueryRecentTelemetry fetches the most recent N telemetry records from InfluxDB
+// Ping checks that InfluxDB is reachable
+func (iw *InfluxWriter) Ping(ctx context.Context) error {
+	ok, err := iw.client.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("influxdb ping failed")
+	}
+	return nil
+}
+
+// source is what the writer's queries read
+func (iw *InfluxWriter) source() fluxSource {
+	return fluxSource{bucket: iw.bucket, retention: iw.retention}
+}
+
+// QueryRecentTelemetry fetches the most recent N telemetry records from InfluxDB.
+// It looks back over each of the writer's recent windows in turn until one
+// has data, so GPUs that stopped reporting a while ago are still found.
 func (iw *InfluxWriter) QueryRecentTelemetry(limit int) ([]telemetry.TelemetryRecord, error) {
-       queryAPI := iw.client.QueryAPI(iw.org)
-       flux := `from(bucket: "` + iw.bucket + `") |> range(start: -24h) |> sort(columns:["_time"], desc:true) |> limit(n:` +  fmt.Sprintf("%d", limit) + `)`
-       result, err := queryAPI.Query(context.Background(), flux)
-       if err != nil {
-	       return nil, err
-       }
-       return iw.parseQueryResults(result)
+	queryAPI := iw.client.QueryAPI(iw.org)
+	records := []telemetry.TelemetryRecord{}
+	for _, window := range iw.recentWindows {
+		result, err := queryAPI.Query(context.Background(), buildRecentQuery(iw.source(), window, limit))
+		if err != nil {
+			return nil, err
+		}
+		records, err = iw.parseQueryResults(result)
+		if err != nil || len(records) > 0 {
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+// buildRecentQuery builds the Flux query QueryRecentTelemetry runs for window
+func buildRecentQuery(src fluxSource, window time.Duration, limit int) string {
+	return newFluxQuery(src, rangeSince(window)).sortDesc("_time").limit(limit).String()
 }
 
 /*from(bucket: "telem_bucket")
@@ -68,8 +162,7 @@ func (iw *InfluxWriter) QueryRecentTelemetry(limit int) ([]telemetry.TelemetryRe
   |> yield(name: "unique") */
 func (iw *InfluxWriter) QueryUniqueUUIDs() ([]string, error) {
 	queryAPI := iw.client.QueryAPI(iw.org)
-	flux := fmt.Sprintf(`from(bucket: "%s") |> range(start: 0) |> group(columns: ["uuid"]) |> keep(columns: ["uuid"]) |> distinct(column: "uuid")`, iw.bucket)
-	result, err := queryAPI.Query(context.Background(), flux)
+	result, err := queryAPI.Query(context.Background(), buildUniqueUUIDsQuery(iw.source()))
 	if err != nil {
 		return nil, err
 	}
@@ -87,17 +180,65 @@ func (iw *InfluxWriter) QueryUniqueUUIDs() ([]string, error) {
 	return uuids, nil
 }
 
+// buildUniqueUUIDsQuery builds the Flux query used by QueryUniqueUUIDs
+func buildUniqueUUIDsQuery(src fluxSource) string {
+	return newFluxQuery(src, rangeAll()).group("uuid").keep("uuid").distinct("uuid").String()
+}
+
+// QueryGPUsWithLastSeen fetches the most recent point of every GPU, one record
+// per UUID, so its tags describe the GPU and its time is when it was last seen
+func (iw *InfluxWriter) QueryGPUsWithLastSeen() ([]telemetry.TelemetryRecord, error) {
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildLastSeenQuery(iw.source()))
+	if err != nil {
+		return nil, err
+	}
+	return iw.parseQueryResults(result)
+}
+
+// buildLastSeenQuery builds the Flux query used by QueryGPUsWithLastSeen. The
+// last point of each series is taken first, which InfluxDB can push down to
+// storage, then the newest of those is kept per UUID.
+func buildLastSeenQuery(src fluxSource) string {
+	return newFluxQuery(src, rangeAll()).last().group("uuid").max("_time").String()
+}
+
 // QueryTelemetryByDevice fetches telemetry records for a specific device
 func (iw *InfluxWriter) QueryTelemetryByDevice(uuid string) ([]telemetry.TelemetryRecord, error) {
 	queryAPI := iw.client.QueryAPI(iw.org)
-	flux := `from(bucket: "` + iw.bucket + `") |> range(start: 0) |> filter(fn: (r) => r.uuid == "` + uuid + `") |> sort(columns:["_time"], desc:true)`
-	result, err := queryAPI.Query(context.Background(), flux)
+	result, err := queryAPI.Query(context.Background(), buildDeviceQuery(iw.source(), uuid, rangeAll()))
+	if err != nil {
+		return nil, err
+	}
+	return iw.parseQueryResults(result)
+}
+
+// QueryTelemetryByDeviceSince fetches telemetry records for a specific device from the last window
+func (iw *InfluxWriter) QueryTelemetryByDeviceSince(uuid string, window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildDeviceQuery(iw.source(), uuid, rangeSince(window)))
+	if err != nil {
+		return nil, err
+	}
+	return iw.parseQueryResults(result)
+}
+
+// QueryLatestTelemetry fetches the most recent record of each metric for every
+// device seen in the last window. A window of 0 scans all history.
+func (iw *InfluxWriter) QueryLatestTelemetry(window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildLatestQuery(iw.source(), window))
 	if err != nil {
 		return nil, err
 	}
 	return iw.parseQueryResults(result)
 }
 
+// buildLatestQuery builds the Flux query used by QueryLatestTelemetry
+func buildLatestQuery(src fluxSource, window time.Duration) string {
+	return newFluxQuery(src, rangeSince(window)).group("uuid", "_measurement").last().String()
+}
+
 // QueryTelemetryByDeviceTimeRange fetches telemetry records for a specific device within a time range
 func (iw *InfluxWriter) QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) ([]telemetry.TelemetryRecord, error) {
 	queryAPI := iw.client.QueryAPI(iw.org)
@@ -110,26 +251,127 @@ func (iw *InfluxWriter) QueryTelemetryByDeviceTimeRange(uuid string, startTime,
 	if err != nil {
 		return nil, fmt.Errorf("invalid end time format: %v", err)
 	}
-	
-	// Use proper RFC3339 formatting for InfluxDB
-	flux := fmt.Sprintf(`from(bucket: "%s") |> range(start: %s, stop: %s) |> filter(fn: (r) => r.uuid == "%s") |> sort(columns:["_time"], desc:true)`, 
-		iw.bucket, 
-		parsedStart.Format(time.RFC3339), 
-		parsedEnd.Format(time.RFC3339), 
-		uuid)
-	
-	result, err := queryAPI.Query(context.Background(), flux)
+
+	result, err := queryAPI.Query(context.Background(), buildDeviceQuery(iw.source(), uuid, rangeBetween(parsedStart, parsedEnd)))
+	if err != nil {
+		return nil, err
+	}
+	return iw.parseQueryResults(result)
+}
+
+// buildDeviceQuery builds the Flux query for a single device over r
+func buildDeviceQuery(src fluxSource, uuid string, r fluxRange) string {
+	return newFluxQuery(src, r).filterEquals("uuid", uuid).sortDesc("_time").String()
+}
+
+// QueryTelemetryByDevices fetches telemetry records for several devices in a single query.
+// Zero start or end times leave that side of the range open, and limit (if positive) caps the
+// records returned per device. Every requested UUID has an entry in the result, even if empty.
+func (iw *InfluxWriter) QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (map[string][]telemetry.TelemetryRecord, error) {
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildDevicesQuery(iw.source(), uuids, start, end, limit))
+	if err != nil {
+		return nil, err
+	}
+	records, err := iw.parseQueryResults(result)
+	if err != nil {
+		return nil, err
+	}
+	return groupByUUID(uuids, records), nil
+}
+
+// buildDevicesQuery builds the Flux query used by QueryTelemetryByDevices
+func buildDevicesQuery(src fluxSource, uuids []string, start, end time.Time, limit int) string {
+	return newFluxQuery(src, rangeBetween(start, end)).
+		filterIn("uuid", uuids).group("uuid").sortDesc("_time").limit(limit).String()
+}
+
+// QueryTelemetryByHost fetches telemetry records from every GPU on a host, newest first.
+// Zero start or end times leave that side of the range open, and limit (if positive) caps
+// the records returned across all of the host's GPUs.
+func (iw *InfluxWriter) QueryTelemetryByHost(hostname string, start, end time.Time, limit int) ([]telemetry.TelemetryRecord, error) {
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildHostQuery(iw.source(), hostname, start, end, limit))
 	if err != nil {
 		return nil, err
 	}
 	return iw.parseQueryResults(result)
 }
 
+// buildHostQuery builds the Flux query used by QueryTelemetryByHost. The host's series
+// are merged into one table so that the sort and limit apply across its GPUs.
+func buildHostQuery(src fluxSource, hostname string, start, end time.Time, limit int) string {
+	return newFluxQuery(src, rangeBetween(start, end)).
+		filterEquals("Hostname", hostname).group().sortDesc("_time").limit(limit).String()
+}
+
+// Functions QueryFleetAggregate can apply
+const (
+	AggregateMean = "mean"
+	AggregateMax  = "max"
+)
+
+// ErrNoData is returned by QueryFleetAggregate when the metric has no points in the range
+var ErrNoData = errors.New("no data in range")
+
+// IsFleetAggregate reports whether QueryFleetAggregate accepts fn
+func IsFleetAggregate(fn string) bool {
+	return fn == AggregateMean || fn == AggregateMax
+}
+
+// QueryFleetAggregate returns the mean or max of a metric across every GPU
+// between start and end, computed by InfluxDB so no points are fetched. Zero
+// start or end times leave that side of the range open.
+func (iw *InfluxWriter) QueryFleetAggregate(metric string, start, end time.Time, fn string) (float64, error) {
+	if !IsFleetAggregate(fn) {
+		return 0, fmt.Errorf("unsupported aggregate function %q", fn)
+	}
+	queryAPI := iw.client.QueryAPI(iw.org)
+	result, err := queryAPI.Query(context.Background(), buildFleetAggregateQuery(iw.source(), metric, start, end, fn))
+	if err != nil {
+		return 0, err
+	}
+	records, err := iw.parseQueryResults(result)
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, ErrNoData
+	}
+	return records[0].Value, nil
+}
+
+// buildFleetAggregateQuery builds the Flux query used by QueryFleetAggregate.
+// Every GPU's series is merged into one table first, so the aggregate covers
+// the whole fleet rather than each series.
+func buildFleetAggregateQuery(src fluxSource, metric string, start, end time.Time, fn string) string {
+	q := newFluxQuery(src, rangeBetween(start, end)).
+		filterEquals("_measurement", metric).filterEquals("_field", "value").group()
+	if fn == AggregateMax {
+		return q.max("_value").String()
+	}
+	return q.mean().String()
+}
+
+// groupByUUID splits records by device UUID, keeping an empty slice for UUIDs without records
+func groupByUUID(uuids []string, records []telemetry.TelemetryRecord) map[string][]telemetry.TelemetryRecord {
+	grouped := make(map[string][]telemetry.TelemetryRecord, len(uuids))
+	for _, uuid := range uuids {
+		grouped[uuid] = []telemetry.TelemetryRecord{}
+	}
+	for _, rec := range records {
+		if _, ok := grouped[rec.UUID]; ok {
+			grouped[rec.UUID] = append(grouped[rec.UUID], rec)
+		}
+	}
+	return grouped
+}
+
 // parseQueryResults is a helper function to parse query results into TelemetryRecord structs
 func (iw *InfluxWriter) parseQueryResults(result *api.QueryTableResult) ([]telemetry.TelemetryRecord, error) {
 	records := []telemetry.TelemetryRecord{}
 	for result.Next() {
-		var deviceID, metric, gpuID, uuid, modelName, hostname, container, pod, namespace, labelsRaw string
+		var deviceID, metric, gpuID, uuid, modelName, hostname, container, pod, namespace, labelsRaw, driverVersion string
 		var value float64
 		
 		if v := result.Record().ValueByKey("device_id"); v != nil {
@@ -192,6 +434,11 @@ func (iw *InfluxWriter) parseQueryResults(result *api.QueryTableResult) ([]telem
 				labelsRaw = s
 			}
 		}
+		if v := result.Record().ValueByKey("driver_version"); v != nil {
+			if s, ok := v.(string); ok {
+				driverVersion = s
+			}
+		}
 		
 		rec := telemetry.TelemetryRecord{
 			DeviceID:  deviceID,
@@ -206,6 +453,8 @@ func (iw *InfluxWriter) parseQueryResults(result *api.QueryTableResult) ([]telem
 			Pod:       pod,
 			Namespace: namespace,
 			LabelsRaw: labelsRaw,
+
+			DriverVersion: driverVersion,
 		}
 		records = append(records, rec)
 	}
@@ -0,0 +1,573 @@
+package influx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+func TestBuildDevicesQuery(t *testing.T) {
+	start := time.Date(2025, 7, 18, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+
+	flux := buildDevicesQuery(fluxSource{bucket: "telem_bucket"}, []string{"GPU-a", "GPU-b"}, start, end, 50)
+	for _, expected := range []string{
+		`from(bucket: "telem_bucket")`,
+		`range(start: 2025-07-18T00:00:00Z, stop: 2025-07-19T00:00:00Z)`,
+		`contains(value: r.uuid, set: ["GPU-a", "GPU-b"])`,
+		`group(columns: ["uuid"])`,
+		`limit(n:50)`,
+	} {
+		if !strings.Contains(flux, expected) {
+			t.Errorf("Expected query to contain %s, got %s", expected, flux)
+		}
+	}
+
+	open := buildDevicesQuery(fluxSource{bucket: "telem_bucket"}, []string{"GPU-a"}, time.Time{}, time.Time{}, 0)
+	if !strings.Contains(open, "range(start: 0)") {
+		t.Errorf("Expected an open range without times, got %s", open)
+	}
+	if strings.Contains(open, "limit(") {
+		t.Errorf("Expected no limit when limit is 0, got %s", open)
+	}
+
+	quoted := buildDevicesQuery(fluxSource{bucket: "telem_bucket"}, []string{`GPU-"x`}, time.Time{}, time.Time{}, 0)
+	if !strings.Contains(quoted, `"GPU-\"x"`) {
+		t.Errorf("Expected UUIDs to be quoted, got %s", quoted)
+	}
+}
+
+func TestGroupByUUID(t *testing.T) {
+	records := []telemetry.TelemetryRecord{
+		{UUID: "GPU-a", Value: 1},
+		{UUID: "GPU-b", Value: 2},
+		{UUID: "GPU-a", Value: 3},
+		{UUID: "GPU-other", Value: 4},
+	}
+
+	grouped := groupByUUID([]string{"GPU-a", "GPU-b", "GPU-missing"}, records)
+
+	if len(grouped) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(grouped))
+	}
+	if len(grouped["GPU-a"]) != 2 || grouped["GPU-a"][0].Value != 1 || grouped["GPU-a"][1].Value != 3 {
+		t.Errorf("Unexpected records for GPU-a: %+v", grouped["GPU-a"])
+	}
+	if len(grouped["GPU-b"]) != 1 || grouped["GPU-b"][0].Value != 2 {
+		t.Errorf("Unexpected records for GPU-b: %+v", grouped["GPU-b"])
+	}
+	if missing := grouped["GPU-missing"]; missing == nil || len(missing) != 0 {
+		t.Errorf("Expected an empty slice for GPU-missing, got %#v", missing)
+	}
+	if _, ok := grouped["GPU-other"]; ok {
+		t.Errorf("Records for unrequested UUIDs should be dropped")
+	}
+}
+
+// parseFluxString reads the Flux string literal at the start of s and returns
+// its value and whatever follows the closing quote
+func parseFluxString(t *testing.T, s string) (string, string) {
+	t.Helper()
+	if !strings.HasPrefix(s, `"`) {
+		t.Fatalf("Expected a string literal, got %s", s)
+	}
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			value.WriteByte(s[i])
+		case '"':
+			return value.String(), s[i+1:]
+		case '$':
+			if i+1 < len(s) && s[i+1] == '{' {
+				t.Fatalf("Unescaped interpolation in %s", s)
+			}
+			value.WriteByte('$')
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	t.Fatalf("Unterminated string literal %s", s)
+	return "", ""
+}
+
+func TestDeviceQueryEscaping(t *testing.T) {
+	ids := []string{
+		"GPU-5fd4f087-86f3-7a43-b711-4771313afc50",
+		`GPU-"x`,
+		`GPU-\`,
+		`GPU-\"`,
+		`x") or r.uuid != ("`,
+		`x" or true or "`,
+		"${r._value}",
+		"GPU-$x",
+	}
+
+	for _, id := range ids {
+		for _, flux := range []string{
+			buildDeviceQuery(fluxSource{bucket: "telem_bucket"}, id, rangeAll()),
+			buildDevicesQuery(fluxSource{bucket: "telem_bucket"}, []string{id}, time.Time{}, time.Time{}, 0),
+		} {
+			marker := "set: ["
+			if strings.Contains(flux, "r.uuid == ") {
+				marker = "r.uuid == "
+			}
+			idx := strings.Index(flux, marker)
+			if idx < 0 {
+				t.Fatalf("Expected %q in query %s", marker, flux)
+			}
+
+			value, rest := parseFluxString(t, flux[idx+len(marker):])
+			if value != id {
+				t.Errorf("Expected literal to decode to %q, got %q (query %s)", id, value, flux)
+			}
+			// The literal must be followed directly by the rest of the original query
+			if !strings.HasPrefix(rest, ")") && !strings.HasPrefix(rest, "]") {
+				t.Errorf("ID %q escaped its literal: %s", id, flux)
+			}
+		}
+	}
+}
+
+func TestBuildHostQuery(t *testing.T) {
+	start := time.Date(2025, 7, 18, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+
+	flux := buildHostQuery(fluxSource{bucket: "telem_bucket"}, "mtv5-dgx1-hgpu-031", start, end, 50)
+	for _, expected := range []string{
+		`from(bucket: "telem_bucket")`,
+		`range(start: 2025-07-18T00:00:00Z, stop: 2025-07-19T00:00:00Z)`,
+		`filter(fn: (r) => r.Hostname == "mtv5-dgx1-hgpu-031")`,
+		`group() |> sort(columns:["_time"], desc:true) |> limit(n:50)`,
+	} {
+		if !strings.Contains(flux, expected) {
+			t.Errorf("Expected query to contain %s, got %s", expected, flux)
+		}
+	}
+
+	open := buildHostQuery(fluxSource{bucket: "telem_bucket"}, "host-1", time.Time{}, time.Time{}, 0)
+	if !strings.Contains(open, "range(start: 0)") || strings.Contains(open, "limit(") {
+		t.Errorf("Expected an open range without a limit, got %s", open)
+	}
+
+	// Hostnames with quotes, backslashes or interpolation stay inside their literal
+	for _, hostname := range []string{`host"1`, `host\`, `x" or true or "`, "${r._value}", "node 7/rack:a"} {
+		flux := buildHostQuery(fluxSource{bucket: "telem_bucket"}, hostname, time.Time{}, time.Time{}, 0)
+		marker := "r.Hostname == "
+		idx := strings.Index(flux, marker)
+		if idx < 0 {
+			t.Fatalf("Expected %q in query %s", marker, flux)
+		}
+		value, rest := parseFluxString(t, flux[idx+len(marker):])
+		if value != hostname {
+			t.Errorf("Expected literal to decode to %q, got %q (query %s)", hostname, value, flux)
+		}
+		if !strings.HasPrefix(rest, ")") {
+			t.Errorf("Hostname %q escaped its literal: %s", hostname, flux)
+		}
+	}
+}
+
+func TestFluxString(t *testing.T) {
+	tests := map[string]string{
+		"GPU-1":    `"GPU-1"`,
+		`a"b`:      `"a\"b"`,
+		`a\b`:      `"a\\b"`,
+		"${x}":     `"\${x}"`,
+		"cost: $5": `"cost: $5"`,
+	}
+	for in, expected := range tests {
+		if got := fluxString(in); got != expected {
+			t.Errorf("fluxString(%q) = %s, expected %s", in, got, expected)
+		}
+	}
+}
+
+func TestDeviceWindowQuery(t *testing.T) {
+	flux := buildDeviceQuery(fluxSource{bucket: "telem_bucket"}, "GPU-1", rangeSince(time.Hour))
+	if !strings.Contains(flux, "|> range(start: -1h) |>") {
+		t.Errorf("Expected a relative one hour range, got %s", flux)
+	}
+	if strings.Contains(flux, "start: 0") {
+		t.Errorf("Expected the window query not to scan from time zero: %s", flux)
+	}
+}
+
+func TestFluxDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		time.Hour:               "1h",
+		24 * time.Hour:          "24h",
+		90 * time.Minute:        "90m",
+		45 * time.Second:        "45s",
+		1500 * time.Millisecond: "1500ms",
+		time.Microsecond:        "1us",
+		time.Nanosecond:         "1ns",
+	}
+	for d, expected := range tests {
+		if got := fluxDuration(d); got != expected {
+			t.Errorf("fluxDuration(%v) = %s, expected %s", d, got, expected)
+		}
+	}
+}
+
+func TestBuildLatestQuery(t *testing.T) {
+	flux := buildLatestQuery(fluxSource{bucket: "telem_bucket"}, 15*time.Minute)
+	for _, part := range []string{
+		`from(bucket: "telem_bucket")`,
+		"|> range(start: -15m) |>",
+		`group(columns: ["uuid", "_measurement"]) |> last()`,
+	} {
+		if !strings.Contains(flux, part) {
+			t.Errorf("Expected query to contain %q, got %s", part, flux)
+		}
+	}
+	if all := buildLatestQuery(fluxSource{bucket: "telem_bucket"}, 0); !strings.Contains(all, "range(start: 0)") {
+		t.Errorf("Expected a zero window to scan all history, got %s", all)
+	}
+}
+
+func TestBuildLastSeenQuery(t *testing.T) {
+	flux := buildLastSeenQuery(fluxSource{bucket: `telem"bucket`})
+	for _, part := range []string{
+		`from(bucket: "telem\"bucket")`,
+		"range(start: 0) |> last()",
+		`group(columns: ["uuid"]) |> max(column: "_time")`,
+	} {
+		if !strings.Contains(flux, part) {
+			t.Errorf("Expected query to contain %q, got %s", part, flux)
+		}
+	}
+}
+
+// writeServer is a fake InfluxDB that counts written points and answers every
+// write with status
+func writeServer(t testing.TB, status int) (*httptest.Server, *int64) {
+	t.Helper()
+	var points int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		atomic.AddInt64(&points, int64(strings.Count(strings.TrimSpace(string(body)), "\n")+1))
+		if status != http.StatusNoContent {
+			http.Error(w, `{"code":"invalid","message":"bad point"}`, status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &points
+}
+
+// eventually waits up to 5s for cond, as async batches finish after Flush
+// hands them to the writer goroutine
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met within 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testRecord() telemetry.TelemetryRecord {
+	return telemetry.TelemetryRecord{
+		DeviceID: "nvidia0", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 42, UUID: "GPU-a",
+		Time: time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC),
+	}
+}
+
+func TestWriteTelemetryBlocking(t *testing.T) {
+	server, points := writeServer(t, http.StatusNoContent)
+	iw := NewInfluxWriter(server.URL, "token", "org", "bucket")
+	defer iw.Close()
+
+	api := iw.writeAPI
+	for i := 0; i < 3; i++ {
+		if err := iw.WriteTelemetry(testRecord()); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt64(points); got != 3 {
+		t.Errorf("Expected 3 points written, got %d", got)
+	}
+	if iw.writeAPI != api {
+		t.Error("Expected the write API to be reused across writes")
+	}
+
+	failing, _ := writeServer(t, http.StatusBadRequest)
+	bad := NewInfluxWriter(failing.URL, "token", "org", "bucket")
+	defer bad.Close()
+	if err := bad.WriteTelemetry(testRecord()); err == nil {
+		t.Error("Expected a blocking write to return the server's error")
+	}
+}
+
+func TestAsyncWrites(t *testing.T) {
+	server, points := writeServer(t, http.StatusNoContent)
+	iw := NewAsyncInfluxWriter(server.URL, "token", "org", "bucket", AsyncOptions{BatchSize: 10, FlushInterval: time.Hour})
+	defer iw.Close()
+
+	for i := 0; i < 25; i++ {
+		if err := iw.WriteTelemetry(testRecord()); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	// Full batches go out on their own; the rest waits for a flush
+	iw.Flush()
+	eventually(t, func() bool { return atomic.LoadInt64(points) == 25 })
+}
+
+func TestAsyncWriteErrorsReachCallback(t *testing.T) {
+	server, _ := writeServer(t, http.StatusBadRequest)
+	var mu sync.Mutex
+	var errs []error
+	iw := NewAsyncInfluxWriter(server.URL, "token", "org", "bucket", AsyncOptions{
+		BatchSize: 5,
+		OnError: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	})
+	defer iw.Close()
+
+	// The write itself succeeds; the failure is reported once the batch is sent
+	if err := iw.WriteTelemetry(testRecord()); err != nil {
+		t.Fatalf("Expected an async write to return nil, got %v", err)
+	}
+	iw.Flush()
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error through the callback, got %d", len(errs))
+	}
+	if !strings.Contains(errs[0].Error(), "bad point") {
+		t.Errorf("Expected the server's message in the error, got %v", errs[0])
+	}
+}
+
+// BenchmarkWriteTelemetry compares one blocking request per point with
+// batched async writes against a local fake InfluxDB
+func BenchmarkWriteTelemetry(b *testing.B) {
+	server, _ := writeServer(b, http.StatusNoContent)
+	record := testRecord()
+
+	b.Run("blocking", func(b *testing.B) {
+		iw := NewInfluxWriter(server.URL, "token", "org", "bucket")
+		defer iw.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := iw.WriteTelemetry(record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("async", func(b *testing.B) {
+		iw := NewAsyncInfluxWriter(server.URL, "token", "org", "bucket", AsyncOptions{BatchSize: 500, FlushInterval: time.Second})
+		defer iw.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := iw.WriteTelemetry(record); err != nil {
+				b.Fatal(err)
+			}
+		}
+		iw.Flush()
+	})
+}
+
+// queryServer is a fake InfluxDB that records the Flux of every query and
+// answers with one record only for queries whose range starts at dataStart
+func queryServer(t *testing.T, dataStart string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		queries = append(queries, body.Query)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if !strings.Contains(body.Query, "range(start: "+dataStart+")") {
+			return
+		}
+		io.WriteString(w, "#datatype,string,long,dateTime:RFC3339,double,string,string\r\n"+
+			"#group,false,false,false,false,true,true\r\n"+
+			"#default,_result,,,,,\r\n"+
+			",result,table,_time,_value,_measurement,uuid\r\n"+
+			",,0,2025-07-12T10:00:00Z,42,DCGM_FI_DEV_GPU_UTIL,GPU-stale\r\n\r\n")
+	}))
+	t.Cleanup(server.Close)
+	return server, &queries
+}
+
+func TestQueryRecentTelemetryWidensWindow(t *testing.T) {
+	t.Setenv("INFLUX_RECENT_WINDOWS", "24h,168h,720h")
+
+	// Data only in the second window: the first comes back empty and the
+	// third is never tried
+	server, queries := queryServer(t, "-168h")
+	iw := NewInfluxWriter(server.URL, "token", "org", "telem_bucket")
+	defer iw.Close()
+	records, err := iw.QueryRecentTelemetry(10)
+	if err != nil {
+		t.Fatalf("QueryRecentTelemetry failed: %v", err)
+	}
+	if len(records) != 1 || records[0].UUID != "GPU-stale" || records[0].Value != 42 {
+		t.Fatalf("Expected the record from the 168h window, got %+v", records)
+	}
+	if len(*queries) != 2 || !strings.Contains((*queries)[0], "range(start: -24h)") {
+		t.Errorf("Expected a 24h query followed by a 168h one, got %q", *queries)
+	}
+
+	// Nothing in any window
+	empty, queries := queryServer(t, "-8760h")
+	iw = NewInfluxWriter(empty.URL, "token", "org", "telem_bucket")
+	defer iw.Close()
+	records, err = iw.QueryRecentTelemetry(10)
+	if err != nil {
+		t.Fatalf("QueryRecentTelemetry failed: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("Expected no records, got %+v", records)
+	}
+	if len(*queries) != 3 || !strings.Contains((*queries)[2], "range(start: -720h)") {
+		t.Errorf("Expected every window to be tried up to 720h, got %q", *queries)
+	}
+}
+
+func TestBuildFleetAggregateQuery(t *testing.T) {
+	start := time.Date(2025, 7, 18, 20, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	flux := buildFleetAggregateQuery(fluxSource{bucket: "telem_bucket"}, "DCGM_FI_DEV_GPU_UTIL", start, end, AggregateMean)
+	for _, part := range []string{
+		"range(start: 2025-07-18T20:00:00Z, stop: 2025-07-18T21:00:00Z)",
+		`filter(fn: (r) => r._measurement == "DCGM_FI_DEV_GPU_UTIL")`,
+		`filter(fn: (r) => r._field == "value") |> group() |> mean()`,
+	} {
+		if !strings.Contains(flux, part) {
+			t.Errorf("Expected query to contain %q, got %s", part, flux)
+		}
+	}
+	if max := buildFleetAggregateQuery(fluxSource{bucket: "telem_bucket"}, "DCGM_FI_DEV_GPU_UTIL", start, end, AggregateMax); !strings.HasSuffix(max, `group() |> max(column: "_value")`) {
+		t.Errorf("Expected a max over the merged table, got %s", max)
+	}
+}
+
+// fleetServer is a fake InfluxDB holding utilization points of several GPUs.
+// It answers a fleet aggregate query the way InfluxDB would, aggregating the
+// points of every GPU when the query merges their series with group(), and
+// each GPU's series on its own otherwise.
+func fleetServer(t *testing.T, points map[string][]float64) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tables [][]float64
+		if strings.Contains(body.Query, "|> group() |>") {
+			var all []float64
+			for _, values := range points {
+				all = append(all, values...)
+			}
+			tables = append(tables, all)
+		} else {
+			for _, values := range points {
+				tables = append(tables, values)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		io.WriteString(w, "#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n")
+		for i, values := range tables {
+			if len(values) == 0 {
+				continue
+			}
+			agg := values[0]
+			for _, v := range values[1:] {
+				if strings.HasSuffix(body.Query, "mean()") {
+					agg += v
+				} else if v > agg {
+					agg = v
+				}
+			}
+			if strings.HasSuffix(body.Query, "mean()") {
+				agg /= float64(len(values))
+			}
+			fmt.Fprintf(w, ",,%d,%g\r\n", i, agg)
+		}
+		io.WriteString(w, "\r\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestQueryFleetAggregate(t *testing.T) {
+	server := fleetServer(t, map[string][]float64{
+		"GPU-a": {10, 20},
+		"GPU-b": {90},
+		"GPU-c": {30, 40, 50},
+	})
+	iw := NewInfluxWriter(server.URL, "token", "org", "telem_bucket")
+	defer iw.Close()
+	end := time.Now()
+
+	// The mean weighs every point of every GPU: (10+20+90+30+40+50)/6
+	mean, err := iw.QueryFleetAggregate("DCGM_FI_DEV_GPU_UTIL", end.Add(-time.Hour), end, AggregateMean)
+	if err != nil {
+		t.Fatalf("QueryFleetAggregate failed: %v", err)
+	}
+	if mean != 40 {
+		t.Errorf("Expected a fleet mean of 40, got %v", mean)
+	}
+	max, err := iw.QueryFleetAggregate("DCGM_FI_DEV_GPU_UTIL", end.Add(-time.Hour), end, AggregateMax)
+	if err != nil {
+		t.Fatalf("QueryFleetAggregate failed: %v", err)
+	}
+	if max != 90 {
+		t.Errorf("Expected a fleet max of 90, got %v", max)
+	}
+
+	if _, err := iw.QueryFleetAggregate("DCGM_FI_DEV_GPU_UTIL", end.Add(-time.Hour), end, "sum"); err == nil {
+		t.Error("Expected an unsupported function to be rejected")
+	}
+
+	empty := fleetServer(t, nil)
+	iw = NewInfluxWriter(empty.URL, "token", "org", "telem_bucket")
+	defer iw.Close()
+	if _, err := iw.QueryFleetAggregate("DCGM_FI_DEV_GPU_UTIL", end.Add(-time.Hour), end, AggregateMean); !errors.Is(err, ErrNoData) {
+		t.Errorf("Expected ErrNoData without points, got %v", err)
+	}
+}
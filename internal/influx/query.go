@@ -0,0 +1,262 @@
+package influx
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultRetention matches the bucket retention the deployment guide sets up
+// (720h). A longer real retention only hides the older data from open-ended
+// queries; set INFLUX_RETENTION to match the bucket.
+const defaultRetention = 30 * 24 * time.Hour
+
+// getRetention returns the bucket retention from INFLUX_RETENTION (a duration
+// such as 168h) or the default; 0 turns clamping off
+func getRetention() time.Duration {
+	if retentionStr := os.Getenv("INFLUX_RETENTION"); retentionStr != "" {
+		if d, err := time.ParseDuration(retentionStr); err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Invalid INFLUX_RETENTION value '%s', using default: %v", retentionStr, defaultRetention)
+	}
+	return defaultRetention
+}
+
+// defaultRecentWindows are the lookbacks QueryRecentTelemetry tries in turn
+var defaultRecentWindows = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+// getRecentWindows returns the lookbacks QueryRecentTelemetry widens through,
+// from INFLUX_RECENT_WINDOWS (comma-separated durations such as 24h,168h) or
+// the default. The windows must be positive and increasing.
+func getRecentWindows() []time.Duration {
+	windowsStr := os.Getenv("INFLUX_RECENT_WINDOWS")
+	if windowsStr == "" {
+		return defaultRecentWindows
+	}
+	var windows []time.Duration
+	for _, part := range strings.Split(windowsStr, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 || (len(windows) > 0 && d <= windows[len(windows)-1]) {
+			log.Printf("Invalid INFLUX_RECENT_WINDOWS value '%s', using default: %v", windowsStr, defaultRecentWindows)
+			return defaultRecentWindows
+		}
+		windows = append(windows, d)
+	}
+	return windows
+}
+
+// fluxSource is the bucket a query reads and how long the bucket keeps data
+type fluxSource struct {
+	bucket string
+	// retention is where open-ended ranges start, as a duration before now;
+	// 0 starts them at time zero
+	retention time.Duration
+}
+
+// fluxRange is the bounds of a query's range() stage as Flux time literals.
+// An empty start is open-ended and is resolved against the source's retention.
+type fluxRange struct {
+	start, stop string
+}
+
+// rangeAll covers all history
+func rangeAll() fluxRange {
+	return fluxRange{}
+}
+
+// rangeSince covers the last window; a window of 0 or less covers all history
+func rangeSince(window time.Duration) fluxRange {
+	if window <= 0 {
+		return rangeAll()
+	}
+	return fluxRange{start: "-" + fluxDuration(window)}
+}
+
+// rangeBetween covers start to end, leaving a side with a zero time open
+func rangeBetween(start, end time.Time) fluxRange {
+	var r fluxRange
+	if !start.IsZero() {
+		r.start = start.UTC().Format(time.RFC3339)
+	}
+	if !end.IsZero() {
+		r.stop = end.UTC().Format(time.RFC3339)
+	}
+	return r
+}
+
+// args renders r as the argument list of range(). An open start is clamped to
+// now minus retention, since nothing older is left to scan.
+func (r fluxRange) args(retention time.Duration) string {
+	start := r.start
+	if start == "" {
+		start = "0"
+		if retention > 0 {
+			start = "-" + fluxDuration(retention)
+		}
+	}
+	if r.stop == "" {
+		return "start: " + start
+	}
+	return "start: " + start + ", stop: " + r.stop
+}
+
+// fluxQuery composes a Flux pipeline stage by stage. Every bucket, column
+// and value passed in is quoted by the builder, so callers never splice raw
+// strings into a query.
+type fluxQuery struct {
+	stages []string
+}
+
+// newFluxQuery starts a query reading src over r
+func newFluxQuery(src fluxSource, r fluxRange) *fluxQuery {
+	return &fluxQuery{stages: []string{
+		"from(bucket: " + fluxString(src.bucket) + ")",
+		"range(" + r.args(src.retention) + ")",
+	}}
+}
+
+func (q *fluxQuery) pipe(stage string) *fluxQuery {
+	q.stages = append(q.stages, stage)
+	return q
+}
+
+// filterEquals keeps rows whose column equals value
+func (q *fluxQuery) filterEquals(column, value string) *fluxQuery {
+	return q.pipe(fmt.Sprintf("filter(fn: (r) => %s == %s)", fluxColumn(column), fluxString(value)))
+}
+
+// filterIn keeps rows whose column is one of values
+func (q *fluxQuery) filterIn(column string, values []string) *fluxQuery {
+	return q.pipe(fmt.Sprintf("filter(fn: (r) => contains(value: %s, set: %s))", fluxColumn(column), fluxStringArray(values)))
+}
+
+// group regroups rows by columns; without columns everything is merged into one table
+func (q *fluxQuery) group(columns ...string) *fluxQuery {
+	if len(columns) == 0 {
+		return q.pipe("group()")
+	}
+	return q.pipe("group(columns: " + fluxStringArray(columns) + ")")
+}
+
+// keep drops every column but columns
+func (q *fluxQuery) keep(columns ...string) *fluxQuery {
+	return q.pipe("keep(columns: " + fluxStringArray(columns) + ")")
+}
+
+// distinct keeps the distinct values of column
+func (q *fluxQuery) distinct(column string) *fluxQuery {
+	return q.pipe("distinct(column: " + fluxString(column) + ")")
+}
+
+// last keeps the last row of each table
+func (q *fluxQuery) last() *fluxQuery {
+	return q.pipe("last()")
+}
+
+// mean replaces each table with the mean of its _value column
+func (q *fluxQuery) mean() *fluxQuery {
+	return q.pipe("mean()")
+}
+
+// max keeps the row with the highest column value in each table
+func (q *fluxQuery) max(column string) *fluxQuery {
+	return q.pipe("max(column: " + fluxString(column) + ")")
+}
+
+// sortDesc sorts each table by columns, highest first
+func (q *fluxQuery) sortDesc(columns ...string) *fluxQuery {
+	return q.pipe("sort(columns:" + fluxStringArray(columns) + ", desc:true)")
+}
+
+// limit keeps the first n rows of each table; n of 0 or less keeps them all
+func (q *fluxQuery) limit(n int) *fluxQuery {
+	if n <= 0 {
+		return q
+	}
+	return q.pipe(fmt.Sprintf("limit(n:%d)", n))
+}
+
+// String returns the query text
+func (q *fluxQuery) String() string {
+	return strings.Join(q.stages, " |> ")
+}
+
+// fluxColumn refers to column of the row r, as r.name for plain identifiers
+// and r["name"] otherwise
+func fluxColumn(column string) string {
+	if isFluxIdentifier(column) {
+		return "r." + column
+	}
+	return "r[" + fluxString(column) + "]"
+}
+
+// isFluxIdentifier reports whether s is a letter or underscore followed by
+// letters, digits or underscores
+func isFluxIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+		if !isLetter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// fluxStringArray quotes values as a Flux array of string literals
+func fluxStringArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fluxString(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// fluxString quotes s as a Flux string literal. Backslashes, quotes and "${"
+// (which would start string interpolation) are escaped so that user-supplied
+// identifiers can't break out of the literal.
+func fluxString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			b.WriteString(`\$`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// fluxDuration formats d as a Flux duration literal in the largest unit that
+// represents it exactly, e.g. 1h, 90m or 1500ms
+func fluxDuration(d time.Duration) string {
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+		{"us", time.Microsecond},
+	}
+	for _, u := range units {
+		if d%u.size == 0 {
+			return fmt.Sprintf("%d%s", d/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dns", d)
+}
@@ -0,0 +1,196 @@
+package influx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFluxQueryStages(t *testing.T) {
+	flux := newFluxQuery(fluxSource{bucket: "telem_bucket"}, rangeAll()).
+		filterEquals("uuid", "GPU-1").
+		filterIn("_measurement", []string{"DCGM_FI_DEV_GPU_UTIL", "DCGM_FI_DEV_GPU_TEMP"}).
+		group("uuid", "_measurement").
+		keep("uuid").
+		distinct("uuid").
+		last().
+		max("_time").
+		sortDesc("_time").
+		limit(10).
+		String()
+
+	expected := `from(bucket: "telem_bucket") |> range(start: 0)` +
+		` |> filter(fn: (r) => r.uuid == "GPU-1")` +
+		` |> filter(fn: (r) => contains(value: r._measurement, set: ["DCGM_FI_DEV_GPU_UTIL", "DCGM_FI_DEV_GPU_TEMP"]))` +
+		` |> group(columns: ["uuid", "_measurement"])` +
+		` |> keep(columns: ["uuid"])` +
+		` |> distinct(column: "uuid")` +
+		` |> last()` +
+		` |> max(column: "_time")` +
+		` |> sort(columns:["_time"], desc:true)` +
+		` |> limit(n:10)`
+	if flux != expected {
+		t.Errorf("Unexpected query:\n got %s\nwant %s", flux, expected)
+	}
+
+	// An ungrouped group() merges every table; a limit of 0 is left out
+	flux = newFluxQuery(fluxSource{bucket: "b"}, rangeAll()).group().limit(0).String()
+	if flux != `from(bucket: "b") |> range(start: 0) |> group()` {
+		t.Errorf("Unexpected query: %s", flux)
+	}
+}
+
+func TestFluxRanges(t *testing.T) {
+	start := time.Date(2025, 7, 18, 2, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	end := time.Date(2025, 7, 19, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		r        fluxRange
+		expected string
+	}{
+		{"All history", rangeAll(), "start: 0"},
+		{"Window", rangeSince(90 * time.Minute), "start: -90m"},
+		{"Zero window", rangeSince(0), "start: 0"},
+		{"Start and end in UTC", rangeBetween(start, end), "start: 2025-07-18T00:00:00Z, stop: 2025-07-19T00:00:00Z"},
+		{"Open end", rangeBetween(start, time.Time{}), "start: 2025-07-18T00:00:00Z"},
+		{"Open start", rangeBetween(time.Time{}, end), "start: 0, stop: 2025-07-19T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flux := newFluxQuery(fluxSource{bucket: "b"}, tt.r).String()
+			if want := `from(bucket: "b") |> range(` + tt.expected + `)`; flux != want {
+				t.Errorf("Expected %s, got %s", want, flux)
+			}
+		})
+	}
+}
+
+func TestFluxQueryEscaping(t *testing.T) {
+	hostile := `x") |> drop() |> yield(name: "${token}`
+
+	flux := newFluxQuery(fluxSource{bucket: hostile}, rangeAll()).filterEquals("Hostname", hostile).filterIn("uuid", []string{hostile}).String()
+	// Only the builder's own stages are present; the hostile text stays quoted
+	if got := strings.Count(flux, "|> drop()"); got != 3 {
+		t.Errorf("Expected the injected text only inside the 3 literals, got %d occurrences in %s", got, flux)
+	}
+	for _, literal := range []string{
+		`from(bucket: "x\") |> drop() |> yield(name: \"\${token}")`,
+		`r.Hostname == "x\") |> drop() |> yield(name: \"\${token}")`,
+		`set: ["x\") |> drop() |> yield(name: \"\${token}"]`,
+	} {
+		if !strings.Contains(flux, literal) {
+			t.Errorf("Expected %s in %s", literal, flux)
+		}
+	}
+
+	tests := map[string]string{
+		"uuid":        "r.uuid",
+		"_time":       "r._time",
+		"gpu_id2":     "r.gpu_id2",
+		"2fast":       `r["2fast"]`,
+		"model-name":  `r["model-name"]`,
+		`a"] or true`: `r["a\"] or true"]`,
+		"":            `r[""]`,
+	}
+	for column, expected := range tests {
+		if got := fluxColumn(column); got != expected {
+			t.Errorf("fluxColumn(%q) = %s, expected %s", column, got, expected)
+		}
+	}
+
+	flux = newFluxQuery(fluxSource{bucket: "b"}, rangeAll()).filterEquals("model-name", "H100").group(`a"b`).String()
+	if !strings.Contains(flux, `filter(fn: (r) => r["model-name"] == "H100")`) || !strings.Contains(flux, `group(columns: ["a\"b"])`) {
+		t.Errorf("Expected column names to be quoted, got %s", flux)
+	}
+}
+
+func TestBuildRecentAndUniqueQueries(t *testing.T) {
+	recent := buildRecentQuery(fluxSource{bucket: `telem"bucket`}, 24*time.Hour, 25)
+	if recent != `from(bucket: "telem\"bucket") |> range(start: -24h) |> sort(columns:["_time"], desc:true) |> limit(n:25)` {
+		t.Errorf("Unexpected recent query: %s", recent)
+	}
+	unique := buildUniqueUUIDsQuery(fluxSource{bucket: "telem_bucket"})
+	if unique != `from(bucket: "telem_bucket") |> range(start: 0) |> group(columns: ["uuid"]) |> keep(columns: ["uuid"]) |> distinct(column: "uuid")` {
+		t.Errorf("Unexpected unique UUIDs query: %s", unique)
+	}
+}
+
+func TestOpenRangesClampedToRetention(t *testing.T) {
+	week := fluxSource{bucket: "telem_bucket", retention: 7 * 24 * time.Hour}
+	start := time.Date(2025, 7, 18, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 7, 19, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		flux     string
+		expected string
+	}{
+		{"Device history", buildDeviceQuery(week, "GPU-1", rangeAll()), "range(start: -168h)"},
+		{"Zero window", buildLatestQuery(week, 0), "range(start: -168h)"},
+		{"GPU list", buildLastSeenQuery(week), "range(start: -168h)"},
+		{"Unique UUIDs", buildUniqueUUIDsQuery(week), "range(start: -168h)"},
+		{"Open start", buildHostQuery(week, "host-1", time.Time{}, end, 0), "range(start: -168h, stop: 2025-07-19T00:00:00Z)"},
+		// Bounded starts are left as asked
+		{"Window", buildLatestQuery(week, time.Hour), "range(start: -1h)"},
+		{"Explicit start", buildDevicesQuery(week, []string{"GPU-1"}, start, time.Time{}, 0), "range(start: 2025-07-18T00:00:00Z)"},
+		// Without a retention open ranges still start at time zero
+		{"No retention", buildDeviceQuery(fluxSource{bucket: "telem_bucket"}, "GPU-1", rangeAll()), "range(start: 0)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(tt.flux, tt.expected) {
+				t.Errorf("Expected %s in %s", tt.expected, tt.flux)
+			}
+		})
+	}
+}
+
+func TestGetRetention(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultRetention},
+		{"168h", 7 * 24 * time.Hour},
+		{"0", 0},
+		{"-1h", defaultRetention},
+		{"7d", defaultRetention},
+	}
+	for _, tt := range tests {
+		t.Setenv("INFLUX_RETENTION", tt.value)
+		if got := getRetention(); got != tt.expected {
+			t.Errorf("INFLUX_RETENTION=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+
+	t.Setenv("INFLUX_RETENTION", "72h")
+	iw := NewInfluxWriter("http://localhost:8086", "token", "org", "telem_bucket")
+	defer iw.Close()
+	if src := iw.source(); src.bucket != "telem_bucket" || src.retention != 72*time.Hour {
+		t.Errorf("Expected the writer to query telem_bucket with a 72h retention, got %+v", src)
+	}
+}
+
+func TestGetRecentWindows(t *testing.T) {
+	day, week := 24*time.Hour, 7*24*time.Hour
+	tests := []struct {
+		value    string
+		expected []time.Duration
+	}{
+		{"", defaultRecentWindows},
+		{"24h", []time.Duration{day}},
+		{"24h, 168h", []time.Duration{day, week}},
+		{"168h,24h", defaultRecentWindows},
+		{"24h,24h", defaultRecentWindows},
+		{"0,24h", defaultRecentWindows},
+		{"7d", defaultRecentWindows},
+	}
+	for _, tt := range tests {
+		t.Setenv("INFLUX_RECENT_WINDOWS", tt.value)
+		if got := getRecentWindows(); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("INFLUX_RECENT_WINDOWS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
@@ -1,13 +1,55 @@
 package metrics
 
 import (
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// LatencyBuckets are histogram buckets (in seconds) tuned for telemetry workloads:
+// from 100µs for in-memory message handling up to 10s for slow database queries
+var LatencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5,
+	1, 2.5, 5, 10,
+}
+
+// MessageSizeBuckets are histogram buckets (in bytes) for message payloads: from
+// 16B for a bare reading up to 4MB, growing fourfold
+var MessageSizeBuckets = prometheus.ExponentialBuckets(16, 4, 10)
+
+// BucketsFromEnv returns histogram buckets parsed from a comma-separated list of
+// seconds in the given environment variable, or the defaults if unset or invalid
+func BucketsFromEnv(key string, defaults []float64) []float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaults
+	}
+
+	buckets := []float64{}
+	for _, part := range strings.Split(value, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || b <= 0 {
+			log.Printf("Invalid %s value '%s', using default buckets", key, value)
+			return defaults
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			log.Printf("Invalid %s value '%s': buckets must be strictly increasing, using default buckets", key, value)
+			return defaults
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
 var (
 	// HTTP metrics
 	HTTPRequestsTotal = prometheus.NewCounterVec(
@@ -22,7 +64,7 @@ var (
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_seconds",
 			Help:    "Duration of HTTP requests in seconds",
-			Buckets: prometheus.DefBuckets,
+			Buckets: BucketsFromEnv("HTTP_DURATION_BUCKETS", LatencyBuckets),
 		},
 		[]string{"service", "method", "endpoint"},
 	)
@@ -48,7 +90,7 @@ var (
 		prometheus.HistogramOpts{
 			Name:    "message_processing_duration_seconds",
 			Help:    "Duration of message processing in seconds",
-			Buckets: prometheus.DefBuckets,
+			Buckets: BucketsFromEnv("MESSAGE_PROCESSING_BUCKETS", LatencyBuckets),
 		},
 		[]string{"service", "topic"},
 	)
@@ -66,7 +108,7 @@ var (
 		prometheus.HistogramOpts{
 			Name:    "database_operation_duration_seconds",
 			Help:    "Duration of database operations in seconds",
-			Buckets: prometheus.DefBuckets,
+			Buckets: BucketsFromEnv("DATABASE_DURATION_BUCKETS", LatencyBuckets),
 		},
 		[]string{"service", "operation"},
 	)
@@ -138,6 +180,204 @@ var (
 		},
 		[]string{"service"},
 	)
+
+	ProxyTopicRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_topic_requests_total",
+			Help: "Total number of requests handled by the proxy per topic",
+		},
+		[]string{"service", "request_type", "topic", "status"},
+	)
+
+	ProxyTopicRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_topic_request_duration_seconds",
+			Help:    "Duration of proxy request forwarding per topic in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service", "request_type", "topic"},
+	)
+
+	ProxyMessageBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_message_bytes",
+			Help:    "Size of produce request bodies forwarded by the proxy in bytes",
+			Buckets: MessageSizeBuckets,
+		},
+		[]string{"service", "topic"},
+	)
+
+	ProxyBrokerConnsInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_broker_connections_in_use",
+			Help: "Number of proxy connections to each broker currently carrying a request",
+		},
+		[]string{"service", "broker"},
+	)
+
+	ProxyBrokerConnsIdle = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_broker_connections_idle",
+			Help: "Number of open proxy connections to each broker waiting in the idle pool",
+		},
+		[]string{"service", "broker"},
+	)
+
+	ProxyBrokerConnsAcquired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_broker_connections_acquired_total",
+			Help: "Total number of connections taken for broker requests, by whether the connection was reused",
+		},
+		[]string{"service", "broker", "reused"},
+	)
+
+	// Queue client metrics
+	QueueConsumerReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_consumer_reconnects_total",
+			Help: "Total number of times a queue consumer reconnected to a partition stream",
+		},
+		[]string{"consumer", "partition", "reason"},
+	)
+
+	QueueConsumerMessagesHandled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_consumer_messages_handled_total",
+			Help: "Total number of messages successfully handled by a queue consumer",
+		},
+		[]string{"consumer", "partition"},
+	)
+
+	QueueConsumerAckFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_consumer_ack_failures_total",
+			Help: "Total number of failed message acknowledgments by a queue consumer",
+		},
+		[]string{"consumer", "partition"},
+	)
+
+	QueueConsumerDuplicatesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_consumer_duplicates_skipped_total",
+			Help: "Total number of redelivered messages a queue consumer acked without handling again because their earlier ack failed",
+		},
+		[]string{"consumer", "partition"},
+	)
+
+	// Broker back-pressure metrics
+	BrokerProduceRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_produce_rejected_total",
+			Help: "Total number of produces rejected because the partition queue was full",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	BrokerProduceThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_produce_throttled_total",
+			Help: "Total number of produces rejected with 429 because the topic's produce rate limit was exceeded",
+		},
+		[]string{"topic"},
+	)
+
+	BrokerProduceBackpressure = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_produce_backpressure_total",
+			Help: "Total number of produces rejected with 429 because the partition queue was above its high watermark",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	BrokerRequeueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_requeue_dropped_total",
+			Help: "Total number of attempts to requeue an expired in-flight message that found the partition queue full",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	BrokerPendingEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_pending_evicted_total",
+			Help: "Total number of expired in-flight messages evicted and lost because the partition queue stayed full",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	BrokerPendingBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "broker_pending_bytes",
+			Help: "Payload bytes of the messages delivered on a partition but not yet acked",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	BrokerConsumerLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "broker_consumer_lag",
+			Help: "Messages an active consumer group has yet to ack on a partition: those waiting for delivery plus the group's unacked ones",
+		},
+		[]string{"topic", "partition", "group"},
+	)
+
+	BrokerMessageBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "broker_message_bytes",
+			Help:    "Size of produced message payloads in bytes",
+			Buckets: MessageSizeBuckets,
+		},
+		[]string{"topic"},
+	)
+
+	// Collector metrics
+	CollectorOutOfRange = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_out_of_range_total",
+			Help: "Total number of telemetry values outside their metric's sanity bounds",
+		},
+		[]string{"metric"},
+	)
+
+	CollectorValidationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_validation_failures_total",
+			Help: "Total number of telemetry records rejected by validation, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	CollectorDuplicatesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_duplicates_skipped_total",
+			Help: "Total number of redelivered messages skipped because their ID was already written",
+		},
+		[]string{"topic"},
+	)
+
+	// Streamer metrics
+	StreamerRecordsSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streamer_records_skipped_total",
+			Help: "Total number of CSV rows the streamer skipped instead of publishing",
+		},
+		[]string{"reason"},
+	)
+
+	// API metrics
+	APIInfluxQueriesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "api_influx_queries_in_flight",
+			Help: "Number of InfluxDB queries the API is currently running",
+		},
+	)
+
+	APIInfluxQueriesRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_influx_queries_rejected_total",
+			Help: "Total number of API requests rejected because no InfluxDB query slot freed up in time",
+		},
+	)
 )
 
 // InitMetrics registers all metrics with Prometheus
@@ -158,6 +398,30 @@ func InitMetrics(serviceName string) {
 		ProxyBrokerRequests,
 		ProxyBrokerHealth,
 		ProxyHealthChecks,
+		ProxyTopicRequestsTotal,
+		ProxyTopicRequestDuration,
+		ProxyMessageBytes,
+		ProxyBrokerConnsInUse,
+		ProxyBrokerConnsIdle,
+		ProxyBrokerConnsAcquired,
+		QueueConsumerReconnects,
+		QueueConsumerMessagesHandled,
+		QueueConsumerAckFailures,
+		QueueConsumerDuplicatesSkipped,
+		BrokerProduceRejected,
+		BrokerProduceThrottled,
+		BrokerProduceBackpressure,
+		BrokerRequeueDropped,
+		BrokerPendingEvicted,
+		BrokerPendingBytes,
+		BrokerConsumerLag,
+		BrokerMessageBytes,
+		CollectorOutOfRange,
+		CollectorValidationFailures,
+		CollectorDuplicatesSkipped,
+		StreamerRecordsSkipped,
+		APIInfluxQueriesInFlight,
+		APIInfluxQueriesRejected,
 	)
 
 	// Set initial health status
@@ -247,3 +511,101 @@ func SetServiceHealth(serviceName string, healthy bool) {
 		ServiceHealth.WithLabelValues(serviceName).Set(0)
 	}
 }
+
+// RecordConsumerReconnect records a queue consumer reconnecting to a partition stream
+func RecordConsumerReconnect(consumer string, partition int, reason string) {
+	QueueConsumerReconnects.WithLabelValues(consumer, strconv.Itoa(partition), reason).Inc()
+}
+
+// RecordConsumerMessageHandled records a message successfully handled by a queue consumer
+func RecordConsumerMessageHandled(consumer string, partition int) {
+	QueueConsumerMessagesHandled.WithLabelValues(consumer, strconv.Itoa(partition)).Inc()
+}
+
+// RecordConsumerAckFailure records a failed acknowledgment by a queue consumer
+func RecordConsumerAckFailure(consumer string, partition int) {
+	QueueConsumerAckFailures.WithLabelValues(consumer, strconv.Itoa(partition)).Inc()
+}
+
+// RecordConsumerDuplicateSkipped records a redelivered message acked without
+// being handled again
+func RecordConsumerDuplicateSkipped(consumer string, partition int) {
+	QueueConsumerDuplicatesSkipped.WithLabelValues(consumer, strconv.Itoa(partition)).Inc()
+}
+
+// RecordBrokerProduceRejected records a produce rejected because the partition queue was full
+func RecordBrokerProduceRejected(topic string, partition int) {
+	BrokerProduceRejected.WithLabelValues(topic, strconv.Itoa(partition)).Inc()
+}
+
+// RecordBrokerProduceThrottled records a produce turned away by the topic's produce rate limit
+func RecordBrokerProduceThrottled(topic string) {
+	BrokerProduceThrottled.WithLabelValues(topic).Inc()
+}
+
+// RecordBrokerProduceBackpressure records a produce turned away because the partition queue was above its high watermark
+func RecordBrokerProduceBackpressure(topic string, partition int) {
+	BrokerProduceBackpressure.WithLabelValues(topic, strconv.Itoa(partition)).Inc()
+}
+
+// RecordBrokerRequeueDropped records an expired message that could not be requeued because the partition queue was full
+func RecordBrokerRequeueDropped(topic string, partition int) {
+	BrokerRequeueDropped.WithLabelValues(topic, strconv.Itoa(partition)).Inc()
+}
+
+// RecordBrokerPendingEvicted records an expired message evicted from pending, and lost, after its requeue kept failing
+func RecordBrokerPendingEvicted(topic string, partition int) {
+	BrokerPendingEvicted.WithLabelValues(topic, strconv.Itoa(partition)).Inc()
+}
+
+// SetBrokerPendingBytes records the payload bytes pending acks on a partition
+func SetBrokerPendingBytes(topic string, partition int, bytes int64) {
+	BrokerPendingBytes.WithLabelValues(topic, strconv.Itoa(partition)).Set(float64(bytes))
+}
+
+// SetBrokerConsumerLag records a consumer group's lag on a partition
+func SetBrokerConsumerLag(topic string, partition int, group string, lag int) {
+	BrokerConsumerLag.WithLabelValues(topic, strconv.Itoa(partition), group).Set(float64(lag))
+}
+
+// DeleteBrokerConsumerLag stops exporting a consumer group's lag on a partition
+func DeleteBrokerConsumerLag(topic string, partition int, group string) {
+	BrokerConsumerLag.DeleteLabelValues(topic, strconv.Itoa(partition), group)
+}
+
+// RecordBrokerMessageBytes records the payload size of a message produced to topic
+func RecordBrokerMessageBytes(topic string, size int) {
+	BrokerMessageBytes.WithLabelValues(topic).Observe(float64(size))
+}
+
+// RecordProxyMessageBytes records the body size of a produce request forwarded for topic
+func RecordProxyMessageBytes(serviceName, topic string, size int) {
+	ProxyMessageBytes.WithLabelValues(serviceName, topic).Observe(float64(size))
+}
+
+// RecordCollectorOutOfRange records a telemetry value outside its metric's sanity bounds
+func RecordCollectorOutOfRange(metric string) {
+	CollectorOutOfRange.WithLabelValues(metric).Inc()
+}
+
+// RecordCollectorValidationFailure records a telemetry record rejected by validation
+func RecordCollectorValidationFailure(reason string) {
+	CollectorValidationFailures.WithLabelValues(reason).Inc()
+}
+
+// RecordCollectorDuplicateSkipped records a redelivered message skipped by the collector
+func RecordCollectorDuplicateSkipped(topic string) {
+	CollectorDuplicatesSkipped.WithLabelValues(topic).Inc()
+}
+
+// RecordStreamerRecordSkipped records a CSV row the streamer skipped; reason is
+// malformed (the row couldn't be parsed), incomplete (too few fields) or
+// invalid (its timestamp or value doesn't parse, with a binary MESSAGE_FORMAT)
+func RecordStreamerRecordSkipped(reason string) {
+	StreamerRecordsSkipped.WithLabelValues(reason).Inc()
+}
+
+// RecordAPIQueryRejected records an API request turned away by the InfluxDB query limit
+func RecordAPIQueryRejected() {
+	APIInfluxQueriesRejected.Inc()
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBucketsFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []float64
+	}{
+		{"Unset", "", LatencyBuckets},
+		{"Custom", "0.001, 0.01,0.1,1", []float64{0.001, 0.01, 0.1, 1}},
+		{"Not a number", "0.1,fast", LatencyBuckets},
+		{"Not increasing", "0.1,0.01", LatencyBuckets},
+		{"Duplicate", "0.1,0.1", LatencyBuckets},
+		{"Negative", "-1,1", LatencyBuckets},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_BUCKETS", tt.value)
+			if got := BucketsFromEnv("TEST_BUCKETS", LatencyBuckets); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected buckets %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCustomBucketObservations(t *testing.T) {
+	t.Setenv("TEST_BUCKETS", "0.0005,0.005,0.05")
+
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "test_duration_seconds",
+			Help:    "Test histogram",
+			Buckets: BucketsFromEnv("TEST_BUCKETS", LatencyBuckets),
+		},
+		[]string{"service"},
+	)
+	registry.MustRegister(histogram)
+
+	// Sub-millisecond, a few milliseconds, and one beyond the largest bucket
+	for _, v := range []float64{0.0002, 0.003, 0.004, 1.5} {
+		histogram.WithLabelValues("test").Observe(v)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("Expected 1 metric family, got %d", len(families))
+	}
+
+	h := families[0].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 4 {
+		t.Errorf("Expected 4 samples, got %d", h.GetSampleCount())
+	}
+
+	// Bucket counts are cumulative
+	expected := map[float64]uint64{0.0005: 1, 0.005: 3, 0.05: 3}
+	buckets := h.GetBucket()
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %d", len(expected), len(buckets))
+	}
+	for _, b := range buckets {
+		if b.GetCumulativeCount() != expected[b.GetUpperBound()] {
+			t.Errorf("Bucket le=%v: expected %d, got %d", b.GetUpperBound(), expected[b.GetUpperBound()], b.GetCumulativeCount())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Pusher sends a service's metrics to a Prometheus Pushgateway, so jobs that
+// exit before Prometheus scrapes /metrics still report them. A nil *Pusher is
+// valid and does nothing.
+type Pusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewPusherFromEnv returns a Pusher for job when PUSHGATEWAY_URL is set, or nil
+// otherwise. PUSHGATEWAY_INTERVAL_MS additionally pushes on that interval; by
+// default metrics are only pushed on Stop.
+func NewPusherFromEnv(job string) *Pusher {
+	url := os.Getenv("PUSHGATEWAY_URL")
+	if url == "" {
+		return nil
+	}
+
+	var interval time.Duration
+	if msStr := os.Getenv("PUSHGATEWAY_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			interval = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid PUSHGATEWAY_INTERVAL_MS value '%s', using default: push on shutdown only", msStr)
+		}
+	}
+	return newPusher(url, job, prometheus.DefaultGatherer, interval)
+}
+
+func newPusher(url, job string, gatherer prometheus.Gatherer, interval time.Duration) *Pusher {
+	pusher := push.New(url, job).Gatherer(gatherer)
+	// Keep replicas of the same job from overwriting each other's metrics
+	if host, err := os.Hostname(); err == nil {
+		pusher = pusher.Grouping("instance", host)
+	}
+	return &Pusher{
+		pusher:   pusher,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins periodic pushes when an interval is configured
+func (p *Pusher) Start() {
+	if p == nil || p.interval <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if err := p.pusher.Push(); err != nil {
+					log.Printf("Failed to push metrics to pushgateway: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends periodic pushes and pushes the final metrics. Call it once the
+// service's work is done, just before exiting.
+func (p *Pusher) Stop() error {
+	if p == nil {
+		return nil
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.wg.Wait()
+	return p.pusher.Push()
+}
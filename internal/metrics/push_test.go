@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakePushgateway records the pushes it receives
+type fakePushgateway struct {
+	mu     sync.Mutex
+	pushes []recordedPush
+}
+
+type recordedPush struct {
+	method string
+	path   string
+	body   []byte
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	g.mu.Lock()
+	g.pushes = append(g.pushes, recordedPush{method: r.Method, path: r.URL.Path, body: body})
+	g.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *fakePushgateway) received() []recordedPush {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]recordedPush(nil), g.pushes...)
+}
+
+func TestPusherPushesOnStop(t *testing.T) {
+	gateway := &fakePushgateway{}
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	registry := prometheus.NewRegistry()
+	health := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "service_health", Help: "test"}, []string{"service"})
+	registry.MustRegister(health)
+	health.WithLabelValues("streamer-service").Set(1)
+
+	p := newPusher(server.URL, "streamer-service", registry, 0)
+	p.Start()
+	if pushes := gateway.received(); len(pushes) != 0 {
+		t.Fatalf("Expected no pushes before Stop without an interval, got %d", len(pushes))
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	pushes := gateway.received()
+	if len(pushes) != 1 {
+		t.Fatalf("Expected 1 push on Stop, got %d", len(pushes))
+	}
+	push := pushes[0]
+	if push.method != http.MethodPut {
+		t.Errorf("Expected a PUT replacing the job's metrics, got %s", push.method)
+	}
+	if !strings.HasPrefix(push.path, "/metrics/job/streamer-service") {
+		t.Errorf("Expected the push to be grouped under the job, got path %s", push.path)
+	}
+	if !bytes.Contains(push.body, []byte("service_health")) || !bytes.Contains(push.body, []byte("streamer-service")) {
+		t.Error("Expected the push to carry the service's metrics")
+	}
+}
+
+func TestPusherPushesPeriodically(t *testing.T) {
+	gateway := &fakePushgateway{}
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	p := newPusher(server.URL, "streamer-service", prometheus.NewRegistry(), 10*time.Millisecond)
+	p.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(gateway.received()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected periodic pushes, got %d", len(gateway.received()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	stopped := len(gateway.received())
+	time.Sleep(50 * time.Millisecond)
+	if got := len(gateway.received()); got != stopped {
+		t.Errorf("Expected no pushes after Stop, got %d more", got-stopped)
+	}
+}
+
+func TestNewPusherFromEnv(t *testing.T) {
+	t.Setenv("PUSHGATEWAY_URL", "")
+	if p := NewPusherFromEnv("job"); p != nil {
+		t.Error("Expected no pusher without PUSHGATEWAY_URL")
+	}
+	// A nil pusher is safe to use
+	var none *Pusher
+	none.Start()
+	if err := none.Stop(); err != nil {
+		t.Errorf("Expected a nil pusher to do nothing, got %v", err)
+	}
+
+	t.Setenv("PUSHGATEWAY_URL", "http://pushgateway:9091")
+	t.Setenv("PUSHGATEWAY_INTERVAL_MS", "bad")
+	p := NewPusherFromEnv("job")
+	if p == nil {
+		t.Fatal("Expected a pusher with PUSHGATEWAY_URL set")
+	}
+	if p.interval != 0 {
+		t.Errorf("Expected an invalid interval to fall back to push on shutdown only, got %v", p.interval)
+	}
+
+	t.Setenv("PUSHGATEWAY_INTERVAL_MS", "30000")
+	if p := NewPusherFromEnv("job"); p.interval != 30*time.Second {
+		t.Errorf("Expected a 30s interval, got %v", p.interval)
+	}
+}
@@ -0,0 +1,162 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// Field numbers of the remote-write protobuf messages (prometheus/prompb)
+const (
+	writeRequestTimeseries = 1
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+)
+
+// metricNameLabel is the label holding a series' metric name
+const metricNameLabel = "__name__"
+
+// label is a remote-write label pair
+type label struct {
+	name  string
+	value string
+}
+
+// sample is a remote-write sample; timestamp is in milliseconds
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+// timeSeries is a remote-write series: its labels sorted by name and its
+// samples oldest first
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// recordLabels returns the labels of record's series sorted by name. They are
+// named like the collector's InfluxDB tags, which are also the labels
+// dcgm-exporter uses; empty values and labels_raw are left out.
+func recordLabels(record telemetry.TelemetryRecord) []label {
+	labels := []label{{name: metricNameLabel, value: metricName(record.Metric)}}
+	for _, l := range []label{
+		{"device_id", record.DeviceID},
+		{"gpu_id", record.GPUID},
+		{"uuid", record.UUID},
+		{"modelName", record.ModelName},
+		{"Hostname", record.Hostname},
+		{"container", record.Container},
+		{"pod", record.Pod},
+		{"namespace", record.Namespace},
+		{"driver_version", record.DriverVersion},
+	} {
+		if l.value != "" {
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// metricName turns a DCGM metric into a valid Prometheus metric name,
+// replacing characters outside [a-zA-Z0-9_:] with underscores
+func metricName(metric string) string {
+	var b strings.Builder
+	for i, r := range metric {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// toTimeSeries converts records into remote-write series. Records with the
+// same labels become samples of one series, ordered by time, since a receiver
+// rejects out-of-order samples within a series. Records without a metric are
+// skipped.
+func toTimeSeries(records []telemetry.TelemetryRecord) []timeSeries {
+	var series []timeSeries
+	index := make(map[string]int)
+	for _, record := range records {
+		if record.Metric == "" {
+			continue
+		}
+		labels := recordLabels(record)
+		key := seriesKey(labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(series)
+			index[key] = i
+			series = append(series, timeSeries{labels: labels})
+		}
+		series[i].samples = append(series[i].samples, sample{value: record.Value, timestamp: record.Time.UnixMilli()})
+	}
+	for _, s := range series {
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].timestamp < s.samples[j].timestamp })
+	}
+	return series
+}
+
+func seriesKey(labels []label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0xff)
+		b.WriteString(l.value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// marshalWriteRequest encodes series as a prometheus.WriteRequest protobuf
+func marshalWriteRequest(series []timeSeries) []byte {
+	var b []byte
+	for _, s := range series {
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalTimeSeries(s))
+	}
+	return b
+}
+
+func marshalTimeSeries(s timeSeries) []byte {
+	var b []byte
+	for _, l := range s.labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, sample := range s.samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, sampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(sample.value))
+		sb = protowire.AppendTag(sb, sampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(sample.timestamp))
+		b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
@@ -0,0 +1,254 @@
+// Package remotewrite sends telemetry to a Prometheus remote-write endpoint.
+package remotewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = 250 * time.Millisecond
+	defaultTimeout       = 10 * time.Second
+)
+
+// ErrClosed is returned by WriteTelemetry after Close
+var ErrClosed = errors.New("remote-write writer is closed")
+
+// Options configures a Writer. Zero values take the defaults.
+type Options struct {
+	// BatchSize is how many records are sent in one request
+	BatchSize int
+	// FlushInterval is the longest a record waits in the buffer
+	FlushInterval time.Duration
+	// MaxRetries is how many times a batch is resent after a network error,
+	// 429 or 5xx response; other failures aren't retried, and a negative
+	// value turns retries off
+	MaxRetries int
+	// RetryBackoff is the pause before the first retry; it doubles after each
+	RetryBackoff time.Duration
+	// Timeout bounds each request
+	Timeout time.Duration
+	// OnError is called from a background goroutine with every batch that
+	// could not be sent, after its retries
+	OnError func(error)
+}
+
+// Writer buffers telemetry records and sends them to a remote-write endpoint
+// in batches from a background goroutine, one batch at a time so samples of
+// a series arrive in order. WriteTelemetry only buffers; a full batch is
+// handed to the sender and waits while the sender is busy, so a slow
+// endpoint holds writers back instead of growing the buffer.
+type Writer struct {
+	url    string
+	client *http.Client
+	opts   Options
+
+	mu      sync.Mutex
+	pending []telemetry.TelemetryRecord
+	closed  bool
+
+	batches   chan batch
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// batch is records for the sender; sent, if not nil, is closed once they
+// and every batch handed over before them have been sent or given up on
+type batch struct {
+	records []telemetry.TelemetryRecord
+	sent    chan struct{}
+}
+
+// NewWriter returns a Writer sending to url, the endpoint's remote-write
+// path such as http://prometheus:9090/api/v1/write
+func NewWriter(url string, opts Options) *Writer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	w := &Writer{
+		url:     url,
+		client:  &http.Client{Timeout: opts.Timeout},
+		opts:    opts,
+		batches: make(chan batch),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// WriteTelemetry buffers record, handing the buffer to the sender once it
+// holds a full batch
+func (w *Writer) WriteTelemetry(record telemetry.TelemetryRecord) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.pending = append(w.pending, record)
+	var full []telemetry.TelemetryRecord
+	if len(w.pending) >= w.opts.BatchSize {
+		full, w.pending = w.pending, nil
+	}
+	w.mu.Unlock()
+
+	if full != nil {
+		w.handOver(batch{records: full})
+	}
+	return nil
+}
+
+// handOver passes b to the sender, dropping it if the sender has stopped
+// because Close raced with the write
+func (w *Writer) handOver(b batch) bool {
+	select {
+	case w.batches <- b:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// Flush sends the buffered records and waits until they and every batch
+// handed over before them have been sent
+func (w *Writer) Flush() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	records := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	w.flush(records)
+}
+
+// flush hands records to the sender and waits until they have been sent
+func (w *Writer) flush(records []telemetry.TelemetryRecord) {
+	sent := make(chan struct{})
+	if w.handOver(batch{records: records, sent: sent}) {
+		<-sent
+	}
+}
+
+// Close sends the buffered records and stops the sender. Later writes
+// return ErrClosed.
+func (w *Writer) Close() {
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		records := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+
+		w.flush(records)
+		close(w.stop)
+		<-w.done
+	})
+}
+
+// run sends batches as they are handed over and the buffer every flush
+// interval, until Close
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case b := <-w.batches:
+			w.send(b.records)
+			if b.sent != nil {
+				close(b.sent)
+			}
+		case <-ticker.C:
+			w.mu.Lock()
+			records := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+			w.send(records)
+		}
+	}
+}
+
+// send posts records, retrying while the failure is retryable, and reports
+// a batch that couldn't be sent to OnError
+func (w *Writer) send(records []telemetry.TelemetryRecord) {
+	series := toTimeSeries(records)
+	if len(series) == 0 {
+		return
+	}
+	body := snappy.Encode(nil, marshalWriteRequest(series))
+
+	backoff := w.opts.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		if retryable, err = w.post(body); err == nil {
+			return
+		}
+		if !retryable || attempt >= w.opts.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if w.opts.OnError != nil {
+		w.opts.OnError(fmt.Errorf("remote-write of %d records failed: %w", len(records), err))
+	}
+}
+
+// post sends one request, reporting whether a failure is worth retrying:
+// network errors, 429 and 5xx are, other rejections of the data are not
+func (w *Writer) post(body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote-write endpoint returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
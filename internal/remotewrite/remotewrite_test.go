@@ -0,0 +1,349 @@
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// decodeWriteRequest parses a WriteRequest protobuf
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	t.Helper()
+	var series []timeSeries
+	for _, ts := range fields(t, b, writeRequestTimeseries) {
+		var s timeSeries
+		for _, l := range fields(t, ts, timeSeriesLabels) {
+			s.labels = append(s.labels, label{
+				name:  string(fields(t, l, labelName)[0]),
+				value: string(fields(t, l, labelValue)[0]),
+			})
+		}
+		for _, smp := range fields(t, ts, timeSeriesSamples) {
+			var parsed sample
+			for len(smp) > 0 {
+				num, typ, n := protowire.ConsumeTag(smp)
+				smp = smp[n:]
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					v, n := protowire.ConsumeFixed64(smp)
+					parsed.value = math.Float64frombits(v)
+					smp = smp[n:]
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					v, n := protowire.ConsumeVarint(smp)
+					parsed.timestamp = int64(v)
+					smp = smp[n:]
+				default:
+					t.Fatalf("Unexpected sample field %d of type %d", num, typ)
+				}
+			}
+			s.samples = append(s.samples, parsed)
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// fields returns the contents of every length-delimited field num in b
+func fields(t *testing.T, b []byte, num protowire.Number) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for len(b) > 0 {
+		n, typ, size := protowire.ConsumeTag(b)
+		if size < 0 {
+			t.Fatalf("Bad protobuf tag: %v", protowire.ParseError(size))
+		}
+		b = b[size:]
+		size = protowire.ConsumeFieldValue(n, typ, b)
+		if size < 0 {
+			t.Fatalf("Bad protobuf field %d: %v", n, protowire.ParseError(size))
+		}
+		if n == num && typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(b)
+			out = append(out, v)
+		}
+		b = b[size:]
+	}
+	return out
+}
+
+// receiver is a fake remote-write endpoint recording the series of every
+// request; status, if set, picks the response to each request by its index
+type receiver struct {
+	t      *testing.T
+	status func(request int) int
+
+	mu       sync.Mutex
+	requests [][]timeSeries
+	headers  []http.Header
+}
+
+func newReceiver(t *testing.T, status func(request int) int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, status: status}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		r.t.Errorf("Failed to decode the snappy body: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series := decodeWriteRequest(r.t, raw)
+
+	r.mu.Lock()
+	n := len(r.requests)
+	r.requests = append(r.requests, series)
+	r.headers = append(r.headers, req.Header.Clone())
+	r.mu.Unlock()
+
+	if r.status != nil {
+		if code := r.status(n); code != http.StatusNoContent {
+			http.Error(w, "try again", code)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *receiver) received() [][]timeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]timeSeries(nil), r.requests...)
+}
+
+func gpuRecord(uuid, metric string, value float64, at time.Time) telemetry.TelemetryRecord {
+	return telemetry.TelemetryRecord{
+		DeviceID:  "nvidia0",
+		Metric:    metric,
+		Value:     value,
+		Time:      at,
+		GPUID:     "0",
+		UUID:      uuid,
+		ModelName: "NVIDIA H100 80GB HBM3",
+		Hostname:  "mtv5-dgx1-hgpu-031",
+		LabelsRaw: `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+	}
+}
+
+func TestWriteRequestPayload(t *testing.T) {
+	r, server := newReceiver(t, nil)
+	w := NewWriter(server.URL, Options{BatchSize: 3, FlushInterval: time.Hour})
+	defer w.Close()
+
+	at := time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC)
+	for _, record := range []telemetry.TelemetryRecord{
+		gpuRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 87, at.Add(time.Second)),
+		gpuRecord("GPU-b", "DCGM_FI_DEV_POWER_USAGE", 312.5, at),
+		// Same series as the first, but older
+		gpuRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 80, at),
+	} {
+		if err := w.WriteTelemetry(record); err != nil {
+			t.Fatalf("WriteTelemetry failed: %v", err)
+		}
+	}
+	w.Flush()
+
+	requests := r.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request for a full batch, got %d", len(requests))
+	}
+	expected := []timeSeries{
+		{
+			labels: []label{
+				{"Hostname", "mtv5-dgx1-hgpu-031"},
+				{"__name__", "DCGM_FI_DEV_GPU_UTIL"},
+				{"device_id", "nvidia0"},
+				{"gpu_id", "0"},
+				{"modelName", "NVIDIA H100 80GB HBM3"},
+				{"uuid", "GPU-a"},
+			},
+			samples: []sample{{80, at.UnixMilli()}, {87, at.Add(time.Second).UnixMilli()}},
+		},
+		{
+			labels: []label{
+				{"Hostname", "mtv5-dgx1-hgpu-031"},
+				{"__name__", "DCGM_FI_DEV_POWER_USAGE"},
+				{"device_id", "nvidia0"},
+				{"gpu_id", "0"},
+				{"modelName", "NVIDIA H100 80GB HBM3"},
+				{"uuid", "GPU-b"},
+			},
+			samples: []sample{{312.5, at.UnixMilli()}},
+		},
+	}
+	if !reflect.DeepEqual(requests[0], expected) {
+		t.Errorf("Unexpected series:\n got %+v\nwant %+v", requests[0], expected)
+	}
+
+	r.mu.Lock()
+	h := r.headers[0]
+	r.mu.Unlock()
+	if h.Get("Content-Encoding") != "snappy" || h.Get("Content-Type") != "application/x-protobuf" || h.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("Missing remote-write headers: %v", h)
+	}
+}
+
+func TestRecordLabels(t *testing.T) {
+	record := telemetry.TelemetryRecord{Metric: "gpu.temp-c", UUID: "GPU-a", DriverVersion: "535.129.03", Namespace: "gpu-operator"}
+	expected := []label{
+		{"__name__", "gpu_temp_c"},
+		{"driver_version", "535.129.03"},
+		{"namespace", "gpu-operator"},
+		{"uuid", "GPU-a"},
+	}
+	if got := recordLabels(record); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, got)
+	}
+
+	for metric, expected := range map[string]string{
+		"DCGM_FI_DEV_GPU_UTIL": "DCGM_FI_DEV_GPU_UTIL",
+		"job:rate5m":           "job:rate5m",
+		"3d_load":              "_3d_load",
+		"temp °C":              "temp__C",
+	} {
+		if got := metricName(metric); got != expected {
+			t.Errorf("metricName(%q): expected %q, got %q", metric, expected, got)
+		}
+	}
+
+	// Records without a metric have no series
+	if series := toTimeSeries([]telemetry.TelemetryRecord{{UUID: "GPU-a", Value: 1}}); len(series) != 0 {
+		t.Errorf("Expected no series for a record without a metric, got %+v", series)
+	}
+}
+
+func TestWriterBatches(t *testing.T) {
+	r, server := newReceiver(t, nil)
+	w := NewWriter(server.URL, Options{BatchSize: 3, FlushInterval: time.Hour})
+
+	at := time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		if err := w.WriteTelemetry(gpuRecord(fmt.Sprintf("GPU-%d", i), "DCGM_FI_DEV_GPU_UTIL", float64(i), at)); err != nil {
+			t.Fatalf("WriteTelemetry %d failed: %v", i, err)
+		}
+	}
+	// Full batches go to the sender straight away; the rest waits for a flush
+	w.Flush()
+	if got := len(r.received()); got != 3 {
+		t.Errorf("Expected 3 requests after the flush, got %d", got)
+	}
+
+	// Close sends what is left, and later writes fail
+	w.WriteTelemetry(gpuRecord("GPU-last", "DCGM_FI_DEV_GPU_UTIL", 1, at))
+	w.Close()
+	requests := r.received()
+	if len(requests) != 4 {
+		t.Fatalf("Expected Close to send the last record, got %d requests", len(requests))
+	}
+	samples := 0
+	for _, series := range requests {
+		for _, s := range series {
+			samples += len(s.samples)
+		}
+	}
+	if samples != 8 {
+		t.Errorf("Expected 8 samples in total, got %d", samples)
+	}
+	if err := w.WriteTelemetry(gpuRecord("GPU-late", "DCGM_FI_DEV_GPU_UTIL", 1, at)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestWriterFlushesOnInterval(t *testing.T) {
+	r, server := newReceiver(t, nil)
+	w := NewWriter(server.URL, Options{BatchSize: 100, FlushInterval: 20 * time.Millisecond})
+	defer w.Close()
+
+	w.WriteTelemetry(gpuRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 1, time.Now()))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the buffered record to be sent within the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWriterRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           func(request int) int
+		expectedRequests int
+		expectedErrors   int
+	}{
+		{
+			name: "Retries server errors until one succeeds",
+			status: func(n int) int {
+				if n < 2 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusNoContent
+			},
+			expectedRequests: 3,
+		},
+		{
+			name:             "Retries rate limiting",
+			status:           func(n int) int { return []int{http.StatusTooManyRequests, http.StatusNoContent}[n%2] },
+			expectedRequests: 2,
+		},
+		{
+			name:             "Gives up after MaxRetries",
+			status:           func(int) int { return http.StatusInternalServerError },
+			expectedRequests: 3,
+			expectedErrors:   1,
+		},
+		{
+			name:             "Doesn't retry rejected data",
+			status:           func(int) int { return http.StatusBadRequest },
+			expectedRequests: 1,
+			expectedErrors:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, server := newReceiver(t, tt.status)
+			var mu sync.Mutex
+			var errs []error
+			w := NewWriter(server.URL, Options{
+				BatchSize:    10,
+				MaxRetries:   2,
+				RetryBackoff: time.Millisecond,
+				OnError: func(err error) {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				},
+			})
+			defer w.Close()
+
+			w.WriteTelemetry(gpuRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 1, time.Now()))
+			w.Flush()
+
+			if got := len(r.received()); got != tt.expectedRequests {
+				t.Errorf("Expected %d requests, got %d", tt.expectedRequests, got)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(errs) != tt.expectedErrors {
+				t.Errorf("Expected %d errors reported, got %v", tt.expectedErrors, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Package reqlog logs HTTP requests. Successful requests are sampled so busy
+// services don't flood their logs; error responses are always logged.
+package reqlog
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// SampleRateFromEnv returns N from LOG_SAMPLE_RATE, meaning 1 in N successful
+// requests is logged. The default of 1 logs every request.
+func SampleRateFromEnv() int {
+	if rateStr := os.Getenv("LOG_SAMPLE_RATE"); rateStr != "" {
+		if rate, err := strconv.Atoi(rateStr); err == nil && rate > 0 {
+			return rate
+		}
+		log.Printf("Invalid LOG_SAMPLE_RATE value '%s', using default: 1", rateStr)
+	}
+	return 1
+}
+
+// Middleware logs one line per request to logger once it completes: every
+// response with a status of 400 or above, and 1 in every sampleRate of the rest
+func Middleware(logger *log.Logger, sampleRate int, next http.Handler) http.Handler {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	var count uint64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if rw.status < http.StatusBadRequest && atomic.AddUint64(&count, 1)%uint64(sampleRate) != 0 {
+			return
+		}
+		logger.Printf("%s %s status=%d duration=%v", r.Method, r.URL.RequestURI(), rw.status, time.Since(start))
+	})
+}
+
+// statusWriter records the response status while passing writes and flushes
+// through, so streamed responses keep working
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
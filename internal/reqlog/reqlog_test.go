@@ -0,0 +1,93 @@
+package reqlog
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareSampling(t *testing.T) {
+	var logs bytes.Buffer
+	handler := Middleware(log.New(&logs, "", 0), 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			http.Error(w, "broker unavailable", http.StatusBadGateway)
+		case "/bad":
+			http.Error(w, "topic required", http.StatusBadRequest)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+
+	for i := 0; i < 100; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", nil))
+	}
+	for i := 0; i < 5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/fail", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/bad", nil))
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	var ok, failed, bad int
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "POST /produce?topic=telemetry&partition=0 status=200"):
+			ok++
+		case strings.HasPrefix(line, "POST /fail status=502"):
+			failed++
+		case strings.HasPrefix(line, "POST /bad status=400"):
+			bad++
+		default:
+			t.Errorf("Unexpected log line %q", line)
+		}
+	}
+	if ok != 10 {
+		t.Errorf("Expected 1 in 10 of 100 successful requests to be logged, got %d", ok)
+	}
+	if failed != 5 || bad != 5 {
+		t.Errorf("Expected every error response to be logged, got %d 502s and %d 400s", failed, bad)
+	}
+}
+
+func TestMiddlewareLogsEverythingByDefault(t *testing.T) {
+	var logs bytes.Buffer
+	handler := Middleware(log.New(&logs, "", 0), 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/topics", nil))
+	}
+	if got := strings.Count(logs.String(), "GET /topics status=200"); got != 3 {
+		t.Errorf("Expected every request to be logged, got %d", got)
+	}
+}
+
+func TestMiddlewareKeepsFlusher(t *testing.T) {
+	handler := Middleware(log.New(&bytes.Buffer{}, "", 0), 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Expected the wrapped writer to support flushing for streamed responses")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/consume", nil))
+}
+
+func TestSampleRateFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"", 1},
+		{"10", 10},
+		{"0", 1},
+		{"-3", 1},
+		{"often", 1},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("LOG_SAMPLE_RATE", tt.value)
+		if got := SampleRateFromEnv(); got != tt.expected {
+			t.Errorf("LOG_SAMPLE_RATE=%q: expected %d, got %d", tt.value, tt.expected, got)
+		}
+	}
+}
@@ -12,6 +12,8 @@ func APIKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip auth for health checks, metrics, and Swagger documentation
 		if r.URL.Path == "/health" ||
+			r.URL.Path == "/ready" ||
+			r.URL.Path == "/version" ||
 			r.URL.Path == "/metrics" ||
 			r.URL.Path == "/topics" ||
 			strings.HasPrefix(r.URL.Path, "/swagger/") ||
@@ -59,7 +61,7 @@ func validateAPIKey(apiKey string) bool {
 func ServiceAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip auth for health checks
-		if r.URL.Path == "/health" || r.URL.Path == "/topics" {
+		if r.URL.Path == "/health" || r.URL.Path == "/version" || r.URL.Path == "/topics" {
 			next.ServeHTTP(w, r)
 			return
 		}
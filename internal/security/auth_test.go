@@ -0,0 +1,33 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionSkipsAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	middlewares := map[string]func(http.Handler) http.Handler{
+		"api key": APIKeyMiddleware,
+		"service": ServiceAuthMiddleware,
+		"hmac":    HMACServiceAuthMiddleware,
+	}
+	for name, middleware := range middlewares {
+		handler := middleware(ok)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s middleware: expected /version without credentials to get 200, got %d", name, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/gpus", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s middleware: expected protected paths to still require credentials, got %d", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newHMACHandler(t *testing.T) http.Handler {
+	t.Helper()
+	t.Setenv("SERVICE_HMAC_SECRET", "test-secret")
+	t.Setenv("SERVICE_SIGNATURE_MAX_SKEW_MS", "60000")
+	return HMACServiceAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func serve(handler http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestHMACServiceAuthValidSignature(t *testing.T) {
+	handler := newHMACHandler(t)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/replay?topic=telemetry&partition=0", nil)
+		if err := SignServiceRequest(req); err != nil {
+			t.Fatalf("Failed to sign request: %v", err)
+		}
+		if code := serve(handler, req); code != http.StatusOK {
+			t.Errorf("Request %d: expected a signed request to get 200, got %d", i, code)
+		}
+	}
+
+	// Timestamps within the skew either side of now are accepted
+	for _, offset := range []time.Duration{-50 * time.Second, 50 * time.Second} {
+		req := httptest.NewRequest("POST", "/replay", nil)
+		setSignature(req, []byte("test-secret"), time.Now().Add(offset), "skew"+offset.String())
+		if code := serve(handler, req); code != http.StatusOK {
+			t.Errorf("Expected a timestamp %v from now to get 200, got %d", offset, code)
+		}
+	}
+}
+
+func TestHMACServiceAuthRejectsStaleTimestamps(t *testing.T) {
+	handler := newHMACHandler(t)
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		req := httptest.NewRequest("POST", "/replay", nil)
+		setSignature(req, []byte("test-secret"), time.Now().Add(offset), "stale"+offset.String())
+		if code := serve(handler, req); code != http.StatusUnauthorized {
+			t.Errorf("Expected a timestamp %v from now to get 401, got %d", offset, code)
+		}
+	}
+}
+
+func TestHMACServiceAuthRejectsTampering(t *testing.T) {
+	handler := newHMACHandler(t)
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request) *http.Request
+	}{
+		{"Path", func(r *http.Request) *http.Request {
+			return retarget(r, "POST", "/topics/telemetry")
+		}},
+		{"Query", func(r *http.Request) *http.Request {
+			return retarget(r, "POST", "/replay?topic=telemetry&partition=1")
+		}},
+		{"Method", func(r *http.Request) *http.Request {
+			return retarget(r, "DELETE", "/replay?topic=telemetry&partition=0")
+		}},
+		{"Timestamp", func(r *http.Request) *http.Request {
+			r.Header.Set(ServiceTimestampHeader, "1")
+			return r
+		}},
+		{"Nonce", func(r *http.Request) *http.Request {
+			r.Header.Set(ServiceNonceHeader, "other")
+			return r
+		}},
+		{"Missing signature", func(r *http.Request) *http.Request {
+			r.Header.Del(ServiceSignatureHeader)
+			return r
+		}},
+		{"Malformed signature", func(r *http.Request) *http.Request {
+			r.Header.Set(ServiceSignatureHeader, "not-hex")
+			return r
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/replay?topic=telemetry&partition=0", nil)
+			if err := SignServiceRequest(req); err != nil {
+				t.Fatalf("Failed to sign request: %v", err)
+			}
+			if code := serve(handler, tt.tamper(req)); code != http.StatusUnauthorized {
+				t.Errorf("Expected a tampered request to get 401, got %d", code)
+			}
+		})
+	}
+
+	// A signature made with another secret
+	req := httptest.NewRequest("POST", "/replay", nil)
+	setSignature(req, []byte("wrong-secret"), time.Now(), "wrong-secret")
+	if code := serve(handler, req); code != http.StatusUnauthorized {
+		t.Errorf("Expected a signature with the wrong secret to get 401, got %d", code)
+	}
+}
+
+// retarget copies r's signature headers onto a new request for method and target
+func retarget(r *http.Request, method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header = r.Header.Clone()
+	return req
+}
+
+func TestHMACServiceAuthRejectsReusedNonce(t *testing.T) {
+	handler := newHMACHandler(t)
+
+	req := httptest.NewRequest("POST", "/replay", nil)
+	if err := SignServiceRequest(req); err != nil {
+		t.Fatalf("Failed to sign request: %v", err)
+	}
+	if code := serve(handler, req); code != http.StatusOK {
+		t.Fatalf("Expected the first request to get 200, got %d", code)
+	}
+	if code := serve(handler, retarget(req, "POST", "/replay")); code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed request to get 401, got %d", code)
+	}
+}
+
+func TestHMACServiceAuthSkipsHealth(t *testing.T) {
+	handler := newHMACHandler(t)
+	if code := serve(handler, httptest.NewRequest("GET", "/health", nil)); code != http.StatusOK {
+		t.Errorf("Expected /health without a signature to get 200, got %d", code)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	c := newNonceCache(time.Minute)
+	start := time.Now()
+
+	if !c.add("a", start) || !c.add("b", start.Add(30*time.Second)) {
+		t.Fatal("Expected new nonces to be accepted")
+	}
+	if c.add("a", start.Add(59*time.Second)) {
+		t.Error("Expected a nonce to be rejected within its ttl")
+	}
+	if !c.add("a", start.Add(time.Minute)) {
+		t.Error("Expected a nonce to be accepted again once expired")
+	}
+	if len(c.seen) != 2 {
+		t.Errorf("Expected expired nonces to be dropped, %d remembered", len(c.seen))
+	}
+}
+
+func TestGetSignatureMaxSkew(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultSignatureMaxSkew},
+		{"30000", 30 * time.Second},
+		{"0", defaultSignatureMaxSkew},
+		{"soon", defaultSignatureMaxSkew},
+	}
+	for _, tt := range tests {
+		t.Setenv("SERVICE_SIGNATURE_MAX_SKEW_MS", tt.value)
+		if got := getSignatureMaxSkew(); got != tt.expected {
+			t.Errorf("SERVICE_SIGNATURE_MAX_SKEW_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
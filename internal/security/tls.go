@@ -0,0 +1,45 @@
+package security
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// TLSFilesFromEnv returns the certificate and key paths from TLS_CERT_FILE and
+// TLS_KEY_FILE. ok is false unless both are set.
+func TLSFilesFromEnv() (certFile, keyFile string, ok bool) {
+	certFile = os.Getenv("TLS_CERT_FILE")
+	keyFile = os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		if certFile != "" || keyFile != "" {
+			log.Println("TLS_CERT_FILE and TLS_KEY_FILE must both be set to enable TLS, serving plaintext")
+		}
+		return "", "", false
+	}
+	return certFile, keyFile, true
+}
+
+// ListenAndServe listens on server.Addr and serves HTTPS when TLS is
+// configured in the environment, plain HTTP otherwise
+func ListenAndServe(server *http.Server) error {
+	addr := server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(server, ln)
+}
+
+// Serve is ListenAndServe for an existing listener
+func Serve(server *http.Server, ln net.Listener) error {
+	if certFile, keyFile, ok := TLSFilesFromEnv(); ok {
+		log.Printf("Serving HTTPS on %s", ln.Addr())
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+	return server.Serve(ln)
+}
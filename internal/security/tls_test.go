@@ -0,0 +1,92 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/testutils"
+)
+
+// startServer serves a /health endpoint with Serve and returns its address
+func startServer(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: mux}
+	go Serve(server, ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+func getHealth(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Expected 200 ok from %s, got %d %q", url, resp.StatusCode, body)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := testutils.SelfSignedCert(t)
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+
+	addr := startServer(t)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	getHealth(t, client, "https://"+addr+"/health")
+
+	// Plaintext requests are refused
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Get("http://" + addr + "/health")
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("Expected a plaintext request to a TLS server to fail")
+		}
+	}
+
+	// A client that doesn't trust the certificate is rejected
+	untrusted := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}},
+	}
+	if _, err := untrusted.Get("https://" + addr + "/health"); err == nil {
+		t.Error("Expected an untrusted certificate to be rejected")
+	}
+}
+
+func TestServePlaintextFallback(t *testing.T) {
+	certFile, _, _ := testutils.SelfSignedCert(t)
+	tests := []struct {
+		name, cert, key string
+	}{
+		{"not configured", "", ""},
+		{"only cert set", certFile, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TLS_CERT_FILE", tt.cert)
+			t.Setenv("TLS_KEY_FILE", tt.key)
+			addr := startServer(t)
+			getHealth(t, &http.Client{Timeout: 5 * time.Second}, "http://"+addr+"/health")
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// Default ack batching: acks are sent once 100 have built up for a partition
+// or every 100ms, whichever comes first
+const (
+	defaultAckBatchSize     = 100
+	defaultAckBatchInterval = 100 * time.Millisecond
+)
+
+// ackKey identifies the broker endpoint a set of acks is sent to
+type ackKey struct {
+	topic     string
+	partition int
+	group     string
+}
+
+// ackBatcher accumulates acks per topic-partition-group and sends each set to
+// the broker's /ack/batch endpoint in one request
+type ackBatcher struct {
+	h *HTTPMessageQueue
+	// size sends a partition's batch once it holds this many acks; 0 leaves
+	// every ack for the interval (auto-commit)
+	size     int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[ackKey][]string
+	// sending tracks batches taken from pending but not yet acked
+	sending sync.WaitGroup
+}
+
+func newAckBatcher(h *HTTPMessageQueue, size int, interval time.Duration) *ackBatcher {
+	return &ackBatcher{h: h, size: size, interval: interval, pending: make(map[ackKey][]string)}
+}
+
+// add queues an ack, sending the partition's batch right away once it is full
+func (b *ackBatcher) add(key ackKey, id string) {
+	b.mu.Lock()
+	ids := append(b.pending[key], id)
+	if b.size == 0 || len(ids) < b.size {
+		b.pending[key] = ids
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.sending.Add(1)
+	b.mu.Unlock()
+	b.send(key, ids)
+}
+
+// flush sends every queued ack and waits for batches already being sent
+func (b *ackBatcher) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[ackKey][]string)
+	b.sending.Add(len(pending))
+	b.mu.Unlock()
+
+	for key, ids := range pending {
+		b.send(key, ids)
+	}
+	b.sending.Wait()
+}
+
+// run flushes on every interval until done is closed
+func (b *ackBatcher) run(done <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+// send acks ids and logs, counts and remembers every one the broker didn't
+// accept
+func (b *ackBatcher) send(key ackKey, ids []string) {
+	defer b.sending.Done()
+	failed, err := b.h.ackBatch(key.topic, key.group, key.partition, ids)
+	if err != nil {
+		fmt.Printf("Failed to ack %d messages on %s partition %d: %v\n", len(ids), key.topic, key.partition, err)
+		for _, id := range ids {
+			metrics.RecordConsumerAckFailure(b.h.name, key.partition)
+			b.h.ackFailed.add(ackFailure{topic: key.topic, partition: key.partition, id: id})
+		}
+		return
+	}
+	for _, id := range ids {
+		if reason, ok := failed[id]; ok {
+			fmt.Printf("Failed to ack message %s: %s\n", id, reason)
+			metrics.RecordConsumerAckFailure(b.h.name, key.partition)
+			b.h.ackFailed.add(ackFailure{topic: key.topic, partition: key.partition, id: id})
+		} else {
+			b.h.ackFailed.remove(ackFailure{topic: key.topic, partition: key.partition, id: id})
+			b.h.recordAcked(key.topic, key.partition, id)
+		}
+	}
+}
+
+// ackBatch acks several messages of one partition in a single request. It
+// returns the IDs the broker rejected with the reason for each; err is set
+// only when the request as a whole failed. Brokers and proxies older than
+// /ack/batch answer 404, and the messages are then acked one at a time.
+func (h *HTTPMessageQueue) ackBatch(topic, group string, partition int, ids []string) (map[string]string, error) {
+	url := fmt.Sprintf("%s/ack/batch?topic=%s&partition=%d&group=%s", h.baseURL, topic, partition, group)
+
+	jsonBody, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ack batch: %w", err)
+	}
+
+	resp, err := h.client.Post(url, "application/json", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to ack batch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		drainBody(resp)
+		return h.ackEach(topic, group, partition, ids), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ack batch failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Acked  int `json:"acked"`
+		Failed []struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"failed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode ack batch response: %w", err)
+	}
+	failed := make(map[string]string, len(result.Failed))
+	for _, f := range result.Failed {
+		failed[f.ID] = f.Error
+	}
+	return failed, nil
+}
+
+// ackEach acks ids one request at a time, returning the IDs that failed with
+// the reason for each
+func (h *HTTPMessageQueue) ackEach(topic, group string, partition int, ids []string) map[string]string {
+	failed := make(map[string]string)
+	for _, id := range ids {
+		if err := h.ackMessage(topic, group, partition, id); err != nil {
+			failed[id] = err.Error()
+		}
+	}
+	return failed
+}
+
+// getAckBatching returns ACK_BATCH_SIZE and ACK_BATCH_INTERVAL_MS or their
+// defaults. A size of 1 turns batching off.
+func getAckBatching() (int, time.Duration) {
+	size := defaultAckBatchSize
+	if sizeStr := os.Getenv("ACK_BATCH_SIZE"); sizeStr != "" {
+		if n, err := strconv.Atoi(sizeStr); err == nil && n > 0 {
+			size = n
+		} else {
+			log.Printf("Invalid ACK_BATCH_SIZE value '%s', using default: %d", sizeStr, defaultAckBatchSize)
+		}
+	}
+
+	interval := defaultAckBatchInterval
+	if msStr := os.Getenv("ACK_BATCH_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			interval = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid ACK_BATCH_INTERVAL_MS value '%s', using default: %v", msStr, defaultAckBatchInterval)
+		}
+	}
+	return size, interval
+}
+
+// getAutoCommitInterval returns ACK_AUTO_COMMIT_INTERVAL_MS, or 0 when auto-commit
+// is off. With auto-commit, handled messages are acked together once per
+// interval however many build up, so a crash redelivers everything handled
+// since the last commit.
+func getAutoCommitInterval() time.Duration {
+	if msStr := os.Getenv("ACK_AUTO_COMMIT_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid ACK_AUTO_COMMIT_INTERVAL_MS value '%s', auto-commit disabled", msStr)
+	}
+	return 0
+}
@@ -0,0 +1,317 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// batchBroker streams messages on /consume and records each /ack/batch
+// request, rejecting the IDs in reject
+type batchBroker struct {
+	messages []string
+	reject   map[string]bool
+	// noBatch answers /ack/batch with 404, like a broker that predates it
+	noBatch bool
+
+	mu      sync.Mutex
+	batches [][]string
+	singles int
+}
+
+func (b *batchBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/consume":
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, id := range b.messages {
+			writeSSEMessage(w, id, "payload-"+id, 0)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	case "/ack":
+		b.mu.Lock()
+		b.singles++
+		b.mu.Unlock()
+		w.Write([]byte("ok"))
+	case "/ack/batch":
+		if b.noBatch {
+			http.NotFound(w, r)
+			return
+		}
+		var ids []string
+		json.NewDecoder(r.Body).Decode(&ids)
+		b.mu.Lock()
+		b.batches = append(b.batches, ids)
+		b.mu.Unlock()
+
+		result := ackBatchResult{Failed: []ackBatchFailure{}}
+		for _, id := range ids {
+			if b.reject[id] {
+				result.Failed = append(result.Failed, ackBatchFailure{ID: id, Error: "message not found"})
+			} else {
+				result.Acked++
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type ackBatchResult struct {
+	Acked  int               `json:"acked"`
+	Failed []ackBatchFailure `json:"failed"`
+}
+
+type ackBatchFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func (b *batchBroker) snapshot() ([][]string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.batches...), b.singles
+}
+
+func subscribeAll(t *testing.T, q *HTTPMessageQueue) {
+	t.Helper()
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+}
+
+func TestAckBatchFlushesWhenFull(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "3")
+	t.Setenv("ACK_BATCH_INTERVAL_MS", "60000")
+	broker := &batchBroker{messages: []string{"m1", "m2", "m3", "m4"}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-batch-full")
+	subscribeAll(t, q)
+
+	waitFor(t, 5*time.Second, func() bool {
+		batches, _ := broker.snapshot()
+		return len(batches) == 1
+	})
+	batches, singles := broker.snapshot()
+	if !reflect.DeepEqual(batches, [][]string{{"m1", "m2", "m3"}}) {
+		t.Errorf("Expected one full batch of 3 acks, got %v", batches)
+	}
+	if singles != 0 {
+		t.Errorf("Expected no single acks, got %d", singles)
+	}
+
+	// The remainder is sent on close
+	q.Close()
+	batches, _ = broker.snapshot()
+	if !reflect.DeepEqual(batches, [][]string{{"m1", "m2", "m3"}, {"m4"}}) {
+		t.Errorf("Expected the remaining ack to be flushed on close, got %v", batches)
+	}
+}
+
+func TestAckBatchFlushesOnInterval(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "100")
+	t.Setenv("ACK_BATCH_INTERVAL_MS", "20")
+	broker := &batchBroker{messages: []string{"m1", "m2"}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-batch-interval")
+	subscribeAll(t, q)
+
+	waitFor(t, 5*time.Second, func() bool {
+		var acked int
+		batches, _ := broker.snapshot()
+		for _, ids := range batches {
+			acked += len(ids)
+		}
+		return acked == 2
+	})
+}
+
+func TestAckBatchRecordsFailures(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "2")
+	const name = "ack-batch-failures"
+	broker := &batchBroker{messages: []string{"m1", "m2"}, reject: map[string]bool{"m2": true}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, name)
+	subscribeAll(t, q)
+
+	waitFor(t, 5*time.Second, func() bool {
+		batches, _ := broker.snapshot()
+		return len(batches) == 1
+	})
+	waitFor(t, 5*time.Second, func() bool {
+		return counterValue(t, metrics.QueueConsumerAckFailures, name, "0") == 1
+	})
+}
+
+func TestAckBatchDisabled(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "1")
+	broker := &batchBroker{messages: []string{"m1", "m2"}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-batch-disabled")
+	if q.acker != nil {
+		t.Fatal("Expected ACK_BATCH_SIZE=1 to turn batching off")
+	}
+	subscribeAll(t, q)
+
+	waitFor(t, 5*time.Second, func() bool {
+		_, singles := broker.snapshot()
+		return singles == 2
+	})
+	if batches, _ := broker.snapshot(); len(batches) != 0 {
+		t.Errorf("Expected no batch requests, got %v", batches)
+	}
+}
+
+func TestAckBatchFallsBackToSingleAcks(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "2")
+	t.Setenv("ACK_BATCH_INTERVAL_MS", "20")
+	broker := &batchBroker{messages: []string{"m1", "m2", "m3"}, noBatch: true}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	name := "ack-batch-fallback"
+	q := newTestQueue(t, server.URL, name)
+	subscribeAll(t, q)
+
+	// A broker without /ack/batch still gets every ack, one request each
+	waitFor(t, 5*time.Second, func() bool {
+		_, singles := broker.snapshot()
+		return singles == 3
+	})
+	if failures := counterValue(t, metrics.QueueConsumerAckFailures, name, "0"); failures != 0 {
+		t.Errorf("Expected no ack failures, got %v", failures)
+	}
+}
+
+func TestGetAckBatching(t *testing.T) {
+	tests := []struct {
+		size, interval   string
+		expectedSize     int
+		expectedInterval time.Duration
+	}{
+		{"", "", defaultAckBatchSize, defaultAckBatchInterval},
+		{"50", "250", 50, 250 * time.Millisecond},
+		{"1", "", 1, defaultAckBatchInterval},
+		{"0", "-5", defaultAckBatchSize, defaultAckBatchInterval},
+		{"many", "soon", defaultAckBatchSize, defaultAckBatchInterval},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q/%q", tt.size, tt.interval), func(t *testing.T) {
+			t.Setenv("ACK_BATCH_SIZE", tt.size)
+			t.Setenv("ACK_BATCH_INTERVAL_MS", tt.interval)
+			size, interval := getAckBatching()
+			if size != tt.expectedSize || interval != tt.expectedInterval {
+				t.Errorf("Expected %d and %v, got %d and %v", tt.expectedSize, tt.expectedInterval, size, interval)
+			}
+		})
+	}
+}
+
+func TestAutoCommitAcksOnInterval(t *testing.T) {
+	// Auto-commit ignores the batch size, so a size of 1 doesn't send acks one by one
+	t.Setenv("ACK_AUTO_COMMIT_INTERVAL_MS", "300")
+	t.Setenv("ACK_BATCH_SIZE", "1")
+	broker := &batchBroker{messages: []string{"m1", "m2", "m3", "m4", "m5"}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-auto-commit")
+	handled := make(chan string, len(broker.messages))
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		handled <- id
+		return nil
+	})
+	for range broker.messages {
+		<-handled
+	}
+
+	// Nothing is acked until the interval comes round, then all at once
+	if batches, singles := broker.snapshot(); len(batches) != 0 || singles != 0 {
+		t.Fatalf("Expected no acks before the commit interval, got batches %v and %d single acks", batches, singles)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		batches, _ := broker.snapshot()
+		return len(batches) == 1
+	})
+	batches, singles := broker.snapshot()
+	if !reflect.DeepEqual(batches, [][]string{{"m1", "m2", "m3", "m4", "m5"}}) {
+		t.Errorf("Expected one commit of all 5 acks, got %v", batches)
+	}
+	if singles != 0 {
+		t.Errorf("Expected no single acks, got %d", singles)
+	}
+}
+
+func TestAutoCommitAcksOnlyHandledMessages(t *testing.T) {
+	t.Setenv("ACK_AUTO_COMMIT_INTERVAL_MS", "10")
+	broker := &batchBroker{messages: []string{"m1", "m2", "m3"}}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-auto-commit-handled")
+	release := make(chan struct{})
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		switch id {
+		case "m1":
+			<-release
+		case "m2":
+			return fmt.Errorf("cannot handle %s", id)
+		}
+		return nil
+	})
+
+	// Several commits go by while m1 is still being handled
+	time.Sleep(100 * time.Millisecond)
+	if batches, _ := broker.snapshot(); len(batches) != 0 {
+		t.Fatalf("Expected no acks while the handler is running, got %v", batches)
+	}
+
+	close(release)
+	acked := func() []string {
+		var ids []string
+		batches, _ := broker.snapshot()
+		for _, batch := range batches {
+			ids = append(ids, batch...)
+		}
+		return ids
+	}
+	waitFor(t, 5*time.Second, func() bool { return len(acked()) == 2 })
+	q.Close()
+	// The failed message is left for the broker to redeliver
+	if ids := acked(); !reflect.DeepEqual(ids, []string{"m1", "m3"}) {
+		t.Errorf("Expected only the handled messages acked, got %v", ids)
+	}
+}
+
+func TestGetAutoCommitInterval(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"5000", 5 * time.Second},
+		{"-1", 0},
+		{"often", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("ACK_AUTO_COMMIT_INTERVAL_MS", tt.value)
+		if got := getAutoCommitInterval(); got != tt.expected {
+			t.Errorf("ACK_AUTO_COMMIT_INTERVAL_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// defaultAckDedupSize is how many handled-but-unacked messages a consumer
+// remembers by default
+const defaultAckDedupSize = 10000
+
+// ackFailure identifies a message whose ack failed
+type ackFailure struct {
+	topic     string
+	partition int
+	id        string
+}
+
+// ackFailures remembers messages that were handled but whose ack failed. The
+// broker redelivers such a message after its visibility timeout; finding it
+// here, the consumer retries the ack instead of running the handler twice. At
+// most limit messages are kept, the oldest forgotten first. A nil
+// *ackFailures remembers nothing.
+type ackFailures struct {
+	mu    sync.Mutex
+	limit int
+	order *list.List
+	index map[ackFailure]*list.Element
+}
+
+func newAckFailures(limit int) *ackFailures {
+	return &ackFailures{limit: limit, order: list.New(), index: make(map[ackFailure]*list.Element)}
+}
+
+// add records a failed ack
+func (f *ackFailures) add(key ackFailure) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.index[key]; ok {
+		return
+	}
+	f.index[key] = f.order.PushBack(key)
+	if f.order.Len() > f.limit {
+		oldest := f.order.Remove(f.order.Front()).(ackFailure)
+		delete(f.index, oldest)
+	}
+}
+
+// remove forgets a message once its ack succeeds
+func (f *ackFailures) remove(key ackFailure) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elem, ok := f.index[key]; ok {
+		f.order.Remove(elem)
+		delete(f.index, key)
+	}
+}
+
+// contains reports whether a message was handled but not acked
+func (f *ackFailures) contains(key ackFailure) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.index[key]
+	return ok
+}
+
+// getAckDedupSize returns how many failed acks to remember from ACK_DEDUP_SIZE;
+// 0 turns deduplication off
+func getAckDedupSize() int {
+	if sizeStr := os.Getenv("ACK_DEDUP_SIZE"); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil && size >= 0 {
+			return size
+		}
+		log.Printf("Invalid ACK_DEDUP_SIZE value '%s', using default: %d", sizeStr, defaultAckDedupSize)
+	}
+	return defaultAckDedupSize
+}
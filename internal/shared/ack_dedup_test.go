@@ -0,0 +1,188 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// redeliveringBroker sends message m1 on every /consume connection, as the
+// broker does once an unacked message's visibility timeout expires. Each
+// redelivery waits until the client has recorded the previous ack's outcome.
+// Acks fail until ackAfter attempts have been made; 0 means they always fail.
+type redeliveringBroker struct {
+	ackAfter int32
+	// ready reports whether the previous delivery's ack has been handled
+	ready func() bool
+
+	consumes int32
+	acks     int32
+}
+
+func (b *redeliveringBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/ack") {
+		attempt := atomic.AddInt32(&b.acks, 1)
+		if b.ackAfter == 0 || attempt < b.ackAfter {
+			http.Error(w, "ack failed", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/ack/batch" {
+			w.Write([]byte(`{"acked":1,"failed":[]}`))
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/topics/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if atomic.AddInt32(&b.consumes, 1) > 1 {
+		deadline := time.Now().Add(5 * time.Second)
+		for !b.ready() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	writeSSEMessage(w, "m1", "payload", 0)
+}
+
+var m1 = ackFailure{topic: "telemetry", partition: 0, id: "m1"}
+
+func TestAckFailureSkipsRedelivery(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		batchSize string
+	}{
+		{"single", "1"},
+		{"batched", "10"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ACK_BATCH_SIZE", tt.batchSize)
+			t.Setenv("ACK_BATCH_INTERVAL_MS", "10")
+			name := "ack-dedup-" + tt.name
+
+			var q *HTTPMessageQueue
+			broker := &redeliveringBroker{}
+			broker.ready = func() bool { return q.ackFailed.contains(m1) }
+			server := httptest.NewServer(broker)
+			t.Cleanup(server.Close)
+
+			q = newTestQueue(t, server.URL, name)
+			var handled int32
+			go q.Subscribe(func(topic string, body []byte, id string) error {
+				atomic.AddInt32(&handled, 1)
+				return nil
+			})
+
+			waitFor(t, 5*time.Second, func() bool {
+				return counterValue(t, metrics.QueueConsumerDuplicatesSkipped, name, "0") >= 3
+			})
+			if got := atomic.LoadInt32(&handled); got != 1 {
+				t.Errorf("Expected the handler to run once for m1, got %d", got)
+			}
+			if got := atomic.LoadInt32(&broker.acks); got < 3 {
+				t.Errorf("Expected each redelivery to retry the ack, got %d ack attempts", got)
+			}
+		})
+	}
+}
+
+func TestAckFailureForgottenOnceAcked(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "1")
+	var q *HTTPMessageQueue
+	broker := &redeliveringBroker{ackAfter: 2}
+	broker.ready = func() bool { return q.ackFailed.contains(m1) }
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q = newTestQueue(t, server.URL, "ack-dedup-recovered")
+	var handled int32
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	// The first ack fails and the redelivery's ack succeeds
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&broker.acks) >= 2 })
+	waitFor(t, 5*time.Second, func() bool { return !q.ackFailed.contains(m1) })
+	if got := atomic.LoadInt32(&handled); got != 1 {
+		t.Errorf("Expected the handler to run once for m1, got %d", got)
+	}
+}
+
+func TestAckDedupDisabled(t *testing.T) {
+	t.Setenv("ACK_BATCH_SIZE", "1")
+	t.Setenv("ACK_DEDUP_SIZE", "0")
+	broker := &redeliveringBroker{ready: func() bool { return true }}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "ack-dedup-disabled")
+	if q.ackFailed != nil {
+		t.Fatal("Expected ACK_DEDUP_SIZE=0 to turn deduplication off")
+	}
+	var handled int32
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&handled) >= 2 })
+}
+
+func TestAckFailuresBounded(t *testing.T) {
+	f := newAckFailures(2)
+	a := ackFailure{topic: "telemetry", id: "a"}
+	b := ackFailure{topic: "telemetry", id: "b"}
+	c := ackFailure{topic: "telemetry", id: "c"}
+
+	f.add(a)
+	f.add(b)
+	f.add(a)
+	f.add(c)
+	if f.contains(a) {
+		t.Error("Expected the oldest failure to be forgotten once over the limit")
+	}
+	if !f.contains(b) || !f.contains(c) {
+		t.Error("Expected the newest failures to be kept")
+	}
+
+	f.remove(b)
+	if f.contains(b) {
+		t.Error("Expected a removed failure to be forgotten")
+	}
+	if f.order.Len() != 1 || len(f.index) != 1 {
+		t.Errorf("Expected one failure left, got %d in order and %d indexed", f.order.Len(), len(f.index))
+	}
+
+	// Messages are told apart by partition as well as ID
+	if f.contains(ackFailure{topic: "telemetry", partition: 1, id: "c"}) {
+		t.Error("Expected the same ID on another partition not to match")
+	}
+}
+
+func TestGetAckDedupSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"", defaultAckDedupSize},
+		{"500", 500},
+		{"0", 0},
+		{"-1", defaultAckDedupSize},
+		{"lots", defaultAckDedupSize},
+	}
+	for _, tt := range tests {
+		t.Setenv("ACK_DEDUP_SIZE", tt.value)
+		if got := getAckDedupSize(); got != tt.expected {
+			t.Errorf("ACK_DEDUP_SIZE=%q: expected %d, got %d", tt.value, tt.expected, got)
+		}
+	}
+}
@@ -3,18 +3,57 @@ package shared
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// Reasons a consumer reconnects to a partition stream, used as metric labels
+const (
+	reconnectTimeout      = "timeout"       // request or stream read timed out
+	reconnectConnectError = "connect_error" // could not reach the broker
+	reconnectServerError  = "server_error"  // broker answered with a non-200 status
+	reconnectEOF          = "eof"           // stream broke off with a read error
+	reconnectNormal       = "normal"        // broker closed the stream cleanly
+	reconnectNotAssigned  = "not_assigned"  // proxy assigned the partition to another consumer of the group
+)
+
+// Produce acknowledgment levels: how far a message must get on the broker
+// before Publish reports success
+const (
+	AcksNone      = "none"      // broker answers without reporting enqueue failures
+	AcksLeader    = "leader"    // broker has queued the message in memory
+	AcksPersisted = "persisted" // broker has synced the message to its partition log
+)
+
+// Produce body compression, selected with PRODUCE_COMPRESSION
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip" // sent with Content-Encoding: gzip, which the broker decompresses
 )
 
+// requestDeadlineHeader tells the broker how many milliseconds a publish waits
+// for its answer, so it can drop work the client gave up on. It is relative
+// so the broker can count it on its own clock.
+const requestDeadlineHeader = "X-Request-Deadline"
+
 // HTTPMessageQueue implements a client for the msg_queue service
 type HTTPMessageQueue struct {
 	baseURL string
@@ -23,9 +62,63 @@ type HTTPMessageQueue struct {
 	group   string
 	name    string
 
+	// consumerID identifies this instance to the proxy, which shares each
+	// topic's partitions among the instances of a group
+	consumerID string
+
+	// Topics consumed by Subscribe; defaults to just topic
+	topics []string
+
 	// Round-robin partition assignment for publishing
 	maxPartitions  int
 	publishCounter uint64
+
+	// Partition counts discovered per topic; maxPartitions (MAX_PARTITIONS)
+	// stands in for topics whose count isn't known
+	partitionsMu sync.Mutex
+	partitions   map[string]*topicPartitions
+
+	// Partitions whose owning broker the proxy reports as down are skipped
+	// when publishing. healthInterval is how often each topic's view is
+	// refreshed; 0 disables the check.
+	healthInterval time.Duration
+	healthMu       sync.Mutex
+	health         map[string]*partitionHealth
+
+	// Produce acknowledgment level sent with every publish
+	acks string
+	// compression is how publish bodies are compressed, CompressionNone or
+	// CompressionGzip
+	compression string
+
+	// acker batches consumer acks, by size and interval or on the
+	// auto-commit interval alone; nil when each ack is sent on its own
+	acker *ackBatcher
+
+	// ackFailed holds handled messages whose ack failed, so redeliveries
+	// are acked again rather than handled twice; nil when turned off
+	ackFailed *ackFailures
+
+	// lastAcked is the ID of the latest message acked on each partition,
+	// sent as Last-Event-ID when a consumer stream reconnects
+	lastAckedMu sync.Mutex
+	lastAcked   map[ackKey]string
+
+	// Delay before reconnecting a consumer stream
+	reconnectDelay time.Duration
+
+	// Maximum time ConsumeN waits for its messages
+	consumeTimeout time.Duration
+
+	// Cancelled by Close to stop consumer loops
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// inflight counts messages between dispatch and ack; once draining is
+	// set (under inflightMu) no new messages are dispatched
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+	draining   bool
 }
 
 // Message represents a message from the queue
@@ -47,22 +140,247 @@ func NewHTTPMessageQueue(baseURL, topic, group, name string) (*HTTPMessageQueue,
 		}
 	}
 
-	return &HTTPMessageQueue{
+	healthInterval := defaultPartitionHealthInterval
+	if msStr := os.Getenv("PARTITION_HEALTH_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			healthInterval = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid PARTITION_HEALTH_INTERVAL_MS value '%s', using default: %v", msStr, defaultPartitionHealthInterval)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &HTTPMessageQueue{
+		acks:           getProduceAcks(),
+		compression:    getProduceCompression(),
 		baseURL:        baseURL,
-		client:         &http.Client{Timeout: 60 * time.Second},
+		client:         &http.Client{Timeout: 60 * time.Second, Transport: newQueueTransport(getQueueTransportConfig())},
 		topic:          topic,
+		topics:         []string{topic},
 		group:          group,
 		name:           name,
+		consumerID:     newConsumerID(name),
 		maxPartitions:  maxPartitions,
 		publishCounter: 0,
-	}, nil
+		healthInterval: healthInterval,
+		health:         make(map[string]*partitionHealth),
+		partitions:     make(map[string]*topicPartitions),
+		lastAcked:      make(map[ackKey]string),
+		reconnectDelay: time.Second,
+		consumeTimeout: 30 * time.Second,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	if interval := getAutoCommitInterval(); interval > 0 {
+		h.acker = newAckBatcher(h, 0, interval)
+		go h.acker.run(ctx.Done())
+	} else if size, interval := getAckBatching(); size > 1 {
+		h.acker = newAckBatcher(h, size, interval)
+		go h.acker.run(ctx.Done())
+	}
+	if size := getAckDedupSize(); size > 0 {
+		h.ackFailed = newAckFailures(size)
+	}
+	// Learn the topic's partition count up front rather than on the first publish
+	h.partitionCount(topic)
+	return h, nil
+}
+
+// newConsumerID returns name with a random suffix, so replicas sharing a
+// consumer name are still told apart
+func newConsumerID(name string) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+	}
+	return name + "-" + hex.EncodeToString(suffix)
+}
+
+// getProduceAcks returns the produce acknowledgment level from PRODUCE_ACKS or
+// the default (leader)
+func getProduceAcks() string {
+	acks := os.Getenv("PRODUCE_ACKS")
+	switch acks {
+	case "":
+		return AcksLeader
+	case AcksNone, AcksLeader, AcksPersisted:
+		return acks
+	default:
+		log.Printf("Invalid PRODUCE_ACKS value '%s', using default: %s", acks, AcksLeader)
+		return AcksLeader
+	}
 }
 
-// calculatePublishPartition returns the next partition for publishing in round-robin fashion
+// SetAcks sets the acknowledgment level required for future publishes
+func (h *HTTPMessageQueue) SetAcks(acks string) error {
+	switch acks {
+	case AcksNone, AcksLeader, AcksPersisted:
+		h.acks = acks
+		return nil
+	default:
+		return fmt.Errorf("invalid acks level %q", acks)
+	}
+}
+
+// getProduceCompression returns the publish body compression from
+// PRODUCE_COMPRESSION or the default (none)
+func getProduceCompression() string {
+	compression := strings.ToLower(strings.TrimSpace(os.Getenv("PRODUCE_COMPRESSION")))
+	switch compression {
+	case "":
+		return CompressionNone
+	case CompressionNone, CompressionGzip:
+		return compression
+	default:
+		log.Printf("Invalid PRODUCE_COMPRESSION value '%s', using default: %s", compression, CompressionNone)
+		return CompressionNone
+	}
+}
+
+// SetCompression sets how future publish bodies are compressed
+func (h *HTTPMessageQueue) SetCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip:
+		h.compression = compression
+		return nil
+	default:
+		return fmt.Errorf("invalid compression %q", compression)
+	}
+}
+
+// SetTopics sets the topics Subscribe consumes from, replacing the default of
+// the constructor's topic. Publish is unaffected.
+func (h *HTTPMessageQueue) SetTopics(topics ...string) error {
+	if len(topics) == 0 {
+		return errors.New("at least one topic is required")
+	}
+	seen := make(map[string]bool, len(topics))
+	list := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if topic == "" {
+			return errors.New("topic names must not be empty")
+		}
+		if !seen[topic] {
+			seen[topic] = true
+			list = append(list, topic)
+		}
+	}
+	h.topics = list
+	return nil
+}
+
+// defaultPartitionHealthInterval is how often publish refreshes partition health
+const defaultPartitionHealthInterval = 5 * time.Second
+
+// partitionHealthTimeout bounds a single partition health fetch
+const partitionHealthTimeout = 2 * time.Second
+
+// partitionHealth is the last known set of unavailable partitions for a topic
+type partitionHealth struct {
+	fetched time.Time
+	down    map[int]bool
+}
+
+// calculatePublishPartition returns the next partition for publishing in round-robin fashion,
+// cycling over only the partitions whose broker is healthy. If every partition is down it
+// falls back to plain round-robin and leaves failover to the proxy.
 func (h *HTTPMessageQueue) calculatePublishPartition(topic string) int {
 	// Atomic increment for thread safety
 	current := atomic.AddUint64(&h.publishCounter, 1)
-	return int((current - 1) % uint64(h.maxPartitions))
+	next := current - 1
+
+	count := h.partitionCount(topic)
+	down := h.unavailablePartitions(topic)
+	if len(down) == 0 {
+		return int(next % uint64(count))
+	}
+	healthy := make([]int, 0, count)
+	for partition := 0; partition < count; partition++ {
+		if !down[partition] {
+			healthy = append(healthy, partition)
+		}
+	}
+	if len(healthy) == 0 {
+		return int(next % uint64(count))
+	}
+	return healthy[next%uint64(len(healthy))]
+}
+
+// unavailablePartitions returns the partitions of topic whose broker was last
+// reported down, refreshing the view once it is older than healthInterval.
+// Only one caller refreshes at a time; the others keep using the previous view.
+func (h *HTTPMessageQueue) unavailablePartitions(topic string) map[int]bool {
+	if h.healthInterval <= 0 {
+		return nil
+	}
+
+	h.healthMu.Lock()
+	entry, ok := h.health[topic]
+	if !ok {
+		entry = &partitionHealth{}
+		h.health[topic] = entry
+	}
+	down := entry.down
+	if time.Since(entry.fetched) < h.healthInterval {
+		h.healthMu.Unlock()
+		return down
+	}
+	// Claim the refresh so concurrent publishes don't fetch too
+	entry.fetched = time.Now()
+	h.healthMu.Unlock()
+
+	fresh, err := h.fetchPartitionHealth(topic)
+	if err != nil {
+		// Without a view assume everything is healthy and let the proxy fail over
+		fmt.Printf("[%s] Failed to fetch partition health for topic %s: %v\n", h.name, topic, err)
+	}
+
+	h.healthMu.Lock()
+	entry.down = fresh
+	h.healthMu.Unlock()
+	return fresh
+}
+
+// fetchPartitionHealth asks the proxy's /ring endpoint which partitions of
+// topic are owned by an unhealthy broker
+func (h *HTTPMessageQueue) fetchPartitionHealth(topic string) (map[int]bool, error) {
+	ctx, cancel := context.WithTimeout(h.ctx, partitionHealthTimeout)
+	defer cancel()
+
+	ringURL := fmt.Sprintf("%s/ring?topic=%s", h.baseURL, url.QueryEscape(topic))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ringURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ring request failed with status %d", resp.StatusCode)
+	}
+
+	var ring struct {
+		Partitions []struct {
+			Partition int  `json:"partition"`
+			Healthy   bool `json:"healthy"`
+		} `json:"partitions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ring); err != nil {
+		return nil, fmt.Errorf("failed to decode ring response: %w", err)
+	}
+
+	down := make(map[int]bool)
+	for _, p := range ring.Partitions {
+		if !p.Healthy {
+			down[p.Partition] = true
+		}
+	}
+	return down, nil
 }
 
 // Publish sends a message to the queue
@@ -74,7 +392,7 @@ func (h *HTTPMessageQueue) Publish(topic string, payload []byte) error {
 	fmt.Printf("[%s] Publishing to topic=%s, partition=%d (publish round-robin assignment)\n", h.name, topic, partition)
 
 	// Send partition explicitly to proxy - no key needed
-	url := fmt.Sprintf("%s/produce?topic=%s&partition=%d", h.baseURL, topic, partition)
+	url := fmt.Sprintf("%s/produce?topic=%s&partition=%d&acks=%s", h.baseURL, topic, partition, h.acks)
 
 	// Create request body with payload
 	reqBody := map[string]string{
@@ -85,119 +403,426 @@ func (h *HTTPMessageQueue) Publish(topic string, payload []byte) error {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	resp, err := h.client.Post(url, "application/json", bytes.NewBuffer(jsonBody))
+	body := jsonBody
+	if h.compression == CompressionGzip {
+		if body, err = gzipBytes(jsonBody); err != nil {
+			return fmt.Errorf("failed to compress payload: %w", err)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create publish request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.compression == CompressionGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if h.client.Timeout > 0 {
+		req.Header.Set(requestDeadlineHeader, strconv.FormatInt(h.client.Timeout.Milliseconds(), 10))
+	}
+
+	resp, err := h.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to publish message: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	// The broker asks producers to slow down while the partition is too full
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, _ := io.ReadAll(resp.Body)
+		return &ThrottledError{
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Message:    strings.TrimSpace(string(body)),
+		}
+	}
+	// With acks=none the broker answers 202 without confirming the enqueue
+	if resp.StatusCode != http.StatusOK && !(h.acks == AcksNone && resp.StatusCode == http.StatusAccepted) {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("publish failed with status %d: %s", resp.StatusCode, string(body))
 	}
+	drainBody(resp)
 
 	return nil
 }
 
-// Subscribe starts consuming messages from the queue (consumes from all partitions)
-func (h *HTTPMessageQueue) Subscribe(handler func(string, []byte, string) error) error {
-	// Start consumer goroutines for all partitions
-	errChan := make(chan error, h.maxPartitions)
+// ThrottledError is returned by Publish when the broker turned the message
+// away with 429 Too Many Requests, because the topic is over its produce rate
+// limit or the partition's queue is above its high watermark
+type ThrottledError struct {
+	// RetryAfter is how long the broker asked the producer to wait before
+	// publishing again; 0 if it didn't say
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("publish throttled (retry after %v): %s", e.RetryAfter, e.Message)
+}
 
-	for partition := 0; partition < h.maxPartitions; partition++ {
-		partition := partition // capture loop variable
-		go func() {
-			fmt.Printf("[%s] Starting consumer for partition %d\n", h.name, partition)
-			h.consumeFromPartition(partition, handler, errChan)
-		}()
+// RetryAfter returns how long err asks a producer to wait before publishing
+// again, or 0 if err is not a *ThrottledError
+func RetryAfter(err error) time.Duration {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return throttled.RetryAfter
 	}
+	return 0
+}
 
-	// Wait for any consumer to report an error (this blocks indefinitely)
-	return <-errChan
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date, returning 0 if it is missing or malformed
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
 }
 
-// consumeFromPartition handles consumption from a specific partition
-func (h *HTTPMessageQueue) consumeFromPartition(partition int, handler func(string, []byte, string) error, errChan chan error) {
-	url := fmt.Sprintf("%s/consume?topic=%s&partition=%d&group=%s", h.baseURL, h.topic, partition, h.group)
+// gzipBytes compresses data with gzip
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	// Create context for cancellation
-	ctx := context.Background()
+// Subscribe starts consuming messages from the queue (consumes from all partitions
+// of every subscribed topic). The handler receives the topic each message came from.
+func (h *HTTPMessageQueue) Subscribe(handler func(string, []byte, string) error) error {
+	// Start consumer goroutines for all topic-partitions
+	counts := make([]int, len(h.topics))
+	total := 0
+	for i, topic := range h.topics {
+		counts[i] = h.partitionCount(topic)
+		total += counts[i]
+	}
+	errChan := make(chan error, total)
+
+	for i, topic := range h.topics {
+		for partition := 0; partition < counts[i]; partition++ {
+			topic, partition := topic, partition // capture loop variables
+			go func() {
+				fmt.Printf("[%s] Starting consumer for topic %s partition %d\n", h.name, topic, partition)
+				h.consumeFromPartition(topic, partition, handler, errChan)
+			}()
+		}
+	}
+
+	// Wait for any consumer to report an error or for the queue to be closed
+	select {
+	case err := <-errChan:
+		return err
+	case <-h.ctx.Done():
+		return nil
+	}
+}
+
+// consumeFromPartition handles consumption from a specific topic-partition
+func (h *HTTPMessageQueue) consumeFromPartition(topic string, partition int, handler func(string, []byte, string) error, errChan chan error) {
+	consumeURL := fmt.Sprintf("%s/consume?topic=%s&partition=%d&group=%s&consumer=%s", h.baseURL, topic, partition, h.group, url.QueryEscape(h.consumerID))
 
 	for {
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if h.ctx.Err() != nil || h.isDraining() {
+			return
+		}
+
+		req, err := http.NewRequestWithContext(h.ctx, "GET", consumeURL, nil)
 		if err != nil {
 			errChan <- fmt.Errorf("failed to create request: %w", err)
 			return
 		}
+		// Resume after the last message acked on this partition, sending
+		// batched acks first so it is up to date
+		h.flushAcks()
+		if lastID := h.lastAckedID(topic, partition); lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
 
 		resp, err := h.client.Do(req)
 		if err != nil {
+			if h.ctx.Err() != nil {
+				return
+			}
 			fmt.Printf("[%s] Failed to start consuming from partition %d: %v\n", h.name, partition, err)
-			time.Sleep(time.Second)
+			reason := reconnectConnectError
+			if isTimeout(err) {
+				reason = reconnectTimeout
+			}
+			metrics.RecordConsumerReconnect(h.name, partition, reason)
+			h.sleep(h.reconnectDelay)
 			continue
 		}
 
+		// Another instance of the group holds the partition; keep asking so
+		// it is picked up when that instance leaves
+		if resp.StatusCode == http.StatusConflict {
+			drainBody(resp)
+			resp.Body.Close()
+			metrics.RecordConsumerReconnect(h.name, partition, reconnectNotAssigned)
+			h.sleep(h.reconnectDelay)
+			continue
+		}
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
 			resp.Body.Close()
 			fmt.Printf("[%s] Consume failed from partition %d with status %d: %s\n", h.name, partition, resp.StatusCode, string(body))
-			time.Sleep(time.Second)
+			metrics.RecordConsumerReconnect(h.name, partition, reconnectServerError)
+			h.sleep(h.reconnectDelay)
 			continue
 		}
 
 		// Parse Server-Sent Events
-		scanner := bufio.NewScanner(resp.Body)
-		var messageID string
-		var messageData string
-
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			if strings.HasPrefix(line, "id: ") {
-				messageID = strings.TrimPrefix(line, "id: ")
-			} else if strings.HasPrefix(line, "data: ") {
-				messageData = strings.TrimPrefix(line, "data: ")
-			} else if line == "" && messageID != "" && messageData != "" {
-				// End of message, parse and handle
-				var msg QueueMessage
-				if err := json.Unmarshal([]byte(messageData), &msg); err != nil {
+		err = readSSE(resp.Body, func(msg QueueMessage) bool {
+			// Leave the message unacked once draining so the broker redelivers it
+			if !h.beginMessage() {
+				return false
+			}
+			defer h.inflight.Done()
+
+			// A redelivery of a message handled earlier whose ack failed only
+			// needs the ack
+			if h.ackFailed.contains(ackFailure{topic: msg.Topic, partition: msg.Partition, id: msg.ID}) {
+				metrics.RecordConsumerDuplicateSkipped(h.name, partition)
+				h.ack(msg)
+				return true
+			}
+
+			// Process the message
+			if err := handler(msg.Topic, []byte(msg.Payload), msg.ID); err != nil {
+				// Log error but continue processing
+				fmt.Printf("Message handler error: %v\n", err)
+				return true
+			}
+			metrics.RecordConsumerMessageHandled(h.name, partition)
+			// Acknowledge the message only if handler succeeded
+			h.ack(msg)
+			return true
+		})
+
+		resp.Body.Close()
+
+		if h.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Printf("[%s] Scanner error from partition %d: %v\n", h.name, partition, err)
+			reason := reconnectEOF
+			if isTimeout(err) {
+				reason = reconnectTimeout
+			}
+			metrics.RecordConsumerReconnect(h.name, partition, reason)
+		} else {
+			metrics.RecordConsumerReconnect(h.name, partition, reconnectNormal)
+		}
+
+		// Wait a bit before reconnecting
+		h.sleep(h.reconnectDelay)
+	}
+}
+
+// maxSSELineBytes bounds a single line of the event stream, so large
+// payloads don't stop the scanner at its 64KB default
+const maxSSELineBytes = 4 << 20
+
+// readSSE parses the broker's Server-Sent Events stream and calls fn for each
+// decoded message until fn returns false or the stream ends. Multi-line data
+// fields are joined with newlines as the SSE format specifies, and the event's
+// partition field, when present, overrides the partition in the payload so
+// acks go to the partition the event was delivered from.
+func readSSE(r io.Reader, fn func(QueueMessage) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSSELineBytes)
+
+	var messageID string
+	var data []string
+	partition := -1
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// A blank line ends the event; events without data are ignored
+			if len(data) > 0 {
+				msg, err := decodeSSEMessage(messageID, strings.Join(data, "\n"), partition)
+				if err != nil {
 					fmt.Printf("Failed to decode message: %v\n", err)
-					messageID = ""
-					messageData = ""
-					continue
+				} else if !fn(msg) {
+					return nil
 				}
+			}
+			messageID, data, partition = "", nil, -1
+			continue
+		}
 
-				// Process the message
-				if err := handler(msg.Topic, []byte(msg.Payload), msg.ID); err != nil {
-					// Log error but continue processing
-					fmt.Printf("Message handler error: %v\n", err)
-				} else {
-					// Acknowledge the message only if handler succeeded
-					if err := h.ackMessage(msg.Topic, msg.Partition, msg.ID); err != nil {
-						fmt.Printf("Failed to ack message %s: %v\n", msg.ID, err)
-					}
-				}
+		// Lines starting with ':' are SSE comments (broker keepalives)
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
 
-				// Reset for next message
-				messageID = ""
-				messageData = ""
+		field, value := parseSSEField(line)
+		switch field {
+		case "id":
+			messageID = value
+		case "data":
+			data = append(data, value)
+		case "partition":
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Printf("Ignoring invalid partition field %q\n", value)
+				continue
 			}
+			partition = p
 		}
+	}
+	return scanner.Err()
+}
 
-		resp.Body.Close()
+// parseSSEField splits an SSE line into its field name and value, dropping
+// the single optional space after the colon
+func parseSSEField(line string) (string, string) {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return line, ""
+	}
+	return line[:idx], strings.TrimPrefix(line[idx+1:], " ")
+}
 
-		if err := scanner.Err(); err != nil {
-			fmt.Printf("[%s] Scanner error from partition %d: %v\n", h.name, partition, err)
+// decodeSSEMessage decodes an event's data into a QueueMessage. The event id
+// fills in a missing message ID and a non-negative partition overrides the
+// one in the payload.
+func decodeSSEMessage(id, data string, partition int) (QueueMessage, error) {
+	var msg QueueMessage
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return msg, err
+	}
+	if msg.ID == "" {
+		msg.ID = id
+	}
+	if partition >= 0 {
+		msg.Partition = partition
+	}
+	return msg, nil
+}
+
+// ConsumeN reads exactly n messages from a partition, acking each one, and then
+// closes the stream. If fewer than n messages arrive before the consume timeout,
+// the messages received so far are returned along with an error.
+func (h *HTTPMessageQueue) ConsumeN(topic string, partition int, group string, n int) ([]QueueMessage, error) {
+	if n <= 0 {
+		return []QueueMessage{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, h.consumeTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/consume?topic=%s&partition=%d&group=%s", h.baseURL, topic, partition, group)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start consuming: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("consume failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	messages := make([]QueueMessage, 0, n)
+	var ackErr error
+	err = readSSE(resp.Body, func(msg QueueMessage) bool {
+		if ackErr = h.ackMessage(msg.Topic, group, msg.Partition, msg.ID); ackErr != nil {
+			return false
 		}
+		messages = append(messages, msg)
+		return len(messages) < n
+	})
 
-		// Wait a bit before reconnecting
-		time.Sleep(time.Second)
+	if ackErr != nil {
+		return messages, fmt.Errorf("failed to ack message: %w", ackErr)
+	}
+	if len(messages) < n {
+		if ctx.Err() != nil {
+			return messages, fmt.Errorf("timed out after receiving %d of %d messages", len(messages), n)
+		}
+		if err != nil {
+			return messages, fmt.Errorf("stream error after receiving %d of %d messages: %w", len(messages), n, err)
+		}
+		return messages, fmt.Errorf("stream closed after receiving %d of %d messages", len(messages), n)
 	}
+	return messages, nil
 }
 
-// ackMessage acknowledges a processed message
-func (h *HTTPMessageQueue) ackMessage(topic string, partition int, messageID string) error {
-	url := fmt.Sprintf("%s/ack?topic=%s&partition=%d&group=%s", h.baseURL, topic, partition, h.group)
+// sleep waits for the given duration or until the queue is closed
+func (h *HTTPMessageQueue) sleep(d time.Duration) {
+	select {
+	case <-h.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// isTimeout reports whether err is a network or deadline timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ack acknowledges a message handled by Subscribe, through the batcher when
+// batching is on. A failed ack is remembered so the redelivery isn't handled.
+func (h *HTTPMessageQueue) ack(msg QueueMessage) {
+	if h.acker != nil {
+		h.acker.add(ackKey{topic: msg.Topic, partition: msg.Partition, group: h.group}, msg.ID)
+		return
+	}
+	key := ackFailure{topic: msg.Topic, partition: msg.Partition, id: msg.ID}
+	if err := h.ackMessage(msg.Topic, h.group, msg.Partition, msg.ID); err != nil {
+		fmt.Printf("Failed to ack message %s: %v\n", msg.ID, err)
+		metrics.RecordConsumerAckFailure(h.name, msg.Partition)
+		h.ackFailed.add(key)
+		return
+	}
+	h.ackFailed.remove(key)
+	h.recordAcked(msg.Topic, msg.Partition, msg.ID)
+}
+
+// recordAcked notes id as the latest message acked on a partition
+func (h *HTTPMessageQueue) recordAcked(topic string, partition int, id string) {
+	h.lastAckedMu.Lock()
+	defer h.lastAckedMu.Unlock()
+	h.lastAcked[ackKey{topic: topic, partition: partition, group: h.group}] = id
+}
+
+// lastAckedID returns the latest message acked on a partition, if any
+func (h *HTTPMessageQueue) lastAckedID(topic string, partition int) string {
+	h.lastAckedMu.Lock()
+	defer h.lastAckedMu.Unlock()
+	return h.lastAcked[ackKey{topic: topic, partition: partition, group: h.group}]
+}
+
+// ackMessage acknowledges a processed message for a consumer group
+func (h *HTTPMessageQueue) ackMessage(topic, group string, partition int, messageID string) error {
+	url := fmt.Sprintf("%s/ack?topic=%s&partition=%d&group=%s", h.baseURL, topic, partition, group)
 
 	reqBody := map[string]string{
 		"id": messageID,
@@ -217,16 +842,66 @@ func (h *HTTPMessageQueue) ackMessage(topic string, partition int, messageID str
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("ack failed with status %d: %s", resp.StatusCode, string(body))
 	}
+	drainBody(resp)
 
 	return nil
 }
 
-// Close closes the HTTP client (no-op for HTTP client)
+// beginMessage registers a message as in flight, or returns false when draining
+func (h *HTTPMessageQueue) beginMessage() bool {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.inflight.Add(1)
+	return true
+}
+
+func (h *HTTPMessageQueue) isDraining() bool {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+	return h.draining
+}
+
+// Drain stops dispatching messages to the Subscribe handler, waits for the
+// ones already dispatched to be handled, sends their acks, then closes the queue.
+// It returns ctx's error if the wait is cut short.
+func (h *HTTPMessageQueue) Drain(ctx context.Context) error {
+	h.inflightMu.Lock()
+	h.draining = true
+	h.inflightMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	h.cancel()
+	h.flushAcks()
+	return err
+}
+
+// Close stops any running consumer loops and sends any acks still batched
 func (h *HTTPMessageQueue) Close() error {
-	// HTTP client doesn't need explicit closing
+	h.cancel()
+	h.flushAcks()
 	return nil
 }
 
+func (h *HTTPMessageQueue) flushAcks() {
+	if h.acker != nil {
+		h.acker.flush()
+	}
+}
+
 // GetTopics returns available topics (for compatibility)
 func (h *HTTPMessageQueue) GetTopics() (map[string][]int, error) {
 	url := fmt.Sprintf("%s/topics", h.baseURL)
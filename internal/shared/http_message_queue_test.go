@@ -0,0 +1,913 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads the current value of a counter in a vector
+func counterValue(t *testing.T, vec *prometheus.CounterVec, labels ...string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// waitFor polls cond until it is true or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Condition not met within %v", timeout)
+}
+
+// newTestQueue creates a queue client against a test server with fast reconnects
+func newTestQueue(t *testing.T, baseURL, name string) *HTTPMessageQueue {
+	t.Helper()
+	t.Setenv("MAX_PARTITIONS", "1")
+	q, err := NewHTTPMessageQueue(baseURL, "telemetry", "group", name)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	q.reconnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// writeSSEMessage writes a single message in the broker's SSE format
+func writeSSEMessage(w http.ResponseWriter, id, payload string, partition int) {
+	data, _ := json.Marshal(QueueMessage{ID: id, Payload: payload, Topic: "telemetry", Partition: partition})
+	fmt.Fprintf(w, "id: %s\n", id)
+	fmt.Fprintf(w, "data: %s\n", string(data))
+	fmt.Fprintf(w, "partition: %d\n\n", partition)
+}
+
+func TestConsumerReconnectMetrics(t *testing.T) {
+	var consumeCalls int32
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ack") {
+			// Every ack fails so the ack failure counter moves
+			http.Error(w, "ack failed", http.StatusInternalServerError)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/topics/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch atomic.AddInt32(&consumeCalls, 1) {
+		case 1:
+			http.Error(w, "broker overloaded", http.StatusServiceUnavailable)
+		case 2:
+			// A single message, then a clean end of stream
+			w.Header().Set("Content-Type", "text/event-stream")
+			writeSSEMessage(w, "msg-1", "hello", 0)
+		case 3:
+			// Cut the connection in the middle of a chunked stream
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n")
+			buf.WriteString("6\r\n: hi\n\n\r\n")
+			buf.Flush()
+			conn.Close()
+		default:
+			// Hold the stream open until the client goes away
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(broker.Close)
+
+	name := "reconnect-test"
+	q := newTestQueue(t, broker.URL, name)
+
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&consumeCalls) >= 4 })
+
+	for _, reason := range []string{reconnectServerError, reconnectNormal, reconnectEOF} {
+		if got := counterValue(t, metrics.QueueConsumerReconnects, name, "0", reason); got != 1 {
+			t.Errorf("Expected 1 reconnect with reason %s, got %v", reason, got)
+		}
+	}
+	if got := counterValue(t, metrics.QueueConsumerMessagesHandled, name, "0"); got != 1 {
+		t.Errorf("Expected 1 handled message, got %v", got)
+	}
+	// Acks are batched, so the failure shows up once the batch is flushed
+	waitFor(t, 5*time.Second, func() bool {
+		return counterValue(t, metrics.QueueConsumerAckFailures, name, "0") >= 1
+	})
+	if got := counterValue(t, metrics.QueueConsumerAckFailures, name, "0"); got != 1 {
+		t.Errorf("Expected 1 ack failure, got %v", got)
+	}
+}
+
+func TestConsumerConnectErrorMetric(t *testing.T) {
+	// Grab a free address and close it so connections are refused
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := server.URL
+	server.Close()
+
+	name := "connect-error-test"
+	q := newTestQueue(t, addr, name)
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+
+	waitFor(t, 5*time.Second, func() bool {
+		return counterValue(t, metrics.QueueConsumerReconnects, name, "0", reconnectConnectError) >= 1
+	})
+}
+
+func TestConsumerWaitsForPartitionAssignment(t *testing.T) {
+	var consumeCalls int32
+	consumers := make(chan string, 16)
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/consume" {
+			http.NotFound(w, r)
+			return
+		}
+		consumers <- r.URL.Query().Get("consumer")
+		// The proxy hands the partition over on the third attempt
+		if atomic.AddInt32(&consumeCalls, 1) < 3 {
+			http.Error(w, "partition 0 of telemetry is assigned to consumer other of group group", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeSSEMessage(w, "msg-1", "hello", 0)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(broker.Close)
+
+	name := "assignment-test"
+	q := newTestQueue(t, broker.URL, name)
+	handled := make(chan string, 1)
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		handled <- id
+		return nil
+	})
+
+	select {
+	case id := <-handled:
+		if id != "msg-1" {
+			t.Errorf("Expected msg-1, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the partition to be assigned")
+	}
+	if got := counterValue(t, metrics.QueueConsumerReconnects, name, "0", reconnectNotAssigned); got != 2 {
+		t.Errorf("Expected 2 not_assigned reconnects, got %v", got)
+	}
+
+	// Every attempt carries the same instance ID, derived from the name
+	first := <-consumers
+	if !strings.HasPrefix(first, name+"-") {
+		t.Errorf("Expected a consumer ID starting with %s-, got %q", name, first)
+	}
+	for i := 0; i < 2; i++ {
+		if id := <-consumers; id != first {
+			t.Errorf("Expected consumer ID %q on every attempt, got %q", first, id)
+		}
+	}
+	if other := newConsumerID(name); other == first {
+		t.Error("Expected instances with the same name to get different IDs")
+	}
+}
+
+func TestSubscribeReturnsOnClose(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(broker.Close)
+
+	q := newTestQueue(t, broker.URL, "close-test")
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+	}()
+
+	q.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected nil error after Close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Subscribe did not return after Close")
+	}
+}
+
+// mockBroker serves a fixed set of messages on /consume and records acks,
+// whether sent one at a time or in batches
+type mockBroker struct {
+	messages []string
+	hold     bool // keep the stream open after the messages are sent
+
+	mu    sync.Mutex
+	acked []string
+}
+
+func (m *mockBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/ack":
+		var body struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		m.mu.Lock()
+		m.acked = append(m.acked, body.ID)
+		m.mu.Unlock()
+		w.Write([]byte("ok"))
+	case "/ack/batch":
+		var ids []string
+		json.NewDecoder(r.Body).Decode(&ids)
+		m.mu.Lock()
+		m.acked = append(m.acked, ids...)
+		m.mu.Unlock()
+		fmt.Fprintf(w, `{"acked":%d,"failed":[]}`, len(ids))
+	case "/consume":
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, id := range m.messages {
+			writeSSEMessage(w, id, "payload-"+id, 0)
+			w.(http.Flusher).Flush()
+		}
+		if m.hold {
+			<-r.Context().Done()
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockBroker) ackedIDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.acked...)
+}
+
+func TestConsumeN(t *testing.T) {
+	broker := &mockBroker{messages: []string{"m1", "m2", "m3", "m4", "m5"}, hold: true}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "consume-n")
+	messages, err := q.ConsumeN("telemetry", 0, "batch", 3)
+	if err != nil {
+		t.Fatalf("ConsumeN failed: %v", err)
+	}
+
+	expected := []string{"m1", "m2", "m3"}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(messages))
+	}
+	for i, id := range expected {
+		if messages[i].ID != id {
+			t.Errorf("Message %d: expected ID %s, got %s", i, id, messages[i].ID)
+		}
+		if messages[i].Payload != "payload-"+id {
+			t.Errorf("Message %d: expected payload %s, got %s", i, "payload-"+id, messages[i].Payload)
+		}
+	}
+	if acked := broker.ackedIDs(); !reflect.DeepEqual(acked, expected) {
+		t.Errorf("Expected acks %v, got %v", expected, acked)
+	}
+}
+
+func TestConsumeNTimeout(t *testing.T) {
+	broker := &mockBroker{messages: []string{"m1"}, hold: true}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "consume-n-timeout")
+	q.consumeTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	messages, err := q.ConsumeN("telemetry", 0, "batch", 3)
+	if err == nil {
+		t.Fatal("Expected a timeout error when fewer than n messages arrive")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ConsumeN took %v, expected it to respect the timeout", elapsed)
+	}
+	if len(messages) != 1 || messages[0].ID != "m1" {
+		t.Errorf("Expected the one received message to be returned, got %+v", messages)
+	}
+}
+
+func TestPublishAcks(t *testing.T) {
+	tests := []struct {
+		acks        string
+		status      int
+		expectError bool
+	}{
+		{AcksNone, http.StatusAccepted, false},
+		{AcksLeader, http.StatusOK, false},
+		{AcksLeader, http.StatusAccepted, true},
+		{AcksPersisted, http.StatusOK, false},
+		{AcksPersisted, http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.acks, tt.status), func(t *testing.T) {
+			var gotAcks string
+			broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAcks = r.URL.Query().Get("acks")
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(broker.Close)
+
+			q := newTestQueue(t, broker.URL, "acks-test")
+			if err := q.SetAcks(tt.acks); err != nil {
+				t.Fatalf("SetAcks failed: %v", err)
+			}
+
+			err := q.Publish("telemetry", []byte("hello"))
+			if (err != nil) != tt.expectError {
+				t.Errorf("Expected error %v, got %v", tt.expectError, err)
+			}
+			if gotAcks != tt.acks {
+				t.Errorf("Expected acks=%s to be sent, got %q", tt.acks, gotAcks)
+			}
+		})
+	}
+}
+
+func TestPublishThrottled(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "4")
+		http.Error(w, "partition telemetry-0 is above its high watermark, slow down", http.StatusTooManyRequests)
+	}))
+	t.Cleanup(broker.Close)
+	q := newTestQueue(t, broker.URL, "throttled-test")
+
+	err := q.Publish("telemetry", []byte("hello"))
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		t.Fatalf("Expected a *ThrottledError, got %v", err)
+	}
+	if throttled.RetryAfter != 4*time.Second || RetryAfter(err) != 4*time.Second {
+		t.Errorf("Expected to be asked to wait 4s, got %v", throttled.RetryAfter)
+	}
+	if !strings.Contains(throttled.Message, "high watermark") {
+		t.Errorf("Expected the broker's message, got %q", throttled.Message)
+	}
+	if RetryAfter(fmt.Errorf("publish failed with status 500")) != 0 {
+		t.Error("Expected no wait for errors that aren't throttling")
+	}
+}
+
+func TestPublishSendsDeadline(t *testing.T) {
+	var header string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(requestDeadlineHeader)
+	}))
+	t.Cleanup(broker.Close)
+	q := newTestQueue(t, broker.URL, "deadline-test")
+	q.client.Timeout = 10 * time.Second
+
+	if err := q.Publish("telemetry", []byte("hello")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	// The client timeout is sent as is, not as a time on the client's clock
+	if header != "10000" {
+		t.Errorf("Expected %s to be the client timeout in milliseconds, got %q", requestDeadlineHeader, header)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"0":                             0,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 15 Jan 2024 10:30:05 GMT": 5 * time.Second,
+		"Mon, 15 Jan 2024 10:29:00 GMT": 0,
+	}
+	for value, expected := range tests {
+		if got := parseRetryAfter(value, now); got != expected {
+			t.Errorf("Retry-After %q: expected %v, got %v", value, expected, got)
+		}
+	}
+}
+
+func TestProduceAcksFromEnv(t *testing.T) {
+	tests := map[string]string{
+		"":          AcksLeader,
+		"none":      AcksNone,
+		"persisted": AcksPersisted,
+		"all":       AcksLeader,
+	}
+	for value, expected := range tests {
+		t.Setenv("PRODUCE_ACKS", value)
+		if got := getProduceAcks(); got != expected {
+			t.Errorf("PRODUCE_ACKS=%q: expected %s, got %s", value, expected, got)
+		}
+	}
+
+	q := newTestQueue(t, "http://localhost", "acks-env")
+	if err := q.SetAcks("all"); err == nil {
+		t.Error("Expected SetAcks to reject an unknown level")
+	}
+}
+
+func TestPublishCompression(t *testing.T) {
+	payload := []byte(strings.Repeat(`["2025-07-18T20:42:34Z","DCGM_FI_DEV_GPU_UTIL","0","nvidia0","GPU-1"],`, 20))
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		t.Run(compression, func(t *testing.T) {
+			var gotEncoding string
+			var sent int64
+			var envelope struct {
+				Payload string `json:"payload"`
+			}
+			broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/produce" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				gotEncoding = r.Header.Get("Content-Encoding")
+				body, _ := io.ReadAll(r.Body)
+				sent = int64(len(body))
+				reader := io.Reader(bytes.NewReader(body))
+				if gotEncoding == "gzip" {
+					zr, err := gzip.NewReader(reader)
+					if err != nil {
+						t.Errorf("Body isn't gzip: %v", err)
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					reader = zr
+				}
+				if err := json.NewDecoder(reader).Decode(&envelope); err != nil {
+					t.Errorf("Failed to decode body: %v", err)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(broker.Close)
+
+			q := newTestQueue(t, broker.URL, "compression-test")
+			if err := q.SetCompression(compression); err != nil {
+				t.Fatalf("SetCompression failed: %v", err)
+			}
+			if err := q.Publish("telemetry", payload); err != nil {
+				t.Fatalf("Publish failed: %v", err)
+			}
+			if envelope.Payload != string(payload) {
+				t.Errorf("Expected the payload to arrive intact, got %q", envelope.Payload)
+			}
+			if compression == CompressionGzip {
+				if gotEncoding != "gzip" {
+					t.Errorf("Expected Content-Encoding gzip, got %q", gotEncoding)
+				}
+				if sent >= int64(len(payload)) {
+					t.Errorf("Expected the compressed body (%d bytes) to be smaller than the payload (%d bytes)", sent, len(payload))
+				}
+			} else if gotEncoding != "" {
+				t.Errorf("Expected no Content-Encoding, got %q", gotEncoding)
+			}
+		})
+	}
+}
+
+func TestProduceCompressionFromEnv(t *testing.T) {
+	tests := map[string]string{
+		"":       CompressionNone,
+		"none":   CompressionNone,
+		" GZIP ": CompressionGzip,
+		"zstd":   CompressionNone,
+	}
+	for value, expected := range tests {
+		t.Setenv("PRODUCE_COMPRESSION", value)
+		if got := getProduceCompression(); got != expected {
+			t.Errorf("PRODUCE_COMPRESSION=%q: expected %s, got %s", value, expected, got)
+		}
+	}
+
+	q := newTestQueue(t, "http://localhost", "compression-env")
+	if err := q.SetCompression("zstd"); err == nil {
+		t.Error("Expected SetCompression to reject an unknown compression")
+	}
+}
+
+func TestSubscribeMultipleTopics(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ack/batch" {
+			w.Write([]byte(`{"acked":1,"failed":[]}`))
+			return
+		}
+		// Each topic-partition stream carries one message tagged with its topic
+		topic := r.URL.Query().Get("topic")
+		partition := r.URL.Query().Get("partition")
+		data, _ := json.Marshal(QueueMessage{ID: topic + "-" + partition, Payload: "payload-" + topic, Topic: topic})
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "id: %s\ndata: %s\n\n", topic+"-"+partition, data)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(broker.Close)
+
+	t.Setenv("MAX_PARTITIONS", "2")
+	q, err := NewHTTPMessageQueue(broker.URL, "telemetry", "group", "multi-topic")
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	if err := q.SetTopics("events", "orders", "events"); err != nil {
+		t.Fatalf("SetTopics failed: %v", err)
+	}
+
+	var mu sync.Mutex
+	received := make(map[string]string) // id -> topic
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		if string(body) != "payload-"+topic {
+			t.Errorf("Message %s delivered with topic %s but payload %s", id, topic, body)
+		}
+		mu.Lock()
+		received[id] = topic
+		mu.Unlock()
+		return nil
+	})
+
+	expected := map[string]string{
+		"events-0": "events",
+		"events-1": "events",
+		"orders-0": "orders",
+		"orders-1": "orders",
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) >= len(expected)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected messages %v, got %v", expected, received)
+	}
+}
+
+func TestSetTopics(t *testing.T) {
+	q := newTestQueue(t, "http://localhost", "set-topics")
+	if !reflect.DeepEqual(q.topics, []string{"telemetry"}) {
+		t.Errorf("Expected the constructor topic by default, got %v", q.topics)
+	}
+	if err := q.SetTopics(); err == nil {
+		t.Error("Expected an error for an empty topic list")
+	}
+	if err := q.SetTopics("events", ""); err == nil {
+		t.Error("Expected an error for an empty topic name")
+	}
+	if err := q.SetTopics("events", "orders", "events"); err != nil {
+		t.Fatalf("SetTopics failed: %v", err)
+	}
+	if !reflect.DeepEqual(q.topics, []string{"events", "orders"}) {
+		t.Errorf("Expected deduplicated topics, got %v", q.topics)
+	}
+}
+
+func TestDrainWaitsForAck(t *testing.T) {
+	broker := &mockBroker{messages: []string{"m1", "m2"}, hold: true}
+	server := httptest.NewServer(broker)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "drain-test")
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	var handled int32
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Subscribe(func(topic string, body []byte, id string) error {
+			if atomic.AddInt32(&handled, 1) == 1 {
+				close(handling)
+				<-release
+			}
+			return nil
+		})
+	}()
+
+	<-handling
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- q.Drain(ctx)
+	}()
+
+	// Drain must wait while the first message is still being handled
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned early with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-drained; err != nil {
+		t.Fatalf("Expected a clean drain, got %v", err)
+	}
+	if acked := broker.ackedIDs(); !reflect.DeepEqual(acked, []string{"m1"}) {
+		t.Errorf("Expected only the in-flight message to be acked, got %v", acked)
+	}
+	if got := atomic.LoadInt32(&handled); got != 1 {
+		t.Errorf("Expected no messages to be handled after draining started, got %d", got)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Subscribe did not return after Drain")
+	}
+}
+
+// fakeRingProxy serves /ring with a mutable set of down partitions and
+// records the partition of every produce
+type fakeRingProxy struct {
+	partitions int
+
+	mu       sync.Mutex
+	down     map[int]bool
+	produced []int
+	fetches  int
+}
+
+func (p *fakeRingProxy) setDown(partitions ...int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = make(map[int]bool)
+	for _, partition := range partitions {
+		p.down[partition] = true
+	}
+}
+
+func (p *fakeRingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch r.URL.Path {
+	case "/ring":
+		p.fetches++
+		type owner struct {
+			Partition int  `json:"partition"`
+			Healthy   bool `json:"healthy"`
+		}
+		owners := make([]owner, 0, p.partitions)
+		for i := 0; i < p.partitions; i++ {
+			owners = append(owners, owner{Partition: i, Healthy: !p.down[i]})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"partitions": owners})
+	case "/produce":
+		var partition int
+		fmt.Sscanf(r.URL.Query().Get("partition"), "%d", &partition)
+		p.produced = append(p.produced, partition)
+		w.Write([]byte(`{"id":"x"}`))
+	}
+}
+
+// takeProduced returns and clears the recorded produce partitions
+func (p *fakeRingProxy) takeProduced() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	produced := p.produced
+	p.produced = nil
+	return produced
+}
+
+func TestPublishSkipsUnhealthyPartitions(t *testing.T) {
+	proxy := &fakeRingProxy{partitions: 3}
+	proxy.setDown(1)
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "50")
+	q := newTestQueue(t, server.URL, "health-test")
+	q.maxPartitions = 3
+
+	for i := 0; i < 6; i++ {
+		if err := q.Publish("telemetry", []byte("hello")); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if got := proxy.takeProduced(); !reflect.DeepEqual(got, []int{0, 2, 0, 2, 0, 2}) {
+		t.Errorf("Expected publishes to alternate between healthy partitions, got %v", got)
+	}
+
+	// Once the broker recovers the partition is used again after the next refresh
+	proxy.setDown()
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := q.Publish("telemetry", []byte("hello")); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	got := proxy.takeProduced()
+	seen := make(map[int]bool)
+	for _, partition := range got {
+		seen[partition] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected all partitions to be used after recovery, got %v", got)
+	}
+
+	proxy.mu.Lock()
+	fetches := proxy.fetches
+	proxy.mu.Unlock()
+	if fetches != 2 {
+		t.Errorf("Expected health to be fetched once per interval (2 times), got %d", fetches)
+	}
+}
+
+func TestPublishAllPartitionsDown(t *testing.T) {
+	proxy := &fakeRingProxy{partitions: 2}
+	proxy.setDown(0, 1)
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "health-all-down")
+	q.maxPartitions = 2
+
+	for i := 0; i < 4; i++ {
+		q.Publish("telemetry", []byte("hello"))
+	}
+	// With nothing healthy the client keeps round-robin and leaves failover to the proxy
+	if got := proxy.takeProduced(); !reflect.DeepEqual(got, []int{0, 1, 0, 1}) {
+		t.Errorf("Expected plain round-robin, got %v", got)
+	}
+}
+
+func TestPublishHealthDisabled(t *testing.T) {
+	proxy := &fakeRingProxy{partitions: 2}
+	proxy.setDown(1)
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "0")
+	q := newTestQueue(t, server.URL, "health-disabled")
+	q.maxPartitions = 2
+
+	for i := 0; i < 2; i++ {
+		q.Publish("telemetry", []byte("hello"))
+	}
+	if got := proxy.takeProduced(); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("Expected health to be ignored when disabled, got %v", got)
+	}
+	if proxy.fetches != 0 {
+		t.Errorf("Expected no health fetches, got %d", proxy.fetches)
+	}
+}
+
+func TestReadSSEMultiLineData(t *testing.T) {
+	stream := strings.Join([]string{
+		": keepalive",
+		"id: m1",
+		`data: {"id": "m1",`,
+		`data:  "payload": "line one",`,
+		`data: "topic": "telemetry", "partition": 0}`,
+		"partition: 3",
+		"",
+		"id: m2",
+		`data:{"payload":"compact","topic":"telemetry","partition":1}`,
+		"",
+		"id: m3",
+		"partition: 2",
+		"",
+		"",
+	}, "\n")
+
+	var got []QueueMessage
+	if err := readSSE(strings.NewReader(stream), func(msg QueueMessage) bool {
+		got = append(got, msg)
+		return true
+	}); err != nil {
+		t.Fatalf("readSSE failed: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 messages (the event without data is skipped), got %d: %+v", len(got), got)
+	}
+	if got[0].ID != "m1" || got[0].Payload != "line one" || got[0].Partition != 3 {
+		t.Errorf("Expected multi-line data decoded with the event's partition, got %+v", got[0])
+	}
+	if got[1].ID != "m2" || got[1].Payload != "compact" || got[1].Partition != 1 {
+		t.Errorf("Expected the event id and payload partition to be used, got %+v", got[1])
+	}
+}
+
+func TestReadSSELargePayload(t *testing.T) {
+	payload := strings.Repeat("x", 256*1024)
+	data, _ := json.Marshal(QueueMessage{ID: "big", Payload: payload})
+	stream := "id: big\ndata: " + string(data) + "\n\n"
+
+	var got QueueMessage
+	if err := readSSE(strings.NewReader(stream), func(msg QueueMessage) bool {
+		got = msg
+		return true
+	}); err != nil {
+		t.Fatalf("readSSE failed: %v", err)
+	}
+	if got.Payload != payload {
+		t.Errorf("Expected a %d byte payload, got %d bytes", len(payload), len(got.Payload))
+	}
+}
+
+func TestAckUsesEventPartition(t *testing.T) {
+	acked := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/consume":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id: m1\n")
+			fmt.Fprint(w, "data: {\"id\":\"m1\",\"payload\":\"p\",\n")
+			fmt.Fprint(w, "data: \"topic\":\"telemetry\",\"partition\":0}\n")
+			fmt.Fprint(w, "partition: 5\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "/ack/batch":
+			select {
+			case acked <- r.URL.Query().Get("partition"):
+			default:
+			}
+			w.Write([]byte(`{"acked":1,"failed":[]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "event-partition")
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+
+	select {
+	case partition := <-acked:
+		if partition != "5" {
+			t.Errorf("Expected the ack to target partition 5 from the event, got %s", partition)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was never acked")
+	}
+}
+
+func TestConsumerResumesWithLastEventID(t *testing.T) {
+	// Acks are only sent when flushed, so the reconnect must flush them first
+	t.Setenv("ACK_BATCH_SIZE", "100")
+	t.Setenv("ACK_BATCH_INTERVAL_MS", "60000")
+
+	var mu sync.Mutex
+	var lastEventIDs []string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ack/batch" {
+			w.Write([]byte(`{"acked":2,"failed":[]}`))
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/topics/") {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		first := len(lastEventIDs) == 1
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if first {
+			writeSSEMessage(w, "m1", "one", 0)
+			writeSSEMessage(w, "m2", "two", 0)
+		}
+	}))
+	defer broker.Close()
+
+	q := newTestQueue(t, broker.URL, "resume-test")
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+
+	waitFor(t, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(lastEventIDs) >= 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if lastEventIDs[0] != "" {
+		t.Errorf("Expected no Last-Event-ID on the first connection, got %q", lastEventIDs[0])
+	}
+	if lastEventIDs[1] != "m2" {
+		t.Errorf("Expected the reconnect to resume after m2, got %q", lastEventIDs[1])
+	}
+}
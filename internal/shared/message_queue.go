@@ -1,8 +1,16 @@
 package shared
 
+import "context"
+
 // MessageQueue defines the interface for message queue implementations
 type MessageQueue interface {
 	Publish(topic string, body []byte) error
 	Subscribe(handler func(topic string, body []byte, id string) error) error
 	Close() error
-}
\ No newline at end of file
+}
+
+// Drainer is implemented by queues that can stop handing out messages and wait
+// for the ones already being handled to finish and be acknowledged
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
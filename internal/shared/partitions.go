@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// partitionDiscoveryRetry is how long a topic whose partition count couldn't
+// be discovered falls back to MAX_PARTITIONS before the client asks again
+const partitionDiscoveryRetry = 30 * time.Second
+
+// topicPartitions is the discovered partition count of a topic
+type topicPartitions struct {
+	count   int // 0 until discovered
+	fetched time.Time
+}
+
+// partitionCount returns how many partitions topic has, as reported by the
+// proxy's /topics/{topic} endpoint, so publishes and consumers cover every
+// partition the brokers have. The count is fetched once per topic; until it
+// is known, or while the lookup fails, MAX_PARTITIONS is used instead.
+func (h *HTTPMessageQueue) partitionCount(topic string) int {
+	h.partitionsMu.Lock()
+	entry, ok := h.partitions[topic]
+	if ok && (entry.count > 0 || time.Since(entry.fetched) < partitionDiscoveryRetry) {
+		count := entry.count
+		h.partitionsMu.Unlock()
+		if count > 0 {
+			return count
+		}
+		return h.maxPartitions
+	}
+	if !ok {
+		entry = &topicPartitions{}
+		h.partitions[topic] = entry
+	}
+	// Claim the lookup so concurrent callers don't fetch too
+	entry.fetched = time.Now()
+	h.partitionsMu.Unlock()
+
+	count, err := h.fetchPartitionCount(topic)
+	if err != nil {
+		fmt.Printf("[%s] Failed to discover partitions for topic %s, using MAX_PARTITIONS=%d: %v\n", h.name, topic, h.maxPartitions, err)
+		return h.maxPartitions
+	}
+
+	h.partitionsMu.Lock()
+	entry.count = count
+	h.partitionsMu.Unlock()
+	if count != h.maxPartitions {
+		fmt.Printf("[%s] Topic %s has %d partitions (MAX_PARTITIONS is %d)\n", h.name, topic, count, h.maxPartitions)
+	}
+	return count
+}
+
+// fetchPartitionCount asks the proxy how many partitions topic has
+func (h *HTTPMessageQueue) fetchPartitionCount(topic string) (int, error) {
+	ctx, cancel := context.WithTimeout(h.ctx, partitionHealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.baseURL+"/topics/"+url.PathEscape(topic), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("topic request failed with status %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Partitions int `json:"partitions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return 0, fmt.Errorf("failed to decode topic response: %w", err)
+	}
+	if info.Partitions <= 0 {
+		return 0, fmt.Errorf("topic reported %d partitions", info.Partitions)
+	}
+	return info.Partitions, nil
+}
@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// topicsProxy serves /topics/{topic} with a fixed partition count per topic
+// and records the partitions every produce and consume asks for
+type topicsProxy struct {
+	counts map[string]int
+
+	mu       sync.Mutex
+	lookups  int
+	produced map[string][]int
+	consumed map[string][]int
+}
+
+func (p *topicsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topic := r.URL.Query().Get("topic")
+	var partition int
+	fmt.Sscanf(r.URL.Query().Get("partition"), "%d", &partition)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/topics/"):
+		p.lookups++
+		name := strings.TrimPrefix(r.URL.Path, "/topics/")
+		count, ok := p.counts[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"topic":%q,"partitions":%d}`, name, count)
+	case r.URL.Path == "/produce":
+		if p.produced == nil {
+			p.produced = make(map[string][]int)
+		}
+		p.produced[topic] = append(p.produced[topic], partition)
+		w.Write([]byte(`{"id":"x"}`))
+	case r.URL.Path == "/consume":
+		if p.consumed == nil {
+			p.consumed = make(map[string][]int)
+		}
+		p.consumed[topic] = append(p.consumed[topic], partition)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// distinct returns the sorted distinct partitions in list
+func distinct(list []int) []int {
+	seen := make(map[int]bool)
+	var out []int
+	for _, partition := range list {
+		if !seen[partition] {
+			seen[partition] = true
+			out = append(out, partition)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+func TestPublishUsesDiscoveredPartitions(t *testing.T) {
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "0")
+	proxy := &topicsProxy{counts: map[string]int{"telemetry": 8, "orders": 4}}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	// MAX_PARTITIONS is 1, but the proxy knows better
+	q := newTestQueue(t, server.URL, "discover-publish")
+	for i := 0; i < 8; i++ {
+		if err := q.Publish("telemetry", []byte("hello")); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if err := q.Publish("orders", []byte("hello")); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	// An unknown topic falls back to MAX_PARTITIONS
+	if err := q.Publish("unknown", []byte("hello")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if got := fmt.Sprint(distinct(proxy.produced["telemetry"])); got != "[0 1 2 3 4 5 6 7]" {
+		t.Errorf("Expected telemetry publishes to reach all 8 partitions, got %s", got)
+	}
+	if got := fmt.Sprint(distinct(proxy.produced["orders"])); got != "[0 1 2 3]" {
+		t.Errorf("Expected orders publishes to stay within its 4 partitions, got %s", got)
+	}
+	if got := fmt.Sprint(proxy.produced["unknown"]); got != "[0]" {
+		t.Errorf("Expected the unknown topic to use MAX_PARTITIONS=1, got %s", got)
+	}
+	// One lookup per topic: telemetry at startup, then orders and unknown
+	if proxy.lookups != 3 {
+		t.Errorf("Expected 3 partition lookups, got %d", proxy.lookups)
+	}
+}
+
+func TestSubscribeUsesDiscoveredPartitions(t *testing.T) {
+	proxy := &topicsProxy{counts: map[string]int{"telemetry": 3, "orders": 2}}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "discover-subscribe")
+	if err := q.SetTopics("telemetry", "orders"); err != nil {
+		t.Fatalf("SetTopics failed: %v", err)
+	}
+	go q.Subscribe(func(topic string, body []byte, id string) error { return nil })
+
+	waitFor(t, 5*time.Second, func() bool {
+		proxy.mu.Lock()
+		defer proxy.mu.Unlock()
+		return len(distinct(proxy.consumed["telemetry"])) == 3 && len(distinct(proxy.consumed["orders"])) == 2
+	})
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if got := fmt.Sprint(distinct(proxy.consumed["telemetry"])); got != "[0 1 2]" {
+		t.Errorf("Expected consumers on telemetry partitions 0-2, got %s", got)
+	}
+	if got := fmt.Sprint(distinct(proxy.consumed["orders"])); got != "[0 1]" {
+		t.Errorf("Expected consumers on orders partitions 0-1, got %s", got)
+	}
+}
+
+func TestPartitionDiscoveryRetriesAfterFailure(t *testing.T) {
+	proxy := &topicsProxy{counts: map[string]int{}}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, server.URL, "discover-retry")
+	if got := q.partitionCount("telemetry"); got != 1 {
+		t.Fatalf("Expected MAX_PARTITIONS while the topic is unknown, got %d", got)
+	}
+
+	// The topic appears, but the failed lookup isn't retried straight away
+	proxy.mu.Lock()
+	proxy.counts["telemetry"] = 4
+	proxy.mu.Unlock()
+	if got := q.partitionCount("telemetry"); got != 1 {
+		t.Errorf("Expected the fallback until the retry interval passes, got %d", got)
+	}
+
+	q.partitionsMu.Lock()
+	q.partitions["telemetry"].fetched = time.Now().Add(-partitionDiscoveryRetry)
+	q.partitionsMu.Unlock()
+	if got := q.partitionCount("telemetry"); got != 4 {
+		t.Errorf("Expected the retried lookup to find 4 partitions, got %d", got)
+	}
+}
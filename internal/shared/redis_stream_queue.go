@@ -2,32 +2,164 @@ package shared
 
 import (
 	"context"
-	"time"
-	"log"
 	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	defaultRedisReadCount = 10
+	defaultRedisBlock     = 5 * time.Second
+)
+
+// Offset reset policies for new consumer groups
+const (
+	// OffsetResetLatest starts a new group after the last entry in the stream
+	OffsetResetLatest = "latest"
+	// OffsetResetEarliest starts a new group at the beginning of the stream,
+	// so it replays the existing backlog
+	OffsetResetEarliest = "earliest"
+)
+
+// redisStreamClient is the subset of the Redis client used by RedisStreamQueue
+type redisStreamClient interface {
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	Close() error
+}
+
 type RedisStreamQueue struct {
-	client *redis.Client
+	client redisStreamClient
 	stream string
 	group  string
 	name   string
+
+	// readCount is the maximum number of messages fetched per XREADGROUP call
+	readCount int64
+	// block is how long XREADGROUP waits for new messages
+	block time.Duration
+
+	// offsetReset is where the consumer group starts if it has to be created
+	offsetReset string
+	// groupReady is set once the consumer group is known to exist
+	groupReady bool
 }
 
+// NewRedisStreamQueue creates a Redis stream queue. The read batch size and block
+// time come from REDIS_READ_COUNT and REDIS_BLOCK_MS, and where a new consumer
+// group starts reading from REDIS_OFFSET_RESET, when set.
 func NewRedisStreamQueue(addr, stream, group, name string) (*RedisStreamQueue, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr: addr,
 	})
-	ctx := context.Background()
-	// Create consumer group if not exists
-	_ = client.XGroupCreateMkStream(ctx, stream, group, "$")
-	return &RedisStreamQueue{client: client, stream: stream, group: group, name: name}, nil
+	return newRedisStreamQueue(client, stream, group, name), nil
+}
+
+func newRedisStreamQueue(client redisStreamClient, stream, group, name string) *RedisStreamQueue {
+	q := &RedisStreamQueue{
+		client:      client,
+		stream:      stream,
+		group:       group,
+		name:        name,
+		readCount:   getRedisReadCount(),
+		block:       getRedisBlock(),
+		offsetReset: getRedisOffsetReset(),
+	}
+	// Redis may not be reachable yet; creating the group is retried before the first read
+	if err := q.ensureGroup(context.Background()); err != nil {
+		log.Printf("Failed to create consumer group %s on stream %s, will retry on subscribe: %v", group, stream, err)
+	}
+	return q
+}
+
+// ensureGroup creates the consumer group at the offset reset position unless
+// it is already known to exist
+func (q *RedisStreamQueue) ensureGroup(ctx context.Context) error {
+	if q.groupReady {
+		return nil
+	}
+	if err := q.client.XGroupCreateMkStream(ctx, q.stream, q.group, offsetResetStart(q.offsetReset)).Err(); err != nil {
+		if !isBusyGroup(err) {
+			return fmt.Errorf("create consumer group %s on stream %s: %w", q.group, q.stream, err)
+		}
+		// An existing group keeps its position; the reset policy only applies to new groups
+		log.Printf("Consumer group %s already exists on stream %s, resuming from its last delivered entry", q.group, q.stream)
+	} else {
+		log.Printf("Created consumer group %s on stream %s at the %s entry", q.group, q.stream, q.offsetReset)
+	}
+	q.groupReady = true
+	return nil
+}
+
+// getRedisOffsetReset returns REDIS_OFFSET_RESET (latest or earliest) or latest
+func getRedisOffsetReset() string {
+	reset := strings.ToLower(strings.TrimSpace(os.Getenv("REDIS_OFFSET_RESET")))
+	switch reset {
+	case "":
+		return OffsetResetLatest
+	case OffsetResetLatest, OffsetResetEarliest:
+		return reset
+	}
+	log.Printf("Invalid REDIS_OFFSET_RESET value '%s', using default: %s", reset, OffsetResetLatest)
+	return OffsetResetLatest
+}
+
+// offsetResetStart maps a reset policy to the XGROUP CREATE start ID
+func offsetResetStart(reset string) string {
+	if reset == OffsetResetEarliest {
+		return "0"
+	}
+	return "$"
+}
+
+// isBusyGroup reports whether err is Redis refusing to create a group that already exists
+func isBusyGroup(err error) bool {
+	return strings.HasPrefix(err.Error(), "BUSYGROUP")
+}
+
+// getRedisReadCount returns REDIS_READ_COUNT or the default; values must be positive
+func getRedisReadCount() int64 {
+	if countStr := os.Getenv("REDIS_READ_COUNT"); countStr != "" {
+		if count, err := strconv.ParseInt(countStr, 10, 64); err == nil && count > 0 {
+			return count
+		}
+		log.Printf("Invalid REDIS_READ_COUNT value '%s', using default: %d", countStr, defaultRedisReadCount)
+	}
+	return defaultRedisReadCount
+}
+
+// getRedisBlock returns REDIS_BLOCK_MS as a duration or the default; values must be positive
+func getRedisBlock() time.Duration {
+	if blockStr := os.Getenv("REDIS_BLOCK_MS"); blockStr != "" {
+		if ms, err := strconv.Atoi(blockStr); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid REDIS_BLOCK_MS value '%s', using default: %v", blockStr, defaultRedisBlock)
+	}
+	return defaultRedisBlock
+}
+
+// readGroupArgs builds the XREADGROUP arguments for this consumer
+func (q *RedisStreamQueue) readGroupArgs() *redis.XReadGroupArgs {
+	return &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.name,
+		Streams:  []string{q.stream, ">"},
+		Count:    q.readCount,
+		Block:    q.block,
+	}
 }
 
 func (q *RedisStreamQueue) Publish(topic string, body []byte) error {
 	ctx := context.Background()
-	id, err :=  q.client.XAdd(ctx, &redis.XAddArgs{
+	id, err := q.client.XAdd(ctx, &redis.XAddArgs{
 		Stream: q.stream,
 		Values: map[string]interface{}{
 			"topic": topic,
@@ -38,38 +170,44 @@ func (q *RedisStreamQueue) Publish(topic string, body []byte) error {
 		log.Fatalf("xadd failed: %v", err)
 		return err
 	}
-	fmt.Println("sent message id:", id)	
+	fmt.Println("sent message id:", id)
 	return nil
 }
 
+// Subscribe handles batches until a read fails and returns the error, so the
+// caller can retry; creating the consumer group is retried along with it
 func (q *RedisStreamQueue) Subscribe(handler func(topic string, body []byte, id string) error) error {
 	ctx := context.Background()
 	for {
-		msgs, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
-			Group:    q.group,
-			Consumer: q.name,
-			Streams:  []string{q.stream, ">"},
-			Count:    10,
-			Block:    5 * time.Second,
-		}).Result()
-
-		if err != nil && err != redis.Nil {
-			log.Fatalf("xreadgroup failed: %v", err)
-			return err
+		if err := q.readBatch(ctx, handler); err != nil {
+			return fmt.Errorf("xreadgroup failed: %w", err)
 		}
-		for _, stream := range msgs {
-			for _, msg := range stream.Messages {
-				fmt.Printf("Processing %s: %v\n", msg.ID, msg.Values)
-				topic, _ := msg.Values["topic"].(string)
-				bodyStr, _ := msg.Values["body"].(string)
-				body := []byte(bodyStr)
-				fmt.Printf("Received message id=%s topic=%s body=%s, len= %d\n", msg.ID, topic, string(body), len(body))
-				if err := handler(topic, body, msg.ID); err == nil {
-					q.client.XAck(ctx, q.stream, q.group, msg.ID)
-				}
+	}
+}
+
+// readBatch reads one XREADGROUP batch, hands each message to handler and acks
+// the ones it accepts
+func (q *RedisStreamQueue) readBatch(ctx context.Context, handler func(topic string, body []byte, id string) error) error {
+	if err := q.ensureGroup(ctx); err != nil {
+		return err
+	}
+	msgs, err := q.client.XReadGroup(ctx, q.readGroupArgs()).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	for _, stream := range msgs {
+		for _, msg := range stream.Messages {
+			fmt.Printf("Processing %s: %v\n", msg.ID, msg.Values)
+			topic, _ := msg.Values["topic"].(string)
+			bodyStr, _ := msg.Values["body"].(string)
+			body := []byte(bodyStr)
+			fmt.Printf("Received message id=%s topic=%s body=%s, len= %d\n", msg.ID, topic, string(body), len(body))
+			if err := handler(topic, body, msg.ID); err == nil {
+				q.client.XAck(ctx, q.stream, q.group, msg.ID)
 			}
 		}
 	}
+	return nil
 }
 
 func (q *RedisStreamQueue) Close() error {
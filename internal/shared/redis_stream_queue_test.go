@@ -0,0 +1,254 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedisClient keeps a single in-memory stream and the position of each
+// consumer group on it, without a Redis server
+type fakeRedisClient struct {
+	groupsCreated []string
+	// createErr, when set, is returned by XGroupCreateMkStream
+	createErr error
+
+	entries []redis.XMessage
+	// groups maps a group to the number of entries delivered to it
+	groups map[string]int
+}
+
+func (f *fakeRedisClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	f.groupsCreated = append(f.groupsCreated, stream+"/"+group)
+	cmd := redis.NewStatusCmd(ctx)
+	if f.createErr != nil {
+		cmd.SetErr(f.createErr)
+		return cmd
+	}
+	if f.groups == nil {
+		f.groups = make(map[string]int)
+	}
+	if _, ok := f.groups[group]; ok {
+		cmd.SetErr(errors.New("BUSYGROUP Consumer Group name already exists"))
+		return cmd
+	}
+	switch start {
+	case "0":
+		f.groups[group] = 0
+	case "$":
+		f.groups[group] = len(f.entries)
+	default:
+		cmd.SetErr(fmt.Errorf("unexpected start ID %q", start))
+	}
+	return cmd
+}
+
+func (f *fakeRedisClient) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	id := fmt.Sprintf("%d-0", len(f.entries)+1)
+	values := map[string]interface{}{}
+	for k, v := range a.Values.(map[string]interface{}) {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		values[k] = v
+	}
+	f.entries = append(f.entries, redis.XMessage{ID: id, Values: values})
+	return redis.NewStringResult(id, nil)
+}
+
+func (f *fakeRedisClient) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	next, ok := f.groups[a.Group]
+	if !ok || next >= len(f.entries) {
+		return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+	}
+	end := len(f.entries)
+	if a.Count > 0 && next+int(a.Count) < end {
+		end = next + int(a.Count)
+	}
+	f.groups[a.Group] = end
+	return redis.NewXStreamSliceCmdResult([]redis.XStream{{Stream: a.Streams[0], Messages: f.entries[next:end]}}, nil)
+}
+
+func (f *fakeRedisClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (f *fakeRedisClient) Close() error { return nil }
+
+func TestRedisReadArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		count         string
+		block         string
+		expectedCount int64
+		expectedBlock time.Duration
+	}{
+		{"Defaults", "", "", 10, 5 * time.Second},
+		{"Custom values", "100", "250", 100, 250 * time.Millisecond},
+		{"Invalid values fall back", "0", "-5", 10, 5 * time.Second},
+		{"Non-numeric values fall back", "many", "soon", 10, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REDIS_READ_COUNT", tt.count)
+			t.Setenv("REDIS_BLOCK_MS", tt.block)
+
+			client := &fakeRedisClient{}
+			q := newRedisStreamQueue(client, "telemetry", "collectors", "collector-0")
+
+			args := q.readGroupArgs()
+			if args.Count != tt.expectedCount {
+				t.Errorf("Expected count %d, got %d", tt.expectedCount, args.Count)
+			}
+			if args.Block != tt.expectedBlock {
+				t.Errorf("Expected block %v, got %v", tt.expectedBlock, args.Block)
+			}
+			if args.Group != "collectors" || args.Consumer != "collector-0" {
+				t.Errorf("Unexpected group/consumer %s/%s", args.Group, args.Consumer)
+			}
+			if len(args.Streams) != 2 || args.Streams[0] != "telemetry" || args.Streams[1] != ">" {
+				t.Errorf("Unexpected streams %v", args.Streams)
+			}
+			if len(client.groupsCreated) != 1 || client.groupsCreated[0] != "telemetry/collectors" {
+				t.Errorf("Expected the consumer group to be created, got %v", client.groupsCreated)
+			}
+		})
+	}
+}
+
+// drain reads batches until the group has nothing left and returns the bodies seen
+func drain(t *testing.T, q *RedisStreamQueue) []string {
+	t.Helper()
+	var bodies []string
+	for i := 0; i < 10; i++ {
+		before := len(bodies)
+		err := q.readBatch(context.Background(), func(topic string, body []byte, id string) error {
+			bodies = append(bodies, string(body))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("readBatch failed: %v", err)
+		}
+		if len(bodies) == before {
+			return bodies
+		}
+	}
+	t.Fatal("Stream was not drained")
+	return nil
+}
+
+// prepopulate adds n messages to the stream before any group exists
+func prepopulate(client *fakeRedisClient, n int) {
+	for i := 0; i < n; i++ {
+		client.XAdd(context.Background(), &redis.XAddArgs{
+			Stream: "telemetry",
+			Values: map[string]interface{}{"topic": "telemetry", "body": []byte(fmt.Sprintf("backlog-%d", i))},
+		})
+	}
+}
+
+func TestOffsetResetEarliestReplaysBacklog(t *testing.T) {
+	t.Setenv("REDIS_OFFSET_RESET", "earliest")
+	t.Setenv("REDIS_READ_COUNT", "2")
+	client := &fakeRedisClient{}
+	prepopulate(client, 5)
+
+	q := newRedisStreamQueue(client, "telemetry", "replay", "collector-0")
+	bodies := drain(t, q)
+	if len(bodies) != 5 || bodies[0] != "backlog-0" || bodies[4] != "backlog-4" {
+		t.Errorf("Expected the new group to consume the 5 backlog messages in order, got %v", bodies)
+	}
+}
+
+func TestOffsetResetLatestSkipsBacklog(t *testing.T) {
+	t.Setenv("REDIS_OFFSET_RESET", "")
+	client := &fakeRedisClient{}
+	prepopulate(client, 3)
+
+	q := newRedisStreamQueue(client, "telemetry", "live", "collector-0")
+	if bodies := drain(t, q); len(bodies) != 0 {
+		t.Errorf("Expected no backlog for a latest group, got %v", bodies)
+	}
+	q.Publish("telemetry", []byte("fresh"))
+	if bodies := drain(t, q); len(bodies) != 1 || bodies[0] != "fresh" {
+		t.Errorf("Expected only the new message, got %v", bodies)
+	}
+}
+
+func TestExistingGroupKeepsPosition(t *testing.T) {
+	t.Setenv("REDIS_OFFSET_RESET", "latest")
+	client := &fakeRedisClient{}
+	prepopulate(client, 3)
+	newRedisStreamQueue(client, "telemetry", "collectors", "collector-0")
+
+	// A restarted consumer asking for earliest must not rewind an existing group
+	t.Setenv("REDIS_OFFSET_RESET", "earliest")
+	q := newRedisStreamQueue(client, "telemetry", "collectors", "collector-1")
+	if bodies := drain(t, q); len(bodies) != 0 {
+		t.Errorf("Expected the existing group to keep its position, got %v", bodies)
+	}
+}
+
+func TestGroupCreateRetriedOnRead(t *testing.T) {
+	t.Setenv("REDIS_OFFSET_RESET", "earliest")
+	// Redis being unreachable at startup must not fail the constructor
+	client := &fakeRedisClient{createErr: errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")}
+	q := newRedisStreamQueue(client, "telemetry", "collectors", "collector-0")
+
+	handler := func(topic string, body []byte, id string) error { return nil }
+	if err := q.readBatch(context.Background(), handler); err == nil {
+		t.Error("Expected a read to fail while the group can't be created")
+	}
+
+	client.createErr = nil
+	prepopulate(client, 2)
+	if bodies := drain(t, q); len(bodies) != 2 {
+		t.Errorf("Expected the group to be created on the next read and replay 2 messages, got %v", bodies)
+	}
+	if len(client.groupsCreated) != 3 {
+		t.Errorf("Expected 3 create attempts (startup, failed read, successful read), got %d", len(client.groupsCreated))
+	}
+}
+
+func TestSubscribeReturnsGroupCreateError(t *testing.T) {
+	t.Setenv("REDIS_OFFSET_RESET", "earliest")
+	createErr := errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")
+	client := &fakeRedisClient{createErr: createErr}
+	q := newRedisStreamQueue(client, "telemetry", "collectors", "collector-0")
+
+	// Redis still being down when the consumer starts is returned for the
+	// caller to retry instead of exiting the process
+	handler := func(topic string, body []byte, id string) error { return nil }
+	if err := q.Subscribe(handler); !errors.Is(err, createErr) {
+		t.Fatalf("Expected Subscribe to return the group create error, got %v", err)
+	}
+
+	client.createErr = nil
+	prepopulate(client, 2)
+	if bodies := drain(t, q); len(bodies) != 2 {
+		t.Errorf("Expected a later read to create the group and replay 2 messages, got %v", bodies)
+	}
+	if len(client.groupsCreated) != 3 {
+		t.Errorf("Expected 3 create attempts (startup, failed subscribe, successful read), got %d", len(client.groupsCreated))
+	}
+}
+
+func TestGetRedisOffsetReset(t *testing.T) {
+	tests := map[string]string{
+		"":         OffsetResetLatest,
+		"latest":   OffsetResetLatest,
+		"Earliest": OffsetResetEarliest,
+		"oldest":   OffsetResetLatest,
+	}
+	for value, expected := range tests {
+		t.Setenv("REDIS_OFFSET_RESET", value)
+		if got := getRedisOffsetReset(); got != expected {
+			t.Errorf("REDIS_OFFSET_RESET=%q: expected %s, got %s", value, expected, got)
+		}
+	}
+}
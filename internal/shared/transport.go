@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Connection pool defaults for the queue client, matching the proxy's broker
+// transport
+const (
+	defaultQueueMaxIdleConns        = 100
+	defaultQueueMaxIdleConnsPerHost = 10
+	defaultQueueIdleConnTimeout     = 90 * time.Second
+	queueKeepAlive                  = 30 * time.Second
+)
+
+// queueTransportConfig is the connection pool tuning for the queue client
+type queueTransportConfig struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+}
+
+// getQueueTransportConfig returns QUEUE_MAX_IDLE_CONNS,
+// QUEUE_MAX_IDLE_CONNS_PER_HOST and QUEUE_IDLE_CONN_TIMEOUT_MS or their
+// defaults
+func getQueueTransportConfig() queueTransportConfig {
+	cfg := queueTransportConfig{
+		maxIdleConns:        defaultQueueMaxIdleConns,
+		maxIdleConnsPerHost: defaultQueueMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultQueueIdleConnTimeout,
+	}
+	if s := os.Getenv("QUEUE_MAX_IDLE_CONNS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.maxIdleConns = n
+		} else {
+			log.Printf("Invalid QUEUE_MAX_IDLE_CONNS value '%s', using default: %d", s, defaultQueueMaxIdleConns)
+		}
+	}
+	if s := os.Getenv("QUEUE_MAX_IDLE_CONNS_PER_HOST"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.maxIdleConnsPerHost = n
+		} else {
+			log.Printf("Invalid QUEUE_MAX_IDLE_CONNS_PER_HOST value '%s', using default: %d", s, defaultQueueMaxIdleConnsPerHost)
+		}
+	}
+	if s := os.Getenv("QUEUE_IDLE_CONN_TIMEOUT_MS"); s != "" {
+		if ms, err := strconv.Atoi(s); err == nil && ms > 0 {
+			cfg.idleConnTimeout = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid QUEUE_IDLE_CONN_TIMEOUT_MS value '%s', using default: %v", s, defaultQueueIdleConnTimeout)
+		}
+	}
+	return cfg
+}
+
+// newQueueTransport builds the pooled, keep-alive transport the queue client
+// uses for every request, so a busy publisher reuses connections instead of
+// opening one per message
+func newQueueTransport(cfg queueTransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: queueKeepAlive,
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        cfg.maxIdleConns,
+		MaxIdleConnsPerHost: cfg.maxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.idleConnTimeout,
+	}
+}
+
+// drainBody reads what is left of a response body so its connection can go
+// back to the idle pool when the body is closed
+func drainBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+}
@@ -0,0 +1,75 @@
+package shared
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublishReusesConnections(t *testing.T) {
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "0")
+	var newConns int64
+	broker := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Answer like the broker, with a body the client has to read past
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "m", "partition": 0, "offset": 1})
+	}))
+	broker.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	broker.Start()
+	t.Cleanup(broker.Close)
+
+	q := newTestQueue(t, broker.URL, "reuse-test")
+	const publishes = 200
+	for i := 0; i < publishes; i++ {
+		if err := q.Publish("telemetry", []byte("hello")); err != nil {
+			t.Fatalf("Publish %d failed: %v", i, err)
+		}
+	}
+
+	// Sequential publishes should all ride the same kept-alive connection
+	if n := atomic.LoadInt64(&newConns); n > 2 {
+		t.Errorf("Expected %d publishes to reuse a connection, opened %d", publishes, n)
+	}
+}
+
+func TestQueueTransportConfigFromEnv(t *testing.T) {
+	t.Setenv("QUEUE_MAX_IDLE_CONNS", "")
+	t.Setenv("QUEUE_MAX_IDLE_CONNS_PER_HOST", "")
+	t.Setenv("QUEUE_IDLE_CONN_TIMEOUT_MS", "")
+	cfg := getQueueTransportConfig()
+	if cfg.maxIdleConns != defaultQueueMaxIdleConns || cfg.maxIdleConnsPerHost != defaultQueueMaxIdleConnsPerHost ||
+		cfg.idleConnTimeout != defaultQueueIdleConnTimeout {
+		t.Errorf("Expected defaults, got %+v", cfg)
+	}
+
+	t.Setenv("QUEUE_MAX_IDLE_CONNS", "50")
+	t.Setenv("QUEUE_MAX_IDLE_CONNS_PER_HOST", "25")
+	t.Setenv("QUEUE_IDLE_CONN_TIMEOUT_MS", "5000")
+	cfg = getQueueTransportConfig()
+	if cfg.maxIdleConns != 50 || cfg.maxIdleConnsPerHost != 25 || cfg.idleConnTimeout != 5*time.Second {
+		t.Errorf("Expected 50/25/5s, got %+v", cfg)
+	}
+
+	tr := newQueueTransport(cfg)
+	if tr.MaxIdleConns != 50 || tr.MaxIdleConnsPerHost != 25 || tr.IdleConnTimeout != 5*time.Second {
+		t.Errorf("Expected the transport to use the config, got %d/%d/%v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	// Invalid values fall back to the defaults
+	t.Setenv("QUEUE_MAX_IDLE_CONNS", "-1")
+	t.Setenv("QUEUE_MAX_IDLE_CONNS_PER_HOST", "many")
+	t.Setenv("QUEUE_IDLE_CONN_TIMEOUT_MS", "0")
+	cfg = getQueueTransportConfig()
+	if cfg.maxIdleConns != defaultQueueMaxIdleConns || cfg.maxIdleConnsPerHost != defaultQueueMaxIdleConnsPerHost ||
+		cfg.idleConnTimeout != defaultQueueIdleConnTimeout {
+		t.Errorf("Expected invalid values to fall back to defaults, got %+v", cfg)
+	}
+}
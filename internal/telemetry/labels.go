@@ -0,0 +1,72 @@
+package telemetry
+
+import "strings"
+
+// LabelDriverVersion is the DCGM exporter label carrying the NVIDIA driver version
+const LabelDriverVersion = "DCGM_FI_DRIVER_VERSION"
+
+// ParseLabels splits a labels_raw string such as
+// DCGM_FI_DRIVER_VERSION="535.129.03",Hostname="node-1"
+// into a key/value map. Values may be quoted, in which case commas and
+// backslash-escaped quotes inside them are kept. Malformed pairs are skipped.
+func ParseLabels(raw string) map[string]string {
+	labels := make(map[string]string)
+	i := 0
+	for i < len(raw) {
+		// key runs up to '='
+		eq := strings.IndexByte(raw[i:], '=')
+		if eq < 0 {
+			break
+		}
+		key := raw[i : i+eq]
+		// text before a comma in the key is a malformed pair without '='
+		if comma := strings.LastIndexByte(key, ','); comma >= 0 {
+			key = key[comma+1:]
+		}
+		key = strings.TrimSpace(key)
+		i += eq + 1
+
+		var value strings.Builder
+		if i < len(raw) && raw[i] == '"' {
+			i++
+			for i < len(raw) && raw[i] != '"' {
+				if raw[i] == '\\' && i+1 < len(raw) {
+					i++
+				}
+				value.WriteByte(raw[i])
+				i++
+			}
+			// skip the closing quote and anything up to the next separator
+			if next := strings.IndexByte(raw[i:], ','); next >= 0 {
+				i += next
+			} else {
+				i = len(raw)
+			}
+		} else {
+			end := strings.IndexByte(raw[i:], ',')
+			if end < 0 {
+				end = len(raw) - i
+			}
+			value.WriteString(strings.TrimSpace(raw[i : i+end]))
+			i += end
+		}
+		i++ // comma
+
+		if key != "" {
+			labels[key] = value.String()
+		}
+	}
+	return labels
+}
+
+// PromoteLabels copies well-known labels from LabelsRaw into their dedicated
+// fields, leaving fields that are already set untouched.
+func (r *TelemetryRecord) PromoteLabels() {
+	if r.LabelsRaw == "" {
+		return
+	}
+	labels := ParseLabels(r.LabelsRaw)
+	if r.DriverVersion == "" {
+		r.DriverVersion = labels[LabelDriverVersion]
+	}
+}
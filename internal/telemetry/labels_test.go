@@ -0,0 +1,90 @@
+package telemetry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected map[string]string
+	}{
+		{
+			name: "DCGM exporter labels",
+			raw:  `DCGM_FI_DRIVER_VERSION="535.129.03",Hostname="mtv5-dgx1-hgpu-031",UUID="GPU-5fd4f087-86f3-7a43-b711-4771313afc50",__name__="DCGM_FI_DEV_GPU_UTIL",device="nvidia0",gpu="0",instance="mtv5-dgx1-hgpu-031:9400",job="dgx_dcgm_exporter",modelName="NVIDIA H100 80GB HBM3"`,
+			expected: map[string]string{
+				"DCGM_FI_DRIVER_VERSION": "535.129.03",
+				"Hostname":               "mtv5-dgx1-hgpu-031",
+				"UUID":                   "GPU-5fd4f087-86f3-7a43-b711-4771313afc50",
+				"__name__":               "DCGM_FI_DEV_GPU_UTIL",
+				"device":                 "nvidia0",
+				"gpu":                    "0",
+				"instance":               "mtv5-dgx1-hgpu-031:9400",
+				"job":                    "dgx_dcgm_exporter",
+				"modelName":              "NVIDIA H100 80GB HBM3",
+			},
+		},
+		{
+			name:     "Single label",
+			raw:      `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+			expected: map[string]string{"DCGM_FI_DRIVER_VERSION": "535.129.03"},
+		},
+		{
+			name:     "Unquoted values and spaces",
+			raw:      `app=ml-training, tier = gpu`,
+			expected: map[string]string{"app": "ml-training", "tier": "gpu"},
+		},
+		{
+			name:     "Quoted value with comma, equals and escaped quote",
+			raw:      `note="a,b=c \"x\"",gpu="1"`,
+			expected: map[string]string{"note": `a,b=c "x"`, "gpu": "1"},
+		},
+		{
+			name:     "Empty values",
+			raw:      `container="",pod=`,
+			expected: map[string]string{"container": "", "pod": ""},
+		},
+		{
+			name:     "Empty string",
+			raw:      "",
+			expected: map[string]string{},
+		},
+		{
+			name:     "Malformed pair is skipped",
+			raw:      `garbage,gpu="2"`,
+			expected: map[string]string{"gpu": "2"},
+		},
+		{
+			name:     "Unterminated quote",
+			raw:      `gpu="3`,
+			expected: map[string]string{"gpu": "3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseLabels(tt.raw); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("ParseLabels(%q) = %v, expected %v", tt.raw, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPromoteLabels(t *testing.T) {
+	rec := TelemetryRecord{LabelsRaw: `DCGM_FI_DRIVER_VERSION="535.129.03",gpu="0"`}
+	rec.PromoteLabels()
+	if rec.DriverVersion != "535.129.03" {
+		t.Errorf("Expected driver version 535.129.03, got %q", rec.DriverVersion)
+	}
+	if rec.LabelsRaw != `DCGM_FI_DRIVER_VERSION="535.129.03",gpu="0"` {
+		t.Errorf("Expected LabelsRaw to be kept, got %q", rec.LabelsRaw)
+	}
+
+	preset := TelemetryRecord{LabelsRaw: `DCGM_FI_DRIVER_VERSION="1.0"`, DriverVersion: "2.0"}
+	preset.PromoteLabels()
+	if preset.DriverVersion != "2.0" {
+		t.Errorf("Expected an existing driver version to be kept, got %q", preset.DriverVersion)
+	}
+}
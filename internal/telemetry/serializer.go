@@ -0,0 +1,266 @@
+package telemetry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message formats a Serializer can be selected by
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+)
+
+// Serializer encodes TelemetryRecords for the message queue
+type Serializer interface {
+	Marshal(record TelemetryRecord) ([]byte, error)
+	Unmarshal(data []byte, record *TelemetryRecord) error
+	// Format is the name the serializer is selected by
+	Format() string
+}
+
+// NewSerializer returns the serializer for format; empty means JSON
+func NewSerializer(format string) (Serializer, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", FormatJSON:
+		return JSONSerializer{}, nil
+	case FormatProtobuf, "proto":
+		return ProtobufSerializer{}, nil
+	}
+	return nil, fmt.Errorf("unknown message format %q (expected %s or %s)", format, FormatJSON, FormatProtobuf)
+}
+
+// QueueSerializer returns s as records are sent on the message queue. The
+// HTTP queue carries each payload as a JSON string, which can't hold
+// arbitrary bytes, so binary formats are base64-encoded; JSON passes through.
+func QueueSerializer(s Serializer) Serializer {
+	if s.Format() == FormatJSON {
+		return s
+	}
+	return base64Serializer{s}
+}
+
+// base64Serializer base64-encodes what the Serializer it wraps produces
+type base64Serializer struct {
+	Serializer
+}
+
+func (b base64Serializer) Marshal(record TelemetryRecord) ([]byte, error) {
+	data, err := b.Serializer.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(out, data)
+	return out, nil
+}
+
+func (b base64Serializer) Unmarshal(data []byte, record *TelemetryRecord) error {
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, data)
+	if err != nil {
+		return fmt.Errorf("invalid base64: %w", err)
+	}
+	return b.Serializer.Unmarshal(raw[:n], record)
+}
+
+// JSONSerializer encodes records as JSON, the same as Marshal
+type JSONSerializer struct{}
+
+func (JSONSerializer) Marshal(record TelemetryRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+func (JSONSerializer) Unmarshal(data []byte, record *TelemetryRecord) error {
+	return json.Unmarshal(data, record)
+}
+
+func (JSONSerializer) Format() string { return FormatJSON }
+
+// Field numbers of the TelemetryRecord protobuf message, see telemetry.proto
+const (
+	fieldDeviceID      protowire.Number = 1
+	fieldMetric        protowire.Number = 2
+	fieldValue         protowire.Number = 3
+	fieldTime          protowire.Number = 4
+	fieldGPUID         protowire.Number = 5
+	fieldUUID          protowire.Number = 6
+	fieldModelName     protowire.Number = 7
+	fieldHostname      protowire.Number = 8
+	fieldContainer     protowire.Number = 9
+	fieldPod           protowire.Number = 10
+	fieldNamespace     protowire.Number = 11
+	fieldLabelsRaw     protowire.Number = 12
+	fieldDriverVersion protowire.Number = 13
+
+	// google.protobuf.Timestamp fields
+	fieldSeconds protowire.Number = 1
+	fieldNanos   protowire.Number = 2
+)
+
+// ProtobufSerializer encodes records in the protobuf wire format described by
+// telemetry.proto, so they can be decoded by any protobuf library. Like proto3,
+// empty strings, a zero value and a zero time are left out.
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) Format() string { return FormatProtobuf }
+
+func (ProtobufSerializer) Marshal(record TelemetryRecord) ([]byte, error) {
+	b := make([]byte, 0, 256)
+	b = appendString(b, fieldDeviceID, record.DeviceID)
+	b = appendString(b, fieldMetric, record.Metric)
+	if bits := math.Float64bits(record.Value); bits != 0 {
+		b = protowire.AppendTag(b, fieldValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, bits)
+	}
+	if !record.Time.IsZero() {
+		var ts []byte
+		if secs := record.Time.Unix(); secs != 0 {
+			ts = protowire.AppendTag(ts, fieldSeconds, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(secs))
+		}
+		if nanos := record.Time.Nanosecond(); nanos != 0 {
+			ts = protowire.AppendTag(ts, fieldNanos, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(nanos))
+		}
+		b = protowire.AppendTag(b, fieldTime, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	b = appendString(b, fieldGPUID, record.GPUID)
+	b = appendString(b, fieldUUID, record.UUID)
+	b = appendString(b, fieldModelName, record.ModelName)
+	b = appendString(b, fieldHostname, record.Hostname)
+	b = appendString(b, fieldContainer, record.Container)
+	b = appendString(b, fieldPod, record.Pod)
+	b = appendString(b, fieldNamespace, record.Namespace)
+	b = appendString(b, fieldLabelsRaw, record.LabelsRaw)
+	b = appendString(b, fieldDriverVersion, record.DriverVersion)
+	return b, nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// Unmarshal decodes data into record. Unknown fields are skipped, so fields
+// added to the message later don't break older readers.
+func (ProtobufSerializer) Unmarshal(data []byte, record *TelemetryRecord) error {
+	*record = TelemetryRecord{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == fieldValue && typ == protowire.Fixed64Type:
+			bits, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			record.Value = math.Float64frombits(bits)
+			data = data[n:]
+		case num == fieldTime && typ == protowire.BytesType:
+			ts, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t, err := unmarshalTimestamp(ts)
+			if err != nil {
+				return err
+			}
+			record.Time = t
+			data = data[n:]
+		case typ == protowire.BytesType && stringField(record, num) != nil:
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*stringField(record, num) = s
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// stringField returns the string field of record numbered num, or nil
+func stringField(record *TelemetryRecord, num protowire.Number) *string {
+	switch num {
+	case fieldDeviceID:
+		return &record.DeviceID
+	case fieldMetric:
+		return &record.Metric
+	case fieldGPUID:
+		return &record.GPUID
+	case fieldUUID:
+		return &record.UUID
+	case fieldModelName:
+		return &record.ModelName
+	case fieldHostname:
+		return &record.Hostname
+	case fieldContainer:
+		return &record.Container
+	case fieldPod:
+		return &record.Pod
+	case fieldNamespace:
+		return &record.Namespace
+	case fieldLabelsRaw:
+		return &record.LabelsRaw
+	case fieldDriverVersion:
+		return &record.DriverVersion
+	}
+	return nil
+}
+
+// unmarshalTimestamp decodes a google.protobuf.Timestamp as a UTC time
+func unmarshalTimestamp(data []byte) (time.Time, error) {
+	var secs, nanos int64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if (num == fieldSeconds || num == fieldNanos) && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return time.Time{}, protowire.ParseError(n)
+			}
+			if num == fieldSeconds {
+				secs = int64(v)
+			} else {
+				nanos = int64(int32(v))
+			}
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	if nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, errors.New("timestamp nanos out of range")
+	}
+	return time.Unix(secs, nanos).UTC(), nil
+}
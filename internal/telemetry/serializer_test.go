@@ -0,0 +1,187 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func fullRecord() TelemetryRecord {
+	return TelemetryRecord{
+		DeviceID:      "nvidia0",
+		Metric:        "DCGM_FI_DEV_GPU_UTIL",
+		Value:         87.25,
+		Time:          time.Date(2025, 7, 18, 13, 42, 33, 123456789, time.UTC),
+		GPUID:         "0",
+		UUID:          "GPU-5fd4f087-86f3-7a43-b711-4771313afc50",
+		ModelName:     "NVIDIA H100 80GB HBM3",
+		Hostname:      "mtv5-dgx1-hgpu-031",
+		Container:     "dcgm-exporter",
+		Pod:           "dcgm-exporter-abc12",
+		Namespace:     "gpu-operator",
+		LabelsRaw:     `DCGM_FI_DRIVER_VERSION="535.129.03",pci_bus_id="00000000:04:00.0"`,
+		DriverVersion: "535.129.03",
+	}
+}
+
+// assertSameRecord compares every field, times by instant
+func assertSameRecord(t *testing.T, got, want TelemetryRecord) {
+	t.Helper()
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("Time: got %v, want %v", got.Time, want.Time)
+	}
+	got.Time, want.Time = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip changed the record:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSerializersRoundTrip(t *testing.T) {
+	offset := fullRecord()
+	offset.Time = time.Date(2025, 7, 18, 15, 42, 33, 0, time.FixedZone("CEST", 2*60*60))
+
+	records := map[string]TelemetryRecord{
+		"All fields":     fullRecord(),
+		"Empty":          {},
+		"Offset time":    offset,
+		"Negative value": {Metric: "DCGM_FI_DEV_POWER_USAGE", Value: -1.5, Time: time.Unix(0, 1).UTC()},
+		"Before epoch":   {UUID: "GPU-1", Time: time.Date(1969, 12, 31, 23, 59, 59, 500, time.UTC)},
+		"Unicode":        {Hostname: "höst-β", LabelsRaw: "k=\"v\\n\""},
+		"Largest value":  {Value: math.MaxFloat64},
+	}
+
+	for _, format := range []string{FormatJSON, FormatProtobuf} {
+		s, err := NewSerializer(format)
+		if err != nil {
+			t.Fatalf("NewSerializer(%q): %v", format, err)
+		}
+		if s.Format() != format {
+			t.Errorf("Expected format %s, got %s", format, s.Format())
+		}
+		for name, record := range records {
+			t.Run(format+"/"+name, func(t *testing.T) {
+				data, err := s.Marshal(record)
+				if err != nil {
+					t.Fatalf("Marshal failed: %v", err)
+				}
+				var decoded TelemetryRecord
+				if err := s.Unmarshal(data, &decoded); err != nil {
+					t.Fatalf("Unmarshal failed: %v", err)
+				}
+				assertSameRecord(t, decoded, record)
+			})
+		}
+	}
+}
+
+func TestNewSerializer(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"", FormatJSON},
+		{"json", FormatJSON},
+		{"protobuf", FormatProtobuf},
+		{" Proto ", FormatProtobuf},
+	}
+	for _, tt := range tests {
+		s, err := NewSerializer(tt.format)
+		if err != nil {
+			t.Errorf("NewSerializer(%q): %v", tt.format, err)
+			continue
+		}
+		if s.Format() != tt.expected {
+			t.Errorf("NewSerializer(%q): expected %s, got %s", tt.format, tt.expected, s.Format())
+		}
+	}
+
+	if _, err := NewSerializer("msgpack"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestJSONSerializerMatchesMarshal(t *testing.T) {
+	record := fullRecord()
+	legacy, err := Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := JSONSerializer{}.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacy) {
+		t.Errorf("Expected the JSON serializer to match Marshal:\n got %s\nwant %s", data, legacy)
+	}
+}
+
+func TestProtobufSerializer(t *testing.T) {
+	record := fullRecord()
+	data, err := ProtobufSerializer{}.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, _ := JSONSerializer{}.Marshal(record)
+	if len(data) >= len(jsonData) {
+		t.Errorf("Expected protobuf (%d bytes) to be smaller than JSON (%d bytes)", len(data), len(jsonData))
+	}
+
+	// Fields added by a newer writer are skipped
+	extended := protowire.AppendTag(append([]byte(nil), data...), 99, protowire.BytesType)
+	extended = protowire.AppendString(extended, "future")
+	extended = protowire.AppendTag(extended, 100, protowire.VarintType)
+	extended = protowire.AppendVarint(extended, 7)
+	var decoded TelemetryRecord
+	if err := (ProtobufSerializer{}).Unmarshal(extended, &decoded); err != nil {
+		t.Fatalf("Unmarshal with unknown fields failed: %v", err)
+	}
+	assertSameRecord(t, decoded, record)
+
+	// Truncated and non-protobuf input is an error rather than a partial record
+	for name, bad := range map[string][]byte{
+		"Truncated": data[:len(data)-3],
+		"JSON":      jsonData,
+	} {
+		if err := (ProtobufSerializer{}).Unmarshal(bad, &decoded); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestQueueSerializer(t *testing.T) {
+	if s := QueueSerializer(JSONSerializer{}); s != (JSONSerializer{}) {
+		t.Errorf("Expected JSON to pass through, got %T", s)
+	}
+
+	record := fullRecord()
+	s := QueueSerializer(ProtobufSerializer{})
+	if s.Format() != FormatProtobuf {
+		t.Errorf("Expected format %s, got %s", FormatProtobuf, s.Format())
+	}
+	data, err := s.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue sends payloads as JSON strings, which must not change the bytes
+	wrapped, _ := json.Marshal(string(data))
+	var sent string
+	if err := json.Unmarshal(wrapped, &sent); err != nil || sent != string(data) {
+		t.Fatalf("Expected the encoded record to survive a JSON string, got %q (%v)", sent, err)
+	}
+	var decoded TelemetryRecord
+	if err := s.Unmarshal([]byte(sent), &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	assertSameRecord(t, decoded, record)
+
+	raw, _ := ProtobufSerializer{}.Marshal(record)
+	if err := s.Unmarshal(raw, &decoded); err == nil {
+		t.Error("Expected unencoded protobuf to be rejected")
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 )
 
-// TelemetryRecord represents a telemetry record with parsed time
+// TelemetryRecord represents a telemetry record with parsed time. Its JSON
+// field names are snake_case, matching the API's responses; UnmarshalJSON
+// also accepts the legacy modelName and Hostname names.
 type TelemetryRecord struct {
 	DeviceID string    `json:"device_id"`
 	Metric   string    `json:"metric"`
@@ -13,12 +15,40 @@ type TelemetryRecord struct {
 	Time     time.Time `json:"time"`
 	GPUID    string `json:"gpu_id"`
 	UUID     string `json:"uuid"`
-	ModelName string `json:"modelName"`
-	Hostname string `json:"Hostname"`
+	ModelName string `json:"model_name"`
+	Hostname string `json:"hostname"`
 	Container string `json:"container"`
 	Pod      string `json:"pod"`
 	Namespace string `json:"namespace"`
 	LabelsRaw string `json:"labels_raw"`
+
+	// DriverVersion is promoted from the DCGM_FI_DRIVER_VERSION label in LabelsRaw
+	DriverVersion string `json:"driver_version,omitempty"`
+}
+
+// UnmarshalJSON decodes a record written with either the canonical field
+// names or the legacy modelName and Hostname, so producers that predate the
+// snake_case names keep working. A non-empty canonical value wins when a
+// payload carries both.
+func (r *TelemetryRecord) UnmarshalJSON(data []byte) error {
+	// record has TelemetryRecord's fields but not this method, so decoding
+	// into it doesn't recurse
+	type record TelemetryRecord
+	aux := struct {
+		*record
+		LegacyModelName string `json:"modelName"`
+		LegacyHostname  string `json:"Hostname"`
+	}{record: (*record)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if r.ModelName == "" {
+		r.ModelName = aux.LegacyModelName
+	}
+	if r.Hostname == "" {
+		r.Hostname = aux.LegacyHostname
+	}
+	return nil
 }
 
 // Marshal marshals TelemetryRecord to JSON.
@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalLegacyAndCanonicalFieldNames(t *testing.T) {
+	want := TelemetryRecord{
+		DeviceID:  "nvidia0",
+		Metric:    "DCGM_FI_DEV_GPU_UTIL",
+		Value:     85.5,
+		Time:      time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC),
+		GPUID:     "0",
+		UUID:      "GPU-5fd4f087",
+		ModelName: "NVIDIA H100 80GB HBM3",
+		Hostname:  "mtv5-dgx1-hgpu-031",
+		LabelsRaw: `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+	}
+	common := `"device_id":"nvidia0","metric":"DCGM_FI_DEV_GPU_UTIL","value":85.5,"time":"2025-07-18T20:42:34Z",` +
+		`"gpu_id":"0","uuid":"GPU-5fd4f087","container":"","pod":"","namespace":"",` +
+		`"labels_raw":"DCGM_FI_DRIVER_VERSION=\"535.129.03\""`
+
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"Canonical", `{` + common + `,"model_name":"NVIDIA H100 80GB HBM3","hostname":"mtv5-dgx1-hgpu-031"}`},
+		{"Legacy", `{` + common + `,"modelName":"NVIDIA H100 80GB HBM3","Hostname":"mtv5-dgx1-hgpu-031"}`},
+		{"Mixed", `{` + common + `,"modelName":"NVIDIA H100 80GB HBM3","hostname":"mtv5-dgx1-hgpu-031"}`},
+		{"Canonical wins", `{` + common + `,"modelName":"old","model_name":"NVIDIA H100 80GB HBM3","Hostname":"old","hostname":"mtv5-dgx1-hgpu-031"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got TelemetryRecord
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			assertSameRecord(t, got, want)
+		})
+	}
+
+	// Records decode inside other values too, as in the API's responses
+	var records []TelemetryRecord
+	if err := json.Unmarshal([]byte(`[{"modelName":"H100"},{"model_name":"A100"}]`), &records); err != nil {
+		t.Fatalf("Unmarshal of a slice failed: %v", err)
+	}
+	if len(records) != 2 || records[0].ModelName != "H100" || records[1].ModelName != "A100" {
+		t.Errorf("Expected both model names, got %+v", records)
+	}
+
+	if err := json.Unmarshal([]byte(`{"value":"high"}`), &TelemetryRecord{}); err == nil {
+		t.Error("Expected an error for a mistyped field")
+	}
+}
+
+func TestMarshalUsesCanonicalFieldNames(t *testing.T) {
+	data, err := Marshal(TelemetryRecord{ModelName: "NVIDIA H100", Hostname: "host-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, field := range []string{`"model_name":"NVIDIA H100"`, `"hostname":"host-1"`} {
+		if !strings.Contains(out, field) {
+			t.Errorf("Expected %s in %s", field, out)
+		}
+	}
+	for _, legacy := range []string{`"modelName"`, `"Hostname"`} {
+		if strings.Contains(out, legacy) {
+			t.Errorf("Expected no legacy %s in %s", legacy, out)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// alertThreshold is the operating range for a metric; a latest value outside
+// it raises an alert. Missing ends are unbounded.
+type alertThreshold struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+func maxThreshold(max float64) alertThreshold {
+	return alertThreshold{Max: &max}
+}
+
+// defaultAlertThresholds flag GPUs running hot or drawing more than an H100's TDP
+var defaultAlertThresholds = map[string]alertThreshold{
+	"DCGM_FI_DEV_GPU_TEMP":    maxThreshold(85),
+	"DCGM_FI_DEV_MEMORY_TEMP": maxThreshold(95),
+	"DCGM_FI_DEV_POWER_USAGE": maxThreshold(700),
+}
+
+// loadAlertThresholds reads thresholds as a JSON object of metric ->
+// {"min": x, "max": y} from ALERT_THRESHOLDS, or from the file named by
+// ALERT_THRESHOLDS_FILE. Without either the built-in defaults are used.
+func loadAlertThresholds() (map[string]alertThreshold, error) {
+	data := []byte(os.Getenv("ALERT_THRESHOLDS"))
+	source := "ALERT_THRESHOLDS"
+	if len(data) == 0 {
+		path := os.Getenv("ALERT_THRESHOLDS_FILE")
+		if path == "" {
+			return defaultAlertThresholds, nil
+		}
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("read alert thresholds: %w", err)
+		}
+		source = path
+	}
+
+	var thresholds map[string]alertThreshold
+	if err := json.Unmarshal(data, &thresholds); err != nil {
+		return nil, fmt.Errorf("parse alert thresholds from %s: %w", source, err)
+	}
+	for metric, th := range thresholds {
+		if th.Min == nil && th.Max == nil {
+			return nil, fmt.Errorf("alert threshold for %s: set min, max or both", metric)
+		}
+		if th.Min != nil && th.Max != nil && *th.Min > *th.Max {
+			return nil, fmt.Errorf("alert threshold for %s: min %v is greater than max %v", metric, *th.Min, *th.Max)
+		}
+	}
+	return thresholds, nil
+}
+
+// evaluateAlerts checks each record against its metric's threshold and returns
+// the GPUs with at least one breach, ordered by UUID. records are expected to
+// hold the latest value of each metric per GPU.
+func evaluateAlerts(records []telemetry.TelemetryRecord, thresholds map[string]alertThreshold) []GPUAlert {
+	byUUID := map[string]*GPUAlert{}
+	for _, rec := range records {
+		th, ok := thresholds[rec.Metric]
+		if !ok {
+			continue
+		}
+		breach := ThresholdBreach{Metric: rec.Metric, Value: rec.Value, Time: rec.Time}
+		switch {
+		case th.Max != nil && rec.Value > *th.Max:
+			breach.Bound, breach.Threshold = "max", *th.Max
+		case th.Min != nil && rec.Value < *th.Min:
+			breach.Bound, breach.Threshold = "min", *th.Min
+		default:
+			continue
+		}
+
+		alert, ok := byUUID[rec.UUID]
+		if !ok {
+			alert = &GPUAlert{UUID: rec.UUID, GPUID: rec.GPUID, Hostname: rec.Hostname, ModelName: rec.ModelName}
+			byUUID[rec.UUID] = alert
+		}
+		alert.Breaches = append(alert.Breaches, breach)
+	}
+
+	alerts := make([]GPUAlert, 0, len(byUUID))
+	for _, alert := range byUUID {
+		sort.Slice(alert.Breaches, func(i, j int) bool { return alert.Breaches[i].Metric < alert.Breaches[j].Metric })
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].UUID < alerts[j].UUID })
+	return alerts
+}
+
+type latestTelemetryQuerier interface {
+	QueryLatestTelemetry(window time.Duration) ([]telemetry.TelemetryRecord, error)
+}
+
+// alertsHandler serves GET /api/v1/gpus/alerts, evaluating thresholds against the
+// latest value of each metric reported within window (0 considers the full retention)
+func alertsHandler(querier latestTelemetryQuerier, thresholds map[string]alertThreshold, window time.Duration, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		records, err := querier.QueryLatestTelemetry(window)
+		if err != nil {
+			logger.Printf("Failed to query InfluxDB for latest metrics: %v", err)
+			writeQueryError(w, err, "Failed to query latest metrics")
+			return
+		}
+
+		alerts := evaluateAlerts(records, thresholds)
+		logger.Printf("%d GPUs breaching alert thresholds", len(alerts))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AlertsResponse{Count: len(alerts), Alerts: alerts})
+	}
+}
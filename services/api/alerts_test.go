@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// fakeLatestQuerier returns canned latest-per-metric records
+type fakeLatestQuerier struct {
+	records   []telemetry.TelemetryRecord
+	err       error
+	gotWindow time.Duration
+}
+
+func (f *fakeLatestQuerier) QueryLatestTelemetry(window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	f.gotWindow = window
+	return f.records, f.err
+}
+
+func latest(uuid, metric string, value float64) telemetry.TelemetryRecord {
+	return telemetry.TelemetryRecord{UUID: uuid, GPUID: "0", Hostname: "host-1", Metric: metric, Value: value, Time: time.Now()}
+}
+
+func TestAlertsHandler(t *testing.T) {
+	querier := &fakeLatestQuerier{records: []telemetry.TelemetryRecord{
+		latest("GPU-hot", "DCGM_FI_DEV_GPU_TEMP", 91),
+		latest("GPU-hot", "DCGM_FI_DEV_POWER_USAGE", 350),
+		latest("GPU-hot", "DCGM_FI_DEV_GPU_UTIL", 100),
+		latest("GPU-cool", "DCGM_FI_DEV_GPU_TEMP", 60),
+		latest("GPU-cool", "DCGM_FI_DEV_POWER_USAGE", 300),
+		latest("GPU-edge", "DCGM_FI_DEV_GPU_TEMP", 85),
+	}}
+	handler := alertsHandler(querier, defaultAlertThresholds, time.Hour, log.New(io.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/v1/gpus/alerts", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if querier.gotWindow != time.Hour {
+		t.Errorf("Expected the query window to be passed through, got %v", querier.gotWindow)
+	}
+
+	var resp AlertsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Count != 1 || len(resp.Alerts) != 1 {
+		t.Fatalf("Expected only GPU-hot to alert, got %+v", resp)
+	}
+	alert := resp.Alerts[0]
+	if alert.UUID != "GPU-hot" || alert.Hostname != "host-1" {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+	if len(alert.Breaches) != 1 {
+		t.Fatalf("Expected one breach, got %+v", alert.Breaches)
+	}
+	b := alert.Breaches[0]
+	if b.Metric != "DCGM_FI_DEV_GPU_TEMP" || b.Value != 91 || b.Bound != "max" || b.Threshold != 85 {
+		t.Errorf("Unexpected breach %+v", b)
+	}
+}
+
+func TestAlertsHandlerNoAlerts(t *testing.T) {
+	handler := alertsHandler(&fakeLatestQuerier{}, defaultAlertThresholds, time.Hour, log.New(io.Discard, "", 0))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/v1/gpus/alerts", nil))
+
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&raw); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if string(raw["alerts"]) != "[]" || string(raw["count"]) != "0" {
+		t.Errorf("Expected an empty alert list, got %s", w.Body.String())
+	}
+}
+
+func TestAlertsHandlerErrors(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	w := httptest.NewRecorder()
+	alertsHandler(&fakeLatestQuerier{err: fmt.Errorf("connection failed")}, defaultAlertThresholds, time.Hour, logger)(
+		w, httptest.NewRequest("GET", "/api/v1/gpus/alerts", nil))
+	decodeErrorResponse(t, w, http.StatusInternalServerError)
+
+	w = httptest.NewRecorder()
+	alertsHandler(&fakeLatestQuerier{}, defaultAlertThresholds, time.Hour, logger)(
+		w, httptest.NewRequest("POST", "/api/v1/gpus/alerts", nil))
+	decodeErrorResponse(t, w, http.StatusMethodNotAllowed)
+}
+
+func TestEvaluateAlertsMinThreshold(t *testing.T) {
+	min := 1000.0
+	thresholds := map[string]alertThreshold{"DCGM_FI_DEV_SM_CLOCK": {Min: &min}}
+	alerts := evaluateAlerts([]telemetry.TelemetryRecord{
+		latest("GPU-b", "DCGM_FI_DEV_SM_CLOCK", 300),
+		latest("GPU-a", "DCGM_FI_DEV_SM_CLOCK", 200),
+		latest("GPU-c", "DCGM_FI_DEV_SM_CLOCK", 1500),
+	}, thresholds)
+	if len(alerts) != 2 || alerts[0].UUID != "GPU-a" || alerts[1].UUID != "GPU-b" {
+		t.Fatalf("Expected GPU-a and GPU-b in order, got %+v", alerts)
+	}
+	if b := alerts[0].Breaches[0]; b.Bound != "min" || b.Threshold != 1000 {
+		t.Errorf("Expected a min breach at 1000, got %+v", b)
+	}
+}
+
+func TestLoadAlertThresholds(t *testing.T) {
+	t.Setenv("ALERT_THRESHOLDS", "")
+	t.Setenv("ALERT_THRESHOLDS_FILE", "")
+	if th, err := loadAlertThresholds(); err != nil || len(th) != len(defaultAlertThresholds) {
+		t.Errorf("Expected the defaults, got %v, %v", th, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "thresholds.json")
+	if err := os.WriteFile(path, []byte(`{"DCGM_FI_DEV_GPU_TEMP": {"max": 70}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write thresholds: %v", err)
+	}
+	t.Setenv("ALERT_THRESHOLDS_FILE", path)
+	th, err := loadAlertThresholds()
+	if err != nil || len(th) != 1 || *th["DCGM_FI_DEV_GPU_TEMP"].Max != 70 {
+		t.Errorf("Expected the file's thresholds, got %v, %v", th, err)
+	}
+
+	// Inline JSON takes precedence over the file
+	t.Setenv("ALERT_THRESHOLDS", `{"DCGM_FI_DEV_POWER_USAGE": {"max": 400}}`)
+	th, err = loadAlertThresholds()
+	if err != nil || len(th) != 1 || *th["DCGM_FI_DEV_POWER_USAGE"].Max != 400 {
+		t.Errorf("Expected the inline thresholds, got %v, %v", th, err)
+	}
+
+	for _, bad := range []string{`not json`, `{"X": {}}`, `{"X": {"min": 5, "max": 1}}`} {
+		t.Setenv("ALERT_THRESHOLDS", bad)
+		if _, err := loadAlertThresholds(); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/example/telemetry/internal/health"
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+const (
+	defaultInfluxPingInterval = 5 * time.Second
+	influxPingTimeout         = 5 * time.Second
+)
+
+// errInfluxUnavailable is returned instead of querying while InfluxDB is known to be down
+var errInfluxUnavailable = errors.New("InfluxDB is unavailable")
+
+// pinger checks that InfluxDB is reachable
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// getInfluxPingInterval returns how often InfluxDB is pinged, from
+// INFLUX_PING_INTERVAL_MS or the default
+func getInfluxPingInterval() time.Duration {
+	if msStr := os.Getenv("INFLUX_PING_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid INFLUX_PING_INTERVAL_MS value '%s', using default: %v", msStr, defaultInfluxPingInterval)
+	}
+	return defaultInfluxPingInterval
+}
+
+// monitorInflux pings InfluxDB every interval until ctx is cancelled and
+// keeps ready in step with the result, logging each change. ready backs both
+// /ready and the data endpoints, which answer 503 while it is false.
+func monitorInflux(ctx context.Context, p pinger, ready *health.Readiness, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, influxPingTimeout)
+		err := p.Ping(pingCtx)
+		cancel()
+		up := err == nil
+		switch {
+		case up && !ready.Ready():
+			logger.Println("InfluxDB reachable, API is ready")
+		case !up && ready.Ready():
+			logger.Printf("InfluxDB unreachable, data endpoints return 503: %v", err)
+		case !up:
+			logger.Printf("Waiting for InfluxDB: %v", err)
+		}
+		ready.SetReady(up)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// availableQuerier fails fast with errInfluxUnavailable while ready is
+// false, instead of letting each request wait on an unreachable InfluxDB
+type availableQuerier struct {
+	next  influxQuerier
+	ready *health.Readiness
+}
+
+func newAvailableQuerier(next influxQuerier, ready *health.Readiness) influxQuerier {
+	return &availableQuerier{next: next, ready: ready}
+}
+
+// check returns errInfluxUnavailable while InfluxDB is known to be down
+func (q *availableQuerier) check() error {
+	if !q.ready.Ready() {
+		return errInfluxUnavailable
+	}
+	return nil
+}
+
+func (q *availableQuerier) QueryTelemetryByDevice(uuid string) ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryTelemetryByDevice(uuid)
+}
+
+func (q *availableQuerier) QueryTelemetryByDeviceSince(uuid string, window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryTelemetryByDeviceSince(uuid, window)
+}
+
+func (q *availableQuerier) QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryTelemetryByDeviceTimeRange(uuid, startTime, endTime)
+}
+
+func (q *availableQuerier) QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (map[string][]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryTelemetryByDevices(uuids, start, end, limit)
+}
+
+func (q *availableQuerier) QueryTelemetryByHost(hostname string, start, end time.Time, limit int) ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryTelemetryByHost(hostname, start, end, limit)
+}
+
+func (q *availableQuerier) QueryGPUsWithLastSeen() ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryGPUsWithLastSeen()
+}
+
+func (q *availableQuerier) QueryLatestTelemetry(window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	return q.next.QueryLatestTelemetry(window)
+}
+
+func (q *availableQuerier) QueryFleetAggregate(metric string, start, end time.Time, fn string) (float64, error) {
+	if err := q.check(); err != nil {
+		return 0, err
+	}
+	return q.next.QueryFleetAggregate(metric, start, end, fn)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/health"
+)
+
+// fakePinger fails its pings while down is set
+type fakePinger struct {
+	down int32
+}
+
+func (p *fakePinger) setDown(down bool) {
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&p.down, v)
+}
+
+func (p *fakePinger) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&p.down) == 1 {
+		return errors.New("dial tcp influxdb:8086: connection refused")
+	}
+	return nil
+}
+
+// waitReady waits for ready to reach want
+func waitReady(t *testing.T, ready *health.Readiness, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for ready.Ready() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for readiness %v", want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMonitorInfluxTracksReachability(t *testing.T) {
+	p := &fakePinger{}
+	p.setDown(true)
+	var ready health.Readiness
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go monitorInflux(ctx, p, &ready, 10*time.Millisecond, log.New(io.Discard, "", 0))
+
+	readyStatus := func() int {
+		w := httptest.NewRecorder()
+		ready.Handler()(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if code := readyStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /ready to return 503 before InfluxDB answers, got %d", code)
+	}
+
+	p.setDown(false)
+	waitReady(t, &ready, true)
+	if code := readyStatus(); code != http.StatusOK {
+		t.Errorf("Expected /ready to return 200 once InfluxDB answers, got %d", code)
+	}
+
+	// Readiness is withdrawn again when InfluxDB goes away after startup
+	p.setDown(true)
+	waitReady(t, &ready, false)
+	if code := readyStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /ready to return 503 after InfluxDB went down, got %d", code)
+	}
+}
+
+func TestDataEndpointsUnavailableWhileInfluxDown(t *testing.T) {
+	backend := newBlockingQuerier()
+	close(backend.release)
+	var ready health.Readiness
+	querier := newAvailableQuerier(backend, &ready)
+	logger := log.New(io.Discard, "", 0)
+
+	endpoints := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{"GPU telemetry", gpuTelemetryHandler(querier, time.Hour, logger), "GET", "/api/v1/gpus/GPU-1/telemetry", ""},
+		{"Batch telemetry", batchTelemetryHandler(querier, logger), "POST", "/api/v1/gpus/telemetry/batch", `{"gpu_ids":["GPU-1"]}`},
+		{"Host telemetry", hostTelemetryHandler(querier, time.Hour, logger), "GET", "/api/v1/hosts/dgx-1/telemetry", ""},
+		{"GPU list", gpuListHandler(newGPUListCache(querier, 0), time.Hour, logger), "GET", "/api/v1/gpus", ""},
+		{"Alerts", alertsHandler(querier, defaultAlertThresholds, time.Hour, logger), "GET", "/api/v1/alerts", ""},
+	}
+
+	serve := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	for _, e := range endpoints {
+		t.Run(e.name, func(t *testing.T) {
+			w := serve(e.handler, e.method, e.target, e.body)
+			resp := decodeErrorResponse(t, w, http.StatusServiceUnavailable)
+			if resp.Error != "Telemetry database unavailable" {
+				t.Errorf("Expected the unavailable error, got %q", resp.Error)
+			}
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("Expected a Retry-After header")
+			}
+		})
+	}
+	if n := len(backend.started); n != 0 {
+		t.Errorf("Expected no queries to reach InfluxDB while it is down, got %d", n)
+	}
+
+	// Liveness is unaffected
+	if w := serve(healthHandler, "GET", "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected /health to return 200 while InfluxDB is down, got %d", w.Code)
+	}
+
+	ready.SetReady(true)
+	for _, e := range endpoints {
+		if w := serve(e.handler, e.method, e.target, e.body); w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 once InfluxDB is back, got %d: %s", e.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGetInfluxPingInterval(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultInfluxPingInterval},
+		{"250", 250 * time.Millisecond},
+		{"0", defaultInfluxPingInterval},
+		{"-5", defaultInfluxPingInterval},
+		{"soon", defaultInfluxPingInterval},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("INFLUX_PING_INTERVAL_MS", tt.value)
+		if got := getInfluxPingInterval(); got != tt.expected {
+			t.Errorf("INFLUX_PING_INTERVAL_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
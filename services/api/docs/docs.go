@@ -47,12 +47,88 @@ const docTemplate = `{
     ],
     "paths": {
 
+        "/api/v1/fleet/aggregate": {
+            "get": {
+                "description": "Get the mean or max of a metric across every GPU in the fleet over the last window, computed by InfluxDB. Without a window the last DEFAULT_QUERY_WINDOW (default 1h) is used",
+                "produces": ["application/json"],
+                "tags": ["fleet"],
+                "summary": "Get a fleet-wide metric aggregate",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Metric to aggregate (default: DCGM_FI_DEV_GPU_UTIL)",
+                        "name": "metric",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Aggregate function: mean or max (default: mean)",
+                        "name": "fn",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "How far back to aggregate, e.g. 15m",
+                        "name": "window",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/FleetAggregateResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/gpus": {
             "get": {
-                "description": "Get a list of all available GPUs with their metadata",
+                "description": "Get a list of all available GPUs with their metadata and when each last reported. GPUs not seen within seen_within (default GPU_SEEN_WITHIN, unset lists every GPU) are left out",
                 "produces": ["application/json"],
                 "tags": ["gpus"],
                 "summary": "List available GPUs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only list GPUs seen within this duration, e.g. 15m; 0 lists every GPU",
+                        "name": "seen_within",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag from a previous response",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -60,6 +136,37 @@ const docTemplate = `{
                             "$ref": "#/definitions/GPUListResponse"
                         }
                     },
+                    "304": {
+                        "description": "GPU list unchanged"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/gpus/alerts": {
+            "get": {
+                "description": "Evaluate the latest value of each metric per GPU (reported within DEFAULT_QUERY_WINDOW) against the configured alert thresholds and list the GPUs outside them",
+                "produces": ["application/json"],
+                "tags": ["gpus"],
+                "summary": "List GPUs breaching alert thresholds",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/AlertsResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -71,7 +178,7 @@ const docTemplate = `{
         },
         "/api/v1/gpus/{id}/telemetry": {
             "get": {
-                "description": "Get telemetry data for a specific GPU with optional time range filtering",
+                "description": "Get telemetry data for a specific GPU with optional time range filtering. Without a time range the last DEFAULT_QUERY_WINDOW (default 1h) is returned",
                 "produces": ["application/json"],
                 "tags": ["telemetry"],
                 "summary": "Get GPU telemetry data",
@@ -85,13 +192,13 @@ const docTemplate = `{
                     },
                     {
                         "type": "string",
-                        "description": "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z)",
+                        "description": "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z); defaults to end_time minus the default window",
                         "name": "start_time",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z)",
+                        "description": "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z); defaults to now",
                         "name": "end_time",
                         "in": "query"
                     },
@@ -129,9 +236,167 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/api/v1/gpus/telemetry/batch": {
+            "post": {
+                "description": "Get telemetry data for several GPUs in one request, keyed by GPU ID. Unknown IDs map to an empty list.",
+                "consumes": ["application/json"],
+                "produces": ["application/json"],
+                "tags": ["telemetry"],
+                "summary": "Get telemetry for multiple GPUs",
+                "parameters": [
+                    {
+                        "description": "GPU IDs and optional time range",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/BatchTelemetryRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/BatchTelemetryResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/hosts/{hostname}/telemetry": {
+            "get": {
+                "description": "Get telemetry data from every GPU on a host, newest first. Hostnames with special characters must be URL-encoded. Without a time range the last DEFAULT_QUERY_WINDOW (default 1h) is returned",
+                "produces": ["application/json"],
+                "tags": ["telemetry"],
+                "summary": "Get host telemetry data",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Hostname",
+                        "name": "hostname",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z); defaults to end_time minus the default window",
+                        "name": "start_time",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z); defaults to now",
+                        "name": "end_time",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of records to return across the host's GPUs (default: 1000, at most 10000)",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/HostTelemetryResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "AlertsResponse": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "alerts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/GPUAlert"
+                    }
+                }
+            }
+        },
+        "BatchTelemetryRequest": {
+            "type": "object",
+            "properties": {
+                "gpu_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": ["GPU-5fd4f087-86f3-7a43-b711-4771313afc50", "GPU-9a1c2b3d-0000-1111-2222-333344445555"]
+                },
+                "start_time": {
+                    "type": "string",
+                    "example": "2025-07-18T00:00:00Z"
+                },
+                "end_time": {
+                    "type": "string",
+                    "example": "2025-07-18T23:59:59Z"
+                },
+                "limit": {
+                    "type": "integer",
+                    "example": 100
+                }
+            }
+        },
+        "BatchTelemetryResponse": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "data": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "array",
+                        "items": {
+                            "$ref": "#/definitions/TelemetryDataResponse"
+                        }
+                    }
+                }
+            }
+        },
         "ErrorResponse": {
             "type": "object",
             "properties": {
@@ -142,6 +407,81 @@ const docTemplate = `{
                 "message": {
                     "type": "string",
                     "example": "Additional error details"
+                },
+                "details": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/FieldError"
+                    }
+                }
+            }
+        },
+        "FieldError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "type": "string",
+                    "example": "start_time"
+                },
+                "reason": {
+                    "type": "string",
+                    "example": "must be an RFC3339 timestamp (e.g., 2023-01-01T00:00:00Z)"
+                }
+            }
+        },
+        "FleetAggregateResponse": {
+            "type": "object",
+            "properties": {
+                "metric": {
+                    "type": "string",
+                    "example": "DCGM_FI_DEV_GPU_UTIL"
+                },
+                "fn": {
+                    "type": "string",
+                    "example": "mean"
+                },
+                "window": {
+                    "type": "string",
+                    "example": "1h0m0s"
+                },
+                "start": {
+                    "type": "string",
+                    "example": "2025-07-18T19:42:34Z"
+                },
+                "end": {
+                    "type": "string",
+                    "example": "2025-07-18T20:42:34Z"
+                },
+                "value": {
+                    "type": "number",
+                    "example": 63.5
+                }
+            }
+        },
+        "GPUAlert": {
+            "type": "object",
+            "properties": {
+                "uuid": {
+                    "type": "string",
+                    "example": "GPU-5fd4f087-86f3-7a43-b711-4771313afc50"
+                },
+                "gpu_id": {
+                    "type": "string",
+                    "example": "0"
+                },
+                "hostname": {
+                    "type": "string",
+                    "example": "mtv5-dgx1-hgpu-031"
+                },
+                "model_name": {
+                    "type": "string",
+                    "example": "NVIDIA H100 80GB HBM3"
+                },
+                "breaches": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/ThresholdBreach"
+                    }
                 }
             }
         },
@@ -201,6 +541,25 @@ const docTemplate = `{
                 }
             }
         },
+        "HostTelemetryResponse": {
+            "type": "object",
+            "properties": {
+                "hostname": {
+                    "type": "string",
+                    "example": "mtv5-dgx1-hgpu-031"
+                },
+                "count": {
+                    "type": "integer",
+                    "example": 100
+                },
+                "data": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/TelemetryDataResponse"
+                    }
+                }
+            }
+        },
         "TelemetryDataResponse": {
             "type": "object",
             "properties": {
@@ -251,6 +610,10 @@ const docTemplate = `{
                 "labels_raw": {
                     "type": "string",
                     "example": "DCGM_FI_DRIVER_VERSION=\"535.129.03\""
+                },
+                "driver_version": {
+                    "type": "string",
+                    "example": "535.129.03"
                 }
             }
         },
@@ -272,6 +635,31 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "ThresholdBreach": {
+            "type": "object",
+            "properties": {
+                "metric": {
+                    "type": "string",
+                    "example": "DCGM_FI_DEV_GPU_TEMP"
+                },
+                "value": {
+                    "type": "number",
+                    "example": 91
+                },
+                "bound": {
+                    "type": "string",
+                    "example": "max"
+                },
+                "threshold": {
+                    "type": "number",
+                    "example": 85
+                },
+                "time": {
+                    "type": "string",
+                    "example": "2025-07-18T20:42:34Z"
+                }
+            }
         }
     }
 }`
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/telemetry/internal/influx"
+)
+
+// defaultFleetMetric is the metric aggregated when none is given
+const defaultFleetMetric = "DCGM_FI_DEV_GPU_UTIL"
+
+// maxFleetMetricLength bounds the length of a metric name accepted by the fleet endpoint
+const maxFleetMetricLength = 128
+
+// fleetAggregateQuerier is the subset of the InfluxDB client used by the fleet aggregate endpoint
+type fleetAggregateQuerier interface {
+	QueryFleetAggregate(metric string, start, end time.Time, fn string) (float64, error)
+}
+
+// metricProblem returns why metric is not a valid metric name, or "" if it is.
+// Metrics are DCGM field names, so only letters, digits, _ and : are accepted.
+func metricProblem(metric string) string {
+	if len(metric) > maxFleetMetricLength {
+		return fmt.Sprintf("must be at most %d characters", maxFleetMetricLength)
+	}
+	for _, c := range metric {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '_' && c != ':' {
+			return fmt.Sprintf("contains invalid character %q", c)
+		}
+	}
+	return ""
+}
+
+// fleetAggregateHandler serves GET /api/v1/fleet/aggregate with one number for
+// the whole fleet: the mean or max of a metric across every GPU over the last
+// window. The metric defaults to GPU utilization, fn to mean and window to
+// defaultWindow.
+func fleetAggregateHandler(querier fleetAggregateQuerier, defaultWindow time.Duration, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		query := r.URL.Query()
+		var details []FieldError
+		metric := query.Get("metric")
+		if metric == "" {
+			metric = defaultFleetMetric
+		} else if problem := metricProblem(metric); problem != "" {
+			details = append(details, FieldError{Field: "metric", Reason: problem})
+		}
+		fn := strings.ToLower(query.Get("fn"))
+		if fn == "" {
+			fn = influx.AggregateMean
+		} else if !influx.IsFleetAggregate(fn) {
+			details = append(details, FieldError{Field: "fn", Reason: fmt.Sprintf("must be one of %s, %s", influx.AggregateMean, influx.AggregateMax)})
+		}
+		window := defaultWindow
+		if windowStr := query.Get("window"); windowStr != "" {
+			parsed, err := time.ParseDuration(windowStr)
+			if err != nil || parsed <= 0 {
+				details = append(details, FieldError{Field: "window", Reason: "must be a positive duration (e.g., 15m)"})
+			}
+			window = parsed
+		}
+		if len(details) > 0 {
+			writeValidationError(w, details...)
+			return
+		}
+
+		end := time.Now().UTC()
+		start := time.Time{}
+		if window > 0 {
+			start = end.Add(-window)
+		}
+		value, err := querier.QueryFleetAggregate(metric, start, end, fn)
+		if errors.Is(err, influx.ErrNoData) {
+			writeError(w, http.StatusNotFound, "No data", fmt.Sprintf("No %s points in the requested window", metric))
+			return
+		}
+		if err != nil {
+			logger.Printf("Failed to query InfluxDB for the fleet %s of %s: %v", fn, metric, err)
+			writeQueryError(w, err, "Failed to query fleet aggregate")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := FleetAggregateResponse{Metric: metric, Function: fn, Window: window.String(), End: end, Value: value}
+		if !start.IsZero() {
+			response.Start = &start
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/influx"
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// fakeFleetQuerier aggregates canned records of several GPUs the way the
+// fleet query does: across every record of the metric in the range
+type fakeFleetQuerier struct {
+	records []telemetry.TelemetryRecord
+	err     error
+
+	gotMetric string
+	gotFn     string
+	gotStart  time.Time
+	gotEnd    time.Time
+}
+
+func (f *fakeFleetQuerier) QueryFleetAggregate(metric string, start, end time.Time, fn string) (float64, error) {
+	f.gotMetric, f.gotFn, f.gotStart, f.gotEnd = metric, fn, start, end
+	if f.err != nil {
+		return 0, f.err
+	}
+	var sum, max float64
+	n := 0
+	for _, rec := range f.records {
+		if rec.Metric != metric || rec.Time.Before(start) || rec.Time.After(end) {
+			continue
+		}
+		if n == 0 || rec.Value > max {
+			max = rec.Value
+		}
+		sum += rec.Value
+		n++
+	}
+	if n == 0 {
+		return 0, influx.ErrNoData
+	}
+	if fn == influx.AggregateMax {
+		return max, nil
+	}
+	return sum / float64(n), nil
+}
+
+func fleetRecord(uuid, metric string, value float64, age time.Duration) telemetry.TelemetryRecord {
+	return telemetry.TelemetryRecord{UUID: uuid, Metric: metric, Value: value, Time: time.Now().Add(-age)}
+}
+
+func TestFleetAggregateHandler(t *testing.T) {
+	querier := &fakeFleetQuerier{records: []telemetry.TelemetryRecord{
+		fleetRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 20, time.Minute),
+		fleetRecord("GPU-a", "DCGM_FI_DEV_GPU_UTIL", 40, 2*time.Minute),
+		fleetRecord("GPU-b", "DCGM_FI_DEV_GPU_UTIL", 90, time.Minute),
+		fleetRecord("GPU-c", "DCGM_FI_DEV_GPU_UTIL", 10, time.Minute),
+		// Outside a 10m window, and another metric
+		fleetRecord("GPU-c", "DCGM_FI_DEV_GPU_UTIL", 100, 2*time.Hour),
+		fleetRecord("GPU-b", "DCGM_FI_DEV_GPU_TEMP", 80, time.Minute),
+	}}
+	handler := fleetAggregateHandler(querier, 10*time.Minute, log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		name     string
+		target   string
+		expected float64
+		fn       string
+	}{
+		{"Mean by default", "/api/v1/fleet/aggregate", 40, "mean"},
+		{"Max", "/api/v1/fleet/aggregate?metric=DCGM_FI_DEV_GPU_UTIL&fn=max", 90, "max"},
+		{"Wider window", "/api/v1/fleet/aggregate?fn=MAX&window=3h", 100, "max"},
+		{"Other metric", "/api/v1/fleet/aggregate?metric=DCGM_FI_DEV_GPU_TEMP", 80, "mean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp FleetAggregateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Value != tt.expected || resp.Function != tt.fn {
+				t.Errorf("Expected %s of %v, got %+v", tt.fn, tt.expected, resp)
+			}
+			if resp.Start == nil || !resp.End.Equal(querier.gotEnd) || !resp.Start.Equal(querier.gotStart) {
+				t.Errorf("Expected the queried range in the response, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestFleetAggregateHandlerErrors(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	tests := []struct {
+		name     string
+		querier  *fakeFleetQuerier
+		method   string
+		target   string
+		expected int
+	}{
+		{"Unknown function", &fakeFleetQuerier{}, "GET", "/api/v1/fleet/aggregate?fn=sum", http.StatusBadRequest},
+		{"Invalid metric", &fakeFleetQuerier{}, "GET", "/api/v1/fleet/aggregate?metric=util%22%29", http.StatusBadRequest},
+		{"Invalid window", &fakeFleetQuerier{}, "GET", "/api/v1/fleet/aggregate?window=-5m", http.StatusBadRequest},
+		{"No data", &fakeFleetQuerier{}, "GET", "/api/v1/fleet/aggregate", http.StatusNotFound},
+		{"Query error", &fakeFleetQuerier{err: errors.New("boom")}, "GET", "/api/v1/fleet/aggregate", http.StatusInternalServerError},
+		{"InfluxDB down", &fakeFleetQuerier{err: errInfluxUnavailable}, "GET", "/api/v1/fleet/aggregate", http.StatusServiceUnavailable},
+		{"Wrong method", &fakeFleetQuerier{}, "POST", "/api/v1/fleet/aggregate", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			fleetAggregateHandler(tt.querier, time.Hour, logger)(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.expected {
+				t.Errorf("Expected %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+			if tt.expected == http.StatusBadRequest && tt.querier.gotFn != "" {
+				t.Error("Expected invalid requests not to reach InfluxDB")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// maxHostnameLength bounds the length of a hostname accepted by the API (the DNS limit)
+const maxHostnameLength = 253
+
+// Record limits for the host telemetry endpoint, which covers every GPU on the host
+const (
+	defaultHostTelemetryLimit = 1000
+	maxHostTelemetryLimit     = 10000
+)
+
+// hostTelemetryQuerier is the subset of the InfluxDB client used by the host telemetry endpoint
+type hostTelemetryQuerier interface {
+	QueryTelemetryByHost(hostname string, start, end time.Time, limit int) ([]telemetry.TelemetryRecord, error)
+}
+
+// hostnameProblem returns why hostname is not acceptable, or "" if it is.
+// Hostnames are reported by the exporters rather than chosen by the API, so
+// anything printable is allowed; the query quotes it as a Flux literal.
+func hostnameProblem(hostname string) string {
+	if strings.TrimSpace(hostname) == "" {
+		return "is required"
+	}
+	if len(hostname) > maxHostnameLength {
+		return fmt.Sprintf("must be at most %d characters", maxHostnameLength)
+	}
+	for _, c := range hostname {
+		if !unicode.IsPrint(c) {
+			return fmt.Sprintf("contains invalid character %q", c)
+		}
+	}
+	return ""
+}
+
+// hostTelemetryHandler serves GET /api/v1/hosts/{hostname}/telemetry with the
+// telemetry of every GPU on the host, newest first. The hostname is taken from
+// the escaped path so that an encoded "/" stays part of it. As with the GPU
+// endpoint a missing start_time defaults to end_time (or now) minus window.
+func hostTelemetryHandler(querier hostTelemetryQuerier, window time.Duration, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/hosts/")
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 || parts[1] != "telemetry" {
+			if path == "" {
+				writeValidationError(w, FieldError{Field: "hostname", Reason: "is required"})
+				return
+			}
+			writeError(w, http.StatusNotFound, "Endpoint not found", "Use /api/v1/hosts/{hostname}/telemetry")
+			return
+		}
+
+		var details []FieldError
+		hostname, err := url.PathUnescape(parts[0])
+		if err != nil {
+			details = append(details, FieldError{Field: "hostname", Reason: "is not validly escaped"})
+		} else if problem := hostnameProblem(hostname); problem != "" {
+			details = append(details, FieldError{Field: "hostname", Reason: problem})
+		}
+
+		query := r.URL.Query()
+		start := parseTimeParam("start_time", query.Get("start_time"), &details)
+		end := parseTimeParam("end_time", query.Get("end_time"), &details)
+		limit := defaultHostTelemetryLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n <= 0 || n > maxHostTelemetryLimit {
+				details = append(details, FieldError{Field: "limit", Reason: fmt.Sprintf("must be an integer between 1 and %d", maxHostTelemetryLimit)})
+			}
+			limit = n
+		}
+		if !start.IsZero() && !end.IsZero() && end.Before(start) {
+			details = append(details, FieldError{Field: "end_time", Reason: "must not be before start_time"})
+		}
+		if len(details) > 0 {
+			writeValidationError(w, details...)
+			return
+		}
+
+		if start.IsZero() && window > 0 {
+			from := end
+			if from.IsZero() {
+				from = time.Now().UTC()
+			}
+			start = from.Add(-window)
+		}
+
+		logger.Printf("Querying telemetry for host %q", hostname)
+		records, err := querier.QueryTelemetryByHost(hostname, start, end, limit)
+		if err != nil {
+			logger.Printf("Failed to query InfluxDB for host %q: %v", hostname, err)
+			writeQueryError(w, err, "Failed to query telemetry data")
+			return
+		}
+
+		if records == nil {
+			records = []telemetry.TelemetryRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]interface{}{
+			"hostname": hostname,
+			"count":    len(records),
+			"data":     records,
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// fakeHostQuerier filters its records by hostname and time range like the Flux query does
+type fakeHostQuerier struct {
+	records []telemetry.TelemetryRecord
+	err     error
+
+	gotHost  string
+	gotStart time.Time
+	gotEnd   time.Time
+	gotLimit int
+}
+
+func (f *fakeHostQuerier) QueryTelemetryByHost(hostname string, start, end time.Time, limit int) ([]telemetry.TelemetryRecord, error) {
+	f.gotHost, f.gotStart, f.gotEnd, f.gotLimit = hostname, start, end, limit
+	if f.err != nil {
+		return nil, f.err
+	}
+	var matched []telemetry.TelemetryRecord
+	for _, rec := range f.records {
+		if rec.Hostname != hostname || (!start.IsZero() && rec.Time.Before(start)) || (!end.IsZero() && !rec.Time.Before(end)) {
+			continue
+		}
+		matched = append(matched, rec)
+		if limit > 0 && len(matched) == limit {
+			break
+		}
+	}
+	return matched, nil
+}
+
+// hostRecords returns one record per GPU for two GPUs on each of two hosts,
+// plus a host whose name needs escaping
+func hostRecords(now time.Time) []telemetry.TelemetryRecord {
+	var records []telemetry.TelemetryRecord
+	for _, host := range []string{"dgx-1", "dgx-2"} {
+		for gpu := 0; gpu < 2; gpu++ {
+			records = append(records, telemetry.TelemetryRecord{
+				Hostname: host,
+				UUID:     fmt.Sprintf("GPU-%s-%d", host, gpu),
+				GPUID:    fmt.Sprint(gpu),
+				Metric:   "DCGM_FI_DEV_GPU_UTIL",
+				Value:    float64(gpu),
+				Time:     now.Add(-time.Duration(gpu) * time.Minute),
+			})
+		}
+	}
+	records = append(records, telemetry.TelemetryRecord{
+		Hostname: `rack 7/node"a"`, UUID: "GPU-odd", Metric: "DCGM_FI_DEV_GPU_UTIL", Time: now,
+	})
+	return records
+}
+
+func TestHostTelemetryEndpoint(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	querier := &fakeHostQuerier{records: hostRecords(now)}
+	handler := hostTelemetryHandler(querier, defaultQueryWindow, log.New(io.Discard, "", 0))
+
+	get := func(target string) HostTelemetryResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response HostTelemetryResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	t.Run("Every GPU on the host", func(t *testing.T) {
+		response := get("/api/v1/hosts/dgx-1/telemetry")
+		if response.Hostname != "dgx-1" || response.Count != 2 || len(response.Data) != 2 {
+			t.Fatalf("Expected 2 records for dgx-1, got %+v", response)
+		}
+		uuids := map[string]bool{}
+		for _, rec := range response.Data {
+			if rec.Hostname != "dgx-1" {
+				t.Errorf("Expected only dgx-1 records, got one from %s", rec.Hostname)
+			}
+			uuids[rec.UUID] = true
+		}
+		if !uuids["GPU-dgx-1-0"] || !uuids["GPU-dgx-1-1"] {
+			t.Errorf("Expected both GPUs of dgx-1, got %v", uuids)
+		}
+		if querier.gotLimit != defaultHostTelemetryLimit {
+			t.Errorf("Expected the default limit %d, got %d", defaultHostTelemetryLimit, querier.gotLimit)
+		}
+		if want := now.Add(-defaultQueryWindow); querier.gotStart.Before(want) || !querier.gotEnd.IsZero() {
+			t.Errorf("Expected the last %v up to now, got %v - %v", defaultQueryWindow, querier.gotStart, querier.gotEnd)
+		}
+	})
+
+	t.Run("Time range and limit", func(t *testing.T) {
+		start := now.Add(-30 * time.Second).Format(time.RFC3339)
+		response := get("/api/v1/hosts/dgx-2/telemetry?start_time=" + start + "&limit=5")
+		if response.Count != 1 || response.Data[0].UUID != "GPU-dgx-2-0" {
+			t.Errorf("Expected only the GPU reporting after start_time, got %+v", response.Data)
+		}
+		if querier.gotLimit != 5 {
+			t.Errorf("Expected limit 5, got %d", querier.gotLimit)
+		}
+	})
+
+	t.Run("Escaped hostname", func(t *testing.T) {
+		response := get("/api/v1/hosts/rack%207%2Fnode%22a%22/telemetry")
+		if querier.gotHost != `rack 7/node"a"` {
+			t.Errorf("Expected the unescaped hostname, got %q", querier.gotHost)
+		}
+		if response.Count != 1 || response.Data[0].UUID != "GPU-odd" {
+			t.Errorf("Expected the record for the escaped host, got %+v", response.Data)
+		}
+	})
+
+	t.Run("Unknown host", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/v1/hosts/dgx-9/telemetry", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, `"count":0`) || !strings.Contains(body, `"data":[]`) {
+			t.Errorf("Expected an empty list, got %s", body)
+		}
+	})
+}
+
+func TestHostTelemetryErrorResponses(t *testing.T) {
+	querier := &fakeHostQuerier{}
+	handler := hostTelemetryHandler(querier, defaultQueryWindow, log.New(io.Discard, "", 0))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	for target, field := range map[string]string{
+		"/api/v1/hosts/":                                     "hostname",
+		"/api/v1/hosts/%20/telemetry":                        "hostname",
+		"/api/v1/hosts/a%0Ab/telemetry":                      "hostname",
+		"/api/v1/hosts/dgx-1/telemetry?limit=0":              "limit",
+		"/api/v1/hosts/dgx-1/telemetry?limit=many":           "limit",
+		"/api/v1/hosts/dgx-1/telemetry?start_time=yesterday": "start_time",
+		"/api/v1/hosts/dgx-1/telemetry?start_time=2025-01-02T00:00:00Z&end_time=2025-01-01T00:00:00Z": "end_time",
+		"/api/v1/hosts/" + strings.Repeat("a", maxHostnameLength+1) + "/telemetry":                    "hostname",
+	} {
+		resp := decodeErrorResponse(t, get(target), http.StatusBadRequest)
+		if _, ok := fieldReasons(resp)[field]; !ok {
+			t.Errorf("%s: expected %s to be reported invalid, got %+v", target, field, resp.Details)
+		}
+	}
+
+	decodeErrorResponse(t, get("/api/v1/hosts/dgx-1/metrics"), http.StatusNotFound)
+
+	querier.err = errors.New("influx down")
+	decodeErrorResponse(t, get("/api/v1/hosts/dgx-1/telemetry"), http.StatusInternalServerError)
+}
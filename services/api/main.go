@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/example/telemetry/internal/buildinfo"
+	"github.com/example/telemetry/internal/health"
 	"github.com/example/telemetry/internal/influx"
 	"github.com/example/telemetry/internal/metrics"
 	"github.com/example/telemetry/internal/security"
@@ -64,17 +73,34 @@ func main() {
 		influxBucket = "telem_bucket"
 	}
 
+	alertThresholds, err := loadAlertThresholds()
+	if err != nil {
+		logger.Fatalf("Invalid alert thresholds: %v", err)
+	}
+
 	influxClient := influx.NewInfluxWriter(influxURL, influxToken, influxOrg, influxBucket)
 	defer influxClient.Close()
 
+	// Readiness follows a periodic InfluxDB ping, so it is withdrawn while InfluxDB is down
+	var ready health.Readiness
+	go monitorInflux(context.Background(), influxClient, &ready, getInfluxPingInterval(), logger)
+
+	// Bound concurrent InfluxDB queries so bursts of requests queue instead of piling onto InfluxDB,
+	// and answer 503 without querying while InfluxDB is known to be down
+	maxQueries, queryQueueTimeout := getQueryLimits()
+	querier := newAvailableQuerier(newLimitedQuerier(influxClient, maxQueries, queryQueueTimeout), &ready)
+
 	// Create HTTP router with API key authentication
 	mux := http.NewServeMux()
 
 	// Public endpoints (no auth required)
-	mux.HandleFunc("/health", metrics.HTTPMiddleware("api-service", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("API service healthy"))
-	}))
+	mux.HandleFunc("/health", metrics.HTTPMiddleware("api-service", healthHandler))
+
+	// Readiness endpoint (no auth required)
+	mux.HandleFunc("/ready", ready.Handler())
+
+	// Build information (no auth required)
+	mux.HandleFunc("/version", buildinfo.Handler("api-service"))
 
 	// Prometheus metrics endpoint
 	mux.Handle("/metrics", metrics.MetricsHandler())
@@ -83,11 +109,11 @@ func main() {
 	mux.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 
 	// @Summary Get GPU telemetry data
-	// @Description Get telemetry data for a specific GPU with optional time range filtering
+	// @Description Get telemetry data for a specific GPU with optional time range filtering. Without a time range the last DEFAULT_QUERY_WINDOW (default 1h) is returned
 	// @Tags telemetry
 	// @Param id path string true "GPU ID (UUID)"
-	// @Param start_time query string false "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z)"
-	// @Param end_time query string false "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z)"
+	// @Param start_time query string false "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z); defaults to end_time minus the default window"
+	// @Param end_time query string false "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z); defaults to now"
 	// @Param limit query int false "Maximum number of records to return (default: 100)"
 	// @Produce json
 	// @Success 200 {object} TelemetryResponse
@@ -96,59 +122,240 @@ func main() {
 	// @Failure 500 {object} ErrorResponse
 	// @Router /api/v1/gpus/{id}/telemetry [get]
 	// New endpoint: GET /api/v1/gpus/{id}/telemetry
-	mux.HandleFunc("/api/v1/gpus/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	mux.HandleFunc("/api/v1/gpus/", gpuTelemetryHandler(querier, getDefaultQueryWindow(), logger))
+
+	// @Summary List GPUs breaching alert thresholds
+	// @Description Evaluate the latest value of each metric per GPU (reported within DEFAULT_QUERY_WINDOW) against the configured alert thresholds and list the GPUs outside them
+	// @Tags gpus
+	// @Produce json
+	// @Security ApiKeyAuth
+	// @Success 200 {object} AlertsResponse
+	// @Failure 500 {object} ErrorResponse
+	// @Router /api/v1/gpus/alerts [get]
+	mux.HandleFunc("/api/v1/gpus/alerts", alertsHandler(querier, alertThresholds, getDefaultQueryWindow(), logger))
+
+	// @Summary Get telemetry for multiple GPUs
+	// @Description Get telemetry data for several GPUs in one request, keyed by GPU ID. Unknown IDs map to an empty list.
+	// @Tags telemetry
+	// @Accept json
+	// @Produce json
+	// @Param request body BatchTelemetryRequest true "GPU IDs and optional time range"
+	// @Success 200 {object} BatchTelemetryResponse
+	// @Failure 400 {object} ErrorResponse
+	// @Failure 500 {object} ErrorResponse
+	// @Router /api/v1/gpus/telemetry/batch [post]
+	mux.HandleFunc("/api/v1/gpus/telemetry/batch", batchTelemetryHandler(querier, logger))
+
+	// @Summary Get host telemetry data
+	// @Description Get telemetry data from every GPU on a host, newest first. Hostnames with special characters must be URL-encoded. Without a time range the last DEFAULT_QUERY_WINDOW (default 1h) is returned
+	// @Tags telemetry
+	// @Param hostname path string true "Hostname"
+	// @Param start_time query string false "Start time in RFC3339 format (e.g., 2023-01-01T00:00:00Z); defaults to end_time minus the default window"
+	// @Param end_time query string false "End time in RFC3339 format (e.g., 2023-01-01T23:59:59Z); defaults to now"
+	// @Param limit query int false "Maximum number of records to return across the host's GPUs (default: 1000, at most 10000)"
+	// @Produce json
+	// @Success 200 {object} HostTelemetryResponse
+	// @Failure 400 {object} ErrorResponse
+	// @Failure 404 {object} ErrorResponse
+	// @Failure 500 {object} ErrorResponse
+	// @Router /api/v1/hosts/{hostname}/telemetry [get]
+	mux.HandleFunc("/api/v1/hosts/", hostTelemetryHandler(querier, getDefaultQueryWindow(), logger))
+
+	// @Summary Get a fleet-wide metric aggregate
+	// @Description Get the mean or max of a metric across every GPU in the fleet over the last window, computed by InfluxDB. Without a window the last DEFAULT_QUERY_WINDOW (default 1h) is used
+	// @Tags fleet
+	// @Param metric query string false "Metric to aggregate (default: DCGM_FI_DEV_GPU_UTIL)"
+	// @Param fn query string false "Aggregate function: mean or max (default: mean)"
+	// @Param window query string false "How far back to aggregate, e.g. 15m"
+	// @Produce json
+	// @Security ApiKeyAuth
+	// @Success 200 {object} FleetAggregateResponse
+	// @Failure 400 {object} ErrorResponse
+	// @Failure 404 {object} ErrorResponse
+	// @Failure 500 {object} ErrorResponse
+	// @Router /api/v1/fleet/aggregate [get]
+	mux.HandleFunc("/api/v1/fleet/aggregate", fleetAggregateHandler(querier, getDefaultQueryWindow(), logger))
+
+	// @Summary List available GPUs
+	// @Description Get a list of all available GPUs with their metadata and when each last reported. GPUs not seen within seen_within (default GPU_SEEN_WITHIN, unset lists every GPU) are left out
+	// @Tags gpus
+	// @Produce json
+	// @Security ApiKeyAuth
+	// @Param seen_within query string false "Only list GPUs seen within this duration, e.g. 15m; 0 lists every GPU"
+	// @Param If-None-Match header string false "ETag from a previous response"
+	// @Success 200 {object} GPUListResponse
+	// @Success 304 "GPU list unchanged"
+	// @Failure 400 {object} ErrorResponse
+	// @Failure 500 {object} ErrorResponse
+	// @Router /api/v1/gpus [get]
+	// Helper endpoint: GET /api/v1/gpus - List available GPUs and when each was last seen
+	gpuCache := newGPUListCache(querier, getGPUListCacheTTL())
+	mux.HandleFunc("/api/v1/gpus", gpuListHandler(gpuCache, getGPUSeenWithin(), logger))
+
+	logger.Println("API service started on :8080")
+	logger.Println("Available endpoints:")
+	logger.Println("  GET /health                            - Health check (no auth)")
+	logger.Println("  GET /ready                             - Readiness check (no auth)")
+	logger.Println("  GET /version                           - Build information (no auth)")
+	logger.Println("  GET /swagger/                          - Swagger UI documentation (no auth)")
+	logger.Println("  GET /api/v1/gpus                       - List available GPUs [API KEY REQUIRED]")
+	logger.Println("  GET /api/v1/gpus/{id}/telemetry        - GPU telemetry [API KEY REQUIRED]")
+	logger.Println("  GET /api/v1/gpus/alerts                - GPUs breaching alert thresholds [API KEY REQUIRED]")
+	logger.Println("  POST /api/v1/gpus/telemetry/batch      - Telemetry for multiple GPUs [API KEY REQUIRED]")
+	logger.Println("  GET /api/v1/hosts/{hostname}/telemetry - Telemetry for every GPU on a host [API KEY REQUIRED]")
+	logger.Println("  GET /api/v1/fleet/aggregate            - Mean or max of a metric across the fleet [API KEY REQUIRED]")
+	logger.Println("")
+	logger.Println("Authentication: Include 'X-API-Key: <your-secret>' header or 'Authorization: Bearer <your-secret>'")
+
+	// Apply API key authentication middleware to all routes
+	securedHandler := security.APIKeyMiddleware(mux)
+	log.Fatal(security.ListenAndServe(&http.Server{Addr: ":8080", Handler: securedHandler}))
+}
+
+// rfc3339Reason is the validation reason given for malformed time parameters
+const rfc3339Reason = "must be an RFC3339 timestamp (e.g., 2023-01-01T00:00:00Z)"
+
+// maxGPUIDLength bounds the length of a GPU ID accepted by the API
+const maxGPUIDLength = 128
+
+// writeError writes an ErrorResponse as JSON with the given status
+func writeError(w http.ResponseWriter, status int, errMsg, message string, details ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: errMsg, Message: message, Details: details})
+}
+
+// writeValidationError writes a 400 listing the parameters that failed validation
+func writeValidationError(w http.ResponseWriter, details ...FieldError) {
+	writeError(w, http.StatusBadRequest, "Invalid request parameters", "", details...)
+}
+
+// writeMethodNotAllowed writes a 405 naming the allowed method
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "Use "+allowed)
+}
+
+// gpuIDProblem returns why id is not a valid GPU ID, or "" if it is. IDs are
+// device names or UUIDs, so only letters, digits and - _ . : are accepted.
+func gpuIDProblem(id string) string {
+	if id == "" {
+		return "is required"
+	}
+	if len(id) > maxGPUIDLength {
+		return fmt.Sprintf("must be at most %d characters", maxGPUIDLength)
+	}
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && !strings.ContainsRune("-_.:", c) {
+			return fmt.Sprintf("contains invalid character %q", c)
 		}
+	}
+	return ""
+}
 
-		// Parse the URL path to extract GPU ID
-		path := strings.TrimPrefix(r.URL.Path, "/api/v1/gpus/")
-		if path == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("GPU ID is required"))
+// parseTimeParam parses an optional RFC3339 parameter, appending a FieldError when it is malformed
+func parseTimeParam(field, value string, details *[]FieldError) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		*details = append(*details, FieldError{Field: field, Reason: rfc3339Reason})
+	}
+	return t
+}
+
+// defaultQueryWindow is how far back GPU telemetry queries look when no time range is given
+const defaultQueryWindow = time.Hour
+
+// getDefaultQueryWindow returns the default lookback from DEFAULT_QUERY_WINDOW (a Go duration
+// such as 1h or 30m) or the default; 0 scans the full retention period
+func getDefaultQueryWindow() time.Duration {
+	if windowStr := os.Getenv("DEFAULT_QUERY_WINDOW"); windowStr != "" {
+		if window, err := time.ParseDuration(windowStr); err == nil && window >= 0 {
+			return window
+		}
+		log.Printf("Invalid DEFAULT_QUERY_WINDOW value '%s', using default: %v", windowStr, defaultQueryWindow)
+	}
+	return defaultQueryWindow
+}
+
+// gpuTelemetryQuerier is the subset of the InfluxDB client used by the GPU telemetry endpoint
+type gpuTelemetryQuerier interface {
+	QueryTelemetryByDevice(uuid string) ([]telemetry.TelemetryRecord, error)
+	QueryTelemetryByDeviceSince(uuid string, window time.Duration) ([]telemetry.TelemetryRecord, error)
+	QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) ([]telemetry.TelemetryRecord, error)
+}
+
+// healthHandler reports liveness only; it stays 200 while InfluxDB is down,
+// which /ready reports instead
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("API service healthy"))
+}
+
+// gpuTelemetryHandler serves GET /api/v1/gpus/{id}/telemetry. Without start_time and
+// end_time it returns the last window of data; a missing bound is filled in from the
+// other one and the window. A window of 0 falls back to scanning the full retention.
+func gpuTelemetryHandler(querier gpuTelemetryQuerier, window time.Duration, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
 			return
 		}
 
 		// Split path to get ID and check for /telemetry suffix
+		path := strings.TrimPrefix(r.URL.Path, "/api/v1/gpus/")
 		parts := strings.Split(path, "/")
-		if len(parts) < 2 || parts[1] != "telemetry" {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("Endpoint not found"))
+		if len(parts) != 2 || parts[1] != "telemetry" {
+			if path == "" {
+				writeValidationError(w, FieldError{Field: "id", Reason: "is required"})
+				return
+			}
+			writeError(w, http.StatusNotFound, "Endpoint not found", "Use /api/v1/gpus/{id}/telemetry")
 			return
 		}
 
 		gpuID := parts[0]
-		logger.Printf("Querying telemetry for GPU ID: %s", gpuID)
+		var details []FieldError
+		if problem := gpuIDProblem(gpuID); problem != "" {
+			details = append(details, FieldError{Field: "id", Reason: problem})
+		}
 
 		// Check for time range query parameters
 		startTimeStr := r.URL.Query().Get("start_time")
 		endTimeStr := r.URL.Query().Get("end_time")
+		parseTimeParam("start_time", startTimeStr, &details)
+		end := parseTimeParam("end_time", endTimeStr, &details)
+		if len(details) > 0 {
+			writeValidationError(w, details...)
+			return
+		}
+
+		logger.Printf("Querying telemetry for GPU ID: %s", gpuID)
 
 		var records []telemetry.TelemetryRecord
 		var err error
-
-		if startTimeStr != "" && endTimeStr != "" {
-			// Parse time parameters
-			_, err1 := time.Parse(time.RFC3339, startTimeStr)
-			_, err2 := time.Parse(time.RFC3339, endTimeStr)
-
-			if err1 != nil || err2 != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Invalid time format. Use RFC3339 format (e.g., 2023-01-01T00:00:00Z)"))
-				return
+		switch {
+		case startTimeStr != "" && endTimeStr != "":
+			records, err = querier.QueryTelemetryByDeviceTimeRange(gpuID, startTimeStr, endTimeStr)
+		case startTimeStr != "":
+			records, err = querier.QueryTelemetryByDeviceTimeRange(gpuID, startTimeStr, time.Now().UTC().Format(time.RFC3339))
+		case endTimeStr != "":
+			from := time.Unix(0, 0).UTC()
+			if window > 0 {
+				from = end.Add(-window)
 			}
-
-			// Query with time range
-			records, err = influxClient.QueryTelemetryByDeviceTimeRange(gpuID, startTimeStr, endTimeStr)
-		} else {
-			records, err = influxClient.QueryTelemetryByDevice(gpuID)
+			records, err = querier.QueryTelemetryByDeviceTimeRange(gpuID, from.Format(time.RFC3339), endTimeStr)
+		case window > 0:
+			records, err = querier.QueryTelemetryByDeviceSince(gpuID, window)
+		default:
+			records, err = querier.QueryTelemetryByDevice(gpuID)
 		}
-
 		if err != nil {
 			logger.Printf("Failed to query InfluxDB for GPU %s: %v", gpuID, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to query telemetry data"))
+			writeQueryError(w, err, "Failed to query telemetry data")
 			return
 		}
 
@@ -159,58 +366,236 @@ func main() {
 			"data":   records,
 		}
 		json.NewEncoder(w).Encode(response)
-	})
+	}
+}
 
-	// @Summary List available GPUs
-	// @Description Get a list of all available GPUs with their metadata
-	// @Tags gpus
-	// @Produce json
-	// @Security ApiKeyAuth
-	// @Success 200 {object} GPUListResponse
-	// @Failure 500 {object} ErrorResponse
-	// @Router /api/v1/gpus [get]
-	// Helper endpoint: GET /api/v1/gpus - List available GPU IDs
-	mux.HandleFunc("/api/v1/gpus", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+// maxBatchGPUs caps the number of GPU IDs accepted by the batch telemetry endpoint
+const maxBatchGPUs = 32
+
+// batchTelemetryQuerier is the subset of the InfluxDB client used by the batch endpoint
+type batchTelemetryQuerier interface {
+	QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (map[string][]telemetry.TelemetryRecord, error)
+}
+
+// batchTelemetryHandler serves POST /api/v1/gpus/telemetry/batch
+func batchTelemetryHandler(querier batchTelemetryQuerier, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
 			return
 		}
 
-		// Query recent telemetry to get available GPU IDs
-		logger.Printf("Querying recent telemetry for GPU list...")
-		records, err := influxClient.QueryUniqueUUIDs()
-		if err != nil {
-			logger.Printf("Failed to query InfluxDB for GPU list: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to query GPU list"))
+		var req BatchTelemetryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON body", err.Error())
 			return
 		}
 
-		logger.Printf("Retrieved %d records from InfluxDB", len(records))
-		if len(records) > 0 {
-			logger.Printf("Sample record: %+v", records[0])
+		// Drop blanks and duplicates so each GPU is queried once
+		var details []FieldError
+		seen := make(map[string]bool, len(req.GPUIDs))
+		gpuIDs := make([]string, 0, len(req.GPUIDs))
+		for i, id := range req.GPUIDs {
+			id = strings.TrimSpace(id)
+			if id == "" || seen[id] {
+				continue
+			}
+			if problem := gpuIDProblem(id); problem != "" {
+				details = append(details, FieldError{Field: fmt.Sprintf("gpu_ids[%d]", i), Reason: problem})
+				continue
+			}
+			seen[id] = true
+			gpuIDs = append(gpuIDs, id)
+		}
+		if len(gpuIDs) == 0 && len(details) == 0 {
+			details = append(details, FieldError{Field: "gpu_ids", Reason: "must contain at least one GPU ID"})
+		}
+		if len(gpuIDs) > maxBatchGPUs {
+			details = append(details, FieldError{Field: "gpu_ids", Reason: fmt.Sprintf("must contain at most %d GPU IDs", maxBatchGPUs)})
+		}
+		if req.Limit < 0 {
+			details = append(details, FieldError{Field: "limit", Reason: "must not be negative"})
+		}
+		start := parseTimeParam("start_time", req.StartTime, &details)
+		end := parseTimeParam("end_time", req.EndTime, &details)
+		if len(details) > 0 {
+			writeValidationError(w, details...)
+			return
 		}
 
-		logger.Printf("Found %d unique GPUs", len(records))
+		logger.Printf("Querying telemetry for %d GPUs", len(gpuIDs))
+		records, err := querier.QueryTelemetryByDevices(gpuIDs, start, end, req.Limit)
+		if err != nil {
+			logger.Printf("Failed to query InfluxDB for GPU batch: %v", err)
+			writeQueryError(w, err, "Failed to query telemetry data")
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		response := map[string]interface{}{
 			"count": len(records),
-			"gpus":  records,
+			"data":  records,
 		}
 		json.NewEncoder(w).Encode(response)
-	})
+	}
+}
 
-	logger.Println("API service started on :8080")
-	logger.Println("Available endpoints:")
-	logger.Println("  GET /health                            - Health check (no auth)")
-	logger.Println("  GET /swagger/                          - Swagger UI documentation (no auth)")
-	logger.Println("  GET /api/v1/gpus                       - List available GPUs [API KEY REQUIRED]")
-	logger.Println("  GET /api/v1/gpus/{id}/telemetry        - GPU telemetry [API KEY REQUIRED]")
-	logger.Println("")
-	logger.Println("Authentication: Include 'X-API-Key: <your-secret>' header or 'Authorization: Bearer <your-secret>'")
+// defaultGPUListCacheTTL is how long the GPU list is served from memory before InfluxDB is queried again
+const defaultGPUListCacheTTL = 10 * time.Second
 
-	// Apply API key authentication middleware to all routes
-	securedHandler := security.APIKeyMiddleware(mux)
-	log.Fatal(http.ListenAndServe(":8080", securedHandler))
+// getGPUListCacheTTL returns the GPU list cache TTL from GPU_LIST_CACHE_TTL_MS or the default; 0 disables caching
+func getGPUListCacheTTL() time.Duration {
+	if ttlStr := os.Getenv("GPU_LIST_CACHE_TTL_MS"); ttlStr != "" {
+		if ms, err := strconv.Atoi(ttlStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid GPU_LIST_CACHE_TTL_MS value '%s', using default: %v", ttlStr, defaultGPUListCacheTTL)
+	}
+	return defaultGPUListCacheTTL
+}
+
+// getGPUSeenWithin returns how recently a GPU must have reported to be listed, from
+// GPU_SEEN_WITHIN (a Go duration such as 15m), or 0 to list every GPU ever seen
+func getGPUSeenWithin() time.Duration {
+	if windowStr := os.Getenv("GPU_SEEN_WITHIN"); windowStr != "" {
+		if window, err := time.ParseDuration(windowStr); err == nil && window >= 0 {
+			return window
+		}
+		log.Printf("Invalid GPU_SEEN_WITHIN value '%s', using default: all GPUs", windowStr)
+	}
+	return 0
+}
+
+// gpuLister is the subset of the InfluxDB client used by the GPU list endpoint
+type gpuLister interface {
+	QueryGPUsWithLastSeen() ([]telemetry.TelemetryRecord, error)
+}
+
+// gpuListCache keeps the last GPU list for a short TTL
+type gpuListCache struct {
+	lister gpuLister
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	gpus    []GPUInfo
+	fetched time.Time
+	valid   bool
+}
+
+func newGPUListCache(lister gpuLister, ttl time.Duration) *gpuListCache {
+	return &gpuListCache{lister: lister, ttl: ttl, now: time.Now}
+}
+
+// get returns every GPU sorted by UUID, querying InfluxDB only when the cached copy has expired
+func (c *gpuListCache) get() ([]GPUInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.valid && c.now().Sub(c.fetched) < c.ttl {
+		return c.gpus, nil
+	}
+
+	records, err := c.lister.QueryGPUsWithLastSeen()
+	if err != nil {
+		return nil, err
+	}
+	gpus := make([]GPUInfo, 0, len(records))
+	for _, rec := range records {
+		gpus = append(gpus, GPUInfo{
+			DeviceID:  rec.DeviceID,
+			GPUID:     rec.GPUID,
+			UUID:      rec.UUID,
+			ModelName: rec.ModelName,
+			Hostname:  rec.Hostname,
+			Container: rec.Container,
+			Pod:       rec.Pod,
+			Namespace: rec.Namespace,
+			LastSeen:  rec.Time,
+		})
+	}
+	sort.Slice(gpus, func(i, j int) bool { return gpus[i].UUID < gpus[j].UUID })
+
+	c.gpus = gpus
+	c.fetched = c.now()
+	c.valid = true
+	return c.gpus, nil
+}
+
+// seenWithin returns the GPUs that reported within window of now; a window of 0 keeps them all
+func seenWithin(gpus []GPUInfo, window time.Duration, now time.Time) []GPUInfo {
+	if window <= 0 {
+		return gpus
+	}
+	cutoff := now.Add(-window)
+	recent := make([]GPUInfo, 0, len(gpus))
+	for _, gpu := range gpus {
+		if !gpu.LastSeen.Before(cutoff) {
+			recent = append(recent, gpu)
+		}
+	}
+	return recent
+}
+
+// gpuListETag hashes a sorted GPU list into a strong ETag. It covers each GPU's
+// UUID and last-seen time, so it changes whenever the response would.
+func gpuListETag(sorted []GPUInfo) string {
+	h := sha256.New()
+	for _, gpu := range sorted {
+		fmt.Fprintf(h, "%s %s\n", gpu.UUID, gpu.LastSeen.UTC().Format(time.RFC3339Nano))
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// gpuListHandler serves GET /api/v1/gpus with ETag and If-None-Match support.
+// GPUs that haven't reported within defaultWindow are left out unless the
+// request's seen_within parameter says otherwise; 0 lists every GPU.
+func gpuListHandler(cache *gpuListCache, defaultWindow time.Duration, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		window := defaultWindow
+		if windowStr := r.URL.Query().Get("seen_within"); windowStr != "" {
+			parsed, err := time.ParseDuration(windowStr)
+			if err != nil || parsed < 0 {
+				writeValidationError(w, FieldError{Field: "seen_within", Reason: "must be a non-negative duration (e.g., 15m or 1h)"})
+				return
+			}
+			window = parsed
+		}
+
+		all, err := cache.get()
+		if err != nil {
+			logger.Printf("Failed to query InfluxDB for GPU list: %v", err)
+			writeQueryError(w, err, "Failed to query GPU list")
+			return
+		}
+		gpus := seenWithin(all, window, cache.now())
+
+		etag := gpuListETag(gpus)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		logger.Printf("Found %d GPUs (%d known)", len(gpus), len(all))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GPUListResponse{Count: len(gpus), GPUs: gpus})
+	}
 }
@@ -3,12 +3,17 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/example/telemetry/internal/telemetry"
 )
 
 // MockInfluxWriter is a mock implementation of the InfluxWriter for testing
@@ -356,3 +361,553 @@ func TestEnvironmentVariables(t *testing.T) {
 		}
 	})
 }
+
+// fakeBatchQuerier serves batch queries from a fixed set of records per UUID
+type fakeBatchQuerier struct {
+	records map[string][]telemetry.TelemetryRecord
+	err     error
+
+	gotIDs   []string
+	gotStart time.Time
+	gotEnd   time.Time
+}
+
+func (f *fakeBatchQuerier) QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (map[string][]telemetry.TelemetryRecord, error) {
+	f.gotIDs, f.gotStart, f.gotEnd = uuids, start, end
+	if f.err != nil {
+		return nil, f.err
+	}
+	result := make(map[string][]telemetry.TelemetryRecord, len(uuids))
+	for _, id := range uuids {
+		result[id] = append([]telemetry.TelemetryRecord{}, f.records[id]...)
+	}
+	return result, nil
+}
+
+func TestBatchTelemetryEndpoint(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	querier := &fakeBatchQuerier{records: map[string][]telemetry.TelemetryRecord{
+		"GPU-a": {
+			{UUID: "GPU-a", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 10, Time: now},
+			{UUID: "GPU-a", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 20, Time: now.Add(-time.Minute)},
+		},
+		"GPU-b": {
+			{UUID: "GPU-b", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 30, Time: now},
+		},
+	}}
+	handler := batchTelemetryHandler(querier, log.New(io.Discard, "", 0))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/gpus/telemetry/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	t.Run("Multiple IDs", func(t *testing.T) {
+		w := post(`{"gpu_ids":["GPU-a","GPU-b","GPU-unknown","GPU-a"],"start_time":"2025-01-01T00:00:00Z"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var response struct {
+			Count int                                    `json:"count"`
+			Data  map[string][]telemetry.TelemetryRecord `json:"data"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		if response.Count != 3 {
+			t.Errorf("Expected 3 GPUs in response, got %d", response.Count)
+		}
+		if len(response.Data["GPU-a"]) != 2 || len(response.Data["GPU-b"]) != 1 {
+			t.Errorf("Expected 2 records for GPU-a and 1 for GPU-b, got %d and %d", len(response.Data["GPU-a"]), len(response.Data["GPU-b"]))
+		}
+		for id, records := range response.Data {
+			for _, rec := range records {
+				if rec.UUID != id {
+					t.Errorf("Record for %s returned under %s", rec.UUID, id)
+				}
+			}
+		}
+		unknown, ok := response.Data["GPU-unknown"]
+		if !ok || unknown == nil || len(unknown) != 0 {
+			t.Errorf("Expected an empty list for an unknown GPU, got %v (present=%v)", unknown, ok)
+		}
+		if len(querier.gotIDs) != 3 {
+			t.Errorf("Expected duplicate IDs to be dropped, got %v", querier.gotIDs)
+		}
+		if !querier.gotStart.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) || !querier.gotEnd.IsZero() {
+			t.Errorf("Unexpected time range passed to query: %v - %v", querier.gotStart, querier.gotEnd)
+		}
+	})
+
+	t.Run("Too many IDs", func(t *testing.T) {
+		ids := make([]string, maxBatchGPUs+1)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("GPU-%d", i)
+		}
+		body, _ := json.Marshal(BatchTelemetryRequest{GPUIDs: ids})
+		if w := post(string(body)); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for _, body := range []string{
+			`not json`,
+			`{"gpu_ids":[]}`,
+			`{"gpu_ids":["GPU-a"],"start_time":"yesterday"}`,
+			`{"gpu_ids":["GPU-a"],"limit":-1}`,
+		} {
+			if w := post(body); w.Code != http.StatusBadRequest {
+				t.Errorf("Body %s: expected status 400, got %d", body, w.Code)
+			}
+		}
+	})
+
+	t.Run("Query error", func(t *testing.T) {
+		failing := &fakeBatchQuerier{err: fmt.Errorf("connection failed")}
+		req := httptest.NewRequest("POST", "/api/v1/gpus/telemetry/batch", strings.NewReader(`{"gpu_ids":["GPU-a"]}`))
+		w := httptest.NewRecorder()
+		batchTelemetryHandler(failing, log.New(io.Discard, "", 0))(w, req)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid method", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/gpus/telemetry/batch", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", w.Code)
+		}
+	})
+}
+
+// fakeGPULister returns the latest record of a fixed set of GPUs and counts queries
+type fakeGPULister struct {
+	records []telemetry.TelemetryRecord
+	calls   int
+}
+
+func (f *fakeGPULister) QueryGPUsWithLastSeen() ([]telemetry.TelemetryRecord, error) {
+	f.calls++
+	return append([]telemetry.TelemetryRecord(nil), f.records...), nil
+}
+
+// lastSeenRecord is the latest point of a GPU on host-1
+func lastSeenRecord(uuid string, seen time.Time) telemetry.TelemetryRecord {
+	return telemetry.TelemetryRecord{
+		DeviceID:  "nvidia0",
+		GPUID:     "0",
+		UUID:      uuid,
+		ModelName: "NVIDIA H100 80GB HBM3",
+		Hostname:  "host-1",
+		Metric:    "DCGM_FI_DEV_GPU_UTIL",
+		Time:      seen,
+	}
+}
+
+func TestGPUListETag(t *testing.T) {
+	now := time.Now()
+	lister := &fakeGPULister{records: []telemetry.TelemetryRecord{
+		lastSeenRecord("GPU-b", now.Add(-time.Minute)),
+		lastSeenRecord("GPU-a", now.Add(-time.Minute)),
+	}}
+	cache := newGPUListCache(lister, time.Minute)
+	cache.now = func() time.Time { return now }
+	handler := gpuListHandler(cache, 0, log.New(io.Discard, "", 0))
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/gpus", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	first := get("")
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	// Order of the UUIDs in the query result must not change the ETag
+	sorted := []GPUInfo{
+		{UUID: "GPU-a", LastSeen: now.Add(-time.Minute)},
+		{UUID: "GPU-b", LastSeen: now.Add(-time.Minute)},
+	}
+	if expected := gpuListETag(sorted); expected != etag {
+		t.Errorf("Expected ETag of the sorted list %s, got %s", expected, etag)
+	}
+
+	second := get(etag)
+	if second.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304 for matching ETag, got %d", second.Code)
+	}
+	if second.Body.Len() != 0 {
+		t.Errorf("Expected empty body on 304, got %q", second.Body.String())
+	}
+	if w := get(`"stale"`); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for a stale ETag, got %d", w.Code)
+	}
+	if lister.calls != 1 {
+		t.Errorf("Expected requests within the TTL to share one query, got %d", lister.calls)
+	}
+
+	// Once the TTL passes the list is queried again and a new GPU changes the ETag
+	lister.records = append(lister.records, lastSeenRecord("GPU-c", now))
+	now = now.Add(2 * time.Minute)
+	third := get(etag)
+	if third.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after the GPU list changed, got %d", third.Code)
+	}
+	if lister.calls != 2 {
+		t.Errorf("Expected the cache to expire after the TTL, got %d queries", lister.calls)
+	}
+	if third.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag after the GPU list changed")
+	}
+}
+
+// getGPUList requests target from handler and decodes the GPU list
+func getGPUList(t *testing.T, handler http.HandlerFunc, target string) GPUListResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp GPUListResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestGPUListLastSeen(t *testing.T) {
+	now := time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC)
+	lister := &fakeGPULister{records: []telemetry.TelemetryRecord{
+		lastSeenRecord("GPU-fresh", now.Add(-time.Minute)),
+		lastSeenRecord("GPU-stale", now.Add(-3*time.Hour)),
+	}}
+	cache := newGPUListCache(lister, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	// Without a window every GPU is listed with its tags and last-seen time
+	resp := getGPUList(t, gpuListHandler(cache, 0, log.New(io.Discard, "", 0)), "/api/v1/gpus")
+	if resp.Count != 2 || len(resp.GPUs) != 2 {
+		t.Fatalf("Expected 2 GPUs, got %+v", resp)
+	}
+	fresh := resp.GPUs[0]
+	expected := GPUInfo{
+		DeviceID:  "nvidia0",
+		GPUID:     "0",
+		UUID:      "GPU-fresh",
+		ModelName: "NVIDIA H100 80GB HBM3",
+		Hostname:  "host-1",
+		LastSeen:  now.Add(-time.Minute),
+	}
+	if !reflect.DeepEqual(fresh, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, fresh)
+	}
+	if !resp.GPUs[1].LastSeen.Equal(now.Add(-3 * time.Hour)) {
+		t.Errorf("Expected GPU-stale last seen 3h ago, got %v", resp.GPUs[1].LastSeen)
+	}
+
+	// The configured window hides GPUs that stopped reporting
+	filtered := gpuListHandler(cache, time.Hour, log.New(io.Discard, "", 0))
+	resp = getGPUList(t, filtered, "/api/v1/gpus")
+	if resp.Count != 1 || resp.GPUs[0].UUID != "GPU-fresh" {
+		t.Errorf("Expected only GPU-fresh within 1h, got %+v", resp.GPUs)
+	}
+
+	// seen_within overrides the configured window per request
+	if resp = getGPUList(t, filtered, "/api/v1/gpus?seen_within=4h"); resp.Count != 2 {
+		t.Errorf("Expected both GPUs within 4h, got %+v", resp.GPUs)
+	}
+	if resp = getGPUList(t, filtered, "/api/v1/gpus?seen_within=0"); resp.Count != 2 {
+		t.Errorf("Expected seen_within=0 to list every GPU, got %+v", resp.GPUs)
+	}
+	if lister.calls != 1 {
+		t.Errorf("Expected every window to be served from one cached query, got %d", lister.calls)
+	}
+
+	w := httptest.NewRecorder()
+	filtered(w, httptest.NewRequest("GET", "/api/v1/gpus?seen_within=soon", nil))
+	if resp := decodeErrorResponse(t, w, http.StatusBadRequest); len(resp.Details) != 1 || resp.Details[0].Field != "seen_within" {
+		t.Errorf("Expected a seen_within validation error, got %+v", resp)
+	}
+}
+
+func TestGPUSeenWithinFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"15m", 15 * time.Minute},
+		{"0", 0},
+		{"-1h", 0},
+		{"recently", 0},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("GPU_SEEN_WITHIN", tt.value)
+		if got := getGPUSeenWithin(); got != tt.expected {
+			t.Errorf("GPU_SEEN_WITHIN=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestGPUListCacheTTLFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultGPUListCacheTTL},
+		{"2500", 2500 * time.Millisecond},
+		{"0", 0},
+		{"-5", defaultGPUListCacheTTL},
+		{"abc", defaultGPUListCacheTTL},
+	}
+	for _, tt := range tests {
+		t.Setenv("GPU_LIST_CACHE_TTL_MS", tt.value)
+		if got := getGPUListCacheTTL(); got != tt.expected {
+			t.Errorf("GPU_LIST_CACHE_TTL_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+// fakeTelemetryQuerier records which query it was asked to run
+type fakeTelemetryQuerier struct {
+	gotQuery  string
+	gotID     string
+	gotWindow time.Duration
+	gotStart  string
+	gotEnd    string
+	err       error
+}
+
+func (f *fakeTelemetryQuerier) QueryTelemetryByDevice(uuid string) ([]telemetry.TelemetryRecord, error) {
+	f.gotQuery, f.gotID = "all", uuid
+	return nil, f.err
+}
+
+func (f *fakeTelemetryQuerier) QueryTelemetryByDeviceSince(uuid string, window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	f.gotQuery, f.gotID, f.gotWindow = "since", uuid, window
+	return nil, f.err
+}
+
+func (f *fakeTelemetryQuerier) QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) ([]telemetry.TelemetryRecord, error) {
+	f.gotQuery, f.gotID, f.gotStart, f.gotEnd = "range", uuid, startTime, endTime
+	return nil, f.err
+}
+
+// decodeErrorResponse checks that w holds a JSON ErrorResponse with the given status
+func decodeErrorResponse(t *testing.T, w *httptest.ResponseRecorder, status int) ErrorResponse {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+	var resp ErrorResponse
+	dec := json.NewDecoder(w.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatalf("Error body is not a valid ErrorResponse: %v", err)
+	}
+	if resp.Error == "" {
+		t.Error("Expected the error field to be set")
+	}
+	return resp
+}
+
+// fieldReasons maps each invalid field in an ErrorResponse to its reason
+func fieldReasons(resp ErrorResponse) map[string]string {
+	reasons := make(map[string]string, len(resp.Details))
+	for _, d := range resp.Details {
+		reasons[d.Field] = d.Reason
+	}
+	return reasons
+}
+
+func TestGPUTelemetryErrorResponses(t *testing.T) {
+	querier := &fakeTelemetryQuerier{}
+	handler := gpuTelemetryHandler(querier, defaultQueryWindow, log.New(io.Discard, "", 0))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	t.Run("Bad GPU IDs", func(t *testing.T) {
+		for target, reason := range map[string]string{
+			"/api/v1/gpus/":                  "is required",
+			"/api/v1/gpus//telemetry":        "is required",
+			"/api/v1/gpus/GPU%20a/telemetry": `contains invalid character ' '`,
+			"/api/v1/gpus/GPU%22a/telemetry": `contains invalid character '"'`,
+			"/api/v1/gpus/" + strings.Repeat("a", maxGPUIDLength+1) + "/telemetry": fmt.Sprintf("must be at most %d characters", maxGPUIDLength),
+		} {
+			resp := decodeErrorResponse(t, get(target), http.StatusBadRequest)
+			if got := fieldReasons(resp)["id"]; got != reason {
+				t.Errorf("%s: expected id reason %q, got %q", target, reason, got)
+			}
+		}
+		if querier.gotID != "" {
+			t.Errorf("Expected invalid IDs not to be queried, got %q", querier.gotID)
+		}
+	})
+
+	t.Run("Bad time formats", func(t *testing.T) {
+		resp := decodeErrorResponse(t, get("/api/v1/gpus/GPU-a/telemetry?start_time=yesterday&end_time=2025-01-01T00:00:00Z"), http.StatusBadRequest)
+		reasons := fieldReasons(resp)
+		if reasons["start_time"] != rfc3339Reason {
+			t.Errorf("Expected start_time to be reported, got %v", resp.Details)
+		}
+		if _, ok := reasons["end_time"]; ok {
+			t.Errorf("Expected only start_time to be reported, got %v", resp.Details)
+		}
+
+		resp = decodeErrorResponse(t, get("/api/v1/gpus/bad%20id/telemetry?start_time=x&end_time=y"), http.StatusBadRequest)
+		if len(resp.Details) != 3 {
+			t.Errorf("Expected id, start_time and end_time to be reported, got %v", resp.Details)
+		}
+	})
+
+	t.Run("Unknown endpoint", func(t *testing.T) {
+		decodeErrorResponse(t, get("/api/v1/gpus/GPU-a/metrics"), http.StatusNotFound)
+	})
+
+	t.Run("Invalid method", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/api/v1/gpus/GPU-a/telemetry", nil))
+		decodeErrorResponse(t, w, http.StatusMethodNotAllowed)
+		if allow := w.Header().Get("Allow"); allow != http.MethodGet {
+			t.Errorf("Expected Allow: GET, got %q", allow)
+		}
+	})
+
+	t.Run("Query error", func(t *testing.T) {
+		failing := gpuTelemetryHandler(&fakeTelemetryQuerier{err: fmt.Errorf("connection failed")}, defaultQueryWindow, log.New(io.Discard, "", 0))
+		w := httptest.NewRecorder()
+		failing(w, httptest.NewRequest("GET", "/api/v1/gpus/GPU-a/telemetry", nil))
+		decodeErrorResponse(t, w, http.StatusInternalServerError)
+	})
+
+	t.Run("Valid request", func(t *testing.T) {
+		if w := get("/api/v1/gpus/GPU-5fd4f087-86f3-7a43-b711-4771313afc50/telemetry"); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestBatchTelemetryErrorResponses(t *testing.T) {
+	handler := batchTelemetryHandler(&fakeBatchQuerier{}, log.New(io.Discard, "", 0))
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/api/v1/gpus/telemetry/batch", strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{"gpu_ids":[]}`, []string{"gpu_ids"}},
+		{`{"gpu_ids":["GPU-a","GPU b"]}`, []string{"gpu_ids[1]"}},
+		{`{"gpu_ids":["GPU-a"],"start_time":"yesterday","end_time":"today"}`, []string{"start_time", "end_time"}},
+		{`{"gpu_ids":["GPU-a"],"limit":-1}`, []string{"limit"}},
+	}
+	for _, tt := range tests {
+		reasons := fieldReasons(decodeErrorResponse(t, post(tt.body), http.StatusBadRequest))
+		if len(reasons) != len(tt.fields) {
+			t.Errorf("Body %s: expected fields %v, got %v", tt.body, tt.fields, reasons)
+		}
+		for _, field := range tt.fields {
+			if _, ok := reasons[field]; !ok {
+				t.Errorf("Body %s: expected %s to be reported, got %v", tt.body, field, reasons)
+			}
+		}
+	}
+
+	resp := decodeErrorResponse(t, post(`not json`), http.StatusBadRequest)
+	if resp.Message == "" {
+		t.Error("Expected the JSON decode error in the message")
+	}
+}
+
+func TestGPUTelemetryDefaultWindow(t *testing.T) {
+	get := func(window time.Duration, target string) *fakeTelemetryQuerier {
+		t.Helper()
+		querier := &fakeTelemetryQuerier{}
+		w := httptest.NewRecorder()
+		gpuTelemetryHandler(querier, window, log.New(io.Discard, "", 0))(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return querier
+	}
+
+	t.Run("No range uses the window", func(t *testing.T) {
+		q := get(30*time.Minute, "/api/v1/gpus/GPU-a/telemetry")
+		if q.gotQuery != "since" || q.gotWindow != 30*time.Minute {
+			t.Errorf("Expected a 30m window query, got %s with window %v", q.gotQuery, q.gotWindow)
+		}
+	})
+
+	t.Run("Explicit range overrides the window", func(t *testing.T) {
+		q := get(time.Hour, "/api/v1/gpus/GPU-a/telemetry?start_time=2025-01-01T00:00:00Z&end_time=2025-01-02T00:00:00Z")
+		if q.gotQuery != "range" || q.gotStart != "2025-01-01T00:00:00Z" || q.gotEnd != "2025-01-02T00:00:00Z" {
+			t.Errorf("Expected the explicit range, got %s %s - %s", q.gotQuery, q.gotStart, q.gotEnd)
+		}
+	})
+
+	t.Run("Only end time", func(t *testing.T) {
+		q := get(time.Hour, "/api/v1/gpus/GPU-a/telemetry?end_time=2025-01-02T00:00:00Z")
+		if q.gotQuery != "range" || q.gotStart != "2025-01-01T23:00:00Z" {
+			t.Errorf("Expected the window to end at end_time, got %s %s - %s", q.gotQuery, q.gotStart, q.gotEnd)
+		}
+	})
+
+	t.Run("Only start time", func(t *testing.T) {
+		q := get(time.Hour, "/api/v1/gpus/GPU-a/telemetry?start_time=2025-01-01T00:00:00Z")
+		end, err := time.Parse(time.RFC3339, q.gotEnd)
+		if q.gotQuery != "range" || q.gotStart != "2025-01-01T00:00:00Z" || err != nil || time.Since(end) > time.Minute {
+			t.Errorf("Expected a range from start_time to now, got %s %s - %s", q.gotQuery, q.gotStart, q.gotEnd)
+		}
+	})
+
+	t.Run("Zero window scans all history", func(t *testing.T) {
+		if q := get(0, "/api/v1/gpus/GPU-a/telemetry"); q.gotQuery != "all" {
+			t.Errorf("Expected a full history query, got %s", q.gotQuery)
+		}
+	})
+}
+
+func TestDefaultQueryWindowFromEnv(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     defaultQueryWindow,
+		"30m":  30 * time.Minute,
+		"24h":  24 * time.Hour,
+		"0":    0,
+		"-1h":  defaultQueryWindow,
+		"soon": defaultQueryWindow,
+	}
+	for value, expected := range tests {
+		t.Setenv("DEFAULT_QUERY_WINDOW", value)
+		if got := getDefaultQueryWindow(); got != expected {
+			t.Errorf("DEFAULT_QUERY_WINDOW=%q: expected %v, got %v", value, expected, got)
+		}
+	}
+}
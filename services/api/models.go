@@ -42,6 +42,29 @@ type TelemetryDataResponse struct {
 	Pod       string    `json:"pod" example:""`
 	Namespace string    `json:"namespace" example:""`
 	LabelsRaw string    `json:"labels_raw" example:"DCGM_FI_DRIVER_VERSION=\"535.129.03\""`
+
+	DriverVersion string `json:"driver_version,omitempty" example:"535.129.03"`
+}
+
+// BatchTelemetryRequest represents the request body for the batch telemetry endpoint
+type BatchTelemetryRequest struct {
+	GPUIDs    []string `json:"gpu_ids" example:"GPU-5fd4f087-86f3-7a43-b711-4771313afc50,GPU-9a1c2b3d-0000-1111-2222-333344445555"`
+	StartTime string   `json:"start_time,omitempty" example:"2025-07-18T00:00:00Z"`
+	EndTime   string   `json:"end_time,omitempty" example:"2025-07-18T23:59:59Z"`
+	Limit     int      `json:"limit,omitempty" example:"100"`
+}
+
+// BatchTelemetryResponse represents the response for the batch telemetry endpoint, keyed by GPU ID
+type BatchTelemetryResponse struct {
+	Count int                                `json:"count" example:"2"`
+	Data  map[string][]TelemetryDataResponse `json:"data"`
+}
+
+// HostTelemetryResponse represents the response for the host telemetry endpoint
+type HostTelemetryResponse struct {
+	Hostname string                  `json:"hostname" example:"mtv5-dgx1-hgpu-031"`
+	Count    int                     `json:"count" example:"100"`
+	Data     []TelemetryDataResponse `json:"data"`
 }
 
 // HostInfo represents host information
@@ -70,6 +93,47 @@ type NamespaceListResponse struct {
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error   string `json:"error" example:"Failed to query data"`
-	Message string `json:"message,omitempty" example:"Additional error details"`
-}
\ No newline at end of file
+	Error   string       `json:"error" example:"Failed to query data"`
+	Message string       `json:"message,omitempty" example:"Additional error details"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError describes why a single request parameter failed validation
+type FieldError struct {
+	Field  string `json:"field" example:"start_time"`
+	Reason string `json:"reason" example:"must be an RFC3339 timestamp (e.g., 2023-01-01T00:00:00Z)"`
+}
+
+// AlertsResponse lists the GPUs whose latest metrics breach an alert threshold
+type AlertsResponse struct {
+	Count  int        `json:"count" example:"1"`
+	Alerts []GPUAlert `json:"alerts"`
+}
+
+// GPUAlert is a GPU with at least one metric outside its alert threshold
+type GPUAlert struct {
+	UUID      string            `json:"uuid" example:"GPU-5fd4f087-86f3-7a43-b711-4771313afc50"`
+	GPUID     string            `json:"gpu_id" example:"0"`
+	Hostname  string            `json:"hostname" example:"mtv5-dgx1-hgpu-031"`
+	ModelName string            `json:"model_name" example:"NVIDIA H100 80GB HBM3"`
+	Breaches  []ThresholdBreach `json:"breaches"`
+}
+
+// ThresholdBreach is a metric whose latest value is outside its threshold
+type ThresholdBreach struct {
+	Metric    string    `json:"metric" example:"DCGM_FI_DEV_GPU_TEMP"`
+	Value     float64   `json:"value" example:"91"`
+	Bound     string    `json:"bound" example:"max"`
+	Threshold float64   `json:"threshold" example:"85"`
+	Time      time.Time `json:"time" example:"2025-07-18T20:42:34Z"`
+}
+
+// FleetAggregateResponse is a metric aggregated across every GPU in the fleet
+type FleetAggregateResponse struct {
+	Metric   string     `json:"metric" example:"DCGM_FI_DEV_GPU_UTIL"`
+	Function string     `json:"fn" example:"mean"`
+	Window   string     `json:"window" example:"1h0m0s"`
+	Start    *time.Time `json:"start,omitempty" example:"2025-07-18T19:42:34Z"`
+	End      time.Time  `json:"end" example:"2025-07-18T20:42:34Z"`
+	Value    float64    `json:"value" example:"63.5"`
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// Default InfluxDB query limits
+const (
+	defaultMaxConcurrentQueries = 10
+	defaultQueryQueueTimeout    = 2 * time.Second
+)
+
+// errQueryLimit is returned when a query couldn't get a slot before the queue timeout
+var errQueryLimit = errors.New("too many concurrent InfluxDB queries")
+
+// influxQuerier is every InfluxDB query the API handlers make
+type influxQuerier interface {
+	gpuTelemetryQuerier
+	batchTelemetryQuerier
+	hostTelemetryQuerier
+	gpuLister
+	latestTelemetryQuerier
+	fleetAggregateQuerier
+}
+
+// queryLimiter caps how many InfluxDB queries run at once. Callers beyond the
+// cap wait up to timeout for a slot and then give up with errQueryLimit.
+type queryLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newQueryLimiter(max int, timeout time.Duration) *queryLimiter {
+	return &queryLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// do runs query once a slot is free
+func (l *queryLimiter) do(query func() error) error {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if !l.wait() {
+			metrics.RecordAPIQueryRejected()
+			return errQueryLimit
+		}
+	}
+	metrics.APIInfluxQueriesInFlight.Inc()
+	defer func() {
+		metrics.APIInfluxQueriesInFlight.Dec()
+		<-l.slots
+	}()
+	return query()
+}
+
+// wait blocks until a slot is taken or the timeout passes
+func (l *queryLimiter) wait() bool {
+	if l.timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// limitedQuerier runs every query through a queryLimiter
+type limitedQuerier struct {
+	next    influxQuerier
+	limiter *queryLimiter
+}
+
+// newLimitedQuerier wraps next with a limit of max concurrent queries; a max of 0 disables the limit
+func newLimitedQuerier(next influxQuerier, max int, timeout time.Duration) influxQuerier {
+	if max <= 0 {
+		return next
+	}
+	return &limitedQuerier{next: next, limiter: newQueryLimiter(max, timeout)}
+}
+
+func (q *limitedQuerier) QueryTelemetryByDevice(uuid string) (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryTelemetryByDevice(uuid)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryTelemetryByDeviceSince(uuid string, window time.Duration) (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryTelemetryByDeviceSince(uuid, window)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryTelemetryByDeviceTimeRange(uuid, startTime, endTime)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (records map[string][]telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryTelemetryByDevices(uuids, start, end, limit)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryTelemetryByHost(hostname string, start, end time.Time, limit int) (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryTelemetryByHost(hostname, start, end, limit)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryGPUsWithLastSeen() (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryGPUsWithLastSeen()
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryLatestTelemetry(window time.Duration) (records []telemetry.TelemetryRecord, err error) {
+	err = q.limiter.do(func() error {
+		records, err = q.next.QueryLatestTelemetry(window)
+		return err
+	})
+	return records, err
+}
+
+func (q *limitedQuerier) QueryFleetAggregate(metric string, start, end time.Time, fn string) (value float64, err error) {
+	err = q.limiter.do(func() error {
+		value, err = q.next.QueryFleetAggregate(metric, start, end, fn)
+		return err
+	})
+	return value, err
+}
+
+// getQueryLimits returns MAX_CONCURRENT_QUERIES (0 disables the limit) and
+// QUERY_QUEUE_TIMEOUT_MS (0 rejects at once when every slot is busy)
+func getQueryLimits() (int, time.Duration) {
+	max := defaultMaxConcurrentQueries
+	if maxStr := os.Getenv("MAX_CONCURRENT_QUERIES"); maxStr != "" {
+		if n, err := strconv.Atoi(maxStr); err == nil && n >= 0 {
+			max = n
+		} else {
+			log.Printf("Invalid MAX_CONCURRENT_QUERIES value '%s', using default: %d", maxStr, defaultMaxConcurrentQueries)
+		}
+	}
+
+	timeout := defaultQueryQueueTimeout
+	if msStr := os.Getenv("QUERY_QUEUE_TIMEOUT_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid QUERY_QUEUE_TIMEOUT_MS value '%s', using default: %v", msStr, defaultQueryQueueTimeout)
+		}
+	}
+	return max, timeout
+}
+
+// writeQueryError reports a failed InfluxDB query: 503 with Retry-After when the
+// query limit turned it away or InfluxDB is known to be down, 500 with errMsg otherwise
+func writeQueryError(w http.ResponseWriter, err error, errMsg string) {
+	if errors.Is(err, errQueryLimit) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "Too many concurrent queries", "Retry shortly")
+		return
+	}
+	if errors.Is(err, errInfluxUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(getInfluxPingInterval().Seconds()+0.999)))
+		writeError(w, http.StatusServiceUnavailable, "Telemetry database unavailable", "InfluxDB is unreachable; the API is up and will serve data once it recovers")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, errMsg, "")
+}
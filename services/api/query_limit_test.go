@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/telemetry"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// blockingQuerier holds every query until release is closed and tracks the
+// highest number of queries running at once
+type blockingQuerier struct {
+	release chan struct{}
+	started chan struct{}
+
+	current int32
+	max     int32
+}
+
+func newBlockingQuerier() *blockingQuerier {
+	return &blockingQuerier{release: make(chan struct{}), started: make(chan struct{}, 100)}
+}
+
+func (q *blockingQuerier) query() {
+	n := atomic.AddInt32(&q.current, 1)
+	for {
+		m := atomic.LoadInt32(&q.max)
+		if n <= m || atomic.CompareAndSwapInt32(&q.max, m, n) {
+			break
+		}
+	}
+	q.started <- struct{}{}
+	<-q.release
+	atomic.AddInt32(&q.current, -1)
+}
+
+func (q *blockingQuerier) QueryTelemetryByDevice(uuid string) ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryTelemetryByDeviceSince(uuid string, window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryTelemetryByDeviceTimeRange(uuid string, startTime, endTime string) ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryTelemetryByDevices(uuids []string, start, end time.Time, limit int) (map[string][]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryTelemetryByHost(hostname string, start, end time.Time, limit int) ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryGPUsWithLastSeen() ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryLatestTelemetry(window time.Duration) ([]telemetry.TelemetryRecord, error) {
+	q.query()
+	return nil, nil
+}
+
+func (q *blockingQuerier) QueryFleetAggregate(metric string, start, end time.Time, fn string) (float64, error) {
+	q.query()
+	return 0, nil
+}
+
+// queriesInFlight reads the api_influx_queries_in_flight gauge
+func queriesInFlight(t *testing.T) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.APIInfluxQueriesInFlight.Write(m); err != nil {
+		t.Fatalf("Failed to read gauge: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// waitStarted waits for n queries to start
+func waitStarted(t *testing.T, q *blockingQuerier, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-q.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d queries started", i, n)
+		}
+	}
+}
+
+func TestQueryLimitCapsConcurrency(t *testing.T) {
+	const limit, requests = 3, 10
+	backend := newBlockingQuerier()
+	handler := gpuTelemetryHandler(newLimitedQuerier(backend, limit, 5*time.Second), time.Hour, log.New(io.Discard, "", 0))
+
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/api/v1/gpus/GPU-1/telemetry", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+
+	waitStarted(t, backend, limit)
+	// Give the queued requests a chance to (wrongly) get through
+	time.Sleep(50 * time.Millisecond)
+	if running := atomic.LoadInt32(&backend.current); running != limit {
+		t.Errorf("Expected %d queries running, got %d", limit, running)
+	}
+	if gauge := queriesInFlight(t); gauge != limit {
+		t.Errorf("Expected the in-flight gauge to read %d, got %v", limit, gauge)
+	}
+
+	close(backend.release)
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&backend.max); max != limit {
+		t.Errorf("Expected at most %d concurrent queries, saw %d", limit, max)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Request %d: expected queued request to succeed, got %d", i, code)
+		}
+	}
+	if gauge := queriesInFlight(t); gauge != 0 {
+		t.Errorf("Expected the in-flight gauge to return to 0, got %v", gauge)
+	}
+}
+
+func TestQueryLimitRejectsAfterTimeout(t *testing.T) {
+	backend := newBlockingQuerier()
+	handler := gpuTelemetryHandler(newLimitedQuerier(backend, 1, 20*time.Millisecond), time.Hour, log.New(io.Discard, "", 0))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/gpus/GPU-1/telemetry", nil))
+	}()
+	waitStarted(t, backend, 1)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/v1/gpus/GPU-2/telemetry", nil))
+	decodeErrorResponse(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	close(backend.release)
+	<-done
+}
+
+func TestQueryLimitDisabled(t *testing.T) {
+	backend := newBlockingQuerier()
+	if q := newLimitedQuerier(backend, 0, time.Second); q != backend {
+		t.Error("Expected a limit of 0 to leave the querier unwrapped")
+	}
+}
+
+func TestGetQueryLimits(t *testing.T) {
+	tests := []struct {
+		name, max, timeout string
+		expectedMax        int
+		expectedTimeout    time.Duration
+	}{
+		{"defaults", "", "", defaultMaxConcurrentQueries, defaultQueryQueueTimeout},
+		{"custom", "4", "250", 4, 250 * time.Millisecond},
+		{"zero disables", "0", "0", 0, 0},
+		{"invalid values", "-1", "soon", defaultMaxConcurrentQueries, defaultQueryQueueTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_CONCURRENT_QUERIES", tt.max)
+			t.Setenv("QUERY_QUEUE_TIMEOUT_MS", tt.timeout)
+			max, timeout := getQueryLimits()
+			if max != tt.expectedMax || timeout != tt.expectedTimeout {
+				t.Errorf("Expected %d and %v, got %d and %v", tt.expectedMax, tt.expectedTimeout, max, timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/telemetry/internal/archive"
+	"github.com/example/telemetry/internal/metrics"
+)
+
+const (
+	defaultArchivePrefix   = "telemetry/raw"
+	defaultArchiveMaxBytes = 64 << 20
+	defaultArchiveMaxAge   = 5 * time.Minute
+)
+
+// archiveConfig selects where the collector archives raw messages
+type archiveConfig struct {
+	enabled bool
+
+	endpoint        string
+	bucket          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+
+	prefix   string
+	maxBytes int
+	maxAge   time.Duration
+}
+
+// loadArchiveConfig reads the ARCHIVE_* settings. Archiving is on when
+// ARCHIVE_S3_BUCKET is set, and then ARCHIVE_S3_ENDPOINT is required; the
+// rotation settings fall back to their defaults.
+func loadArchiveConfig() (archiveConfig, error) {
+	ac := archiveConfig{
+		bucket:          strings.TrimSpace(os.Getenv("ARCHIVE_S3_BUCKET")),
+		endpoint:        strings.TrimSpace(os.Getenv("ARCHIVE_S3_ENDPOINT")),
+		region:          strings.TrimSpace(os.Getenv("ARCHIVE_S3_REGION")),
+		accessKeyID:     os.Getenv("ARCHIVE_S3_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("ARCHIVE_S3_SECRET_ACCESS_KEY"),
+		prefix:          defaultArchivePrefix,
+		maxBytes:        defaultArchiveMaxBytes,
+		maxAge:          defaultArchiveMaxAge,
+	}
+	if ac.bucket == "" {
+		return ac, nil
+	}
+	ac.enabled = true
+	if ac.endpoint == "" {
+		return ac, fmt.Errorf("ARCHIVE_S3_BUCKET is set but ARCHIVE_S3_ENDPOINT is not")
+	}
+	if (ac.accessKeyID == "") != (ac.secretAccessKey == "") {
+		return ac, fmt.Errorf("ARCHIVE_S3_ACCESS_KEY_ID and ARCHIVE_S3_SECRET_ACCESS_KEY must be set together")
+	}
+
+	if prefix, ok := os.LookupEnv("ARCHIVE_PREFIX"); ok {
+		ac.prefix = strings.TrimSpace(prefix)
+	}
+	if nStr := os.Getenv("ARCHIVE_MAX_BYTES"); nStr != "" {
+		if n, err := strconv.Atoi(nStr); err == nil && n > 0 {
+			ac.maxBytes = n
+		} else {
+			log.Printf("Invalid ARCHIVE_MAX_BYTES value '%s', using default: %d", nStr, defaultArchiveMaxBytes)
+		}
+	}
+	if msStr := os.Getenv("ARCHIVE_MAX_AGE_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			ac.maxAge = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid ARCHIVE_MAX_AGE_MS value '%s', using default: %v", msStr, defaultArchiveMaxAge)
+		}
+	}
+	return ac, nil
+}
+
+// newArchiveWriter builds the raw message archive for ac. Files are uploaded
+// in the background and named after this host, so replicas don't overwrite
+// each other; a file that can't be uploaded is logged and counted but its
+// messages have already been acked.
+func newArchiveWriter(ac archiveConfig, logger *log.Logger) *archive.Writer {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = "collector"
+	}
+	logger.Printf("Archiving raw messages to %s/%s/%s: max_bytes=%d, max_age=%v",
+		ac.endpoint, ac.bucket, ac.prefix, ac.maxBytes, ac.maxAge)
+	store := archive.NewS3Store(archive.S3Options{
+		Endpoint:        ac.endpoint,
+		Bucket:          ac.bucket,
+		Region:          ac.region,
+		AccessKeyID:     ac.accessKeyID,
+		SecretAccessKey: ac.secretAccessKey,
+	})
+	return archive.NewWriter(store, archive.Options{
+		Prefix:   ac.prefix,
+		Name:     name,
+		MaxBytes: ac.maxBytes,
+		MaxAge:   ac.maxAge,
+		OnError: func(err error) {
+			logger.Printf("Archive upload failed: %v", err)
+			metrics.DatabaseOperations.WithLabelValues("collector-service", "archive_upload", "error").Inc()
+		},
+		OnUpload: func(key string, records, size int) {
+			metrics.DatabaseOperations.WithLabelValues("collector-service", "archive_upload", "success").Inc()
+		},
+	})
+}
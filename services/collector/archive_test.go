@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/archive"
+	"github.com/example/telemetry/internal/influx"
+)
+
+func TestLoadArchiveConfig(t *testing.T) {
+	for _, key := range []string{"ARCHIVE_S3_BUCKET", "ARCHIVE_S3_ENDPOINT", "ARCHIVE_S3_REGION", "ARCHIVE_S3_ACCESS_KEY_ID",
+		"ARCHIVE_S3_SECRET_ACCESS_KEY", "ARCHIVE_MAX_BYTES", "ARCHIVE_MAX_AGE_MS"} {
+		t.Setenv(key, "")
+	}
+	ac, err := loadArchiveConfig()
+	if err != nil || ac.enabled {
+		t.Fatalf("Expected archiving off without a bucket, got %+v, %v", ac, err)
+	}
+
+	t.Setenv("ARCHIVE_S3_BUCKET", "telemetry-archive")
+	if _, err := loadArchiveConfig(); err == nil {
+		t.Error("Expected an error for a bucket without an endpoint")
+	}
+
+	t.Setenv("ARCHIVE_S3_ENDPOINT", "http://minio:9000")
+	t.Setenv("ARCHIVE_S3_ACCESS_KEY_ID", "minio")
+	if _, err := loadArchiveConfig(); err == nil {
+		t.Error("Expected an error for an access key without a secret")
+	}
+
+	t.Setenv("ARCHIVE_S3_SECRET_ACCESS_KEY", "minio123")
+	ac, err = loadArchiveConfig()
+	if err != nil || !ac.enabled || ac.prefix != defaultArchivePrefix || ac.maxBytes != defaultArchiveMaxBytes || ac.maxAge != defaultArchiveMaxAge {
+		t.Errorf("Expected archiving on with the defaults, got %+v, %v", ac, err)
+	}
+
+	t.Setenv("ARCHIVE_PREFIX", "cold/")
+	t.Setenv("ARCHIVE_MAX_BYTES", "1048576")
+	t.Setenv("ARCHIVE_MAX_AGE_MS", "60000")
+	ac, _ = loadArchiveConfig()
+	if ac.prefix != "cold/" || ac.maxBytes != 1<<20 || ac.maxAge != time.Minute {
+		t.Errorf("Expected 1MiB files every minute under cold/, got %+v", ac)
+	}
+
+	t.Setenv("ARCHIVE_MAX_BYTES", "0")
+	t.Setenv("ARCHIVE_MAX_AGE_MS", "later")
+	ac, _ = loadArchiveConfig()
+	if ac.maxBytes != defaultArchiveMaxBytes || ac.maxAge != defaultArchiveMaxAge {
+		t.Errorf("Expected invalid values to use the defaults, got %+v", ac)
+	}
+}
+
+func TestHandleMessageArchivesRawMessages(t *testing.T) {
+	var influxWrites int32
+	influxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&influxWrites, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(influxServer.Close)
+
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	t.Cleanup(s3Server.Close)
+
+	influxWriter := influx.NewInfluxWriter(influxServer.URL, "token", "org", "bucket")
+	t.Cleanup(influxWriter.Close)
+	ac := archiveConfig{endpoint: s3Server.URL, bucket: "archive", prefix: "raw", maxBytes: 1 << 20, maxAge: time.Hour}
+	cs := &CollectorService{
+		logger:  log.New(io.Discard, "", 0),
+		influx:  influxWriter,
+		archive: newArchiveWriter(ac, log.New(io.Discard, "", 0)),
+		filter:  &valueFilter{bounds: defaultValueBounds},
+	}
+
+	valid := mustJSON(t, validRow())
+	invalid := []byte(`["not", "a", "row"]`)
+	if err := cs.handleMessage("telemetry", valid, "1-0"); err != nil {
+		t.Fatalf("handleMessage failed: %v", err)
+	}
+	cs.handleMessage("telemetry", invalid, "2-0")
+	cs.archive.Close()
+
+	// The sink still gets the valid record
+	if got := atomic.LoadInt32(&influxWrites); got != 1 {
+		t.Errorf("Expected 1 InfluxDB write, got %d", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(objects) != 1 {
+		t.Fatalf("Expected one archive file, got %d", len(objects))
+	}
+	for path, body := range objects {
+		if !strings.HasPrefix(path, "/archive/raw/") || !strings.HasSuffix(path, ".ndjson.gz") {
+			t.Errorf("Unexpected object path %s", path)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Archive file is not gzip: %v", err)
+		}
+		var records []archive.Record
+		scanner := bufio.NewScanner(zr)
+		for scanner.Scan() {
+			var r archive.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("Bad archive line: %v", err)
+			}
+			records = append(records, r)
+		}
+		// Both messages are archived as received, the invalid one included
+		if len(records) != 2 || !bytes.Equal(records[0].Body, valid) || records[0].ID != "1-0" ||
+			!bytes.Equal(records[1].Body, invalid) || records[1].Topic != "telemetry" {
+			t.Errorf("Expected both raw messages archived, got %+v", records)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+const (
+	boundsModeDrop  = "drop"
+	boundsModeClamp = "clamp"
+)
+
+// valueBound is the accepted range for a metric; missing ends are unbounded
+type valueBound struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+func bound(min, max float64) valueBound {
+	return valueBound{Min: &min, Max: &max}
+}
+
+func lowerBound(min float64) valueBound {
+	return valueBound{Min: &min}
+}
+
+// defaultValueBounds are physically plausible ranges for the DCGM metrics we collect
+var defaultValueBounds = map[string]valueBound{
+	"DCGM_FI_DEV_GPU_UTIL":      bound(0, 100),
+	"DCGM_FI_DEV_MEM_COPY_UTIL": bound(0, 100),
+	"DCGM_FI_DEV_ENC_UTIL":      bound(0, 100),
+	"DCGM_FI_DEV_DEC_UTIL":      bound(0, 100),
+	"DCGM_FI_DEV_GPU_TEMP":      bound(0, 150),
+	"DCGM_FI_DEV_MEMORY_TEMP":   bound(0, 150),
+	"DCGM_FI_DEV_POWER_USAGE":   bound(0, 2000),
+	"DCGM_FI_DEV_FB_USED":       lowerBound(0),
+	"DCGM_FI_DEV_FB_FREE":       lowerBound(0),
+	"DCGM_FI_DEV_SM_CLOCK":      lowerBound(0),
+	"DCGM_FI_DEV_MEM_CLOCK":     lowerBound(0),
+}
+
+// valueFilter drops or clamps telemetry values outside their metric's bounds
+type valueFilter struct {
+	bounds map[string]valueBound
+	clamp  bool
+}
+
+// loadValueFilter builds the filter from VALUE_BOUNDS_FILE (a JSON object of
+// metric -> {"min": x, "max": y}) and VALUE_BOUNDS_MODE (drop or clamp).
+// Without a file the built-in defaults are used.
+func loadValueFilter() (*valueFilter, error) {
+	f := &valueFilter{bounds: defaultValueBounds}
+
+	switch mode := os.Getenv("VALUE_BOUNDS_MODE"); mode {
+	case "", boundsModeDrop:
+	case boundsModeClamp:
+		f.clamp = true
+	default:
+		return nil, fmt.Errorf("invalid VALUE_BOUNDS_MODE %q: expected %s or %s", mode, boundsModeDrop, boundsModeClamp)
+	}
+
+	path := os.Getenv("VALUE_BOUNDS_FILE")
+	if path == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read value bounds: %w", err)
+	}
+	var bounds map[string]valueBound
+	if err := json.Unmarshal(data, &bounds); err != nil {
+		return nil, fmt.Errorf("parse value bounds %s: %w", path, err)
+	}
+	for metric, b := range bounds {
+		if b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+			return nil, fmt.Errorf("value bounds for %s: min %v is greater than max %v", metric, *b.Min, *b.Max)
+		}
+	}
+	f.bounds = bounds
+	return f, nil
+}
+
+// apply checks value against the bounds for metric. It returns the value to
+// store and false if the record should be dropped. Out-of-range values are
+// counted; NaN and infinities are always dropped.
+func (f *valueFilter) apply(metric string, value float64) (float64, bool) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		metrics.RecordCollectorOutOfRange(metric)
+		return value, false
+	}
+	b, ok := f.bounds[metric]
+	if !ok {
+		return value, true
+	}
+
+	clamped := value
+	if b.Min != nil && value < *b.Min {
+		clamped = *b.Min
+	}
+	if b.Max != nil && value > *b.Max {
+		clamped = *b.Max
+	}
+	if clamped == value {
+		return value, true
+	}
+
+	metrics.RecordCollectorOutOfRange(metric)
+	return clamped, f.clamp
+}
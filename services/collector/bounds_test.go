@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/telemetry/internal/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// outOfRangeCount reads collector_out_of_range_total for a metric
+func outOfRangeCount(t *testing.T, metric string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.CollectorOutOfRange.WithLabelValues(metric).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestValueFilterDefaults(t *testing.T) {
+	t.Setenv("VALUE_BOUNDS_FILE", "")
+	t.Setenv("VALUE_BOUNDS_MODE", "")
+	f, err := loadValueFilter()
+	if err != nil {
+		t.Fatalf("Failed to load filter: %v", err)
+	}
+
+	tests := []struct {
+		metric string
+		value  float64
+		keep   bool
+	}{
+		{"DCGM_FI_DEV_GPU_UTIL", 55, true},
+		{"DCGM_FI_DEV_GPU_UTIL", 100, true},
+		{"DCGM_FI_DEV_GPU_UTIL", -1, false},
+		{"DCGM_FI_DEV_GPU_UTIL", 250, false},
+		{"DCGM_FI_DEV_GPU_TEMP", 80, true},
+		{"DCGM_FI_DEV_GPU_TEMP", 900, false},
+		{"DCGM_FI_DEV_FB_USED", 1e9, true},
+		{"DCGM_FI_DEV_FB_USED", -5, false},
+		{"SOME_UNBOUNDED_METRIC", -1e6, true},
+		{"SOME_UNBOUNDED_METRIC", math.NaN(), false},
+	}
+
+	for _, tt := range tests {
+		before := outOfRangeCount(t, tt.metric)
+		value, keep := f.apply(tt.metric, tt.value)
+		if keep != tt.keep {
+			t.Errorf("%s=%v: expected keep=%v, got %v", tt.metric, tt.value, tt.keep, keep)
+		}
+		if keep && value != tt.value {
+			t.Errorf("%s=%v: expected value to be unchanged, got %v", tt.metric, tt.value, value)
+		}
+		expectedCount := 0.0
+		if !tt.keep {
+			expectedCount = 1
+		}
+		if got := outOfRangeCount(t, tt.metric) - before; got != expectedCount {
+			t.Errorf("%s=%v: expected out-of-range count to grow by %v, got %v", tt.metric, tt.value, expectedCount, got)
+		}
+	}
+}
+
+func TestValueFilterClampFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bounds.json")
+	if err := os.WriteFile(path, []byte(`{"CUSTOM_UTIL": {"min": 0, "max": 1}, "CUSTOM_FLOOR": {"min": 10}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write bounds file: %v", err)
+	}
+	t.Setenv("VALUE_BOUNDS_FILE", path)
+	t.Setenv("VALUE_BOUNDS_MODE", "clamp")
+
+	f, err := loadValueFilter()
+	if err != nil {
+		t.Fatalf("Failed to load filter: %v", err)
+	}
+
+	before := outOfRangeCount(t, "CUSTOM_UTIL")
+	if value, keep := f.apply("CUSTOM_UTIL", 1.7); !keep || value != 1 {
+		t.Errorf("Expected 1.7 to be clamped to 1, got %v (keep=%v)", value, keep)
+	}
+	if value, keep := f.apply("CUSTOM_UTIL", -0.3); !keep || value != 0 {
+		t.Errorf("Expected -0.3 to be clamped to 0, got %v (keep=%v)", value, keep)
+	}
+	if got := outOfRangeCount(t, "CUSTOM_UTIL") - before; got != 2 {
+		t.Errorf("Expected 2 clamped values to be counted, got %v", got)
+	}
+	if value, keep := f.apply("CUSTOM_FLOOR", 1e12); !keep || value != 1e12 {
+		t.Errorf("Expected a value above an open upper bound to pass, got %v (keep=%v)", value, keep)
+	}
+
+	// A file replaces the defaults entirely
+	if value, keep := f.apply("DCGM_FI_DEV_GPU_UTIL", 500); !keep || value != 500 {
+		t.Errorf("Expected metrics missing from the file to be unbounded, got %v (keep=%v)", value, keep)
+	}
+	// Non-finite values cannot be clamped meaningfully
+	if _, keep := f.apply("CUSTOM_UTIL", math.Inf(1)); keep {
+		t.Errorf("Expected +Inf to be dropped even in clamp mode")
+	}
+}
+
+func TestValueFilterInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name string
+		file string
+		mode string
+	}{
+		{"Unknown mode", "", "ignore"},
+		{"Missing file", filepath.Join(dir, "missing.json"), ""},
+		{"Malformed JSON", write("bad.json", `{"X": {"min": `), ""},
+		{"Min above max", write("inverted.json", `{"X": {"min": 5, "max": 1}}`), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VALUE_BOUNDS_FILE", tt.file)
+			t.Setenv("VALUE_BOUNDS_MODE", tt.mode)
+			if _, err := loadValueFilter(); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default dedup cache settings
+const (
+	defaultDedupWindow = 5 * time.Minute
+	defaultDedupMaxIDs = 100000
+)
+
+// seenIDs remembers recently written message IDs so that redeliveries (for
+// example after a crash between the InfluxDB write and the ack) are skipped.
+// Entries expire after window and the oldest are evicted beyond maxIDs, so
+// this narrows duplicates rather than ruling them out.
+type seenIDs struct {
+	window time.Duration
+	maxIDs int
+
+	mu    sync.Mutex
+	ids   map[string]*list.Element
+	order *list.List // oldest first
+}
+
+type seenEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newSeenIDs(window time.Duration, maxIDs int) *seenIDs {
+	return &seenIDs{
+		window: window,
+		maxIDs: maxIDs,
+		ids:    make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// contains reports whether id was added within the window ending at now
+func (s *seenIDs) contains(id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	_, ok := s.ids[id]
+	return ok
+}
+
+// add records id as processed at now
+func (s *seenIDs) add(id string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.ids[id]; ok {
+		elem.Value.(*seenEntry).seen = now
+		s.order.MoveToBack(elem)
+	} else {
+		s.ids[id] = s.order.PushBack(&seenEntry{id: id, seen: now})
+	}
+	s.expire(now)
+	for s.order.Len() > s.maxIDs {
+		s.remove(s.order.Front())
+	}
+}
+
+// len returns the number of IDs currently remembered
+func (s *seenIDs) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// expire drops entries older than the window; callers hold mu
+func (s *seenIDs) expire(now time.Time) {
+	for elem := s.order.Front(); elem != nil; elem = s.order.Front() {
+		if now.Sub(elem.Value.(*seenEntry).seen) < s.window {
+			return
+		}
+		s.remove(elem)
+	}
+}
+
+func (s *seenIDs) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.ids, elem.Value.(*seenEntry).id)
+}
+
+// loadSeenIDs builds the dedup cache from DEDUP_WINDOW_MS and DEDUP_MAX_IDS.
+// A window of 0 disables dedup and returns nil.
+func loadSeenIDs() *seenIDs {
+	window := defaultDedupWindow
+	if msStr := os.Getenv("DEDUP_WINDOW_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			window = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid DEDUP_WINDOW_MS value '%s', using default: %v", msStr, defaultDedupWindow)
+		}
+	}
+	if window == 0 {
+		return nil
+	}
+
+	maxIDs := defaultDedupMaxIDs
+	if maxStr := os.Getenv("DEDUP_MAX_IDS"); maxStr != "" {
+		if n, err := strconv.Atoi(maxStr); err == nil && n > 0 {
+			maxIDs = n
+		} else {
+			log.Printf("Invalid DEDUP_MAX_IDS value '%s', using default: %d", maxStr, defaultDedupMaxIDs)
+		}
+	}
+	return newSeenIDs(window, maxIDs)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/influx"
+	"github.com/example/telemetry/internal/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// duplicatesSkipped reads collector_duplicates_skipped_total for a topic
+func duplicatesSkipped(t *testing.T, topic string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.CollectorDuplicatesSkipped.WithLabelValues(topic).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestSeenIDsWindow(t *testing.T) {
+	s := newSeenIDs(time.Minute, 10)
+	now := time.Now()
+
+	s.add("a", now)
+	if !s.contains("a", now.Add(30*time.Second)) {
+		t.Error("Expected ID to be remembered within the window")
+	}
+	if s.contains("b", now) {
+		t.Error("Expected unknown ID not to be reported as seen")
+	}
+	if s.contains("a", now.Add(time.Minute)) {
+		t.Error("Expected ID to expire after the window")
+	}
+	if s.len() != 0 {
+		t.Errorf("Expected expired entries to be dropped, %d remain", s.len())
+	}
+}
+
+func TestSeenIDsBounded(t *testing.T) {
+	s := newSeenIDs(time.Hour, 2)
+	now := time.Now()
+
+	s.add("a", now)
+	s.add("b", now)
+	s.add("c", now)
+	if s.len() != 2 {
+		t.Errorf("Expected the cache to hold 2 IDs, got %d", s.len())
+	}
+	if s.contains("a", now) {
+		t.Error("Expected the oldest ID to be evicted")
+	}
+	if !s.contains("b", now) || !s.contains("c", now) {
+		t.Error("Expected the newest IDs to be kept")
+	}
+}
+
+func TestLoadSeenIDs(t *testing.T) {
+	t.Setenv("DEDUP_WINDOW_MS", "0")
+	if s := loadSeenIDs(); s != nil {
+		t.Error("Expected a zero window to disable dedup")
+	}
+
+	t.Setenv("DEDUP_WINDOW_MS", "bogus")
+	t.Setenv("DEDUP_MAX_IDS", "50")
+	s := loadSeenIDs()
+	if s == nil || s.window != defaultDedupWindow || s.maxIDs != 50 {
+		t.Errorf("Expected the default window and 50 IDs, got %+v", s)
+	}
+}
+
+func TestDuplicateMessageWrittenOnce(t *testing.T) {
+	var writes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/write" {
+			atomic.AddInt32(&writes, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	writer := influx.NewInfluxWriter(server.URL, "token", "org", "bucket")
+	t.Cleanup(writer.Close)
+
+	cs := &CollectorService{
+		logger: log.New(io.Discard, "", 0),
+		influx: writer,
+		filter: &valueFilter{bounds: defaultValueBounds},
+		seen:   newSeenIDs(time.Minute, 100),
+	}
+	body, _ := json.Marshal([]string{
+		"2025-07-18T20:42:34Z", "DCGM_FI_DEV_GPU_UTIL", "0", "nvidia0", "GPU-1", "H100",
+		"host", "", "", "", "42", "",
+	})
+
+	before := duplicatesSkipped(t, "dedup-test")
+	for i := 0; i < 2; i++ {
+		if err := cs.handleMessage("dedup-test", body, "msg-1"); err != nil {
+			t.Fatalf("Delivery %d failed: %v", i+1, err)
+		}
+	}
+	if err := cs.handleMessage("dedup-test", body, "msg-2"); err != nil {
+		t.Fatalf("Delivery of a new ID failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&writes); got != 2 {
+		t.Errorf("Expected 2 InfluxDB writes (one per ID), got %d", got)
+	}
+	if after := duplicatesSkipped(t, "dedup-test"); after != before+1 {
+		t.Errorf("Expected one skipped duplicate, counter went from %v to %v", before, after)
+	}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/example/telemetry/config"
+	"github.com/example/telemetry/internal/archive"
+	"github.com/example/telemetry/internal/buildinfo"
+	"github.com/example/telemetry/internal/health"
 	"github.com/example/telemetry/internal/influx"
 	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/remotewrite"
 	"github.com/example/telemetry/internal/shared"
 	"github.com/example/telemetry/internal/telemetry"
 )
@@ -22,7 +28,85 @@ type CollectorService struct {
 	queue  shared.MessageQueue
 	logger *log.Logger
 	config config.Config
-	influx *influx.InfluxWriter
+	influx *influx.InfluxWriter // nil unless TELEMETRY_SINKS includes influx
+	filter *valueFilter
+	seen   *seenIDs // nil when dedup is disabled
+	// remoteWrite forwards telemetry to Prometheus; nil unless
+	// TELEMETRY_SINKS includes remote_write
+	remoteWrite *remotewrite.Writer
+	// archive keeps every raw message in object storage alongside the
+	// sinks; nil unless ARCHIVE_S3_BUCKET is set
+	archive *archive.Writer
+
+	// dlqTopic receives records that fail validation; empty disables it
+	dlqTopic string
+	// maxMessageBytes is the largest message body that is decoded
+	maxMessageBytes int
+	// serializer decodes records that aren't CSV rows (MESSAGE_FORMAT); nil
+	// accepts only CSV rows
+	serializer telemetry.Serializer
+
+	// ready is set once InfluxDB is reachable and the consumer is running
+	ready health.Readiness
+
+	// subscribeFailures counts Subscribe failures since a message was last
+	// handled; at subscribeRetry.maxFailures the consumer is reported failing
+	subscribeRetry    subscribeRetry
+	subscribeFailures int32
+
+	// inflight counts messages being handled; once draining is set (under
+	// inflightMu) new messages are refused so shutdown can wait them out
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+	draining   bool
+}
+
+// dependencyRetryInterval is how often readiness retries an unreachable InfluxDB
+const dependencyRetryInterval = 2 * time.Second
+
+// defaultShutdownTimeout bounds how long shutdown waits for in-flight messages
+const defaultShutdownTimeout = 10 * time.Second
+
+// errShuttingDown is returned for messages that arrive after shutdown started,
+// leaving them unacked so they are redelivered
+var errShuttingDown = errors.New("collector is shutting down")
+
+// getShutdownTimeout returns the drain timeout from SHUTDOWN_TIMEOUT_MS or the default
+func getShutdownTimeout() time.Duration {
+	if msStr := os.Getenv("SHUTDOWN_TIMEOUT_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid SHUTDOWN_TIMEOUT_MS value '%s', using default: %v", msStr, defaultShutdownTimeout)
+	}
+	return defaultShutdownTimeout
+}
+
+// waitForDependencies blocks until InfluxDB answers a ping, then marks the
+// service ready. It gives up when ctx is cancelled. Without an InfluxDB sink
+// the service is ready at once.
+func (cs *CollectorService) waitForDependencies(ctx context.Context, retry time.Duration) {
+	if cs.influx == nil {
+		cs.ready.SetReady(true)
+		return
+	}
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := cs.influx.Ping(pingCtx)
+		cancel()
+		if err == nil && ctx.Err() == nil {
+			cs.ready.SetReady(true)
+			cs.logger.Println("InfluxDB reachable, collector is ready")
+			return
+		}
+		cs.logger.Printf("Waiting for InfluxDB: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
 }
 
 func NewCollectorService() *CollectorService {
@@ -40,11 +124,19 @@ func NewCollectorService() *CollectorService {
 
 	if cfg.UseHTTPQueue {
 		// Use HTTP message queue
-		queue, err = shared.NewHTTPMessageQueue(cfg.MsgQueueAddr, cfg.MsgQueueTopic, cfg.MsgQueueGroup, cfg.MsgQueueConsumerName)
+		httpQueue, err := shared.NewHTTPMessageQueue(cfg.MsgQueueAddr, cfg.MsgQueueTopic, cfg.MsgQueueGroup, cfg.MsgQueueConsumerName)
 		if err != nil {
 			logger.Fatalf("Failed to create HTTP message queue: %v", err)
 		}
-		logger.Printf("Using HTTP message queue at %s, topic=%s, group=%s, name=%s", cfg.MsgQueueAddr, cfg.MsgQueueTopic, cfg.MsgQueueGroup, cfg.MsgQueueConsumerName)
+		topics := []string{cfg.MsgQueueTopic}
+		if len(cfg.MsgQueueSubscribeTopics) > 0 {
+			if err := httpQueue.SetTopics(cfg.MsgQueueSubscribeTopics...); err != nil {
+				logger.Fatalf("Invalid MSG_QUEUE_SUBSCRIBE_TOPICS: %v", err)
+			}
+			topics = cfg.MsgQueueSubscribeTopics
+		}
+		queue = httpQueue
+		logger.Printf("Using HTTP message queue at %s, topics=%v, group=%s, name=%s", cfg.MsgQueueAddr, topics, cfg.MsgQueueGroup, cfg.MsgQueueConsumerName)
 	} else {
 		// Use Redis (initial trial version)
 		redisAddr := os.Getenv("REDIS_ADDR")
@@ -71,13 +163,55 @@ func NewCollectorService() *CollectorService {
 		logger.Printf("Using Redis stream queue at %s, stream=%s, group=%s, name=%s", redisAddr, stream, group, name)
 	}
 
-	influxWriter := influx.NewInfluxWriter(cfg.InfluxDBURL, cfg.InfluxDBToken, cfg.InfluxDBOrg, cfg.InfluxDBBucket)
+	filter, err := loadValueFilter()
+	if err != nil {
+		logger.Fatalf("Failed to load value bounds: %v", err)
+	}
+
+	serializer, err := telemetry.NewSerializer(cfg.MessageFormat)
+	if err != nil {
+		logger.Fatalf("Invalid MESSAGE_FORMAT: %v", err)
+	}
+	serializer = telemetry.QueueSerializer(serializer)
+	logger.Printf("Accepting CSV rows and %s records", serializer.Format())
+
+	sinks, err := loadSinkConfig()
+	if err != nil {
+		logger.Fatalf("Invalid sink configuration: %v", err)
+	}
+	var influxWriter *influx.InfluxWriter
+	if sinks.influx {
+		influxWriter = newInfluxWriter(cfg, loadInfluxWriteConfig(), logger)
+	}
+	var remoteWriter *remotewrite.Writer
+	if sinks.remoteWrite {
+		remoteWriter = newRemoteWriter(sinks, logger)
+	}
+	archiveCfg, err := loadArchiveConfig()
+	if err != nil {
+		logger.Fatalf("Invalid archive configuration: %v", err)
+	}
+	var archiveWriter *archive.Writer
+	if archiveCfg.enabled {
+		archiveWriter = newArchiveWriter(archiveCfg, logger)
+	}
 
 	return &CollectorService{
 		queue:  queue,
 		logger: logger,
 		config: cfg,
 		influx: influxWriter,
+		filter: filter,
+		seen:   loadSeenIDs(),
+
+		remoteWrite: remoteWriter,
+		archive:     archiveWriter,
+
+		dlqTopic:        loadDLQTopic(),
+		maxMessageBytes: loadMaxMessageBytes(),
+		serializer:      serializer,
+
+		subscribeRetry: loadSubscribeRetry(),
 	}
 }
 
@@ -87,10 +221,9 @@ func (cs *CollectorService) Start() {
 	// Start HTTP server for health checks
 	port := cs.config.Port
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "OK")
-	})
+	http.HandleFunc("/health", cs.healthHandler)
+	http.HandleFunc("/ready", cs.readyHandler())
+	http.HandleFunc("/version", buildinfo.Handler("collector-service"))
 
 	// Add Prometheus metrics endpoint
 	http.Handle("/metrics", metrics.MetricsHandler())
@@ -102,98 +235,195 @@ func (cs *CollectorService) Start() {
 		}
 	}()
 
-	// Start consuming telemetry messages from message queue
+	// Readiness waits for InfluxDB and is withdrawn if the consumer stops
+	readyCtx, stopReady := context.WithCancel(context.Background())
+	defer stopReady()
+
+	// Start consuming telemetry messages from message queue, restarting
+	// the subscription whenever it fails
 	go func() {
 		cs.logger.Printf("Starting message consumption...")
-		if err := cs.queue.Subscribe(func(topic string, body []byte, id string) error {
-			start := time.Now()
+		cs.superviseSubscribe(readyCtx, cs.subscribeRetry)
+		// The consumer loop has stopped, so stop taking readiness traffic
+		stopReady()
+		cs.ready.SetReady(false)
+	}()
 
-			// Record message consumption
-			metrics.RecordMessageConsumed("collector-service", topic)
+	go cs.waitForDependencies(readyCtx, dependencyRetryInterval)
 
-			if len(body) == 0 {
-				cs.logger.Printf("Skipped empty message body for id %s", id)
-				metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-				return nil
-			}
+	// For demonstration, let's also add a periodic stats reporter
+	//go cs.reportStats()
 
-			// Parse the CSV record array
-			var csvRecord []string
-			if err := json.Unmarshal(body, &csvRecord); err != nil {
-				cs.logger.Printf("Invalid CSV record for id %s: %v. Raw body: %s", id, err, string(body))
-				metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-				return err
-			}
+	// Wait for interrupt signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
 
-			// Validate CSV record has enough fields
-			if len(csvRecord) < 12 {
-				cs.logger.Printf("Invalid CSV record length for id %s: expected 12 fields, got %d", id, len(csvRecord))
-				metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-				return nil
-			}
+	cs.logger.Println("Shutting down collector service...")
+	ctx, cancel := context.WithTimeout(context.Background(), getShutdownTimeout())
+	defer cancel()
+	if err := cs.Shutdown(ctx); err != nil {
+		cs.logger.Printf("Gave up waiting for in-flight messages: %v", err)
+	} else {
+		cs.logger.Println("In-flight messages drained")
+	}
+}
 
-			// Parse value field
-			value, err := strconv.ParseFloat(csvRecord[10], 64)
-			if err != nil {
-				cs.logger.Printf("Failed to parse value field '%s' for id %s: %v", csvRecord[10], id, err)
-				metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-				return nil
-			}
+// consume is the Subscribe handler. Once shutdown has started it refuses new
+// messages so that they stay unacked and are redelivered.
+func (cs *CollectorService) consume(topic string, body []byte, id string) error {
+	if !cs.beginMessage() {
+		return errShuttingDown
+	}
+	defer cs.inflight.Done()
+	cs.consumerRecovered()
+	return cs.handleMessage(topic, body, id)
+}
 
-			// Parse timestamp
-			timestamp, err := time.Parse(time.RFC3339, csvRecord[0])
-			if err != nil {
-				cs.logger.Printf("Failed to parse timestamp '%s' for id %s: %v", csvRecord[0], id, err)
-				metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-				return nil
-			}
+// beginMessage registers a message as in flight, or returns false when draining
+func (cs *CollectorService) beginMessage() bool {
+	cs.inflightMu.Lock()
+	defer cs.inflightMu.Unlock()
+	if cs.draining {
+		return false
+	}
+	cs.inflight.Add(1)
+	return true
+}
 
-			// Convert CSV record to TelemetryRecord
-			data := telemetry.TelemetryRecord{
-				DeviceID:  csvRecord[3],  // device
-				Metric:    csvRecord[1],  // metric_name
-				Value:     value,         // value (parsed)
-				Time:      timestamp,     // timestamp (parsed)
-				GPUID:     csvRecord[2],  // gpu_id
-				UUID:      csvRecord[4],  // uuid
-				ModelName: csvRecord[5],  // modelName
-				Hostname:  csvRecord[6],  // Hostname
-				Container: csvRecord[7],  // container
-				Pod:       csvRecord[8],  // pod
-				Namespace: csvRecord[9],  // namespace
-				LabelsRaw: csvRecord[11], // labels_raw
-			}
+// handleMessage decodes a telemetry message and writes it to the configured sinks
+func (cs *CollectorService) handleMessage(topic string, body []byte, id string) error {
+	start := time.Now()
 
-			cs.logger.Printf("Received telemetry [%s]: device=%s, metric=%s, value=%f", id, data.DeviceID, data.Metric, data.Value)
-
-			// Write to InfluxDB
-			dbStart := time.Now()
-			err = cs.influx.WriteTelemetry(data)
-			if err != nil {
-				cs.logger.Printf("Failed to write to InfluxDB: %v", err)
-				metrics.RecordDatabaseOperation("collector-service", "write", "error", time.Since(dbStart))
-			} else {
-				metrics.RecordDatabaseOperation("collector-service", "write", "success", time.Since(dbStart))
-				metrics.RecordTelemetryDataPoint("collector-service", "gpu_metric")
-			}
+	// Record message consumption
+	metrics.RecordMessageConsumed("collector-service", topic)
+
+	if len(body) == 0 {
+		cs.logger.Printf("Skipped empty message body for id %s", id)
+		metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
+		return nil
+	}
+
+	// Skip redeliveries of messages already written
+	if cs.seen != nil && id != "" && cs.seen.contains(id, time.Now()) {
+		cs.logger.Printf("Skipped duplicate message id %s", id)
+		metrics.RecordCollectorDuplicateSkipped(topic)
+		metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
+		return nil
+	}
 
-			// Record overall message processing time
-			metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
-			return err
-		}); err != nil {
-			cs.logger.Printf("Failed to subscribe to message queue: %v", err)
+	// Archive the message as received, whether or not it turns out valid, so
+	// it can be reprocessed later
+	if cs.archive != nil {
+		if err := cs.archive.Write(archive.Record{ID: id, Topic: topic, ReceivedAt: start.UTC(), Body: body}); err != nil {
+			cs.logger.Printf("Failed to archive message %s: %v", id, err)
 		}
-	}()
+	}
 
-	// For demonstration, let's also add a periodic stats reporter
-	//go cs.reportStats()
+	// Validate the record and convert it to a TelemetryRecord
+	verr := checkSize(body, cs.maxMessageBytes)
+	var data telemetry.TelemetryRecord
+	if verr == nil {
+		data, verr = cs.decodeRecord(body)
+	}
+	if verr != nil {
+		err := cs.reject(topic, id, body, verr)
+		metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
+		return err
+	}
 
-	// Wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	// Drop or clamp values outside the metric's sanity bounds
+	filtered, ok := cs.filter.apply(data.Metric, data.Value)
+	if !ok {
+		cs.logger.Printf("Dropped out-of-range value %v for metric %s (id %s)", data.Value, data.Metric, id)
+		metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
+		return nil
+	}
+	data.Value = filtered
 
-	cs.logger.Println("Shutting down collector service...")
+	// Promote well-known labels such as the driver version into their own tags
+	data.PromoteLabels()
+
+	cs.logger.Printf("Received telemetry [%s]: device=%s, metric=%s, value=%f", id, data.DeviceID, data.Metric, data.Value)
+
+	// Write to InfluxDB and/or Prometheus remote-write
+	dbStart := time.Now()
+	err := cs.write(data)
+	if err != nil {
+		cs.logger.Printf("Failed to write telemetry: %v", err)
+		metrics.RecordDatabaseOperation("collector-service", "write", "error", time.Since(dbStart))
+	} else {
+		metrics.RecordDatabaseOperation("collector-service", "write", "success", time.Since(dbStart))
+		metrics.RecordTelemetryDataPoint("collector-service", "gpu_metric")
+		if cs.seen != nil && id != "" {
+			cs.seen.add(id, time.Now())
+		}
+	}
+
+	// Record overall message processing time
+	metrics.RecordMessageProcessing("collector-service", topic, time.Since(start))
+	return err
+}
+
+// write sends data to each configured sink, stopping at the first failure so
+// the message is redelivered
+func (cs *CollectorService) write(data telemetry.TelemetryRecord) error {
+	if cs.influx != nil {
+		if err := cs.influx.WriteTelemetry(data); err != nil {
+			return fmt.Errorf("influxdb: %w", err)
+		}
+	}
+	if cs.remoteWrite != nil {
+		if err := cs.remoteWrite.WriteTelemetry(data); err != nil {
+			return fmt.Errorf("remote-write: %w", err)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops taking new messages, waits for in-flight writes (and, for
+// queues that support draining, their acks) to finish, flushes buffered
+// InfluxDB points and remote-write samples, uploads the open archive file,
+// then closes the queue.
+// It returns ctx's error if the wait is cut short.
+func (cs *CollectorService) Shutdown(ctx context.Context) error {
+	cs.ready.SetReady(false)
+
+	cs.inflightMu.Lock()
+	cs.draining = true
+	cs.inflightMu.Unlock()
+
+	var err error
+	if drainer, ok := cs.queue.(shared.Drainer); ok {
+		err = drainer.Drain(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	// Send points still buffered by an async writer
+	if cs.influx != nil {
+		cs.influx.Flush()
+	}
+	if cs.remoteWrite != nil {
+		cs.remoteWrite.Close()
+	}
+	if cs.archive != nil {
+		cs.archive.Close()
+	}
+
+	cs.queue.Close()
+	return err
 }
 
 /*func (cs *CollectorService) reportStats() {
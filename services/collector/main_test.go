@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/example/telemetry/internal/influx"
 )
 
 // MockMessageQueue implements basic message queue functionality for testing
@@ -292,3 +301,177 @@ func TestTelemetryDataProcessing(t *testing.T) {
 		}
 	})
 }
+
+func TestCollectorReadiness(t *testing.T) {
+	// Fake InfluxDB that fails its first two pings
+	var pings int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&pings, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	influxWriter := influx.NewInfluxWriter(server.URL, "token", "org", "bucket")
+	defer influxWriter.Close()
+	cs := &CollectorService{logger: log.New(io.Discard, "", 0), influx: influxWriter}
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		cs.ready.Handler()(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 before dependencies are checked, got %d", code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.waitForDependencies(context.Background(), 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForDependencies did not return once InfluxDB was reachable")
+	}
+
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("Expected 200 once InfluxDB is reachable, got %d", code)
+	}
+	if got := atomic.LoadInt32(&pings); got != 3 {
+		t.Errorf("Expected 3 pings, got %d", got)
+	}
+}
+
+func TestCollectorReadinessCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	influxWriter := influx.NewInfluxWriter(server.URL, "token", "org", "bucket")
+	defer influxWriter.Close()
+	cs := &CollectorService{logger: log.New(io.Discard, "", 0), influx: influxWriter}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cs.waitForDependencies(ctx, 10*time.Millisecond)
+
+	if cs.ready.Ready() {
+		t.Error("Expected collector to stay not ready while InfluxDB is unreachable")
+	}
+}
+
+// drainTestQueue hands a single message to the handler and then blocks until closed
+type drainTestQueue struct {
+	body    []byte
+	handled chan error
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (q *drainTestQueue) Publish(topic string, body []byte) error { return nil }
+
+func (q *drainTestQueue) Subscribe(handler func(topic string, body []byte, id string) error) error {
+	q.handled <- handler("telemetry", q.body, "msg-1")
+	<-q.closed
+	return nil
+}
+
+func (q *drainTestQueue) Close() error {
+	q.once.Do(func() { close(q.closed) })
+	return nil
+}
+
+// slowInflux returns a fake InfluxDB whose writes take delay, and a channel
+// that receives once a write has started
+func slowInflux(t *testing.T, delay time.Duration) (*influx.InfluxWriter, <-chan struct{}, *int32) {
+	t.Helper()
+	started := make(chan struct{}, 1)
+	var finished int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/write" {
+			started <- struct{}{}
+			time.Sleep(delay)
+			atomic.StoreInt32(&finished, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	writer := influx.NewInfluxWriter(server.URL, "token", "org", "bucket")
+	t.Cleanup(writer.Close)
+	return writer, started, &finished
+}
+
+func newDrainTestCollector(t *testing.T, writer *influx.InfluxWriter) (*CollectorService, *drainTestQueue) {
+	t.Helper()
+	body, _ := json.Marshal([]string{
+		"2025-07-18T20:42:34Z", "DCGM_FI_DEV_GPU_UTIL", "0", "nvidia0", "GPU-1", "H100",
+		"host", "", "", "", "42", `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+	})
+	queue := &drainTestQueue{body: body, handled: make(chan error, 1), closed: make(chan struct{})}
+	cs := &CollectorService{
+		queue:  queue,
+		logger: log.New(io.Discard, "", 0),
+		influx: writer,
+		filter: &valueFilter{bounds: defaultValueBounds},
+	}
+	return cs, queue
+}
+
+func TestShutdownWaitsForInflightWrite(t *testing.T) {
+	writer, started, finished := slowInflux(t, 300*time.Millisecond)
+	cs, queue := newDrainTestCollector(t, writer)
+
+	go cs.queue.Subscribe(cs.consume)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write never started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cs.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if atomic.LoadInt32(finished) != 1 {
+		t.Error("Shutdown returned before the in-flight write finished")
+	}
+	if err := <-queue.handled; err != nil {
+		t.Errorf("Expected the in-flight message to be handled, got %v", err)
+	}
+	select {
+	case <-queue.closed:
+	default:
+		t.Error("Expected the queue to be closed after draining")
+	}
+
+	// Messages arriving after shutdown are refused so they get redelivered
+	if err := cs.consume("telemetry", queue.body, "msg-2"); !errors.Is(err, errShuttingDown) {
+		t.Errorf("Expected errShuttingDown after shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	writer, started, _ := slowInflux(t, time.Second)
+	cs, _ := newDrainTestCollector(t, writer)
+
+	go cs.queue.Subscribe(cs.consume)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := cs.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v, expected it to give up at the deadline", elapsed)
+	}
+}
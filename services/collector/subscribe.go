@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSubscribeBackoffMin  = 500 * time.Millisecond
+	defaultSubscribeBackoffMax  = 30 * time.Second
+	defaultSubscribeMaxFailures = 5
+)
+
+// subscribeRetry controls how a failed Subscribe is restarted
+type subscribeRetry struct {
+	backoffMin time.Duration
+	backoffMax time.Duration
+	// maxFailures consecutive failures mark the consumer as failing
+	maxFailures int
+}
+
+// loadSubscribeRetry reads SUBSCRIBE_BACKOFF_MIN_MS, SUBSCRIBE_BACKOFF_MAX_MS
+// and SUBSCRIBE_MAX_FAILURES, falling back to the defaults. A maximum below
+// the minimum is raised to it.
+func loadSubscribeRetry() subscribeRetry {
+	retry := subscribeRetry{
+		backoffMin:  defaultSubscribeBackoffMin,
+		backoffMax:  defaultSubscribeBackoffMax,
+		maxFailures: defaultSubscribeMaxFailures,
+	}
+	if msStr := os.Getenv("SUBSCRIBE_BACKOFF_MIN_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			retry.backoffMin = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid SUBSCRIBE_BACKOFF_MIN_MS value '%s', using default: %v", msStr, defaultSubscribeBackoffMin)
+		}
+	}
+	if msStr := os.Getenv("SUBSCRIBE_BACKOFF_MAX_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			retry.backoffMax = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid SUBSCRIBE_BACKOFF_MAX_MS value '%s', using default: %v", msStr, defaultSubscribeBackoffMax)
+		}
+	}
+	if retry.backoffMax < retry.backoffMin {
+		retry.backoffMax = retry.backoffMin
+	}
+	if nStr := os.Getenv("SUBSCRIBE_MAX_FAILURES"); nStr != "" {
+		if n, err := strconv.Atoi(nStr); err == nil && n > 0 {
+			retry.maxFailures = n
+		} else {
+			log.Printf("Invalid SUBSCRIBE_MAX_FAILURES value '%s', using default: %d", nStr, defaultSubscribeMaxFailures)
+		}
+	}
+	return retry
+}
+
+// superviseSubscribe runs Subscribe and restarts it with exponential backoff
+// each time it fails, until ctx is cancelled, shutdown starts or Subscribe
+// returns without an error (the queue was closed). After retry.maxFailures
+// failures in a row the consumer is reported as failing, which takes the
+// collector out of /ready and /health until a message is handled again.
+func (cs *CollectorService) superviseSubscribe(ctx context.Context, retry subscribeRetry) {
+	backoff := retry.backoffMin
+	for {
+		err := cs.queue.Subscribe(cs.consume)
+		if err == nil || ctx.Err() != nil || cs.isDraining() {
+			return
+		}
+
+		// A handled message since the last failure means the consumer had recovered
+		if atomic.LoadInt32(&cs.subscribeFailures) == 0 {
+			backoff = retry.backoffMin
+		}
+		failures := atomic.AddInt32(&cs.subscribeFailures, 1)
+		cs.logger.Printf("Subscribe failed (%d in a row), retrying in %v: %v", failures, backoff, err)
+		if int(failures) == retry.maxFailures {
+			cs.logger.Printf("Consumer has failed %d times in a row, reporting unhealthy", failures)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > retry.backoffMax {
+			backoff = retry.backoffMax
+		}
+	}
+}
+
+// consumerFailing reports whether Subscribe has failed maxFailures times in a
+// row without a message being handled in between
+func (cs *CollectorService) consumerFailing() bool {
+	return cs.subscribeRetry.maxFailures > 0 && int(atomic.LoadInt32(&cs.subscribeFailures)) >= cs.subscribeRetry.maxFailures
+}
+
+// consumerRecovered clears the failure count once a message gets through
+func (cs *CollectorService) consumerRecovered() {
+	if atomic.SwapInt32(&cs.subscribeFailures, 0) != 0 {
+		cs.logger.Println("Consumer recovered")
+	}
+}
+
+// isDraining reports whether shutdown has started
+func (cs *CollectorService) isDraining() bool {
+	cs.inflightMu.Lock()
+	defer cs.inflightMu.Unlock()
+	return cs.draining
+}
+
+// healthHandler serves /health: 200 unless the consumer keeps failing
+func (cs *CollectorService) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if cs.consumerFailing() {
+		http.Error(w, "consumer failing", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// readyHandler serves /ready: ready once InfluxDB is reachable, and not while
+// the consumer keeps failing
+func (cs *CollectorService) readyHandler() http.HandlerFunc {
+	influxReady := cs.ready.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.consumerFailing() {
+			http.Error(w, "consumer failing", http.StatusServiceUnavailable)
+			return
+		}
+		influxReady(w, r)
+	}
+}
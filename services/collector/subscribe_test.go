@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyQueue fails Subscribe a number of times, then waits for release and
+// delivers one message, holding the subscription open until closed
+type flakyQueue struct {
+	failures int32
+	release  chan struct{}
+	handled  chan error
+	closed   chan struct{}
+	once     sync.Once
+
+	calls int32
+}
+
+func (q *flakyQueue) Publish(topic string, body []byte) error {
+	return nil
+}
+
+func (q *flakyQueue) Subscribe(handler func(topic string, body []byte, id string) error) error {
+	if atomic.AddInt32(&q.calls, 1) <= q.failures {
+		return errors.New("broker unavailable")
+	}
+	select {
+	case <-q.release:
+	case <-q.closed:
+		return nil
+	}
+	q.handled <- handler("telemetry", nil, "msg-1")
+	<-q.closed
+	return nil
+}
+
+func (q *flakyQueue) Close() error {
+	q.once.Do(func() { close(q.closed) })
+	return nil
+}
+
+func TestSubscribeRestartsAfterFailures(t *testing.T) {
+	queue := &flakyQueue{
+		failures: 4,
+		release:  make(chan struct{}),
+		handled:  make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	retry := subscribeRetry{backoffMin: time.Millisecond, backoffMax: 5 * time.Millisecond, maxFailures: 3}
+	cs := &CollectorService{
+		queue:          queue,
+		logger:         log.New(io.Discard, "", 0),
+		filter:         &valueFilter{bounds: defaultValueBounds},
+		subscribeRetry: retry,
+	}
+	cs.ready.SetReady(true)
+
+	status := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.superviseSubscribe(context.Background(), retry)
+		close(done)
+	}()
+
+	// Repeated failures take the collector out of rotation
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&queue.calls) <= queue.failures && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !cs.consumerFailing() {
+		t.Fatal("Expected the consumer to be reported failing after repeated Subscribe errors")
+	}
+	if code := status(cs.readyHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /ready to return 503 while failing, got %d", code)
+	}
+	if code := status(cs.healthHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /health to return 503 while failing, got %d", code)
+	}
+
+	// The next subscription works and the collector resumes consuming
+	close(queue.release)
+	select {
+	case err := <-queue.handled:
+		if err != nil {
+			t.Errorf("Expected the message to be handled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Collector never resumed consuming")
+	}
+	if cs.consumerFailing() {
+		t.Error("Expected the consumer to recover once a message was handled")
+	}
+	if code := status(cs.readyHandler()); code != http.StatusOK {
+		t.Errorf("Expected /ready to return 200 after recovering, got %d", code)
+	}
+	if code := status(cs.healthHandler); code != http.StatusOK {
+		t.Errorf("Expected /health to return 200 after recovering, got %d", code)
+	}
+
+	// Closing the queue ends the subscription without a restart
+	queue.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("superviseSubscribe did not return after the queue was closed")
+	}
+	if calls := atomic.LoadInt32(&queue.calls); calls != queue.failures+1 {
+		t.Errorf("Expected %d Subscribe calls, got %d", queue.failures+1, calls)
+	}
+}
+
+func TestLoadSubscribeRetry(t *testing.T) {
+	t.Setenv("SUBSCRIBE_BACKOFF_MIN_MS", "")
+	t.Setenv("SUBSCRIBE_BACKOFF_MAX_MS", "")
+	t.Setenv("SUBSCRIBE_MAX_FAILURES", "")
+	retry := loadSubscribeRetry()
+	if retry.backoffMin != defaultSubscribeBackoffMin || retry.backoffMax != defaultSubscribeBackoffMax ||
+		retry.maxFailures != defaultSubscribeMaxFailures {
+		t.Errorf("Expected defaults, got %+v", retry)
+	}
+
+	t.Setenv("SUBSCRIBE_BACKOFF_MIN_MS", "2000")
+	t.Setenv("SUBSCRIBE_BACKOFF_MAX_MS", "1000")
+	t.Setenv("SUBSCRIBE_MAX_FAILURES", "zero")
+	retry = loadSubscribeRetry()
+	if retry.backoffMin != 2*time.Second || retry.backoffMax != 2*time.Second {
+		t.Errorf("Expected the maximum raised to the 2s minimum, got %+v", retry)
+	}
+	if retry.maxFailures != defaultSubscribeMaxFailures {
+		t.Errorf("Expected an invalid failure count to use the default, got %d", retry.maxFailures)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/telemetry"
+)
+
+// csvFieldCount is the number of fields in a streamed DCGM CSV row
+const csvFieldCount = 12
+
+// defaultMaxMessageBytes caps the size of a message the collector decodes. A
+// streamed CSV row is a few hundred bytes, so this leaves plenty of headroom.
+const defaultMaxMessageBytes = 64 * 1024
+
+// deadLetterPreviewBytes is how much of an oversized message its dead letter keeps
+const deadLetterPreviewBytes = 1024
+
+// Reasons a telemetry record fails validation, used as the reason label of
+// collector_validation_failures_total
+const (
+	reasonOversized        = "oversized"         // body is larger than MAX_MESSAGE_BYTES
+	reasonMalformed        = "malformed"         // body is not a JSON array of strings or a MESSAGE_FORMAT record
+	reasonFieldCount       = "field_count"       // fewer than csvFieldCount fields
+	reasonInvalidTimestamp = "invalid_timestamp" // timestamp is not RFC3339
+	reasonInvalidValue     = "invalid_value"     // value is not a number
+	reasonMissingMetric    = "missing_metric"    // metric name is empty
+	reasonMissingUUID      = "missing_uuid"      // GPU UUID is empty
+)
+
+// validationError is a record rejected before it reaches InfluxDB
+type validationError struct {
+	reason string
+	detail string
+}
+
+func (e *validationError) Error() string {
+	return e.reason + ": " + e.detail
+}
+
+func invalid(reason, format string, args ...interface{}) *validationError {
+	return &validationError{reason: reason, detail: fmt.Sprintf(format, args...)}
+}
+
+// loadMaxMessageBytes returns MAX_MESSAGE_BYTES or the default; 0 turns the
+// limit off
+func loadMaxMessageBytes() int {
+	if sizeStr := os.Getenv("MAX_MESSAGE_BYTES"); sizeStr != "" {
+		if n, err := strconv.Atoi(sizeStr); err == nil && n >= 0 {
+			return n
+		}
+		log.Printf("Invalid MAX_MESSAGE_BYTES value '%s', using default: %d", sizeStr, defaultMaxMessageBytes)
+	}
+	return defaultMaxMessageBytes
+}
+
+// checkSize rejects a body larger than maxBytes, when set, before it is
+// decoded. The body is already in memory, but decoding it would allocate
+// several times its size again, so a huge message from a misbehaving producer
+// is turned away here rather than risking the collector's memory.
+func checkSize(body []byte, maxBytes int) *validationError {
+	if maxBytes > 0 && len(body) > maxBytes {
+		return invalid(reasonOversized, "message is %d bytes, limit is %d", len(body), maxBytes)
+	}
+	return nil
+}
+
+// parseRecord checks the shape of a CSV telemetry message and maps its
+// fields to a TelemetryRecord. The fields are positional, so a format change
+// on the streamer side shows up here as a typed or empty field in the wrong
+// place rather than as a tag silently holding the wrong value.
+func parseRecord(body []byte) (telemetry.TelemetryRecord, *validationError) {
+	var fields []string
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return telemetry.TelemetryRecord{}, invalid(reasonMalformed, "%v", err)
+	}
+	if len(fields) < csvFieldCount {
+		return telemetry.TelemetryRecord{}, invalid(reasonFieldCount, "expected %d fields, got %d", csvFieldCount, len(fields))
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, strings.TrimSpace(fields[0]))
+	if err != nil {
+		return telemetry.TelemetryRecord{}, invalid(reasonInvalidTimestamp, "timestamp %q: %v", fields[0], err)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(fields[10]), 64)
+	if err != nil {
+		return telemetry.TelemetryRecord{}, invalid(reasonInvalidValue, "value %q is not a number", fields[10])
+	}
+	if strings.TrimSpace(fields[1]) == "" {
+		return telemetry.TelemetryRecord{}, invalid(reasonMissingMetric, "metric name is empty")
+	}
+	if strings.TrimSpace(fields[4]) == "" {
+		return telemetry.TelemetryRecord{}, invalid(reasonMissingUUID, "uuid is empty")
+	}
+
+	return telemetry.TelemetryRecord{
+		DeviceID:  fields[3],  // device
+		Metric:    fields[1],  // metric_name
+		Value:     value,      // value (parsed)
+		Time:      timestamp,  // timestamp (parsed)
+		GPUID:     fields[2],  // gpu_id
+		UUID:      fields[4],  // uuid
+		ModelName: fields[5],  // modelName
+		Hostname:  fields[6],  // Hostname
+		Container: fields[7],  // container
+		Pod:       fields[8],  // pod
+		Namespace: fields[9],  // namespace
+		LabelsRaw: fields[11], // labels_raw
+	}, nil
+}
+
+// decodeRecord decodes a message body into a TelemetryRecord. CSV rows, which
+// streamers send with the default MESSAGE_FORMAT, are always accepted, so the
+// collector can be switched to a binary format before its producers are;
+// anything else is decoded with the configured serializer.
+func (cs *CollectorService) decodeRecord(body []byte) (telemetry.TelemetryRecord, *validationError) {
+	if cs.serializer == nil || isCSVRow(body, cs.serializer.Format()) {
+		return parseRecord(body)
+	}
+	var record telemetry.TelemetryRecord
+	if err := cs.serializer.Unmarshal(body, &record); err != nil {
+		return telemetry.TelemetryRecord{}, invalid(reasonMalformed, "%s record: %v", cs.serializer.Format(), err)
+	}
+	return record, checkRecord(record)
+}
+
+// isCSVRow reports whether body is a streamed CSV row rather than a record in
+// format. A JSON record is an object; a protobuf record is sent base64-encoded,
+// and '[' is not in the base64 alphabet.
+func isCSVRow(body []byte, format string) bool {
+	if format == telemetry.FormatJSON {
+		trimmed := bytes.TrimLeft(body, " \t\r\n")
+		return len(trimmed) == 0 || trimmed[0] != '{'
+	}
+	return len(body) > 0 && body[0] == '['
+}
+
+// checkRecord applies parseRecord's checks to a record decoded whole
+func checkRecord(record telemetry.TelemetryRecord) *validationError {
+	if record.Time.IsZero() {
+		return invalid(reasonInvalidTimestamp, "timestamp is missing")
+	}
+	if strings.TrimSpace(record.Metric) == "" {
+		return invalid(reasonMissingMetric, "metric name is empty")
+	}
+	if strings.TrimSpace(record.UUID) == "" {
+		return invalid(reasonMissingUUID, "uuid is empty")
+	}
+	return nil
+}
+
+// deadLetter is published to DLQ_TOPIC for every rejected record
+type deadLetter struct {
+	ID         string    `json:"id"`
+	Topic      string    `json:"topic"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error"`
+	Body       string    `json:"body"`
+	Truncated  bool      `json:"truncated,omitempty"` // Body holds only the start of an oversized message
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+// loadDLQTopic returns DLQ_TOPIC; empty means rejected records are only
+// logged and counted
+func loadDLQTopic() string {
+	return strings.TrimSpace(os.Getenv("DLQ_TOPIC"))
+}
+
+// reject counts a record that failed validation and sends it to the DLQ
+// topic if one is set. A failed DLQ publish is returned so the message is
+// redelivered instead of being lost.
+func (cs *CollectorService) reject(topic, id string, body []byte, verr *validationError) error {
+	cs.logger.Printf("Rejected record for id %s (%s): %s", id, verr.reason, verr.detail)
+	metrics.RecordCollectorValidationFailure(verr.reason)
+	if cs.dlqTopic == "" {
+		return nil
+	}
+
+	// Don't republish an oversized message whole
+	truncated := verr.reason == reasonOversized && len(body) > deadLetterPreviewBytes
+	if truncated {
+		body = body[:deadLetterPreviewBytes]
+	}
+	letter := deadLetter{
+		ID:         id,
+		Topic:      topic,
+		Reason:     verr.reason,
+		Error:      verr.detail,
+		Body:       string(body),
+		Truncated:  truncated,
+		RejectedAt: time.Now().UTC(),
+	}
+	payload, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("encode dead letter: %w", err)
+	}
+	if err := cs.queue.Publish(cs.dlqTopic, payload); err != nil {
+		cs.logger.Printf("Failed to publish rejected record %s to %s: %v", id, cs.dlqTopic, err)
+		return fmt.Errorf("publish to dlq: %w", err)
+	}
+	return nil
+}
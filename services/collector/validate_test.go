@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/telemetry"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// validationFailures reads collector_validation_failures_total for a reason
+func validationFailures(t *testing.T, reason string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.CollectorValidationFailures.WithLabelValues(reason).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// validRow returns a well-formed streamed CSV row
+func validRow() []string {
+	return []string{
+		"2025-07-18T20:42:34Z", "DCGM_FI_DEV_GPU_UTIL", "0", "nvidia0", "GPU-5fd4f087", "NVIDIA H100",
+		"host-1", "", "", "", "42", `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+	}
+}
+
+// dlqQueue records what the collector publishes to the DLQ
+type dlqQueue struct {
+	err       error
+	published map[string][][]byte
+}
+
+func (q *dlqQueue) Publish(topic string, body []byte) error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.published == nil {
+		q.published = make(map[string][][]byte)
+	}
+	q.published[topic] = append(q.published[topic], body)
+	return nil
+}
+
+func (q *dlqQueue) Subscribe(handler func(topic string, body []byte, id string) error) error {
+	return nil
+}
+
+func (q *dlqQueue) Close() error {
+	return nil
+}
+
+func TestParseRecord(t *testing.T) {
+	record, verr := parseRecord(mustJSON(t, validRow()))
+	if verr != nil {
+		t.Fatalf("Expected a valid row to parse, got %v", verr)
+	}
+	if record.Metric != "DCGM_FI_DEV_GPU_UTIL" || record.DeviceID != "nvidia0" || record.UUID != "GPU-5fd4f087" ||
+		record.Hostname != "host-1" || record.Value != 42 {
+		t.Errorf("Expected fields mapped by position, got %+v", record)
+	}
+
+	// swap exchanges two fields of a valid row
+	swap := func(i, j int) []string {
+		row := validRow()
+		row[i], row[j] = row[j], row[i]
+		return row
+	}
+	// set replaces one field of a valid row
+	set := func(i int, v string) []string {
+		row := validRow()
+		row[i] = v
+		return row
+	}
+
+	tests := []struct {
+		name   string
+		body   []byte
+		reason string
+	}{
+		{"Not an array", []byte(`{"metric":"DCGM_FI_DEV_GPU_UTIL"}`), reasonMalformed},
+		{"Numbers instead of strings", []byte(`[1, 2, 3]`), reasonMalformed},
+		{"Missing trailing fields", mustJSON(t, validRow()[:11]), reasonFieldCount},
+		{"Timestamp and metric swapped", mustJSON(t, swap(0, 1)), reasonInvalidTimestamp},
+		{"Non-RFC3339 timestamp", mustJSON(t, set(0, "2025-07-18 20:42:34")), reasonInvalidTimestamp},
+		{"Value and labels swapped", mustJSON(t, swap(10, 11)), reasonInvalidValue},
+		{"Hostname in the value field", mustJSON(t, swap(6, 10)), reasonInvalidValue},
+		{"Empty value", mustJSON(t, set(10, "")), reasonInvalidValue},
+		{"Empty metric", mustJSON(t, set(1, " ")), reasonMissingMetric},
+		{"UUID and container swapped", mustJSON(t, swap(4, 7)), reasonMissingUUID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, verr := parseRecord(tt.body)
+			if verr == nil {
+				t.Fatalf("Expected the record to be rejected with %s", tt.reason)
+			}
+			if verr.reason != tt.reason {
+				t.Errorf("Expected reason %s, got %s (%s)", tt.reason, verr.reason, verr.detail)
+			}
+		})
+	}
+}
+
+func TestDecodeRecordFormats(t *testing.T) {
+	record := telemetry.TelemetryRecord{
+		DeviceID: "nvidia0", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 42,
+		Time:  time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC),
+		GPUID: "0", UUID: "GPU-5fd4f087", ModelName: "NVIDIA H100", Hostname: "host-1",
+		LabelsRaw: `DCGM_FI_DRIVER_VERSION="535.129.03"`,
+	}
+	encode := func(s telemetry.Serializer, r telemetry.TelemetryRecord) []byte {
+		b, err := s.Marshal(r)
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		return b
+	}
+	noUUID := record
+	noUUID.UUID = ""
+
+	for _, s := range []telemetry.Serializer{telemetry.JSONSerializer{}, telemetry.QueueSerializer(telemetry.ProtobufSerializer{})} {
+		cs := &CollectorService{serializer: s}
+		t.Run(s.Format(), func(t *testing.T) {
+			got, verr := cs.decodeRecord(encode(s, record))
+			if verr != nil {
+				t.Fatalf("Expected the record to decode, got %v", verr)
+			}
+			if got != record {
+				t.Errorf("Expected the record back:\n got %+v\nwant %+v", got, record)
+			}
+
+			// CSV rows are still accepted
+			row, verr := cs.decodeRecord(mustJSON(t, validRow()))
+			if verr != nil || row.UUID != "GPU-5fd4f087" {
+				t.Errorf("Expected a CSV row to decode, got %+v (%v)", row, verr)
+			}
+
+			// Decoded records get the same checks as CSV rows
+			if _, verr := cs.decodeRecord(encode(s, noUUID)); verr == nil || verr.reason != reasonMissingUUID {
+				t.Errorf("Expected a record without a UUID to be rejected, got %v", verr)
+			}
+			if _, verr := cs.decodeRecord(encode(s, telemetry.TelemetryRecord{Metric: "m", UUID: "GPU-1"})); verr == nil || verr.reason != reasonInvalidTimestamp {
+				t.Errorf("Expected a record without a time to be rejected, got %v", verr)
+			}
+		})
+	}
+
+	cs := &CollectorService{serializer: telemetry.QueueSerializer(telemetry.ProtobufSerializer{})}
+	if _, verr := cs.decodeRecord([]byte(`{"uuid":"GPU-1"}`)); verr == nil || verr.reason != reasonMalformed {
+		t.Errorf("Expected JSON to be malformed with the protobuf format, got %v", verr)
+	}
+}
+
+func TestRejectedRecordsSentToDLQ(t *testing.T) {
+	queue := &dlqQueue{}
+	cs := &CollectorService{
+		queue:    queue,
+		logger:   log.New(io.Discard, "", 0),
+		filter:   &valueFilter{bounds: defaultValueBounds},
+		dlqTopic: "telemetry-dlq",
+	}
+	row := validRow()
+	row[10], row[11] = row[11], row[10]
+	body := mustJSON(t, row)
+
+	before := validationFailures(t, reasonInvalidValue)
+	// Rejected records are acked rather than retried; no InfluxDB write is attempted
+	if err := cs.handleMessage("telemetry", body, "msg-1"); err != nil {
+		t.Fatalf("Expected the rejected record to be acked, got %v", err)
+	}
+	if after := validationFailures(t, reasonInvalidValue); after != before+1 {
+		t.Errorf("Expected one invalid_value failure, counter went from %v to %v", before, after)
+	}
+
+	letters := queue.published["telemetry-dlq"]
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(letters[0], &letter); err != nil {
+		t.Fatalf("Failed to decode dead letter: %v", err)
+	}
+	if letter.ID != "msg-1" || letter.Topic != "telemetry" || letter.Reason != reasonInvalidValue || letter.Body != string(body) {
+		t.Errorf("Expected the dead letter to carry the record and reason, got %+v", letter)
+	}
+
+	// A failed DLQ publish leaves the message unacked so it is redelivered
+	queue.err = errors.New("queue down")
+	if err := cs.handleMessage("telemetry", body, "msg-2"); err == nil {
+		t.Error("Expected an error when the dead letter can't be published")
+	}
+
+	// Without a DLQ topic rejected records are only counted
+	cs.dlqTopic = ""
+	queue.err = nil
+	before = validationFailures(t, reasonMalformed)
+	if err := cs.handleMessage("telemetry", []byte("not json"), "msg-3"); err != nil {
+		t.Fatalf("Expected the rejected record to be acked, got %v", err)
+	}
+	if after := validationFailures(t, reasonMalformed); after != before+1 {
+		t.Errorf("Expected one malformed failure, counter went from %v to %v", before, after)
+	}
+	if len(queue.published["telemetry-dlq"]) != 1 {
+		t.Error("Expected nothing more published without a DLQ topic")
+	}
+}
+
+func TestOversizedMessageRejected(t *testing.T) {
+	queue := &dlqQueue{}
+	cs := &CollectorService{
+		queue:           queue,
+		logger:          log.New(io.Discard, "", 0),
+		filter:          &valueFilter{bounds: defaultValueBounds},
+		dlqTopic:        "telemetry-dlq",
+		maxMessageBytes: 1024,
+	}
+
+	// A 16 MiB array of strings would take far more than its size to decode
+	body := []byte("[" + strings.Repeat(`"GPU-5fd4f087",`, 16<<20/15) + `"x"]`)
+	before := validationFailures(t, reasonOversized)
+	var start, end runtime.MemStats
+	runtime.ReadMemStats(&start)
+	if err := cs.handleMessage("telemetry", body, "msg-huge"); err != nil {
+		t.Fatalf("Expected the oversized message to be acked, got %v", err)
+	}
+	runtime.ReadMemStats(&end)
+	if allocated := end.TotalAlloc - start.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Expected the message to be rejected without decoding it, %d bytes were allocated", allocated)
+	}
+	if after := validationFailures(t, reasonOversized); after != before+1 {
+		t.Errorf("Expected one oversized failure, counter went from %v to %v", before, after)
+	}
+
+	letters := queue.published["telemetry-dlq"]
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(letters[0], &letter); err != nil {
+		t.Fatalf("Failed to decode dead letter: %v", err)
+	}
+	if letter.Reason != reasonOversized || !letter.Truncated || letter.Body != string(body[:deadLetterPreviewBytes]) {
+		t.Errorf("Expected a truncated oversized dead letter, got reason %s, truncated %v and a %d byte body",
+			letter.Reason, letter.Truncated, len(letter.Body))
+	}
+
+	// A message exactly at the limit is still decoded
+	row := mustJSON(t, validRow())
+	cs.maxMessageBytes = len(row)
+	if verr := checkSize(row, cs.maxMessageBytes); verr != nil {
+		t.Errorf("Expected a message at the limit to pass, got %v", verr)
+	}
+	if verr := checkSize(append(row, ' '), cs.maxMessageBytes); verr == nil || verr.reason != reasonOversized {
+		t.Errorf("Expected a message over the limit to be oversized, got %v", verr)
+	}
+	if verr := checkSize(body, 0); verr != nil {
+		t.Errorf("Expected a limit of 0 to accept any size, got %v", verr)
+	}
+}
+
+func TestLoadMaxMessageBytes(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"", defaultMaxMessageBytes},
+		{"4096", 4096},
+		{"0", 0},
+		{"-1", defaultMaxMessageBytes},
+		{"big", defaultMaxMessageBytes},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_MESSAGE_BYTES", tt.value)
+		if got := loadMaxMessageBytes(); got != tt.expected {
+			t.Errorf("MAX_MESSAGE_BYTES=%q: expected %d, got %d", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestLoadDLQTopic(t *testing.T) {
+	t.Setenv("DLQ_TOPIC", "")
+	if got := loadDLQTopic(); got != "" {
+		t.Errorf("Expected no DLQ topic by default, got %q", got)
+	}
+	t.Setenv("DLQ_TOPIC", " telemetry-dlq ")
+	if got := loadDLQTopic(); got != "telemetry-dlq" {
+		t.Errorf("Expected telemetry-dlq, got %q", got)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/telemetry/config"
+	"github.com/example/telemetry/internal/influx"
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/remotewrite"
+)
+
+const (
+	writeModeBlocking = "blocking"
+	writeModeAsync    = "async"
+
+	defaultInfluxBatchSize     = 500
+	defaultInfluxFlushInterval = time.Second
+)
+
+// influxWriteConfig selects how the collector writes to InfluxDB
+type influxWriteConfig struct {
+	mode          string
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// loadInfluxWriteConfig reads INFLUX_WRITE_MODE (blocking or async),
+// INFLUX_BATCH_SIZE and INFLUX_FLUSH_INTERVAL_MS, falling back to the
+// defaults. The batch settings only apply in async mode.
+func loadInfluxWriteConfig() influxWriteConfig {
+	wc := influxWriteConfig{
+		mode:          writeModeBlocking,
+		batchSize:     defaultInfluxBatchSize,
+		flushInterval: defaultInfluxFlushInterval,
+	}
+	if mode := strings.ToLower(strings.TrimSpace(os.Getenv("INFLUX_WRITE_MODE"))); mode != "" {
+		if mode == writeModeBlocking || mode == writeModeAsync {
+			wc.mode = mode
+		} else {
+			log.Printf("Invalid INFLUX_WRITE_MODE value '%s', using default: %s", mode, writeModeBlocking)
+		}
+	}
+	if nStr := os.Getenv("INFLUX_BATCH_SIZE"); nStr != "" {
+		if n, err := strconv.Atoi(nStr); err == nil && n > 0 {
+			wc.batchSize = n
+		} else {
+			log.Printf("Invalid INFLUX_BATCH_SIZE value '%s', using default: %d", nStr, defaultInfluxBatchSize)
+		}
+	}
+	if msStr := os.Getenv("INFLUX_FLUSH_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			wc.flushInterval = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid INFLUX_FLUSH_INTERVAL_MS value '%s', using default: %v", msStr, defaultInfluxFlushInterval)
+		}
+	}
+	return wc
+}
+
+// newInfluxWriter builds the writer for wc. In async mode a message is acked
+// once its point is buffered, so a batch that later fails is logged and
+// counted but not redelivered.
+func newInfluxWriter(cfg config.Config, wc influxWriteConfig, logger *log.Logger) *influx.InfluxWriter {
+	if wc.mode != writeModeAsync {
+		return influx.NewInfluxWriter(cfg.InfluxDBURL, cfg.InfluxDBToken, cfg.InfluxDBOrg, cfg.InfluxDBBucket)
+	}
+	logger.Printf("Writing to InfluxDB asynchronously: batch_size=%d, flush_interval=%v", wc.batchSize, wc.flushInterval)
+	return influx.NewAsyncInfluxWriter(cfg.InfluxDBURL, cfg.InfluxDBToken, cfg.InfluxDBOrg, cfg.InfluxDBBucket, influx.AsyncOptions{
+		BatchSize:     uint(wc.batchSize),
+		FlushInterval: wc.flushInterval,
+		OnError: func(err error) {
+			logger.Printf("Async InfluxDB batch write failed: %v", err)
+			metrics.DatabaseOperations.WithLabelValues("collector-service", "batch_write", "error").Inc()
+		},
+	})
+}
+
+// Sinks the collector can write telemetry to, selected with TELEMETRY_SINKS
+const (
+	sinkInflux      = "influx"
+	sinkRemoteWrite = "remote_write"
+
+	defaultRemoteWriteBatchSize     = 500
+	defaultRemoteWriteFlushInterval = time.Second
+	defaultRemoteWriteMaxRetries    = 3
+)
+
+// sinkConfig selects where the collector writes telemetry
+type sinkConfig struct {
+	influx      bool
+	remoteWrite bool
+
+	remoteWriteURL           string
+	remoteWriteBatchSize     int
+	remoteWriteFlushInterval time.Duration
+	remoteWriteMaxRetries    int
+}
+
+// loadSinkConfig reads TELEMETRY_SINKS, a comma-separated list of influx and
+// remote_write (default: influx), and the REMOTE_WRITE_* settings. Unlike
+// the tuning settings, which fall back to their defaults, an unknown sink or
+// remote_write without REMOTE_WRITE_URL is an error.
+func loadSinkConfig() (sinkConfig, error) {
+	sc := sinkConfig{
+		remoteWriteURL:           strings.TrimSpace(os.Getenv("REMOTE_WRITE_URL")),
+		remoteWriteBatchSize:     defaultRemoteWriteBatchSize,
+		remoteWriteFlushInterval: defaultRemoteWriteFlushInterval,
+		remoteWriteMaxRetries:    defaultRemoteWriteMaxRetries,
+	}
+	sinks := os.Getenv("TELEMETRY_SINKS")
+	if strings.TrimSpace(sinks) == "" {
+		sinks = sinkInflux
+	}
+	for _, sink := range strings.Split(sinks, ",") {
+		switch strings.ToLower(strings.TrimSpace(sink)) {
+		case sinkInflux:
+			sc.influx = true
+		case sinkRemoteWrite:
+			sc.remoteWrite = true
+		case "":
+		default:
+			return sc, fmt.Errorf("unknown sink %q in TELEMETRY_SINKS, expected %s or %s", sink, sinkInflux, sinkRemoteWrite)
+		}
+	}
+	if !sc.influx && !sc.remoteWrite {
+		return sc, fmt.Errorf("TELEMETRY_SINKS selects no sink")
+	}
+	if sc.remoteWrite && sc.remoteWriteURL == "" {
+		return sc, fmt.Errorf("TELEMETRY_SINKS includes %s but REMOTE_WRITE_URL is not set", sinkRemoteWrite)
+	}
+
+	if nStr := os.Getenv("REMOTE_WRITE_BATCH_SIZE"); nStr != "" {
+		if n, err := strconv.Atoi(nStr); err == nil && n > 0 {
+			sc.remoteWriteBatchSize = n
+		} else {
+			log.Printf("Invalid REMOTE_WRITE_BATCH_SIZE value '%s', using default: %d", nStr, defaultRemoteWriteBatchSize)
+		}
+	}
+	if msStr := os.Getenv("REMOTE_WRITE_FLUSH_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			sc.remoteWriteFlushInterval = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid REMOTE_WRITE_FLUSH_INTERVAL_MS value '%s', using default: %v", msStr, defaultRemoteWriteFlushInterval)
+		}
+	}
+	if nStr := os.Getenv("REMOTE_WRITE_MAX_RETRIES"); nStr != "" {
+		if n, err := strconv.Atoi(nStr); err == nil && n >= 0 {
+			sc.remoteWriteMaxRetries = n
+		} else {
+			log.Printf("Invalid REMOTE_WRITE_MAX_RETRIES value '%s', using default: %d", nStr, defaultRemoteWriteMaxRetries)
+		}
+	}
+	return sc, nil
+}
+
+// newRemoteWriter builds the Prometheus remote-write sink for sc. Like async
+// InfluxDB writes, a message is acked once its sample is buffered, so a
+// batch that fails after its retries is logged and counted but not
+// redelivered.
+func newRemoteWriter(sc sinkConfig, logger *log.Logger) *remotewrite.Writer {
+	logger.Printf("Writing to Prometheus remote-write at %s: batch_size=%d, flush_interval=%v, max_retries=%d",
+		sc.remoteWriteURL, sc.remoteWriteBatchSize, sc.remoteWriteFlushInterval, sc.remoteWriteMaxRetries)
+	maxRetries := sc.remoteWriteMaxRetries
+	if maxRetries == 0 {
+		// remotewrite treats 0 as its default
+		maxRetries = -1
+	}
+	return remotewrite.NewWriter(sc.remoteWriteURL, remotewrite.Options{
+		BatchSize:     sc.remoteWriteBatchSize,
+		FlushInterval: sc.remoteWriteFlushInterval,
+		MaxRetries:    maxRetries,
+		OnError: func(err error) {
+			logger.Printf("Remote-write batch failed: %v", err)
+			metrics.DatabaseOperations.WithLabelValues("collector-service", "remote_write", "error").Inc()
+		},
+	})
+}
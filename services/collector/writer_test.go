@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/influx"
+	"github.com/example/telemetry/internal/remotewrite"
+)
+
+func TestLoadInfluxWriteConfig(t *testing.T) {
+	t.Setenv("INFLUX_WRITE_MODE", "")
+	t.Setenv("INFLUX_BATCH_SIZE", "")
+	t.Setenv("INFLUX_FLUSH_INTERVAL_MS", "")
+	wc := loadInfluxWriteConfig()
+	if wc.mode != writeModeBlocking || wc.batchSize != defaultInfluxBatchSize || wc.flushInterval != defaultInfluxFlushInterval {
+		t.Errorf("Expected defaults, got %+v", wc)
+	}
+
+	t.Setenv("INFLUX_WRITE_MODE", "Async")
+	t.Setenv("INFLUX_BATCH_SIZE", "1000")
+	t.Setenv("INFLUX_FLUSH_INTERVAL_MS", "250")
+	wc = loadInfluxWriteConfig()
+	if wc.mode != writeModeAsync || wc.batchSize != 1000 || wc.flushInterval != 250*time.Millisecond {
+		t.Errorf("Expected async with batch 1000 every 250ms, got %+v", wc)
+	}
+
+	t.Setenv("INFLUX_WRITE_MODE", "fire-and-forget")
+	t.Setenv("INFLUX_BATCH_SIZE", "-1")
+	t.Setenv("INFLUX_FLUSH_INTERVAL_MS", "soon")
+	wc = loadInfluxWriteConfig()
+	if wc.mode != writeModeBlocking || wc.batchSize != defaultInfluxBatchSize || wc.flushInterval != defaultInfluxFlushInterval {
+		t.Errorf("Expected invalid values to use the defaults, got %+v", wc)
+	}
+}
+
+func TestLoadSinkConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		sinks       string
+		url         string
+		influx      bool
+		remoteWrite bool
+		wantErr     string
+	}{
+		{name: "Default", influx: true},
+		{name: "Influx only", sinks: "influx", influx: true},
+		{name: "Both", sinks: "influx, Remote_Write", url: "http://prometheus:9090/api/v1/write", influx: true, remoteWrite: true},
+		{name: "Remote-write only", sinks: "remote_write", url: "http://prometheus:9090/api/v1/write", remoteWrite: true},
+		{name: "Remote-write without URL", sinks: "influx,remote_write", wantErr: "REMOTE_WRITE_URL"},
+		{name: "Unknown sink", sinks: "influx,graphite", wantErr: "graphite"},
+		{name: "No sink", sinks: ",", wantErr: "no sink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TELEMETRY_SINKS", tt.sinks)
+			t.Setenv("REMOTE_WRITE_URL", tt.url)
+			sc, err := loadSinkConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected an error mentioning %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sc.influx != tt.influx || sc.remoteWrite != tt.remoteWrite {
+				t.Errorf("Expected influx=%v remote_write=%v, got %+v", tt.influx, tt.remoteWrite, sc)
+			}
+		})
+	}
+
+	t.Setenv("TELEMETRY_SINKS", "")
+	t.Setenv("REMOTE_WRITE_BATCH_SIZE", "100")
+	t.Setenv("REMOTE_WRITE_FLUSH_INTERVAL_MS", "soon")
+	t.Setenv("REMOTE_WRITE_MAX_RETRIES", "0")
+	sc, err := loadSinkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.remoteWriteBatchSize != 100 || sc.remoteWriteFlushInterval != defaultRemoteWriteFlushInterval || sc.remoteWriteMaxRetries != 0 {
+		t.Errorf("Expected batch 100, the default interval and no retries, got %+v", sc)
+	}
+}
+
+func TestHandleMessageWritesToEverySink(t *testing.T) {
+	var influxWrites, remoteWrites int32
+	influxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/write" {
+			atomic.AddInt32(&influxWrites, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(influxServer.Close)
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "snappy" {
+			atomic.AddInt32(&remoteWrites, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(remoteServer.Close)
+
+	influxWriter := influx.NewInfluxWriter(influxServer.URL, "token", "org", "bucket")
+	t.Cleanup(influxWriter.Close)
+	remoteWriter := remotewrite.NewWriter(remoteServer.URL, remotewrite.Options{BatchSize: 2, FlushInterval: time.Hour})
+	t.Cleanup(remoteWriter.Close)
+
+	cs := &CollectorService{
+		logger:      log.New(io.Discard, "", 0),
+		influx:      influxWriter,
+		remoteWrite: remoteWriter,
+		filter:      &valueFilter{bounds: defaultValueBounds},
+	}
+	for i := 0; i < 3; i++ {
+		if err := cs.handleMessage("sink-test", mustJSON(t, validRow()), ""); err != nil {
+			t.Fatalf("handleMessage %d failed: %v", i, err)
+		}
+	}
+	remoteWriter.Flush()
+
+	if got := atomic.LoadInt32(&influxWrites); got != 3 {
+		t.Errorf("Expected 3 InfluxDB writes, got %d", got)
+	}
+	// One full batch of two, then the flushed remainder
+	if got := atomic.LoadInt32(&remoteWrites); got != 2 {
+		t.Errorf("Expected 2 remote-write requests, got %d", got)
+	}
+
+	// Without InfluxDB the collector is ready without pinging it, and writes
+	// only to remote-write
+	cs.influx = nil
+	cs.waitForDependencies(context.Background(), time.Hour)
+	if !cs.ready.Ready() {
+		t.Error("Expected a collector without InfluxDB to be ready")
+	}
+	if err := cs.handleMessage("sink-test", mustJSON(t, validRow()), ""); err != nil {
+		t.Fatalf("handleMessage without InfluxDB failed: %v", err)
+	}
+	remoteWriter.Flush()
+	if got := atomic.LoadInt32(&influxWrites); got != 3 {
+		t.Errorf("Expected no further InfluxDB writes, got %d", got)
+	}
+	if got := atomic.LoadInt32(&remoteWrites); got != 3 {
+		t.Errorf("Expected 3 remote-write requests, got %d", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTopics          = "events:8,orders:4,default:8"
+	defaultMaxMessageBytes = 1 << 20 // 1MB
+)
+
+// BrokerConfig holds broker configuration.
+// Values are resolved with precedence: command-line flag, then environment variable, then default.
+type BrokerConfig struct {
+	Topics      map[string]int // topic -> partitions count
+	BrokerIndex int
+	BrokerCount int
+	Port        string
+	StorageDir  string
+
+	// MaxMessageBytes caps the size of a produce request body
+	MaxMessageBytes int64
+
+	// TopicRateLimits caps produces per second on each listed topic; topics
+	// not listed are unlimited
+	TopicRateLimits map[string]float64
+
+	// AdvertisedURL is the address clients can reach this broker at, sent
+	// back on produce and consume responses as X-Owning-Broker; empty means
+	// http://<hostname>:<port>
+	AdvertisedURL string
+}
+
+// loadBrokerConfig parses command-line arguments on top of environment variables and defaults
+func loadBrokerConfig(args []string) (BrokerConfig, error) {
+	fs := flag.NewFlagSet("msg_queue", flag.ContinueOnError)
+
+	// Non-positive BROKER_COUNT values are ignored
+	envBrokerCount := getEnvInt("BROKER_COUNT", 1)
+	if envBrokerCount <= 0 {
+		envBrokerCount = 1
+	}
+
+	// Environment values become the flag defaults so an explicit flag always wins
+	topics := fs.String("topics", getEnv("TOPICS", defaultTopics), "comma-separated topic:partitions list (env TOPICS)")
+	brokerIndex := fs.Int("broker-index", getEnvInt("BROKER_INDEX", 0), "index of this broker instance (env BROKER_INDEX)")
+	brokerCount := fs.Int("broker-count", envBrokerCount, "total number of broker instances (env BROKER_COUNT)")
+	port := fs.String("port", getEnv("PORT", "8080"), "HTTP listen port (env PORT)")
+	storage := fs.String("storage-dir", getEnv("STORAGE_DIR", defaultStorageDir), "directory for partition logs (env STORAGE_DIR)")
+	maxMessageBytes := fs.Int("max-message-bytes", getEnvInt("MAX_MESSAGE_BYTES", defaultMaxMessageBytes), "maximum produce payload size in bytes (env MAX_MESSAGE_BYTES)")
+	advertisedURL := fs.String("advertised-url", getEnv("ADVERTISED_URL", ""), "address clients can reach this broker at, reported in X-Owning-Broker (env ADVERTISED_URL)")
+	rateLimits := fs.String("topic-rate-limits", getEnv("TOPIC_RATE_LIMITS", ""), `JSON map of topic to produce messages/sec, e.g. {"telemetry":500} (env TOPIC_RATE_LIMITS)`)
+
+	if err := fs.Parse(args); err != nil {
+		return BrokerConfig{}, err
+	}
+	if *brokerCount <= 0 {
+		return BrokerConfig{}, fmt.Errorf("broker count must be positive, got %d", *brokerCount)
+	}
+	if *maxMessageBytes <= 0 {
+		return BrokerConfig{}, fmt.Errorf("max message bytes must be positive, got %d", *maxMessageBytes)
+	}
+	topicRateLimits, err := parseTopicRateLimits(*topics, *rateLimits)
+	if err != nil {
+		return BrokerConfig{}, err
+	}
+
+	return BrokerConfig{
+		Topics:      parseTopics(*topics),
+		BrokerIndex: *brokerIndex,
+		BrokerCount: *brokerCount,
+		Port:        *port,
+		StorageDir:  *storage,
+
+		MaxMessageBytes: int64(*maxMessageBytes),
+		TopicRateLimits: topicRateLimits,
+		AdvertisedURL:   *advertisedURL,
+	}, nil
+}
+
+// parseTopics parses a topic list like events:8,orders:4, skipping malformed
+// entries. An entry may carry a produce rate limit as a third field, see
+// parseTopicRateLimits.
+func parseTopics(s string) map[string]int {
+	topics := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.Split(part, ":")
+		if len(kv) != 2 && len(kv) != 3 {
+			continue
+		}
+		n, _ := strconv.Atoi(kv[1])
+		topics[kv[0]] = n
+	}
+	return topics
+}
+
+// parseTopicRateLimits collects produce rate limits in messages per second
+// from the third field of topic list entries (events:8:500) and from a JSON
+// map of topic to rate, which takes precedence. A rate of 0 lifts a limit set
+// in the topic list.
+func parseTopicRateLimits(topics, jsonMap string) (map[string]float64, error) {
+	limits := map[string]float64{}
+	for _, part := range strings.Split(topics, ",") {
+		kv := strings.Split(part, ":")
+		if len(kv) != 3 {
+			continue
+		}
+		rate, err := strconv.ParseFloat(kv[2], 64)
+		if err != nil || !(rate >= 0) {
+			return nil, fmt.Errorf("invalid produce rate limit %q for topic %s", kv[2], kv[0])
+		}
+		limits[kv[0]] = rate
+	}
+
+	if jsonMap != "" {
+		var overrides map[string]float64
+		if err := json.Unmarshal([]byte(jsonMap), &overrides); err != nil {
+			return nil, fmt.Errorf("invalid topic rate limits: %w", err)
+		}
+		for topic, rate := range overrides {
+			if rate < 0 {
+				return nil, fmt.Errorf("invalid produce rate limit %v for topic %s", rate, topic)
+			}
+			limits[topic] = rate
+		}
+	}
+
+	for topic, rate := range limits {
+		if rate == 0 {
+			delete(limits, topic)
+		}
+	}
+	return limits, nil
+}
+
+// getEnv gets an environment variable with a fallback default
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvInt gets an environment variable as integer with a fallback default
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadBrokerConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		args          []string
+		expectedIndex int
+		expectedCount int
+		expectedPort  string
+		expectedDir   string
+		expectedTopic map[string]int
+	}{
+		{
+			name:          "Defaults",
+			expectedIndex: 0,
+			expectedCount: 1,
+			expectedPort:  "8080",
+			expectedDir:   defaultStorageDir,
+			expectedTopic: map[string]int{"events": 8, "orders": 4, "default": 8},
+		},
+		{
+			name:          "Env beats default",
+			env:           map[string]string{"BROKER_INDEX": "1", "BROKER_COUNT": "3", "PORT": "9090", "STORAGE_DIR": "/tmp/env", "TOPICS": "telemetry:2"},
+			expectedIndex: 1,
+			expectedCount: 3,
+			expectedPort:  "9090",
+			expectedDir:   "/tmp/env",
+			expectedTopic: map[string]int{"telemetry": 2},
+		},
+		{
+			name:          "Flag beats env",
+			env:           map[string]string{"BROKER_INDEX": "1", "BROKER_COUNT": "3", "PORT": "9090", "STORAGE_DIR": "/tmp/env", "TOPICS": "telemetry:2"},
+			args:          []string{"-broker-index=2", "-broker-count=4", "-port=7070", "-storage-dir=/tmp/flag", "-topics=telemetry:6,events:1"},
+			expectedIndex: 2,
+			expectedCount: 4,
+			expectedPort:  "7070",
+			expectedDir:   "/tmp/flag",
+			expectedTopic: map[string]int{"telemetry": 6, "events": 1},
+		},
+		{
+			name:          "Invalid env count ignored",
+			env:           map[string]string{"BROKER_COUNT": "0"},
+			expectedIndex: 0,
+			expectedCount: 1,
+			expectedPort:  "8080",
+			expectedDir:   defaultStorageDir,
+			expectedTopic: map[string]int{"events": 8, "orders": 4, "default": 8},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"BROKER_INDEX", "BROKER_COUNT", "PORT", "STORAGE_DIR", "TOPICS"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			cfg, err := loadBrokerConfig(tt.args)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cfg.BrokerIndex != tt.expectedIndex {
+				t.Errorf("Expected broker index %d, got %d", tt.expectedIndex, cfg.BrokerIndex)
+			}
+			if cfg.BrokerCount != tt.expectedCount {
+				t.Errorf("Expected broker count %d, got %d", tt.expectedCount, cfg.BrokerCount)
+			}
+			if cfg.Port != tt.expectedPort {
+				t.Errorf("Expected port %s, got %s", tt.expectedPort, cfg.Port)
+			}
+			if cfg.StorageDir != tt.expectedDir {
+				t.Errorf("Expected storage dir %s, got %s", tt.expectedDir, cfg.StorageDir)
+			}
+			if len(cfg.Topics) != len(tt.expectedTopic) {
+				t.Errorf("Expected topics %v, got %v", tt.expectedTopic, cfg.Topics)
+			}
+			for topic, n := range tt.expectedTopic {
+				if cfg.Topics[topic] != n {
+					t.Errorf("Expected topic %s to have %d partitions, got %d", topic, n, cfg.Topics[topic])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBrokerConfigInvalidFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-broker-count=0"},
+		{"-broker-index=abc"},
+		{"-unknown-flag"},
+	} {
+		if _, err := loadBrokerConfig(args); err == nil {
+			t.Errorf("Expected error for args %v", args)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestDeadlineHeader carries how many milliseconds the client still waits
+// for the answer. It is relative so the broker doesn't depend on the client's
+// clock: the deadline is taken from the broker's own clock on arrival.
+const requestDeadlineHeader = "X-Request-Deadline"
+
+// parseRequestDeadline reads the deadline a client sent with its request,
+// counting from now. ok is false if it didn't send one.
+func parseRequestDeadline(r *http.Request, now time.Time) (deadline time.Time, ok bool, err error) {
+	value := r.Header.Get(requestDeadlineHeader)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("bad %s %q: expected a number of milliseconds", requestDeadlineHeader, value)
+	}
+	return now.Add(time.Duration(ms) * time.Millisecond), true, nil
+}
+
+// deadlineMiddleware gives each request that carries a client deadline a
+// context ending at it, so handlers stop working on it once the client has
+// given up. A request whose deadline has already passed is answered with 504
+// without being handled.
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		deadline, ok, err := parseRequestDeadline(r, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !now.Before(deadline) {
+			http.Error(w, "request deadline already passed", http.StatusGatewayTimeout)
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProduceRequestDeadline(t *testing.T) {
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	handler := deadlineMiddleware(http.HandlerFunc(b.produceHandler))
+
+	tests := []struct {
+		name           string
+		deadline       string
+		expectedStatus int
+		expectQueued   bool
+	}{
+		{"No deadline", "", http.StatusOK, true},
+		{"Future deadline", "60000", http.StatusOK, true},
+		{"Past deadline", "0", http.StatusGatewayTimeout, false},
+		{"Negative deadline", "-1000", http.StatusGatewayTimeout, false},
+		{"Malformed deadline", "in a minute", http.StatusBadRequest, false},
+		{"Absolute deadline", time.Now().Add(time.Minute).Format(time.RFC3339Nano), http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depth := len(p.queue)
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader("hello"))
+			if tt.deadline != "" {
+				req.Header.Set(requestDeadlineHeader, tt.deadline)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if queued := len(p.queue) > depth; queued != tt.expectQueued {
+				t.Errorf("Expected message queued %v, got %v", tt.expectQueued, queued)
+			}
+		})
+	}
+}
+
+func TestProduceAbandonedWhileReading(t *testing.T) {
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	// The deadline passes after the middleware let the request through
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Millisecond))
+	defer cancel()
+	req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader("hello")).WithContext(ctx)
+	w := httptest.NewRecorder()
+	b.produceHandler(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status 504, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := len(p.queue); n != 0 {
+		t.Errorf("Expected nothing queued for an abandoned produce, got %d messages", n)
+	}
+}
+
+func TestDeadlineMiddlewareSetsContext(t *testing.T) {
+	var got time.Time
+	var ok bool
+	handler := deadlineMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok = r.Context().Deadline()
+	}))
+
+	// The deadline is counted from the broker's clock when the request arrives
+	req := httptest.NewRequest("GET", "/consume", nil)
+	req.Header.Set(requestDeadlineHeader, "60000")
+	before := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !ok || got.Before(before.Add(time.Minute)) || got.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the handler's context to end a minute from arrival, got %v (set %v)", got.Sub(before), ok)
+	}
+
+	ok = false
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/consume", nil))
+	if ok {
+		t.Error("Expected no deadline on a request without the header")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultGroupIdleTimeout is how long a consumer group with no open streams
+// and no consume or ack requests stays listed
+const defaultGroupIdleTimeout = 10 * time.Minute
+
+// getGroupIdleTimeout returns the consumer group idle timeout from
+// GROUP_IDLE_TIMEOUT_MS or the default. A value of 0 keeps groups forever.
+func getGroupIdleTimeout() time.Duration {
+	if msStr := os.Getenv("GROUP_IDLE_TIMEOUT_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid GROUP_IDLE_TIMEOUT_MS value '%s', using default: %v", msStr, defaultGroupIdleTimeout)
+	}
+	return defaultGroupIdleTimeout
+}
+
+// groupRegistry records the consumer groups seen in consume and ack requests
+// for each topic. A group is forgotten once it has had no open stream and no
+// requests for the idle timeout.
+type groupRegistry struct {
+	mu     sync.Mutex
+	idle   time.Duration
+	groups map[string]map[string]*groupEntry // topic -> group
+}
+
+type groupEntry struct {
+	lastSeen time.Time
+	streams  int // open consume streams
+}
+
+// groupActivity is what the registry knows about one group
+type groupActivity struct {
+	Group       string    `json:"group"`
+	OpenStreams int       `json:"open_streams"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+func newGroupRegistry(idle time.Duration) *groupRegistry {
+	return &groupRegistry{idle: idle, groups: make(map[string]map[string]*groupEntry)}
+}
+
+// entry returns group's entry on topic, creating it; the caller holds mu
+func (g *groupRegistry) entry(topic, group string) *groupEntry {
+	tg := g.groups[topic]
+	if tg == nil {
+		tg = make(map[string]*groupEntry)
+		g.groups[topic] = tg
+	}
+	e := tg[group]
+	if e == nil {
+		e = &groupEntry{}
+		tg[group] = e
+	}
+	return e
+}
+
+// touch records activity by group on topic
+func (g *groupRegistry) touch(topic, group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.entry(topic, group).lastSeen = time.Now()
+}
+
+// openStream records a consume stream opened by group on topic and returns
+// the function to call when it closes. A group with an open stream is never
+// expired, however long the stream stays idle.
+func (g *groupRegistry) openStream(topic, group string) (closeStream func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.entry(topic, group)
+	e.streams++
+	e.lastSeen = time.Now()
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		e.streams--
+		e.lastSeen = time.Now()
+	}
+}
+
+// list returns topic's active groups sorted by name, dropping any that have
+// been idle past the timeout as of now
+func (g *groupRegistry) list(topic string, now time.Time) []groupActivity {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tg := g.groups[topic]
+	out := make([]groupActivity, 0, len(tg))
+	for group, e := range tg {
+		if g.idle > 0 && e.streams == 0 && now.Sub(e.lastSeen) > g.idle {
+			delete(tg, group)
+			continue
+		}
+		out = append(out, groupActivity{Group: group, OpenStreams: e.streams, LastSeen: e.lastSeen.UTC()})
+	}
+	if len(tg) == 0 {
+		delete(g.groups, topic)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Group < out[j].Group })
+	return out
+}
+
+// forget drops every group of a deleted topic
+func (g *groupRegistry) forget(topic string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.groups, topic)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// defaultLagSampleInterval is how often broker_consumer_lag is recomputed
+const defaultLagSampleInterval = 15 * time.Second
+
+// getLagSampleInterval returns the consumer lag sampling interval from
+// LAG_SAMPLE_INTERVAL_MS or the default. A value of 0 turns sampling off.
+func getLagSampleInterval() time.Duration {
+	if msStr := os.Getenv("LAG_SAMPLE_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid LAG_SAMPLE_INTERVAL_MS value '%s', using default: %v", msStr, defaultLagSampleInterval)
+	}
+	return defaultLagSampleInterval
+}
+
+// lagSeries identifies one broker_consumer_lag series
+type lagSeries struct {
+	topic     string
+	partition int
+	group     string
+}
+
+// sampleLagEvery samples consumer lag every interval until the broker is closed
+func (b *Broker) sampleLagEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			b.sampleLag(now)
+		}
+	}
+}
+
+// sampleLag sets broker_consumer_lag for every partition of each topic and
+// every group active on the topic as of now. A group's lag on a partition is
+// the messages waiting for delivery there plus the group's unacked ones.
+// Only groups listed by /groups are exported, so series of groups that went
+// idle, and of deleted topics, are removed and cardinality stays bounded.
+func (b *Broker) sampleLag(now time.Time) {
+	parts := make(map[string][]*Partition)
+	b.partitionsMu.RLock()
+	for topic, pm := range b.partitions {
+		for _, p := range pm {
+			parts[topic] = append(parts[topic], p)
+		}
+	}
+	b.partitionsMu.RUnlock()
+
+	current := make(map[lagSeries]bool)
+	for topic, ps := range parts {
+		groups := b.groups.list(topic, now)
+		if len(groups) == 0 {
+			continue
+		}
+		for _, p := range ps {
+			waiting := p.state().QueueDepth
+			pending := p.pendingByGroup()
+			for _, g := range groups {
+				metrics.SetBrokerConsumerLag(topic, p.index, g.Group, waiting+pending[g.Group])
+				current[lagSeries{topic: topic, partition: p.index, group: g.Group}] = true
+			}
+		}
+	}
+
+	b.lagMu.Lock()
+	defer b.lagMu.Unlock()
+	for s := range b.lagExported {
+		if !current[s] {
+			metrics.DeleteBrokerConsumerLag(s.topic, s.partition, s.group)
+		}
+	}
+	b.lagExported = current
+}
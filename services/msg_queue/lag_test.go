@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+var initMetricsOnce sync.Once
+
+// scrapeMetrics returns the text exposition served on /metrics
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	initMetricsOnce.Do(func() {
+		metrics.InitMetrics("msg-queue-service")
+	})
+	w := httptest.NewRecorder()
+	metrics.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+// lagLine is the exposition line of a broker_consumer_lag series
+func lagLine(partition int, group string, lag int) string {
+	return fmt.Sprintf(`broker_consumer_lag{group="%s",partition="%d",topic="telemetry"} %d`, group, partition, lag)
+}
+
+func TestConsumerLagMetric(t *testing.T) {
+	t.Setenv("LAG_SAMPLE_INTERVAL_MS", "0")
+	b := newTestBroker(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consume", b.consumeHandler)
+	mux.HandleFunc("/ack", b.ackHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		produceAt(t, b, 0, "")
+	}
+	produceAt(t, b, 1, "")
+
+	// g1 takes the backlog of partition 0 without acking; g2 takes partition 1 and acks it
+	if ids := consumeIDs(t, server.URL, 0, "lag-g1"); len(ids) != 5 {
+		t.Fatalf("Expected lag-g1 to get 5 messages, got %v", ids)
+	}
+	ids := consumeIDs(t, server.URL, 1, "lag-g2")
+	if len(ids) != 1 {
+		t.Fatalf("Expected lag-g2 to get 1 message, got %v", ids)
+	}
+	resp, err := http.Post(server.URL+"/ack?topic=telemetry&partition=1&group=lag-g2", "application/json", strings.NewReader(`{"id":"`+ids[0]+`"}`))
+	if err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	resp.Body.Close()
+	// Two new messages wait on partition 0, lag for every active group
+	produceAt(t, b, 0, "")
+	produceAt(t, b, 0, "")
+
+	b.sampleLag(time.Now())
+	body := scrapeMetrics(t)
+	for _, expected := range []string{
+		lagLine(0, "lag-g1", 7),
+		lagLine(1, "lag-g1", 0),
+		lagLine(0, "lag-g2", 2),
+		lagLine(1, "lag-g2", 0),
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in /metrics", expected)
+		}
+	}
+
+	// Series of groups that went idle are removed
+	b.groups.idle = time.Minute
+	b.sampleLag(time.Now().Add(2 * time.Minute))
+	if body := scrapeMetrics(t); strings.Contains(body, `group="lag-g1"`) || strings.Contains(body, `group="lag-g2"`) {
+		t.Errorf("Expected idle groups to be dropped from broker_consumer_lag, got:\n%s", body)
+	}
+}
+
+func TestLagSampleIntervalFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultLagSampleInterval},
+		{"5000", 5 * time.Second},
+		{"0", 0},
+		{"-1", defaultLagSampleInterval},
+		{"often", defaultLagSampleInterval},
+	}
+	for _, tt := range tests {
+		t.Setenv("LAG_SAMPLE_INTERVAL_MS", tt.value)
+		if got := getLagSampleInterval(); got != tt.expected {
+			t.Errorf("LAG_SAMPLE_INTERVAL_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
@@ -6,38 +6,96 @@
 // - Dynamic partition creation: partitions are created on-demand when first accessed
 //   (you can run multiple broker instances for load balancing).
 // - HTTP API for producing messages, consuming (SSE), ack-ing messages.
-// - In-memory queue with append-only file persistence per partition.
+// - In-memory queue with append-only log persistence per partition (a file
+//   by default; see PartitionStore).
 // - Visibility timeout for in-flight messages and automatic requeue on timeout.
 
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/example/telemetry/internal/buildinfo"
+	"github.com/example/telemetry/internal/health"
 	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/reqlog"
+	"github.com/example/telemetry/internal/security"
 )
 
 const (
 	defaultVisibilityTimeout = 30 * time.Second
-	storageDir               = "./data"
+	defaultStorageDir        = "./data"
 	defaultQueueSize         = 1000
+	defaultSyncInterval      = 500 * time.Millisecond
+	defaultFetchWait         = 5 * time.Second
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultPollBackoffMin    = 10 * time.Millisecond
+	defaultPollBackoffMax    = 250 * time.Millisecond
+	defaultPendingEvictAfter = 10 * time.Minute
 )
 
+var (
+	// errNoMessages is returned by fetchAndTrack when nothing arrived within the wait window.
+	errNoMessages = errors.New("no messages available")
+	// errPartitionClosed is returned when a partition has been shut down.
+	errPartitionClosed = errors.New("partition closed")
+	// errQueueFull is returned by trySend when the in-memory queue has no room.
+	errQueueFull = errors.New("queue full")
+	// errUnknownTopic is returned for topics the broker is not configured with.
+	errUnknownTopic = errors.New("unknown topic")
+)
+
+// Persistence sync policies for partition log files.
+const (
+	syncNone     = "none"     // rely on the OS to flush writes
+	syncAlways   = "always"   // fsync after every write
+	syncInterval = "interval" // fsync periodically from a background flusher
+)
+
+// Produce acknowledgment levels, selected per request with the acks parameter.
+const (
+	acksNone      = "none"      // answer 202 without reporting enqueue failures
+	acksLeader    = "leader"    // answer once the message is in the in-memory queue
+	acksPersisted = "persisted" // answer once the message is synced to the partition log
+)
+
+// Consume ack modes, selected per stream with the ack_mode parameter.
+const (
+	ackModeManual = "manual" // deliveries stay pending until acked or the visibility timeout
+	ackModeAuto   = "auto"   // deliveries count as acked once sent (at-most-once)
+)
+
+// What a consume does when its partition hasn't been created yet, selected
+// per stream with the missing parameter.
+const (
+	missingError = "error" // reject the consume with 400
+	missingWait  = "wait"  // create the partition and wait for its first message
+)
+
+// owningBrokerHeader names the broker that served a produce or consume, so
+// clients can cache which broker owns each topic-partition
+const owningBrokerHeader = "X-Owning-Broker"
+
 // getQueueSize returns the queue size from environment variable or default value
 func getQueueSize() int {
 	if sizeStr := os.Getenv("QUEUE_SIZE"); sizeStr != "" {
@@ -50,6 +108,160 @@ func getQueueSize() int {
 	return defaultQueueSize
 }
 
+// getPersistSync returns the persistence sync policy and flush interval from
+// environment variables (PERSIST_SYNC, PERSIST_SYNC_MS) or defaults
+func getPersistSync() (string, time.Duration) {
+	mode := os.Getenv("PERSIST_SYNC")
+	switch mode {
+	case "", syncNone:
+		return syncNone, 0
+	case syncAlways:
+		return syncAlways, 0
+	case syncInterval:
+		interval := defaultSyncInterval
+		if msStr := os.Getenv("PERSIST_SYNC_MS"); msStr != "" {
+			if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+				interval = time.Duration(ms) * time.Millisecond
+			} else {
+				log.Printf("Invalid PERSIST_SYNC_MS value '%s', using default: %v", msStr, defaultSyncInterval)
+			}
+		}
+		return syncInterval, interval
+	default:
+		log.Printf("Invalid PERSIST_SYNC value '%s', using default: %s", mode, syncNone)
+		return syncNone, 0
+	}
+}
+
+// getHeartbeatInterval returns the SSE keepalive interval from HEARTBEAT_INTERVAL_MS
+// or the default. A value of 0 disables heartbeats.
+func getHeartbeatInterval() time.Duration {
+	if msStr := os.Getenv("HEARTBEAT_INTERVAL_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid HEARTBEAT_INTERVAL_MS value '%s', using default: %v", msStr, defaultHeartbeatInterval)
+	}
+	return defaultHeartbeatInterval
+}
+
+// getPollBackoff returns the shortest and longest pause between fetches on an
+// idle consume stream from POLL_BACKOFF_MIN_MS and POLL_BACKOFF_MAX_MS, or the
+// defaults. The maximum is raised to the minimum if it is smaller.
+func getPollBackoff() (minPause, maxPause time.Duration) {
+	minPause, maxPause = defaultPollBackoffMin, defaultPollBackoffMax
+	if msStr := os.Getenv("POLL_BACKOFF_MIN_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			minPause = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid POLL_BACKOFF_MIN_MS value '%s', using default: %v", msStr, defaultPollBackoffMin)
+		}
+	}
+	if msStr := os.Getenv("POLL_BACKOFF_MAX_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms > 0 {
+			maxPause = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Invalid POLL_BACKOFF_MAX_MS value '%s', using default: %v", msStr, defaultPollBackoffMax)
+		}
+	}
+	if maxPause < minPause {
+		log.Printf("POLL_BACKOFF_MAX_MS %v is below POLL_BACKOFF_MIN_MS %v, using %v", maxPause, minPause, minPause)
+		maxPause = minPause
+	}
+	return minPause, maxPause
+}
+
+// pollBackoff paces an idle consume stream: each pause after an empty fetch
+// doubles from min up to max, and delivering a message starts over from min
+type pollBackoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// wait returns how long to pause after an empty fetch
+func (pb *pollBackoff) wait() time.Duration {
+	if pb.next < pb.min {
+		pb.next = pb.min
+	}
+	d := pb.next
+	if pb.next *= 2; pb.next > pb.max {
+		pb.next = pb.max
+	}
+	return d
+}
+
+// reset starts the next idle period from the minimum pause
+func (pb *pollBackoff) reset() {
+	pb.next = pb.min
+}
+
+// getMaxInFlight returns how many unacked messages a consumer group may hold
+// per partition, from MAX_IN_FLIGHT_PER_GROUP. A value of 0 (the default)
+// leaves groups unlimited.
+func getMaxInFlight() int {
+	if maxStr := os.Getenv("MAX_IN_FLIGHT_PER_GROUP"); maxStr != "" {
+		if max, err := strconv.Atoi(maxStr); err == nil && max >= 0 {
+			return max
+		}
+		log.Printf("Invalid MAX_IN_FLIGHT_PER_GROUP value '%s', using default: unlimited", maxStr)
+	}
+	return 0
+}
+
+// getMaxPendingBytes returns how many payload bytes a partition may hold in
+// delivered but unacked messages, from MAX_PENDING_BYTES_PER_PARTITION. A
+// value of 0 (the default) leaves partitions unlimited.
+func getMaxPendingBytes() int64 {
+	if maxStr := os.Getenv("MAX_PENDING_BYTES_PER_PARTITION"); maxStr != "" {
+		if max, err := strconv.ParseInt(maxStr, 10, 64); err == nil && max >= 0 {
+			return max
+		}
+		log.Printf("Invalid MAX_PENDING_BYTES_PER_PARTITION value '%s', using default: unlimited", maxStr)
+	}
+	return 0
+}
+
+// getQueueHighWatermark returns how full, in percent of QUEUE_SIZE, a
+// partition queue may get before produces to it are turned away with 429,
+// from QUEUE_HIGH_WATERMARK_PERCENT. A value of 0 (the default) turns
+// backpressure off, leaving producers to find the queue full.
+func getQueueHighWatermark() int {
+	if pctStr := os.Getenv("QUEUE_HIGH_WATERMARK_PERCENT"); pctStr != "" {
+		if pct, err := strconv.Atoi(pctStr); err == nil && pct >= 0 && pct <= 100 {
+			return pct
+		}
+		log.Printf("Invalid QUEUE_HIGH_WATERMARK_PERCENT value '%s', using default: off", pctStr)
+	}
+	return 0
+}
+
+// getPrewarmPartitions reports whether the broker creates every partition of
+// its configured topics at startup, from PREWARM_PARTITIONS. By default
+// partitions are created by their first produce.
+func getPrewarmPartitions() bool {
+	if prewarmStr := os.Getenv("PREWARM_PARTITIONS"); prewarmStr != "" {
+		if prewarm, err := strconv.ParseBool(prewarmStr); err == nil {
+			return prewarm
+		}
+		log.Printf("Invalid PREWARM_PARTITIONS value '%s', using default: false", prewarmStr)
+	}
+	return false
+}
+
+// getPendingEvictAfter returns how long an expired message may wait in the
+// pending map for room on its full queue before it is evicted and lost, from
+// PENDING_EVICT_AFTER_MS or the default. A value of 0 evicts it the first time
+// its requeue fails.
+func getPendingEvictAfter() time.Duration {
+	if msStr := os.Getenv("PENDING_EVICT_AFTER_MS"); msStr != "" {
+		if ms, err := strconv.Atoi(msStr); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		log.Printf("Invalid PENDING_EVICT_AFTER_MS value '%s', using default: %v", msStr, defaultPendingEvictAfter)
+	}
+	return defaultPendingEvictAfter
+}
+
 // Message is the unit of transfer.
 type Message struct {
 	ID        string    `json:"id"`
@@ -57,6 +269,7 @@ type Message struct {
 	CreatedAt time.Time `json:"created_at"`
 	Topic     string    `json:"topic"`
 	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"` // position assigned at produce time within the partition
 	// attempt meta (not serialized)
 }
 
@@ -65,123 +278,301 @@ type pending struct {
 	msg      Message
 	deadline time.Time
 	group    string
+	// requeueFailed is set once the message expired but its queue was full.
+	// The group's slot has been released and no longer holds the message;
+	// requeueing is retried on every check until the entry is evicted.
+	requeueFailed bool
 }
 
 // Partition holds the queue and persistence for a single partition.
 type Partition struct {
+	// nextOffset is the offset the next produced message gets; produced
+	// counts messages queued since the broker started and lastActivity is the
+	// UnixNano time of the last produce, delivery or ack. All three are
+	// accessed atomically and kept first for 64-bit alignment.
+	nextOffset   int64
+	produced     int64
+	lastActivity int64
+
 	topic     string
 	index     int
 	queue     chan Message // main queue
 	pendingMu sync.Mutex
 	pending   map[string]pending // messageID -> pending
-	file      *os.File
-	fileMu    sync.Mutex
+	// inFlight counts each group's pending messages, including fetches that
+	// have reserved a slot but not yet received a message; capped at
+	// maxInFlight unless it is 0. freed is closed and replaced whenever a
+	// slot is released. All three are guarded by pendingMu.
+	inFlight    map[string]int
+	maxInFlight int
+	freed       chan struct{}
+	// pendingBytes is the payload size of every message in pending. While it
+	// is at maxPendingBytes, unless that is 0, fetches wait as they do at the
+	// in-flight limit. Both are guarded by pendingMu.
+	pendingBytes    int64
+	maxPendingBytes int64
+	// lastAcked is each group's most recently acked message, so a
+	// reconnecting consumer can resume after it; guarded by pendingMu
+	lastAcked map[string]ackMark
+	// evictAfter is how long past its deadline a message that can't be
+	// requeued stays pending before it is dropped
+	evictAfter time.Duration
+	// requeueMode is requeueTail or requeueOrdered. In ordered mode expired
+	// messages wait in redeliver, delivered before the queue, and
+	// redelivered is closed and replaced whenever one is added; both are
+	// guarded by pendingMu.
+	requeueMode string
+	redeliver   offsetHeap
+	redelivered chan struct{}
+
+	store     PartitionStore
+	storeMu   sync.Mutex
+	syncMode  string
+	syncEvery time.Duration
+	dirty     bool // unsynced writes pending (guarded by storeMu)
 	visTO     time.Duration
 	ctx       context.Context
 	cancel    context.CancelFunc
+
+	// closeMu guards closed; senders hold it for reading so the queue
+	// channel is never closed underneath an in-progress send
+	closeMu   sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
 }
 
-func newPartition(topic string, index int, visTO time.Duration) (*Partition, error) {
-	dir := filepath.Join(storageDir, topic)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return nil, err
-	}
-	fpath := filepath.Join(dir, fmt.Sprintf("partition-%d.log", index))
-	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+// newPartition opens a partition whose log is kept in the store newStore opens
+func newPartition(newStore storeFactory, topic string, index int, visTO time.Duration) (*Partition, error) {
+	store, err := newStore(topic, index)
 	if err != nil {
 		return nil, err
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	queueSize := getQueueSize()
+	syncMode, syncEvery := getPersistSync()
 	p := &Partition{
-		topic:   topic,
-		index:   index,
-		queue:   make(chan Message, queueSize),
-		pending: make(map[string]pending),
-		file:    f,
-		visTO:   visTO,
-		ctx:     ctx,
-		cancel:  cancel,
+		topic:     topic,
+		index:     index,
+		queue:     make(chan Message, queueSize),
+		pending:   make(map[string]pending),
+		store:     store,
+		syncMode:  syncMode,
+		syncEvery: syncEvery,
+		visTO:     visTO,
+		ctx:       ctx,
+		cancel:    cancel,
+
+		inFlight:        make(map[string]int),
+		maxInFlight:     getMaxInFlight(),
+		maxPendingBytes: getMaxPendingBytes(),
+		freed:           make(chan struct{}),
+		lastAcked:       make(map[string]ackMark),
+		evictAfter:      getPendingEvictAfter(),
+		requeueMode:     getRequeueMode(),
+		redelivered:     make(chan struct{}),
+	}
+	// Resume offsets after the highest one in the log before accepting produces
+	if err := p.recoverNextOffset(); err != nil {
+		store.Close()
+		cancel()
+		return nil, err
 	}
 	// load persisted messages into queue asynchronously to avoid blocking
-	// Commenting out file loading to test timeout issues
 	go func() {
-		if err := p.loadFromFile(); err != nil {
-			log.Printf("partition %s-%d: failed to load from file: %v", topic, index, err)
+		if err := p.loadFromStore(); err != nil {
+			log.Printf("partition %s-%d: failed to load from store: %v", topic, index, err)
 		} else {
-			log.Printf("partition %s-%d: successfully loaded messages from file", topic, index)
+			log.Printf("partition %s-%d: successfully loaded messages from store", topic, index)
 		}
 	}()
 	// start monitor for timeouts
 	go p.monitorPending()
+	if p.syncMode == syncInterval {
+		go p.flushLoop()
+	}
 	return p, nil
 }
 
+// Close stops the partition's background work and closes its queue and store.
+// It is safe to call more than once and concurrently with producers and consumers.
 func (p *Partition) Close() {
-	p.cancel()
-	p.file.Close()
-	close(p.queue)
+	p.closeOnce.Do(func() {
+		p.cancel()
+
+		p.closeMu.Lock()
+		p.closed = true
+		close(p.queue)
+		p.closeMu.Unlock()
+
+		p.storeMu.Lock()
+		if p.dirty {
+			_ = p.store.Sync()
+			p.dirty = false
+		}
+		p.store.Close()
+		p.storeMu.Unlock()
+	})
+}
+
+// recoverNextOffset sets nextOffset to one past the highest offset in the log
+func (p *Partition) recoverNextOffset() error {
+	var next int64
+	err := p.store.Replay(func(m Message) error {
+		if m.Offset >= next {
+			next = m.Offset + 1
+		}
+		return nil
+	})
+	atomic.StoreInt64(&p.nextOffset, next)
+	return err
+}
+
+// assignOffset reserves the next offset in the partition
+func (p *Partition) assignOffset() int64 {
+	return atomic.AddInt64(&p.nextOffset, 1) - 1
+}
+
+// recordProduced counts a message accepted onto the queue
+func (p *Partition) recordProduced() {
+	atomic.AddInt64(&p.produced, 1)
+	p.touch()
+}
+
+// touch marks the partition as active now
+func (p *Partition) touch() {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+}
+
+// trySend pushes m onto the queue without blocking. It fails with
+// errPartitionClosed after Close and errQueueFull when there is no room.
+func (p *Partition) trySend(m Message) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return errPartitionClosed
+	}
+	select {
+	case p.queue <- m:
+		return nil
+	default:
+		return errQueueFull
+	}
 }
 
 func (p *Partition) persist(m Message) error {
-	p.fileMu.Lock()
-	defer p.fileMu.Unlock()
-	b, _ := json.Marshal(m)
-	_, err := p.file.Write(append(b, '\n'))
-	if err != nil {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	if err := p.store.Append(m); err != nil {
 		return err
 	}
-	// Commenting out sync to avoid blocking HTTP responses
-	// return p.file.Sync()
+	switch p.syncMode {
+	case syncAlways:
+		// Trades throughput for durability: the write is on disk before we return
+		return p.store.Sync()
+	case syncInterval:
+		p.dirty = true
+	}
 	return nil
 }
 
-func (p *Partition) loadFromFile() error {
-	p.fileMu.Lock()
-	defer p.fileMu.Unlock()
-	// read from beginning
-	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+// persistSync appends m to the log and syncs it to disk regardless of the
+// partition's sync policy
+func (p *Partition) persistSync(m Message) error {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	// Close cancels the context before closing the store under storeMu
+	if p.ctx.Err() != nil {
+		return errPartitionClosed
+	}
+	if err := p.store.Append(m); err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(p.file)
-	for scanner.Scan() {
-		var m Message
-		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
-			log.Printf("partition %s-%d: skip bad line: %v", p.topic, p.index, err)
-			continue
+	if err := p.store.Sync(); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
+
+// flushLoop periodically syncs unflushed writes for the interval sync policy
+func (p *Partition) flushLoop() {
+	ticker := time.NewTicker(p.syncEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.storeMu.Lock()
+			if p.dirty {
+				if err := p.store.Sync(); err != nil {
+					log.Printf("partition %s-%d: periodic sync failed: %v", p.topic, p.index, err)
+				} else {
+					p.dirty = false
+				}
+			}
+			p.storeMu.Unlock()
 		}
+	}
+}
+
+// loadFromStore queues the messages replayed from the partition's store
+func (p *Partition) loadFromStore() error {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	return p.store.Replay(func(m Message) error {
 		// push into queue (non-blocking)
-		select {
-		case p.queue <- m:
-			// Successfully loaded message
-		default:
+		if err := p.trySend(m); err != nil {
+			if errors.Is(err, errPartitionClosed) {
+				return err
+			}
 			// Queue is full, skip this persisted message
 			log.Printf("partition %s-%d: skipping persisted message %s - queue full", p.topic, p.index, m.ID)
 		}
-	}
-	// seek to end for future appends
-	_, _ = p.file.Seek(0, io.SeekEnd)
-	return nil
+		return nil
+	})
 }
 
 func (p *Partition) enqueue(m Message) error {
 	log.Printf("partition %s-%d: queue size before enqueue: %d", p.topic, p.index, len(p.queue))
 
 	// First try to enqueue(Non-blocking) to in-memory queue
-	select {
-	case p.queue <- m:
+	err := p.trySend(m)
+	switch {
+	case err == nil:
 		return nil
+	case errors.Is(err, errPartitionClosed):
+		return err
 	default:
 		// Queue is full - persist as fallback before rejecting
 		log.Printf("partition %s-%d: queue full (%d messages), persisting message %s as fallback", p.topic, p.index, len(p.queue), m.ID)
+		metrics.RecordBrokerProduceRejected(p.topic, p.index)
 		if err := p.persist(m); err != nil {
 			log.Printf("partition %s-%d: failed to persist fallback message %s: %v", p.topic, p.index, m.ID, err)
-			return fmt.Errorf("queue full and persistence failed: %v", err)
+			return fmt.Errorf("%w and persistence failed: %v", errQueueFull, err)
 		}
-		return fmt.Errorf("queue full (%d messages), message persisted as fallback", len(p.queue))
+		return fmt.Errorf("%w (%d messages), message persisted as fallback", errQueueFull, len(p.queue))
 	}
 }
 
+// enqueuePersisted writes m to the partition log and syncs it before queueing
+// it, so a nil error means the message survives a broker restart.
+func (p *Partition) enqueuePersisted(m Message) error {
+	if err := p.persistSync(m); err != nil {
+		if errors.Is(err, errPartitionClosed) {
+			return err
+		}
+		return fmt.Errorf("persist failed: %w", err)
+	}
+
+	err := p.trySend(m)
+	if errors.Is(err, errQueueFull) {
+		metrics.RecordBrokerProduceRejected(p.topic, p.index)
+		return fmt.Errorf("%w (%d messages), message persisted", errQueueFull, len(p.queue))
+	}
+	return err
+}
+
 func (p *Partition) monitorPending() {
 	ticker := time.NewTicker(100 * time.Second)
 
@@ -191,48 +582,171 @@ func (p *Partition) monitorPending() {
 		case <-p.ctx.Done():
 			return
 		case now := <-ticker.C:
-			p.pendingMu.Lock()
-			for id, pd := range p.pending {
-				if now.After(pd.deadline) {
-					// requeue the message
-					log.Printf("visibility timeout: requeue msg %s (topic=%s p=%d group=%s)", id, p.topic, p.index, pd.group)
-					// remove from pending and re-enqueue
-					delete(p.pending, id)
-					// push back to queue (as new attempt; ID remains same)
-					log.Printf("partition %s-%d: queue size before requeue: %d", p.topic, p.index, len(p.queue))
-					select {
-					case p.queue <- pd.msg:
-						// Successfully requeued
-						delete(p.pending, id)
-					default:
-						// Queue is full, cannot requeue - message will be lost
-						log.Printf("partition %s-%d: cannot requeue message %s - queue full, message lost", p.topic, p.index, id)
-					}
-				}
-			}
-			p.pendingMu.Unlock()
+			p.requeueExpired(now)
 		}
 	}
 }
 
-func (p *Partition) fetchAndTrack(group string) (Message, error) {
-	select {
-	case <-p.ctx.Done():
-		return Message{}, errors.New("partition closed")
-	case msg := <-p.queue:
-		// track as pending for this group
+// requeueExpired moves in-flight messages whose visibility deadline has passed
+// back onto the queue, or in ordered mode ahead of it. A message that finds
+// the queue full stays pending and is retried on later checks; once it has
+// been expired for evictAfter it is evicted and lost.
+func (p *Partition) requeueExpired(now time.Time) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	for id, pd := range p.pending {
+		if !now.After(pd.deadline) {
+			continue
+		}
+		if !pd.requeueFailed {
+			log.Printf("visibility timeout: requeue msg %s (topic=%s p=%d group=%s)", id, p.topic, p.index, pd.group)
+			p.releaseSlot(pd.group)
+		}
+		// push back to queue (as new attempt; ID remains same)
+		log.Printf("partition %s-%d: queue size before requeue: %d", p.topic, p.index, len(p.queue))
+		var err error
+		if p.requeueMode == requeueOrdered {
+			err = p.requeueInOrder(pd.msg)
+		} else {
+			err = p.trySend(pd.msg)
+		}
+		if err == nil {
+			p.untrackPending(id, pd)
+			continue
+		}
+		if !errors.Is(err, errQueueFull) {
+			// Partition closed, cannot requeue - message will be lost
+			p.untrackPending(id, pd)
+			log.Printf("partition %s-%d: cannot requeue message %s - %v, message lost", p.topic, p.index, id, err)
+			continue
+		}
+
+		metrics.RecordBrokerRequeueDropped(p.topic, p.index)
+		if now.Sub(pd.deadline) >= p.evictAfter {
+			p.untrackPending(id, pd)
+			metrics.RecordBrokerPendingEvicted(p.topic, p.index)
+			log.Printf("partition %s-%d: evicting message %s, expired %v ago and the queue is still full, message lost",
+				p.topic, p.index, id, now.Sub(pd.deadline).Round(time.Second))
+			continue
+		}
+		log.Printf("partition %s-%d: cannot requeue message %s - %v, will retry", p.topic, p.index, id, err)
+		pd.requeueFailed = true
+		p.pending[id] = pd
+	}
+}
+
+// reserveSlot takes one of group's in-flight slots, waiting for an ack or
+// requeue to free one while the group is at its limit or the partition's
+// pending messages are at the byte cap
+func (p *Partition) reserveSlot(group string, timeout <-chan time.Time) error {
+	for {
 		p.pendingMu.Lock()
-		p.pending[msg.ID] = pending{
-			msg:      msg,
-			deadline: time.Now().Add(p.visTO),
-			group:    group,
+		underBytes := p.maxPendingBytes <= 0 || p.pendingBytes < p.maxPendingBytes
+		if underBytes && (p.maxInFlight <= 0 || p.inFlight[group] < p.maxInFlight) {
+			p.inFlight[group]++
+			p.pendingMu.Unlock()
+			return nil
 		}
+		freed := p.freed
 		p.pendingMu.Unlock()
-		return msg, nil
-	case <-time.After(5 * time.Second):
-		// Return empty message after timeout - consumer will retry
-		return Message{}, errors.New("no messages available")
+
+		select {
+		case <-p.ctx.Done():
+			return errPartitionClosed
+		case <-freed:
+		case <-timeout:
+			return errNoMessages
+		}
+	}
+}
+
+// releaseSlot gives back one of group's in-flight slots and wakes fetches
+// waiting for one. The caller must hold pendingMu.
+func (p *Partition) releaseSlot(group string) {
+	if p.inFlight[group]--; p.inFlight[group] <= 0 {
+		delete(p.inFlight, group)
+	}
+	p.wakeFetches()
+}
+
+// wakeFetches wakes fetches waiting in reserveSlot to check again. The caller
+// must hold pendingMu.
+func (p *Partition) wakeFetches() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// trackPending adds a delivered message to pending. The caller must hold
+// pendingMu.
+func (p *Partition) trackPending(id string, pd pending) {
+	p.pending[id] = pd
+	p.pendingBytes += int64(len(pd.msg.Payload))
+	metrics.SetBrokerPendingBytes(p.topic, p.index, p.pendingBytes)
+}
+
+// untrackPending removes a message from pending, waking fetches held back by
+// the byte cap. The caller must hold pendingMu.
+func (p *Partition) untrackPending(id string, pd pending) {
+	delete(p.pending, id)
+	p.pendingBytes -= int64(len(pd.msg.Payload))
+	metrics.SetBrokerPendingBytes(p.topic, p.index, p.pendingBytes)
+	if p.maxPendingBytes > 0 {
+		p.wakeFetches()
+	}
+}
+
+// fetchAndTrack hands the next message to group and tracks it as pending
+// until acked. It returns errNoMessages if nothing arrived, or the group
+// stayed at its in-flight limit or the partition at its pending byte cap, for
+// the whole wait. The cap is checked before the message is taken, so it can be
+// overshot by the last message let through.
+func (p *Partition) fetchAndTrack(group string, wait time.Duration) (Message, error) {
+	// Messages still buffered after Close stay on disk for the next start
+	if p.ctx.Err() != nil {
+		return Message{}, errPartitionClosed
+	}
+	timeout := time.After(wait)
+	if err := p.reserveSlot(group, timeout); err != nil {
+		return Message{}, err
+	}
+	msg, err := p.receive(timeout)
+	if err != nil {
+		// After a timeout the consumer will retry
+		p.cancelSlot(group)
+		return Message{}, err
+	}
+	// track as pending for this group
+	p.pendingMu.Lock()
+	p.trackPending(msg.ID, pending{
+		msg:      msg,
+		deadline: time.Now().Add(p.visTO),
+		group:    group,
+	})
+	p.pendingMu.Unlock()
+	p.touch()
+	return msg, nil
+}
+
+// fetchAuto takes the next message without tracking it as pending, for
+// ack_mode=auto consumers: nothing is held against the group's in-flight
+// limit, no ack is expected, and a message lost in transit is not redelivered
+func (p *Partition) fetchAuto(wait time.Duration) (Message, error) {
+	if p.ctx.Err() != nil {
+		return Message{}, errPartitionClosed
+	}
+	msg, err := p.receive(time.After(wait))
+	if err != nil {
+		return Message{}, err
 	}
+	p.touch()
+	return msg, nil
+}
+
+// cancelSlot releases a slot reserved by a fetch that got no message
+func (p *Partition) cancelSlot(group string) {
+	p.pendingMu.Lock()
+	p.releaseSlot(group)
+	p.pendingMu.Unlock()
 }
 
 func (p *Partition) ack(msgID string, group string) bool {
@@ -246,37 +760,261 @@ func (p *Partition) ack(msgID string, group string) bool {
 		// ack from wrong group/consumer
 		return false
 	}
-	delete(p.pending, msgID)
+	p.untrackPending(msgID, pd)
+	// A late ack for a message waiting to be requeued still counts, but its
+	// slot was already given back
+	if !pd.requeueFailed {
+		p.releaseSlot(group)
+	}
+	p.lastAcked[group] = ackMark{id: msgID, offset: pd.msg.Offset}
+	p.touch()
 	return true
 }
 
+// ackMark identifies an acked message by ID and offset
+type ackMark struct {
+	id     string
+	offset int64
+}
+
+// resumeAfter returns the messages group should get again when its consumer
+// reconnects having processed everything up to lastID: the group's pending
+// messages with higher offsets, oldest first, with fresh visibility
+// deadlines. lastID may be the group's last acked message or one of its
+// pending ones; for any other ID nothing is resent, and unacked messages come
+// back once their visibility timeout expires as usual.
+func (p *Partition) resumeAfter(group, lastID string) []Message {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	var after int64
+	if mark, ok := p.lastAcked[group]; ok && mark.id == lastID {
+		after = mark.offset
+	} else if pd, ok := p.pending[lastID]; ok && pd.group == group {
+		after = pd.msg.Offset
+	} else {
+		return nil
+	}
+
+	var resend []Message
+	deadline := time.Now().Add(p.visTO)
+	for id, pd := range p.pending {
+		if pd.group == group && !pd.requeueFailed && pd.msg.Offset > after {
+			pd.deadline = deadline
+			p.pending[id] = pd
+			resend = append(resend, pd.msg)
+		}
+	}
+	sort.Slice(resend, func(i, j int) bool { return resend[i].Offset < resend[j].Offset })
+	return resend
+}
+
+// partitionState is one partition's entry in the /partitions response
+type partitionState struct {
+	Topic      string `json:"topic"`
+	Partition  int    `json:"partition"`
+	QueueDepth int    `json:"queue_depth"` // messages waiting for delivery
+	Pending    int    `json:"pending"`     // delivered but not yet acked
+	// PendingBytes is the payload size of the pending messages
+	PendingBytes int64 `json:"pending_bytes"`
+	Produced     int64 `json:"produced"` // queued since the broker started
+	NextOffset   int64 `json:"next_offset"`
+	// LastActivity is the last produce, delivery or ack; omitted if none yet
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+}
+
+// state returns a snapshot of the partition's counters
+func (p *Partition) state() partitionState {
+	p.pendingMu.Lock()
+	pendingCount := len(p.pending)
+	pendingBytes := p.pendingBytes
+	redeliverCount := len(p.redeliver)
+	p.pendingMu.Unlock()
+
+	st := partitionState{
+		Topic:        p.topic,
+		Partition:    p.index,
+		QueueDepth:   len(p.queue) + redeliverCount,
+		Pending:      pendingCount,
+		PendingBytes: pendingBytes,
+		Produced:     atomic.LoadInt64(&p.produced),
+		NextOffset:   atomic.LoadInt64(&p.nextOffset),
+	}
+	if ns := atomic.LoadInt64(&p.lastActivity); ns != 0 {
+		last := time.Unix(0, ns).UTC()
+		st.LastActivity = &last
+	}
+	return st
+}
+
+// pendingByGroup counts the partition's unacked messages per consumer group,
+// leaving out expired ones waiting to be requeued
+func (p *Partition) pendingByGroup() map[string]int {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	counts := make(map[string]int)
+	for _, pd := range p.pending {
+		if !pd.requeueFailed {
+			counts[pd.group]++
+		}
+	}
+	return counts
+}
+
 // Broker coordinates topics and partitions.
 type Broker struct {
-	topics       map[string]int // topic -> partitions count
+	topics map[string]int // topic -> partitions count
+	// partitions holds topic -> partition -> Partition. partitionsMu guards
+	// both levels: the inner maps grow as partitions are created on demand,
+	// so they are only read under RLock and only written under Lock, and
+	// callers copy out what they need rather than keep an inner map.
 	partitions   map[string]map[int]*Partition
 	visTO        time.Duration
 	brokerIndex  int
 	brokerCount  int
+	storageDir   string
 	partitionsMu sync.RWMutex
+
+	// newStore opens the log store of each partition as it is created
+	newStore storeFactory
+
+	// nextPartition is the round-robin position of each topic for produces
+	// that don't name a partition
+	nextPartition   map[string]int
+	nextPartitionMu sync.Mutex
+
+	// maxMessageBytes caps produce request bodies
+	maxMessageBytes int64
+
+	// produceLimiters holds the produce rate limit of each limited topic;
+	// it isn't modified after NewBroker
+	produceLimiters map[string]*produceLimiter
+
+	// advertisedURL is reported in owningBrokerHeader on produce and consume
+	// responses
+	advertisedURL string
+
+	// highWatermark is the queue fill, in percent, above which produces get
+	// 429 (0 disables backpressure)
+	highWatermark int
+
+	// heartbeatInterval is how long a consume stream may stay silent before
+	// a keepalive comment is sent (0 disables heartbeats)
+	heartbeatInterval time.Duration
+
+	// pollBackoffMin and pollBackoffMax bound the pause between fetches on an
+	// idle consume stream
+	pollBackoffMin time.Duration
+	pollBackoffMax time.Duration
+
+	// groups records the consumer groups active on each topic
+	groups *groupRegistry
+
+	// ready is set once the broker is initialized and about to serve
+	ready health.Readiness
+
+	// lagExported holds the broker_consumer_lag series set by the last
+	// sample, so those of groups that went idle can be deleted; guarded by lagMu
+	lagMu       sync.Mutex
+	lagExported map[lagSeries]bool
+
+	// done is closed by Close to stop background work
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewBroker(topics map[string]int, visTO time.Duration, brokerIndex, brokerCount int) (*Broker, error) {
+func NewBroker(cfg BrokerConfig, visTO time.Duration) (*Broker, error) {
 	b := &Broker{
-		topics:      topics,
-		partitions:  make(map[string]map[int]*Partition),
-		visTO:       visTO,
-		brokerIndex: brokerIndex,
-		brokerCount: brokerCount,
+		topics:            cfg.Topics,
+		partitions:        make(map[string]map[int]*Partition),
+		nextPartition:     make(map[string]int),
+		visTO:             visTO,
+		brokerIndex:       cfg.BrokerIndex,
+		brokerCount:       cfg.BrokerCount,
+		storageDir:        cfg.StorageDir,
+		newStore:          fileStoreFactory(cfg.StorageDir),
+		maxMessageBytes:   cfg.MaxMessageBytes,
+		produceLimiters:   newProduceLimiters(cfg.TopicRateLimits),
+		advertisedURL:     advertisedURL(cfg),
+		highWatermark:     getQueueHighWatermark(),
+		heartbeatInterval: getHeartbeatInterval(),
+		groups:            newGroupRegistry(getGroupIdleTimeout()),
+		done:              make(chan struct{}),
+	}
+	b.pollBackoffMin, b.pollBackoffMax = getPollBackoff()
+	if interval := getLagSampleInterval(); interval > 0 {
+		go b.sampleLagEvery(interval)
 	}
 	// Initialize partition maps for topics but don't create partitions yet
-	for topic := range topics {
+	for topic := range cfg.Topics {
 		b.partitions[topic] = make(map[int]*Partition)
 		log.Printf("initialized topic %s (partitions will be created on-demand)", topic)
 	}
+	for topic, rate := range cfg.TopicRateLimits {
+		log.Printf("topic %s: produces limited to %g messages/sec", topic, rate)
+	}
+	if getPrewarmPartitions() {
+		if err := b.prewarmPartitions(); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
 	return b, nil
 }
 
+// advertisedURL returns the address the broker reports itself at: the
+// configured one, or http://<hostname>:<port>
+func advertisedURL(cfg BrokerConfig) string {
+	if cfg.AdvertisedURL != "" {
+		return cfg.AdvertisedURL
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s:%s", host, cfg.Port)
+}
+
+// owns reports whether partition is assigned to this broker instance:
+// partition % BROKER_COUNT == BROKER_INDEX
+func (b *Broker) owns(partition int) bool {
+	return b.brokerCount <= 1 || partition%b.brokerCount == b.brokerIndex
+}
+
+// prewarmPartitions creates the partitions of the configured topics that this
+// broker owns, so the first produce to each doesn't pay for opening its log
+// and starting its goroutines
+func (b *Broker) prewarmPartitions() error {
+	b.partitionsMu.RLock()
+	topics := make(map[string]int, len(b.topics))
+	for topic, count := range b.topics {
+		topics[topic] = count
+	}
+	b.partitionsMu.RUnlock()
+
+	start := time.Now()
+	created := 0
+	for topic, count := range topics {
+		for partition := 0; partition < count; partition++ {
+			if !b.owns(partition) {
+				continue
+			}
+			if _, err := b.createPartitionIfNotExists(topic, partition); err != nil {
+				return fmt.Errorf("prewarm %s-%d: %w", topic, partition, err)
+			}
+			created++
+		}
+	}
+	log.Printf("prewarmed %d partitions across %d topics in %v", created, len(topics), time.Since(start))
+	return nil
+}
+
 func (b *Broker) Close() {
+	// Stop taking readiness traffic before partitions go away
+	b.ready.SetReady(false)
+	b.closeOnce.Do(func() { close(b.done) })
+	b.partitionsMu.RLock()
+	defer b.partitionsMu.RUnlock()
 	for _, pm := range b.partitions {
 		for _, p := range pm {
 			p.Close()
@@ -284,15 +1022,26 @@ func (b *Broker) Close() {
 	}
 }
 
-// createPartitionIfNotExists creates a partition if it doesn't exist
+// createPartitionIfNotExists creates a partition if it doesn't exist. It
+// holds partitionsMu for writing throughout, so of concurrent produces to a
+// new partition exactly one creates it, and listings never see a half-built
+// topic map.
 func (b *Broker) createPartitionIfNotExists(topic string, partition int) (*Partition, error) {
 	b.partitionsMu.Lock()
 	defer b.partitionsMu.Unlock()
 
+	// Close closes done before it walks the partitions, so a partition
+	// created after that would never be closed
+	select {
+	case <-b.done:
+		return nil, errPartitionClosed
+	default:
+	}
+
 	// Check if topic exists
 	pm, ok := b.partitions[topic]
 	if !ok {
-		return nil, fmt.Errorf("unknown topic")
+		return nil, errUnknownTopic
 	}
 
 	// Check if partition already exists
@@ -303,14 +1052,14 @@ func (b *Broker) createPartitionIfNotExists(topic string, partition int) (*Parti
 	// Check if partition is within valid range
 	maxPartitions, ok := b.topics[topic]
 	if !ok {
-		return nil, fmt.Errorf("unknown topic")
+		return nil, errUnknownTopic
 	}
 	if partition >= maxPartitions {
 		return nil, fmt.Errorf("partition %d exceeds max partitions %d for topic %s", partition, maxPartitions, topic)
 	}
 
 	// Create new partition
-	p, err := newPartition(topic, partition, b.visTO)
+	p, err := newPartition(b.newStore, topic, partition, b.visTO)
 	if err != nil {
 		return nil, fmt.Errorf("create partition %s-%d error: %w", topic, partition, err)
 	}
@@ -325,7 +1074,7 @@ func (b *Broker) getPartition(topic string, partition int, isProduceHandling boo
 	pm, ok := b.partitions[topic]
 	if !ok {
 		b.partitionsMu.RUnlock()
-		return nil, fmt.Errorf("unknown topic")
+		return nil, errUnknownTopic
 	}
 	p, exists := pm[partition]
 	b.partitionsMu.RUnlock()
@@ -342,43 +1091,223 @@ func (b *Broker) getPartition(topic string, partition int, isProduceHandling boo
 	return p, nil
 }
 
-// produceHandler: POST /produce?topic=foo&partition=0
-// body: raw payload (text) or JSON {"payload":"..."}
-// If partition is not specified, auto-assign to an available partition
-func (b *Broker) produceHandler(w http.ResponseWriter, r *http.Request) {
-	topic := r.URL.Query().Get("topic")
-	partStr := r.URL.Query().Get("partition")
-	log.Printf("Broker received produce request: topic=%s, partition=%s", topic, partStr)
+// choosePartition picks the partition for a produce that didn't name one: the
+// hash of key when one is given, so equal keys share a partition, otherwise the
+// topic's next partition in round-robin order
+func (b *Broker) choosePartition(topic, key string) (int, error) {
+	b.partitionsMu.RLock()
+	count, ok := b.topics[topic]
+	b.partitionsMu.RUnlock()
+	if !ok {
+		return 0, errUnknownTopic
+	}
+	if count <= 0 {
+		return 0, fmt.Errorf("topic %s has no partitions", topic)
+	}
 
-	if topic == "" || partStr == "" {
-		log.Printf("Rejecting request: topic and partition required")
-		http.Error(w, "topic and partition required", http.StatusBadRequest)
-		return
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32() % uint32(count)), nil
 	}
 
-	var part int
+	b.nextPartitionMu.Lock()
+	defer b.nextPartitionMu.Unlock()
+	part := b.nextPartition[topic] % count
+	b.nextPartition[topic] = part + 1
+	return part, nil
+}
+
+// decodeProducePayload extracts the message payload from a produce body.
+// application/json bodies must be a {"payload": "..."} envelope; any other
+// or missing content type is taken as the raw payload.
+func decodeProducePayload(contentType string, body []byte) (string, error) {
+	mediaType := ""
+	if contentType != "" {
+		mt, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", fmt.Errorf("bad content type: %v", err)
+		}
+		mediaType = mt
+	}
+	if mediaType != "application/json" {
+		return string(body), nil
+	}
+
+	var envelope struct {
+		Payload *string `json:"payload"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&envelope); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if dec.More() {
+		return "", errors.New("invalid JSON body: unexpected data after envelope")
+	}
+	if envelope.Payload == nil {
+		return "", errors.New(`invalid JSON body: missing "payload" field`)
+	}
+	return *envelope.Payload, nil
+}
+
+// Errors reading a produce body
+var (
+	errMessageTooLarge     = errors.New("message too large")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBadGzip             = errors.New("invalid gzip body")
+)
+
+// cappedReader reads at most limit bytes from r and fails with
+// errMessageTooLarge once there are more. http.MaxBytesReader does the same,
+// but its error can't be told apart from other read failures before Go 1.19.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, errMessageTooLarge
+	}
+	// Read one byte past the cap so an oversized body is noticed
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n + int(c.remaining), errMessageTooLarge
+	}
+	return n, err
+}
+
+// readProduceBody reads a produce request body, decompressing it when its
+// Content-Encoding is gzip. The body is capped at limit both as sent and
+// once decompressed, so a small gzip body can't expand without bound; either
+// cap returns errMessageTooLarge.
+func readProduceBody(r *http.Request, limit int64) ([]byte, error) {
+	body := &cappedReader{r: r.Body, remaining: limit}
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.ReadAll(body)
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, gzipError(err)
+		}
+		defer zr.Close()
+		data, err := io.ReadAll(&cappedReader{r: zr, remaining: limit})
+		if err != nil {
+			return nil, gzipError(err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w %q: only gzip is supported", errUnsupportedEncoding, encoding)
+	}
+}
+
+// gzipError wraps a failure to decompress a gzip body in errBadGzip, unless
+// either the compressed or the decompressed body was too large
+func gzipError(err error) error {
+	if errors.Is(err, errMessageTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errBadGzip, err)
+}
+
+// parseAcks validates the produce acks parameter; empty means acksLeader
+func parseAcks(s string) (string, error) {
+	switch s {
+	case "":
+		return acksLeader, nil
+	case acksNone, acksLeader, acksPersisted:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid acks %q: must be %s, %s or %s", s, acksNone, acksLeader, acksPersisted)
+	}
+}
+
+// produceHandler: POST /produce?topic=foo[&partition=0|&key=k][&acks=none|leader|persisted]
+// body: raw payload (text) or JSON {"payload":"..."}, optionally gzip
+// compressed with Content-Encoding: gzip
+// If partition is not specified, it is chosen by hashing key, or round-robin
+// across the topic's partitions without one
+func (b *Broker) produceHandler(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	partStr := r.URL.Query().Get("partition")
+
+	if topic == "" {
+		http.Error(w, "topic required", http.StatusBadRequest)
+		return
+	}
+	// Checked before the body is read so a throttled producer costs little
+	if limiter := b.produceLimiters[topic]; limiter != nil {
+		if ok, wait := limiter.allow(time.Now()); !ok {
+			metrics.RecordBrokerProduceThrottled(topic)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			http.Error(w, fmt.Sprintf("produce rate limit of %g messages/sec exceeded for topic %s", limiter.rate, topic), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	var part int
 	var err error
 
-	part, err = strconv.Atoi(partStr)
+	if partStr == "" {
+		part, err = b.choosePartition(topic, r.URL.Query().Get("key"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		part, err = strconv.Atoi(partStr)
+		if err != nil {
+			http.Error(w, "bad partition", http.StatusBadRequest)
+			return
+		}
+	}
+	acks, err := parseAcks(r.URL.Query().Get("acks"))
 	if err != nil {
-		http.Error(w, "bad partition", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("Publishing message for partition %d for topic %s", part, topic)
-	body, err := io.ReadAll(r.Body)
+	body, err := readProduceBody(r, b.maxMessageBytes)
 	if err != nil {
-		http.Error(w, "read body error", http.StatusBadRequest)
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			http.Error(w, fmt.Sprintf("message exceeds maximum size of %d bytes", b.maxMessageBytes), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errUnsupportedEncoding):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, errBadGzip):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, "read body error", http.StatusBadRequest)
+		}
 		return
 	}
-	payload := strings.TrimSpace(string(body))
-	// If JSON with payload field, try to decode
-	if strings.HasPrefix(payload, "{") {
-		var tmp struct {
-			Payload string `json:"payload"`
-		}
-		if err := json.Unmarshal([]byte(payload), &tmp); err == nil && tmp.Payload != "" {
-			payload = tmp.Payload
-		}
+	payload, err := decodeProducePayload(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The client gave up while the body was read; a message queued now would
+	// only be sent again by its retry
+	if err := r.Context().Err(); err != nil {
+		http.Error(w, "request deadline passed: "+err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	p, err := b.getPartition(topic, part, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(owningBrokerHeader, b.advertisedURL)
+	if over, wait := p.aboveWatermark(b.highWatermark); over {
+		metrics.RecordBrokerProduceBackpressure(topic, part)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, fmt.Sprintf("partition %s-%d is above its high watermark, slow down", topic, part), http.StatusTooManyRequests)
+		return
 	}
 	msg := Message{
 		ID:        genID(),
@@ -386,25 +1315,96 @@ func (b *Broker) produceHandler(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: time.Now().UTC(),
 		Topic:     topic,
 		Partition: part,
+		Offset:    p.assignOffset(),
 	}
-	p, err := b.getPartition(topic, part, true)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	resp := produceResponse{ID: msg.ID, Partition: msg.Partition, Offset: msg.Offset}
+
+	if acks == acksNone {
+		// The producer asked not to wait, so failures are only logged
+		if err := p.enqueue(msg); err != nil {
+			log.Printf("partition %s-%d: enqueue failed for unacknowledged message %s: %v", topic, part, msg.ID, err)
+		} else {
+			p.recordProduced()
+			metrics.RecordMessageProduced("msg-queue-service", topic)
+			metrics.RecordBrokerMessageBytes(topic, len(msg.Payload))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(resp)
 		return
 	}
-	if err := p.enqueue(msg); err != nil {
+
+	if acks == acksPersisted {
+		err = p.enqueuePersisted(msg)
+	} else {
+		err = p.enqueue(msg)
+	}
+	if err != nil {
+		if errors.Is(err, errPartitionClosed) {
+			// topic deleted or broker shutting down while this produce was in flight
+			http.Error(w, "enqueue failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "enqueue failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Record successful message production
+	p.recordProduced()
 	metrics.RecordMessageProduced("msg-queue-service", topic)
+	metrics.RecordBrokerMessageBytes(topic, len(msg.Payload))
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{"id": msg.ID})
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// produceResponse tells the producer where its message landed. Offsets increase
+// within a partition but may have gaps where a produce failed.
+type produceResponse struct {
+	ID        string `json:"id"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// parseMaxWait parses the optional max_wait consume parameter; empty means wait forever
+func parseMaxWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad max_wait %q: expected a positive duration such as 500ms or 30s", s)
+	}
+	return d, nil
 }
 
-// consumeHandler: GET /consume?topic=foo&partition=0&group=g1
+// parseAckMode parses the optional ack_mode consume parameter and reports
+// whether deliveries are acked automatically
+func parseAckMode(s string) (bool, error) {
+	switch s {
+	case "", ackModeManual:
+		return false, nil
+	case ackModeAuto:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid ack_mode %q: must be %s or %s", s, ackModeManual, ackModeAuto)
+	}
+}
+
+// parseMissing parses the optional missing consume parameter and reports
+// whether a partition that doesn't exist yet is created rather than an error
+func parseMissing(s string) (bool, error) {
+	switch s {
+	case "", missingError:
+		return false, nil
+	case missingWait:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid missing %q: must be %s or %s", s, missingError, missingWait)
+	}
+}
+
+// consumeHandler: GET /consume?topic=foo&partition=0&group=g1[&max_wait=30s][&ack_mode=manual|auto][&missing=error|wait]
 // uses Server-Sent Events (text/event-stream)
 // If partition is not specified, auto-assign to an owned partition
 func (b *Broker) consumeHandler(w http.ResponseWriter, r *http.Request) {
@@ -416,10 +1416,7 @@ func (b *Broker) consumeHandler(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
 	partStr := r.URL.Query().Get("partition")
 	group := r.URL.Query().Get("group")
-	log.Printf("Broker received consume request: topic=%s, partition=%s, group=%s", topic, partStr, group)
-
 	if topic == "" || partStr == "" || group == "" {
-		log.Printf("Rejecting consume request: topic, partition and group required")
 		http.Error(w, "topic, partition and group required", http.StatusBadRequest)
 		return
 	}
@@ -432,15 +1429,59 @@ func (b *Broker) consumeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad partition", http.StatusBadRequest)
 		return
 	}
-	p, err := b.getPartition(topic, part, false)
+	maxWait, err := parseMaxWait(r.URL.Query().Get("max_wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	autoAck, err := parseAckMode(r.URL.Query().Get("ack_mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	waitForPartition, err := parseMissing(r.URL.Query().Get("missing"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Creating the partition is what a produce would do first; the stream then
+	// waits on it like on any empty partition
+	p, err := b.getPartition(topic, part, waitForPartition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer b.groups.openStream(topic, group)()
+
 	// set headers for SSE
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set(owningBrokerHeader, b.advertisedURL)
+
+	// Wait no longer than the heartbeat interval so idle streams get keepalives on time
+	fetchWait := defaultFetchWait
+	if b.heartbeatInterval > 0 && b.heartbeatInterval < fetchWait {
+		fetchWait = b.heartbeatInterval
+	}
+	lastSent := time.Now()
+	// lastMessage tracks idleness for max_wait; keepalives do not reset it
+	lastMessage := lastSent
+	streamed := false
+	backoff := pollBackoff{min: b.pollBackoffMin, max: b.pollBackoffMax}
+
+	// A reconnecting consumer names the last message it processed; resend the
+	// ones it was given after that before handing out new messages. Auto-acked
+	// deliveries leave nothing pending to resend.
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" && !autoAck {
+		for _, msg := range p.resumeAfter(group, lastID) {
+			writeSSEMessage(w, msg)
+			streamed = true
+		}
+		if streamed {
+			flusher.Flush()
+		}
+	}
 
 	ctx := r.Context()
 	// consumer loop
@@ -450,12 +1491,48 @@ func (b *Broker) consumeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		default:
 		}
-		msg, err := p.fetchAndTrack(group)
+		wait := fetchWait
+		if maxWait > 0 {
+			remaining := maxWait - time.Since(lastMessage)
+			if remaining <= 0 {
+				// Nothing arrived within max_wait: 204 if the stream never
+				// started, otherwise end the stream cleanly
+				if !streamed {
+					w.Header().Del("Content-Type")
+					w.WriteHeader(http.StatusNoContent)
+				}
+				return
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		var msg Message
+		if autoAck {
+			msg, err = p.fetchAuto(wait)
+		} else {
+			msg, err = p.fetchAndTrack(group, wait)
+		}
 		if err != nil {
 			// Check if it's a timeout (no messages available) vs partition closed
-			if err.Error() == "no messages available" {
-				// Just continue polling - don't send anything to client
-				time.Sleep(1 * time.Second) // Small delay before retry
+			if errors.Is(err, errNoMessages) {
+				// Send an SSE comment so clients and intermediaries can tell
+				// an idle stream from a dead one
+				if b.heartbeatInterval > 0 && time.Since(lastSent) >= b.heartbeatInterval {
+					fmt.Fprint(w, ": keepalive\n\n")
+					flusher.Flush()
+					lastSent = time.Now()
+					streamed = true
+				}
+				if maxWait == 0 {
+					// Pause briefly before retrying, longer the longer the
+					// stream stays idle
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(backoff.wait()):
+					}
+				}
 				continue
 			}
 			// partition closed or other error
@@ -464,34 +1541,30 @@ func (b *Broker) consumeHandler(w http.ResponseWriter, r *http.Request) {
 		// Record successful message consumption
 		metrics.RecordMessageConsumed("msg-queue-service", topic)
 
-		data, _ := json.Marshal(msg)
-		// SSE format
-		fmt.Fprintf(w, "id: %s\n", msg.ID)
-		fmt.Fprintf(w, "data: %s\n", string(data))
-		fmt.Fprintf(w, "partition: %d\n\n", msg.Partition)
+		writeSSEMessage(w, msg)
 		flusher.Flush()
+		lastSent = time.Now()
+		lastMessage = lastSent
+		streamed = true
+		backoff.reset()
 		// continue to next message
 	}
 }
 
+// writeSSEMessage writes msg as a server-sent event; the event ID is the
+// message ID, which consumers send back as Last-Event-ID to resume
+func writeSSEMessage(w io.Writer, msg Message) {
+	data, _ := json.Marshal(msg)
+	fmt.Fprintf(w, "id: %s\n", msg.ID)
+	fmt.Fprintf(w, "data: %s\n", string(data))
+	fmt.Fprintf(w, "partition: %d\n\n", msg.Partition)
+}
+
 // ackHandler: POST /ack?topic=foo&partition=0&group=g1
 // body: {"id":"..."}
 func (b *Broker) ackHandler(w http.ResponseWriter, r *http.Request) {
-	topic := r.URL.Query().Get("topic")
-	partStr := r.URL.Query().Get("partition")
-	group := r.URL.Query().Get("group")
-	if topic == "" || partStr == "" || group == "" {
-		http.Error(w, "topic, partition and group required", http.StatusBadRequest)
-		return
-	}
-	part, err := strconv.Atoi(partStr)
-	if err != nil {
-		http.Error(w, "bad partition", http.StatusBadRequest)
-		return
-	}
-	p, err := b.getPartition(topic, part, false)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	p, group, ok := b.ackTarget(w, r)
+	if !ok {
 		return
 	}
 	var body struct {
@@ -501,7 +1574,7 @@ func (b *Broker) ackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad body", http.StatusBadRequest)
 		return
 	}
-	ok := p.ack(body.ID, group)
+	ok = p.ack(body.ID, group)
 	if !ok {
 		http.Error(w, "ack failed (unknown id or wrong group)", http.StatusBadRequest)
 		return
@@ -510,18 +1583,297 @@ func (b *Broker) ackHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+// ackBatchResponse reports how many IDs an ack batch removed from pending and
+// why the others were not
+type ackBatchResponse struct {
+	Acked  int          `json:"acked"`
+	Failed []ackFailure `json:"failed"`
+}
+
+type ackFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// ackBatchHandler: POST /ack/batch?topic=&partition=&group= with a JSON array
+// of message IDs. Each ID is acked independently; failures are listed in the
+// response rather than failing the request.
+func (b *Broker) ackBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, group, ok := b.ackTarget(w, r)
+	if !ok {
+		return
+	}
+	var ids []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, b.maxMessageBytes)).Decode(&ids); err != nil || len(ids) == 0 {
+		http.Error(w, "bad body: expected a non-empty JSON array of message ids", http.StatusBadRequest)
+		return
+	}
+
+	resp := ackBatchResponse{Failed: []ackFailure{}}
+	for _, id := range ids {
+		switch {
+		case id == "":
+			resp.Failed = append(resp.Failed, ackFailure{ID: id, Error: "empty id"})
+		case !p.ack(id, group):
+			resp.Failed = append(resp.Failed, ackFailure{ID: id, Error: "unknown id or wrong group"})
+		default:
+			resp.Acked++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ackTarget resolves the partition and group of an ack request, writing a 400
+// and returning false if they are missing or invalid
+func (b *Broker) ackTarget(w http.ResponseWriter, r *http.Request) (*Partition, string, bool) {
+	topic := r.URL.Query().Get("topic")
+	partStr := r.URL.Query().Get("partition")
+	group := r.URL.Query().Get("group")
+	if topic == "" || partStr == "" || group == "" {
+		http.Error(w, "topic, partition and group required", http.StatusBadRequest)
+		return nil, "", false
+	}
+	part, err := strconv.Atoi(partStr)
+	if err != nil {
+		http.Error(w, "bad partition", http.StatusBadRequest)
+		return nil, "", false
+	}
+	p, err := b.getPartition(topic, part, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	b.groups.touch(topic, group)
+	return p, group, true
+}
+
 func (b *Broker) topicsHandler(w http.ResponseWriter, r *http.Request) {
 	// returns partitions owned by this broker
 	out := make(map[string][]int)
+	b.partitionsMu.RLock()
 	for t, pm := range b.partitions {
 		for idx := range pm {
 			out[t] = append(out[t], idx)
 		}
 	}
+	b.partitionsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// topicMetadata is one topic's entry in the /metadata response
+type topicMetadata struct {
+	Partitions          int   `json:"partitions"`
+	VisibilityTimeoutMs int64 `json:"visibility_timeout_ms"`
+}
+
+// metadataHandler: GET /metadata
+// reports the configuration of every topic: its partition count, including
+// partitions not created yet, and how long a delivery stays pending before
+// it is redelivered. The proxy reads it to route each topic within its range.
+func (b *Broker) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.partitionsMu.RLock()
+	topics := make(map[string]topicMetadata, len(b.topics))
+	for topic, count := range b.topics {
+		topics[topic] = topicMetadata{Partitions: count, VisibilityTimeoutMs: b.visTO.Milliseconds()}
+	}
+	b.partitionsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"broker_index": b.brokerIndex,
+		"topics":       topics,
+	})
+}
+
+// partitionsHandler: GET /partitions
+// reports the state of every partition this broker owns, sorted by topic and partition
+func (b *Broker) partitionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var parts []*Partition
+	b.partitionsMu.RLock()
+	for _, pm := range b.partitions {
+		for _, p := range pm {
+			parts = append(parts, p)
+		}
+	}
+	b.partitionsMu.RUnlock()
+
+	out := make([]partitionState, 0, len(parts))
+	for _, p := range parts {
+		out = append(out, p.state())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Partition < out[j].Partition
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(out)
 }
 
+// groupState is one consumer group's entry in the /groups response
+type groupState struct {
+	groupActivity
+	Pending int `json:"pending"` // unacked messages across the topic's partitions
+}
+
+// groupsHandler: GET /groups?topic=<topic>
+// lists the consumer groups active on a topic with their unacked message counts
+func (b *Broker) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "topic required", http.StatusBadRequest)
+		return
+	}
+
+	var parts []*Partition
+	b.partitionsMu.RLock()
+	pm, ok := b.partitions[topic]
+	for _, p := range pm {
+		parts = append(parts, p)
+	}
+	b.partitionsMu.RUnlock()
+	if !ok {
+		http.Error(w, errUnknownTopic.Error(), http.StatusNotFound)
+		return
+	}
+
+	pending := make(map[string]int)
+	for _, p := range parts {
+		for group, n := range p.pendingByGroup() {
+			pending[group] += n
+		}
+	}
+
+	groups := make([]groupState, 0)
+	for _, g := range b.groups.list(topic, time.Now()) {
+		groups = append(groups, groupState{groupActivity: g, Pending: pending[g.Group]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"topic":  topic,
+		"groups": groups,
+	})
+}
+
+// topicHandler routes /topics/{topic}: GET describes the topic, DELETE removes it
+func (b *Broker) topicHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		b.topicInfoHandler(w, r)
+		return
+	}
+	b.deleteTopicHandler(w, r)
+}
+
+// topicInfoHandler: GET /topics/{topic}
+// reports the topic's configured partition count, so clients spread publishes
+// and consumers over every partition rather than guessing from their own config
+func (b *Broker) topicInfoHandler(w http.ResponseWriter, r *http.Request) {
+	topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+	if topic == "" || strings.Contains(topic, "/") {
+		http.Error(w, "bad topic", http.StatusBadRequest)
+		return
+	}
+
+	b.partitionsMu.RLock()
+	count, ok := b.topics[topic]
+	b.partitionsMu.RUnlock()
+	if !ok {
+		http.Error(w, errUnknownTopic.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"topic":      topic,
+		"partitions": count,
+	})
+}
+
+// deleteTopicHandler: DELETE /topics/{topic}[?purge=true]
+// closes the topic's partitions and forgets the topic; purge also removes its logs from disk
+func (b *Broker) deleteTopicHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+	if topic == "" || strings.Contains(topic, "/") || topic == "." || topic == ".." {
+		http.Error(w, "bad topic", http.StatusBadRequest)
+		return
+	}
+	purge := r.URL.Query().Get("purge") == "true"
+
+	closed, err := b.deleteTopic(topic, purge)
+	if err != nil {
+		if errors.Is(err, errUnknownTopic) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"topic":             topic,
+		"partitions_closed": closed,
+		"purged":            purge,
+	})
+}
+
+// deleteTopic removes a topic and closes its partitions, returning how many were closed.
+// The topic is unlinked under the partitions lock first, so new produces fail with
+// unknown topic; produces already holding a partition fail once it is closed.
+func (b *Broker) deleteTopic(topic string, purge bool) (int, error) {
+	b.partitionsMu.Lock()
+	pm, ok := b.partitions[topic]
+	if !ok {
+		b.partitionsMu.Unlock()
+		return 0, errUnknownTopic
+	}
+	delete(b.partitions, topic)
+	delete(b.topics, topic)
+	b.partitionsMu.Unlock()
+	b.groups.forget(topic)
+
+	for _, p := range pm {
+		p.Close()
+	}
+	log.Printf("deleted topic %s (%d partitions closed)", topic, len(pm))
+
+	if purge {
+		dir := filepath.Join(b.storageDir, topic)
+		if err := os.RemoveAll(dir); err != nil {
+			return len(pm), fmt.Errorf("remove %s: %w", dir, err)
+		}
+		log.Printf("purged topic %s logs from %s", topic, dir)
+	}
+	return len(pm), nil
+}
+
 func (b *Broker) healthHandler(w http.ResponseWriter, r *http.Request) {
 	// Simple health check - return owned partitions count
 	b.partitionsMu.RLock()
@@ -549,47 +1901,17 @@ func main() {
 	metrics.InitMetrics("msg-queue-service")
 	log.Println("Prometheus metrics initialized")
 
-	// Configuration (could be flags/env)
-	topicsConf := map[string]int{
-		"events":  8,
-		"orders":  4,
-		"default": 8,
+	// Configuration from flags, then env, then defaults
+	cfg, err := loadBrokerConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
 	}
 	visTO := defaultVisibilityTimeout
 
-	// Broker index/count for partition ownership (env)
-	brokerIndex := 0
-	brokerCount := 1
-	if v := os.Getenv("BROKER_INDEX"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			brokerIndex = n
-		}
-	}
-	if v := os.Getenv("BROKER_COUNT"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			brokerCount = n
-		}
-	}
-	// override topics via env TOPICS=events:8,orders:4
-	if tcfg := os.Getenv("TOPICS"); tcfg != "" {
-		topicsConf = map[string]int{}
-		for _, part := range strings.Split(tcfg, ",") {
-			if part == "" {
-				continue
-			}
-			kv := strings.Split(part, ":")
-			if len(kv) != 2 {
-				continue
-			}
-			n, _ := strconv.Atoi(kv[1])
-			topicsConf[kv[0]] = n
-		}
-	}
-
 	// Create storage dir
-	_ = os.MkdirAll(storageDir, 0o755)
+	_ = os.MkdirAll(cfg.StorageDir, 0o755)
 
-	broker, err := NewBroker(topicsConf, visTO, brokerIndex, brokerCount)
+	broker, err := NewBroker(cfg, visTO)
 	if err != nil {
 		log.Fatalf("broker init failed: %v", err)
 	}
@@ -599,20 +1921,27 @@ func main() {
 	mux.HandleFunc("/produce", broker.produceHandler)
 	mux.HandleFunc("/consume", broker.consumeHandler)
 	mux.HandleFunc("/ack", broker.ackHandler)
+	mux.HandleFunc("/ack/batch", broker.ackBatchHandler)
 	mux.HandleFunc("/topics", broker.topicsHandler)
+	mux.HandleFunc("/topics/", broker.topicHandler)
+	mux.HandleFunc("/partitions", broker.partitionsHandler)
+	mux.HandleFunc("/metadata", broker.metadataHandler)
+	mux.HandleFunc("/groups", broker.groupsHandler)
+	// Replaying redelivers old messages, so only other services may ask for it
+	mux.Handle("/replay", security.ServiceAuthMiddleware(http.HandlerFunc(broker.replayHandler)))
 	mux.HandleFunc("/health", broker.healthHandler)
+	mux.HandleFunc("/ready", broker.ready.Handler())
+	mux.HandleFunc("/version", buildinfo.Handler("msg-queue-service"))
 
 	// Add Prometheus metrics endpoint
 	mux.Handle("/metrics", metrics.MetricsHandler())
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	addr := ":" + port
+	addr := ":" + cfg.Port
 	queueSize := getQueueSize()
-	log.Printf("Message Broker starting on %s (index=%d count=%d, queue_size=%d)", addr, brokerIndex, brokerCount, queueSize)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	log.Printf("Message Broker starting on %s (index=%d count=%d, queue_size=%d)", addr, cfg.BrokerIndex, cfg.BrokerCount, queueSize)
+	broker.ready.SetReady(true)
+	handler := reqlog.Middleware(log.Default(), reqlog.SampleRateFromEnv(), deadlineMiddleware(mux))
+	log.Fatal(security.ListenAndServe(&http.Server{Addr: addr, Handler: handler}))
 }
 
 // genID generates a URL-safe random id (~22 chars).
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/shared"
+	"github.com/example/telemetry/internal/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestMessage(t *testing.T) {
@@ -344,3 +359,2124 @@ func TestIDGeneration(t *testing.T) {
 		}
 	})
 }
+
+func TestPersistSyncPolicy(t *testing.T) {
+	tests := []struct {
+		name             string
+		mode             string
+		ms               string
+		expectedMode     string
+		expectedInterval time.Duration
+	}{
+		{"Default", "", "", syncNone, 0},
+		{"None", "none", "", syncNone, 0},
+		{"Always", "always", "", syncAlways, 0},
+		{"Interval default", "interval", "", syncInterval, defaultSyncInterval},
+		{"Interval custom", "interval", "50", syncInterval, 50 * time.Millisecond},
+		{"Interval invalid ms", "interval", "abc", syncInterval, defaultSyncInterval},
+		{"Unknown mode", "sometimes", "", syncNone, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PERSIST_SYNC", tt.mode)
+			t.Setenv("PERSIST_SYNC_MS", tt.ms)
+
+			mode, interval := getPersistSync()
+			if mode != tt.expectedMode {
+				t.Errorf("Expected mode %s, got %s", tt.expectedMode, mode)
+			}
+			if interval != tt.expectedInterval {
+				t.Errorf("Expected interval %v, got %v", tt.expectedInterval, interval)
+			}
+		})
+	}
+}
+
+func TestPersistSurvivesRestart(t *testing.T) {
+	for _, mode := range []string{syncNone, syncAlways, syncInterval} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("PERSIST_SYNC", mode)
+			t.Setenv("PERSIST_SYNC_MS", "10")
+
+			p, err := newPartition(fileStoreFactory(dir), "telemetry", 0, time.Second)
+			if err != nil {
+				t.Fatalf("Failed to create partition: %v", err)
+			}
+			defer p.Close()
+
+			msg := Message{ID: "durable-" + mode, Payload: "data", CreatedAt: time.Now(), Topic: "telemetry"}
+			if err := p.persist(msg); err != nil {
+				t.Fatalf("persist failed: %v", err)
+			}
+			if mode == syncInterval {
+				// Give the background flusher a chance to run
+				time.Sleep(50 * time.Millisecond)
+				p.storeMu.Lock()
+				dirty := p.dirty
+				p.storeMu.Unlock()
+				if dirty {
+					t.Errorf("Expected interval flusher to have synced the write")
+				}
+			}
+
+			// Simulate a restart by reading the log directly while the partition is still open
+			content, err := os.ReadFile(filepath.Join(dir, "telemetry", "partition-0.log"))
+			if err != nil {
+				t.Fatalf("Failed to read partition log: %v", err)
+			}
+			if !strings.Contains(string(content), msg.ID) {
+				t.Errorf("Expected persisted message %s in log, got %q", msg.ID, string(content))
+			}
+		})
+	}
+}
+
+// newTestBroker creates a broker with a single two-partition telemetry topic
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	cfg := BrokerConfig{
+		Topics:      map[string]int{"telemetry": 2},
+		BrokerCount: 1,
+		Port:        "8080",
+		StorageDir:  t.TempDir(),
+
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+func TestConsumeHeartbeat(t *testing.T) {
+	b := newTestBroker(t)
+	b.heartbeatInterval = 50 * time.Millisecond
+	if _, err := b.getPartition("telemetry", 0, true); err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(b.consumeHandler))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/consume?topic=telemetry&partition=0&group=g1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Consume request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == ": keepalive" {
+			return
+		}
+	}
+	t.Fatalf("Expected a keepalive comment on an idle partition, stream ended: %v", scanner.Err())
+}
+
+func TestHeartbeatIntervalFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultHeartbeatInterval},
+		{"250", 250 * time.Millisecond},
+		{"0", 0},
+		{"-5", defaultHeartbeatInterval},
+		{"abc", defaultHeartbeatInterval},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("HEARTBEAT_INTERVAL_MS", tt.value)
+		if got := getHeartbeatInterval(); got != tt.expected {
+			t.Errorf("HEARTBEAT_INTERVAL_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestConsumeFirstMessageAfterIdle(t *testing.T) {
+	b := newTestBroker(t)
+	// Short fetch windows so an idle stream spends most of its time pausing
+	// between fetches, where a fixed one-second pause used to delay delivery
+	b.heartbeatInterval = 20 * time.Millisecond
+	if _, err := b.getPartition("telemetry", 0, true); err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(b.consumeHandler))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/consume?topic=telemetry&partition=0&group=g1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Consume request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	received := make(chan time.Time, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "id: ") {
+				received <- time.Now()
+				return
+			}
+		}
+	}()
+
+	// Stay idle long enough for the pause to reach its cap (10ms doubling to
+	// 250ms takes about half a second)
+	time.Sleep(time.Second)
+	produced := time.Now()
+	produceAt(t, b, 0, "")
+
+	select {
+	case at := <-received:
+		if latency := at.Sub(produced); latency > 2*defaultPollBackoffMax {
+			t.Errorf("Expected the message within %v of an idle period, took %v", 2*defaultPollBackoffMax, latency)
+		}
+	case <-ctx.Done():
+		t.Fatal("Message never arrived")
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	pb := pollBackoff{min: 10 * time.Millisecond, max: 50 * time.Millisecond}
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, pb.wait())
+	}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i := range want {
+		if got[i] != want[i]*time.Millisecond {
+			t.Fatalf("Expected pauses %v ms, got %v", want, got)
+		}
+	}
+
+	pb.reset()
+	if d := pb.wait(); d != 10*time.Millisecond {
+		t.Errorf("Expected a delivery to reset the pause to the minimum, got %v", d)
+	}
+}
+
+func TestPollBackoffFromEnv(t *testing.T) {
+	tests := []struct {
+		min, max         string
+		wantMin, wantMax time.Duration
+	}{
+		{"", "", defaultPollBackoffMin, defaultPollBackoffMax},
+		{"5", "100", 5 * time.Millisecond, 100 * time.Millisecond},
+		{"0", "-1", defaultPollBackoffMin, defaultPollBackoffMax},
+		{"fast", "slow", defaultPollBackoffMin, defaultPollBackoffMax},
+		// A maximum below the minimum is raised to it
+		{"500", "100", 500 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Setenv("POLL_BACKOFF_MIN_MS", tt.min)
+		t.Setenv("POLL_BACKOFF_MAX_MS", tt.max)
+		if gotMin, gotMax := getPollBackoff(); gotMin != tt.wantMin || gotMax != tt.wantMax {
+			t.Errorf("POLL_BACKOFF_MIN_MS=%q POLL_BACKOFF_MAX_MS=%q: expected %v..%v, got %v..%v",
+				tt.min, tt.max, tt.wantMin, tt.wantMax, gotMin, gotMax)
+		}
+	}
+}
+
+func TestProduceMaxMessageSize(t *testing.T) {
+	b := newTestBroker(t)
+	b.maxMessageBytes = 64
+
+	tests := []struct {
+		name           string
+		size           int
+		expectedStatus int
+	}{
+		{"Below limit", 10, http.StatusOK},
+		{"At limit", 64, http.StatusOK},
+		{"Above limit", 65, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Repeat("x", tt.size)
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader(body))
+			w := httptest.NewRecorder()
+
+			b.produceHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// gzipped compresses data for a produce body
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProduceContentEncoding(t *testing.T) {
+	b := newTestBroker(t)
+	b.maxMessageBytes = 1024
+
+	tests := []struct {
+		name           string
+		encoding       string
+		contentType    string
+		body           []byte
+		expectedStatus int
+		expected       string
+	}{
+		{"Gzip raw payload", "gzip", "", gzipped(t, "hello"), http.StatusOK, "hello"},
+		{"Gzip JSON envelope", "gzip", "application/json", gzipped(t, `{"payload":"hello"}`), http.StatusOK, "hello"},
+		{"Identity", "identity", "", []byte("hello"), http.StatusOK, "hello"},
+		{"Corrupt gzip", "gzip", "", []byte("not gzip"), http.StatusBadRequest, ""},
+		{"Truncated gzip", "gzip", "", gzipped(t, "hello")[:12], http.StatusBadRequest, ""},
+		// A small body that expands past the limit is refused all the same
+		{"Expands past limit", "gzip", "", gzipped(t, strings.Repeat("x", 1025)), http.StatusRequestEntityTooLarge, ""},
+		{"Unsupported encoding", "br", "", []byte("hello"), http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			b.produceHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			p, _ := b.getPartition("telemetry", 0, false)
+			msg, err := p.fetchAndTrack("g1", time.Second)
+			if err != nil {
+				t.Fatalf("Failed to fetch the produced message: %v", err)
+			}
+			if msg.Payload != tt.expected {
+				t.Errorf("Expected payload %q, got %q", tt.expected, msg.Payload)
+			}
+		})
+	}
+}
+
+func TestPublishGzipThroughBroker(t *testing.T) {
+	b := newTestBroker(t)
+	var encoding string
+	var sent int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/produce", func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		sent = r.ContentLength
+		b.produceHandler(w, r)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	t.Setenv("MAX_PARTITIONS", "1")
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "0")
+	t.Setenv("PRODUCE_COMPRESSION", "gzip")
+	q, err := shared.NewHTTPMessageQueue(server.URL, "telemetry", "g1", "streamer")
+	if err != nil {
+		t.Fatalf("Failed to create queue client: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	row, _ := json.Marshal([]string{
+		"2025-07-18T20:42:34Z", "DCGM_FI_DEV_GPU_UTIL", "0", "nvidia0", "GPU-5fd4f087-86f3-7a43-b711-4771313afc50",
+		"NVIDIA H100 80GB HBM3", "mtv5-dgx1-hgpu-031", "dcgm-exporter", "dcgm-exporter-abc12", "gpu-operator", "87",
+		strings.Repeat(`DCGM_FI_DRIVER_VERSION="535.129.03",`, 10),
+	})
+	if err := q.Publish("telemetry", row); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if encoding != "gzip" || sent >= int64(len(row)) {
+		t.Errorf("Expected a gzip body smaller than the %d byte payload, got encoding %q and %d bytes", len(row), encoding, sent)
+	}
+
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+	msg, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to fetch the published message: %v", err)
+	}
+	if msg.Payload != string(row) {
+		t.Errorf("Stored payload differs from the original:\n got %s\nwant %s", msg.Payload, row)
+	}
+}
+
+func TestProtobufRecordThroughBroker(t *testing.T) {
+	// Heartbeats let the open stream notice the client has gone once the test ends
+	t.Setenv("HEARTBEAT_INTERVAL_MS", "50")
+	b := newTestBroker(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/produce", b.produceHandler)
+	mux.HandleFunc("/consume", b.consumeHandler)
+	mux.HandleFunc("/ack", b.ackHandler)
+	mux.HandleFunc("/ack/batch", b.ackBatchHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	t.Setenv("MAX_PARTITIONS", "1")
+	t.Setenv("PARTITION_HEALTH_INTERVAL_MS", "0")
+	q, err := shared.NewHTTPMessageQueue(server.URL, "telemetry", "collectors", "collector")
+	if err != nil {
+		t.Fatalf("Failed to create queue client: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	record := telemetry.TelemetryRecord{
+		DeviceID: "nvidia0", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 85.5,
+		Time:  time.Date(2025, 7, 18, 20, 42, 34, 0, time.UTC),
+		GPUID: "0", UUID: "GPU-5fd4f087-86f3-7a43-b711-4771313afc50", Hostname: "mtv5-dgx1-hgpu-031",
+	}
+	// The raw encoding isn't valid UTF-8, which a JSON string would mangle
+	if raw, _ := (telemetry.ProtobufSerializer{}).Marshal(record); utf8.Valid(raw) {
+		t.Fatal("Expected the protobuf record to contain bytes that aren't valid UTF-8")
+	}
+
+	serializer := telemetry.QueueSerializer(telemetry.ProtobufSerializer{})
+	body, err := serializer.Marshal(record)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	if err := q.Publish("telemetry", body); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	received := make(chan []byte, 1)
+	go q.Subscribe(func(topic string, body []byte, id string) error {
+		received <- body
+		return nil
+	})
+	select {
+	case got := <-received:
+		var decoded telemetry.TelemetryRecord
+		if err := serializer.Unmarshal(got, &decoded); err != nil {
+			t.Fatalf("Failed to decode the consumed record: %v", err)
+		}
+		if decoded != record {
+			t.Errorf("Consumed record differs:\n got %+v\nwant %+v", decoded, record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the record to be consumed")
+	}
+}
+
+func TestPartitionCloseRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p, err := newPartition(fileStoreFactory(t.TempDir()), "telemetry", 0, time.Nanosecond)
+		if err != nil {
+			t.Fatalf("Failed to create partition: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		worker := func(fn func()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						fn()
+					}
+				}
+			}()
+		}
+
+		worker(func() { p.enqueue(Message{ID: generateID(), Payload: "x"}) })
+		worker(func() { p.fetchAndTrack("group", time.Millisecond) })
+		worker(func() { p.requeueExpired(time.Now()) })
+
+		time.Sleep(5 * time.Millisecond)
+		p.Close()
+		p.Close() // a second Close must be a no-op
+
+		if err := p.enqueue(Message{ID: "late"}); !errors.Is(err, errPartitionClosed) {
+			t.Errorf("Expected errPartitionClosed after Close, got %v", err)
+		}
+		if _, err := p.fetchAndTrack("group", time.Millisecond); !errors.Is(err, errPartitionClosed) {
+			t.Errorf("Expected errPartitionClosed from fetch after Close, got %v", err)
+		}
+
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestConsumeMaxWait(t *testing.T) {
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(b.consumeHandler))
+	defer server.Close()
+
+	t.Run("Empty partition returns 204", func(t *testing.T) {
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=0&group=g1&max_wait=200ms")
+		if err != nil {
+			t.Fatalf("Consume request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Consume took %v, expected it to return after max_wait", elapsed)
+		}
+	})
+
+	t.Run("Stream ends after idle max_wait", func(t *testing.T) {
+		if err := p.enqueue(Message{ID: "m1", Payload: "hello", Topic: "telemetry"}); err != nil {
+			t.Fatalf("Failed to enqueue: %v", err)
+		}
+
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=0&group=g2&max_wait=200ms")
+		if err != nil {
+			t.Fatalf("Consume request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read stream: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(string(body), "id: m1") {
+			t.Errorf("Expected message m1 in stream, got %q", body)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Stream stayed open for %v, expected it to end after max_wait", elapsed)
+		}
+	})
+
+	t.Run("Invalid max_wait", func(t *testing.T) {
+		for _, value := range []string{"abc", "-1s", "0"} {
+			resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=0&group=g3&max_wait=" + value)
+			if err != nil {
+				t.Fatalf("Consume request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("max_wait=%s: expected status 400, got %d", value, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestConsumeMissingPartition(t *testing.T) {
+	b := newTestBroker(t)
+	server := httptest.NewServer(http.HandlerFunc(b.consumeHandler))
+	defer server.Close()
+
+	t.Run("Strict by default", func(t *testing.T) {
+		for _, query := range []string{"", "&missing=error"} {
+			resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=0&group=g1" + query)
+			if err != nil {
+				t.Fatalf("Consume request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%q: expected status 400, got %d", query, resp.StatusCode)
+			}
+		}
+		if _, err := b.getPartition("telemetry", 0, false); err == nil {
+			t.Error("Expected a strict consume not to create the partition")
+		}
+	})
+
+	t.Run("Wait delivers the first message", func(t *testing.T) {
+		type result struct {
+			status int
+			body   string
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=1&group=g1&missing=wait&max_wait=500ms")
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			done <- result{status: resp.StatusCode, body: string(body), err: err}
+		}()
+
+		// The consume creates the partition; produce once it exists
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, err := b.getPartition("telemetry", 1, false); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the waiting consume to create the partition")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		produced := produceAt(t, b, 1, "")
+
+		res := <-done
+		if res.err != nil {
+			t.Fatalf("Consume failed: %v", res.err)
+		}
+		if res.status != http.StatusOK || !strings.Contains(res.body, "id: "+produced.ID) {
+			t.Errorf("Expected the stream to deliver %s, got %d %q", produced.ID, res.status, res.body)
+		}
+	})
+
+	t.Run("Wait rejects partitions out of range", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=5&group=g1&missing=wait")
+		if err != nil {
+			t.Fatalf("Consume request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Invalid missing", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/consume?topic=telemetry&partition=0&group=g1&missing=create")
+		if err != nil {
+			t.Fatalf("Consume request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// counterValue reads the current value of a counter in a vector
+func counterValue(t *testing.T, vec *prometheus.CounterVec, labels ...string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// gaugeValue reads the current value of a gauge in a vector
+func gaugeValue(t *testing.T, vec *prometheus.GaugeVec, labels ...string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatalf("Failed to read gauge: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// histogramBuckets reads the cumulative bucket counts of a histogram in a
+// vector, keyed by upper bound
+func histogramBuckets(t *testing.T, vec *prometheus.HistogramVec, labels ...string) map[float64]uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	buckets := make(map[float64]uint64)
+	for _, b := range m.GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return buckets
+}
+
+func TestProduceRecordsMessageBytes(t *testing.T) {
+	b := newTestBroker(t)
+	before := histogramBuckets(t, metrics.BrokerMessageBytes, "telemetry")
+
+	// One payload in each of the 16B, 256B, 16KB and 256KB buckets
+	for _, size := range []int{10, 100, 5000, 200000} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader(strings.Repeat("x", size)))
+		b.produceHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Produce of %d bytes failed with status %d: %s", size, w.Code, w.Body.String())
+		}
+	}
+
+	after := histogramBuckets(t, metrics.BrokerMessageBytes, "telemetry")
+	// Bucket counts are cumulative
+	expected := map[float64]uint64{16: 1, 64: 1, 256: 2, 1024: 2, 4096: 2, 16384: 3, 65536: 3, 262144: 4, 4194304: 4}
+	for bound, want := range expected {
+		if got := after[bound] - before[bound]; got != want {
+			t.Errorf("Bucket le=%v: expected %d new observations, got %d", bound, want, got)
+		}
+	}
+}
+
+func TestQueueFullMetrics(t *testing.T) {
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 1, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	// Fill the in-memory queue
+	for i := 0; p.trySend(Message{ID: fmt.Sprintf("fill-%d", i)}) == nil; i++ {
+	}
+
+	rejectedBefore := counterValue(t, metrics.BrokerProduceRejected, "telemetry", "1")
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=1", strings.NewReader(`{"payload":"x"}`))
+		w := httptest.NewRecorder()
+		b.produceHandler(w, req)
+		if w.Code == http.StatusOK {
+			t.Fatalf("Expected produce to a full partition to fail")
+		}
+	}
+	if got := counterValue(t, metrics.BrokerProduceRejected, "telemetry", "1") - rejectedBefore; got != 3 {
+		t.Errorf("Expected 3 rejected produces, got %v", got)
+	}
+
+	// An expired in-flight message cannot be requeued while the queue is full
+	droppedBefore := counterValue(t, metrics.BrokerRequeueDropped, "telemetry", "1")
+	p.pendingMu.Lock()
+	p.pending["expired"] = pending{msg: Message{ID: "expired"}, deadline: time.Now().Add(-time.Second), group: "g1"}
+	p.pendingMu.Unlock()
+	p.requeueExpired(time.Now())
+	if got := counterValue(t, metrics.BrokerRequeueDropped, "telemetry", "1") - droppedBefore; got != 1 {
+		t.Errorf("Expected 1 dropped requeue, got %v", got)
+	}
+}
+
+func TestStuckPendingEvicted(t *testing.T) {
+	t.Setenv("PENDING_EVICT_AFTER_MS", "60000")
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 1, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	// g1 takes three messages and never acks them, then the queue fills up
+	for i := 0; i < 3; i++ {
+		produceAt(t, b, 1, "")
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	for i := 0; p.trySend(Message{ID: fmt.Sprintf("fill-%d", i)}) == nil; i++ {
+	}
+
+	// Expired, the messages can't go back on the queue; they stay pending
+	// for another try instead of being lost, and no longer count against g1
+	expired := time.Now().Add(b.visTO + time.Second)
+	droppedBefore := counterValue(t, metrics.BrokerRequeueDropped, "telemetry", "1")
+	evictedBefore := counterValue(t, metrics.BrokerPendingEvicted, "telemetry", "1")
+	p.requeueExpired(expired)
+	if got := p.state().Pending; got != 3 {
+		t.Fatalf("Expected 3 messages kept pending, got %d", got)
+	}
+	if got := p.pendingByGroup()["g1"]; got != 0 {
+		t.Errorf("Expected g1 to no longer hold the expired messages, got %d", got)
+	}
+	if got := counterValue(t, metrics.BrokerRequeueDropped, "telemetry", "1") - droppedBefore; got != 3 {
+		t.Errorf("Expected 3 failed requeues, got %v", got)
+	}
+
+	// g1 takes a fresh message, which also makes room on the queue
+	fresh, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	// A late ack still removes its stuck message, without giving back the
+	// slot it already released
+	if !p.ack(ids[0], "g1") {
+		t.Fatal("Expected a late ack of a stuck message to succeed")
+	}
+	p.pendingMu.Lock()
+	inFlight := p.inFlight["g1"]
+	p.pendingMu.Unlock()
+	if inFlight != 1 {
+		t.Errorf("Expected g1 to still hold the slot of its fresh message, got %d", inFlight)
+	}
+	p.ack(fresh.ID, "g1")
+
+	// With room on the queue, the next check requeues one stuck message
+	p.requeueExpired(expired)
+	if got := p.state().Pending; got != 1 {
+		t.Fatalf("Expected one stuck message requeued and one left, got %d pending", got)
+	}
+
+	// The last one is evicted once it has been expired for PENDING_EVICT_AFTER_MS
+	p.requeueExpired(expired.Add(30 * time.Second))
+	if got := p.state().Pending; got != 1 {
+		t.Fatalf("Expected the message to be kept before the eviction age, got %d pending", got)
+	}
+	p.requeueExpired(expired.Add(time.Minute))
+	if got := p.state().Pending; got != 0 {
+		t.Errorf("Expected the stuck message to be evicted, got %d pending", got)
+	}
+	if got := counterValue(t, metrics.BrokerPendingEvicted, "telemetry", "1") - evictedBefore; got != 1 {
+		t.Errorf("Expected 1 evicted message, got %v", got)
+	}
+}
+
+func TestPendingEvictAfterFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultPendingEvictAfter},
+		{"30000", 30 * time.Second},
+		{"0", 0},
+		{"-1", defaultPendingEvictAfter},
+		{"later", defaultPendingEvictAfter},
+	}
+	for _, tt := range tests {
+		t.Setenv("PENDING_EVICT_AFTER_MS", tt.value)
+		if got := getPendingEvictAfter(); got != tt.expected {
+			t.Errorf("PENDING_EVICT_AFTER_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestProduceContentType(t *testing.T) {
+	b := newTestBroker(t)
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		contentType     string
+		body            string
+		expectedStatus  int
+		expectedPayload string
+	}{
+		{"Raw payload starting with brace", "", `{"payload":"not an envelope"}`, http.StatusOK, `{"payload":"not an envelope"}`},
+		{"Plain text", "text/plain", `{broken`, http.StatusOK, `{broken`},
+		{"JSON envelope", "application/json", `{"payload":"hello"}`, http.StatusOK, "hello"},
+		{"JSON envelope with charset", "application/json; charset=utf-8", `{"payload":"{\"nested\":true}"}`, http.StatusOK, `{"nested":true}`},
+		{"JSON empty payload", "application/json", `{"payload":""}`, http.StatusOK, ""},
+		{"Malformed JSON", "application/json", `{"payload":`, http.StatusBadRequest, ""},
+		{"JSON without payload field", "application/json", `{"data":"x"}`, http.StatusBadRequest, ""},
+		{"JSON with trailing data", "application/json", `{"payload":"a"}{"payload":"b"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			b.produceHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			msg, err := p.fetchAndTrack("g1", time.Second)
+			if err != nil {
+				t.Fatalf("Failed to fetch produced message: %v", err)
+			}
+			if msg.Payload != tt.expectedPayload {
+				t.Errorf("Expected payload %q, got %q", tt.expectedPayload, msg.Payload)
+			}
+		})
+	}
+}
+
+func TestDeleteTopic(t *testing.T) {
+	b := newTestBroker(t)
+
+	produce := func() int {
+		req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=1", strings.NewReader("hello"))
+		w := httptest.NewRecorder()
+		b.produceHandler(w, req)
+		return w.Code
+	}
+	deleteTopic := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		b.deleteTopicHandler(w, httptest.NewRequest("DELETE", path, nil))
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := produce(); code != http.StatusOK {
+			t.Fatalf("Expected produce to succeed, got %d", code)
+		}
+	}
+	topicDir := filepath.Join(b.storageDir, "telemetry")
+	if _, err := os.Stat(topicDir); err != nil {
+		t.Fatalf("Expected topic directory to exist: %v", err)
+	}
+
+	// Produces racing with the delete must fail cleanly rather than panic
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				produce()
+			}
+		}
+	}()
+
+	w := deleteTopic("/topics/telemetry?purge=true")
+	close(stop)
+	wg.Wait()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if code := produce(); code != http.StatusBadRequest {
+		t.Errorf("Expected produce to a deleted topic to be rejected with 400, got %d", code)
+	}
+	if _, err := os.Stat(topicDir); !os.IsNotExist(err) {
+		t.Errorf("Expected topic directory to be purged, stat error: %v", err)
+	}
+
+	topics := httptest.NewRecorder()
+	b.topicsHandler(topics, httptest.NewRequest("GET", "/topics", nil))
+	if strings.Contains(topics.Body.String(), "telemetry") {
+		t.Errorf("Expected deleted topic to be gone from /topics, got %s", topics.Body.String())
+	}
+
+	if w := deleteTopic("/topics/telemetry"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 deleting an unknown topic, got %d", w.Code)
+	}
+	if w := deleteTopic("/topics/.."); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad topic name, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	b.deleteTopicHandler(w, httptest.NewRequest("GET", "/topics/telemetry", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestDeleteTopicKeepsLogs(t *testing.T) {
+	b := newTestBroker(t)
+	if _, err := b.getPartition("telemetry", 0, true); err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	if _, err := b.deleteTopic("telemetry", false); err != nil {
+		t.Fatalf("Failed to delete topic: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.storageDir, "telemetry", "partition-0.log")); err != nil {
+		t.Errorf("Expected partition log to be kept without purge: %v", err)
+	}
+}
+
+func TestTopicInfo(t *testing.T) {
+	b := newTestBroker(t)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		b.topicHandler(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/topics/telemetry")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var info struct {
+		Topic      string `json:"topic"`
+		Partitions int    `json:"partitions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	// Reports the configured count, not just the partitions created so far
+	if info.Topic != "telemetry" || info.Partitions != 2 {
+		t.Errorf("Expected telemetry with 2 partitions, got %+v", info)
+	}
+
+	if w := get("/topics/nope"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown topic, got %d", w.Code)
+	}
+	if w := get("/topics/"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a topic, got %d", w.Code)
+	}
+}
+
+func TestProduceAcks(t *testing.T) {
+	// Count syncs so we can tell which levels wait for the disk
+	var syncs int32
+	origSync := syncFile
+	syncFile = func(f *os.File) error {
+		atomic.AddInt32(&syncs, 1)
+		return origSync(f)
+	}
+	t.Cleanup(func() { syncFile = origSync })
+
+	tests := []struct {
+		acks           string
+		expectedStatus int
+		expectSync     bool
+	}{
+		{"", http.StatusOK, false},
+		{"none", http.StatusAccepted, false},
+		{"leader", http.StatusOK, false},
+		{"persisted", http.StatusOK, true},
+		{"all", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run("acks="+tt.acks, func(t *testing.T) {
+			b := newTestBroker(t)
+			p, err := b.getPartition("telemetry", 0, true)
+			if err != nil {
+				t.Fatalf("Failed to create partition: %v", err)
+			}
+			atomic.StoreInt32(&syncs, 0)
+
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0&acks="+tt.acks, strings.NewReader("hello"))
+			w := httptest.NewRecorder()
+			b.produceHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if synced := atomic.LoadInt32(&syncs) > 0; synced != tt.expectSync {
+				t.Errorf("Expected sync before response %v, got %v", tt.expectSync, synced)
+			}
+
+			logPath := filepath.Join(b.storageDir, "telemetry", "partition-0.log")
+			data, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("Failed to read partition log: %v", err)
+			}
+			if persisted := strings.Contains(string(data), `"payload":"hello"`); persisted != tt.expectSync {
+				t.Errorf("Expected message in log %v, got %v", tt.expectSync, persisted)
+			}
+
+			if tt.expectedStatus == http.StatusBadRequest {
+				return
+			}
+			msg, err := p.fetchAndTrack("g1", time.Second)
+			if err != nil {
+				t.Fatalf("Expected the message to be queued: %v", err)
+			}
+			if msg.Payload != "hello" {
+				t.Errorf("Expected payload hello, got %q", msg.Payload)
+			}
+		})
+	}
+}
+
+// produceAt sends a produce request and decodes the response
+func produceAt(t *testing.T, b *Broker, partition int, acks string) produceResponse {
+	t.Helper()
+	target := fmt.Sprintf("/produce?topic=telemetry&partition=%d&acks=%s", partition, acks)
+	w := httptest.NewRecorder()
+	b.produceHandler(w, httptest.NewRequest("POST", target, strings.NewReader("hello")))
+	if w.Code != http.StatusOK && w.Code != http.StatusAccepted {
+		t.Fatalf("Produce failed with status %d: %s", w.Code, w.Body.String())
+	}
+	var resp produceResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode produce response: %v", err)
+	}
+	return resp
+}
+
+func TestProduceOffsets(t *testing.T) {
+	b := newTestBroker(t)
+
+	for i := int64(0); i < 3; i++ {
+		resp := produceAt(t, b, 0, "")
+		if resp.Partition != 0 || resp.Offset != i || resp.ID == "" {
+			t.Errorf("Produce %d to partition 0: expected offset %d, got %+v", i, i, resp)
+		}
+	}
+	// Offsets are counted per partition
+	for i := int64(0); i < 2; i++ {
+		if resp := produceAt(t, b, 1, "none"); resp.Partition != 1 || resp.Offset != i {
+			t.Errorf("Produce %d to partition 1: expected offset %d, got %+v", i, i, resp)
+		}
+	}
+
+	// Consumers see the same offset the producer was given
+	p, _ := b.getPartition("telemetry", 0, false)
+	msg, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Expected a queued message: %v", err)
+	}
+	if msg.Offset != 0 {
+		t.Errorf("Expected the first message to have offset 0, got %d", msg.Offset)
+	}
+}
+
+func TestProduceOffsetsResumeFromLog(t *testing.T) {
+	cfg := BrokerConfig{
+		Topics:      map[string]int{"telemetry": 1},
+		BrokerCount: 1,
+		Port:        "8080",
+		StorageDir:  t.TempDir(),
+
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		produceAt(t, b, 0, "persisted")
+	}
+	b.Close()
+
+	restarted, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to restart broker: %v", err)
+	}
+	t.Cleanup(restarted.Close)
+	if resp := produceAt(t, restarted, 0, ""); resp.Offset != 3 {
+		t.Errorf("Expected offsets to resume at 3 after restart, got %d", resp.Offset)
+	}
+}
+
+func TestOwningBrokerHeader(t *testing.T) {
+	cfg := BrokerConfig{
+		Topics:        map[string]int{"telemetry": 2},
+		BrokerCount:   1,
+		Port:          "8080",
+		StorageDir:    t.TempDir(),
+		AdvertisedURL: "http://msg-queue-0.msg-queue-headless:8080",
+
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	w := httptest.NewRecorder()
+	b.produceHandler(w, httptest.NewRequest("POST", "/produce?topic=telemetry&partition=1", strings.NewReader("hello")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Produce failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(owningBrokerHeader); got != cfg.AdvertisedURL {
+		t.Errorf("Expected produce response %s %q, got %q", owningBrokerHeader, cfg.AdvertisedURL, got)
+	}
+
+	w = httptest.NewRecorder()
+	b.consumeHandler(w, httptest.NewRequest("GET", "/consume?topic=telemetry&partition=1&group=g1&max_wait=100ms", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Consume failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(owningBrokerHeader); got != cfg.AdvertisedURL {
+		t.Errorf("Expected consume response %s %q, got %q", owningBrokerHeader, cfg.AdvertisedURL, got)
+	}
+
+	// Without one configured the broker advertises its hostname
+	host, _ := os.Hostname()
+	cfg.AdvertisedURL = ""
+	if got, want := advertisedURL(cfg), "http://"+host+":8080"; got != want {
+		t.Errorf("Expected default advertised URL %q, got %q", want, got)
+	}
+}
+
+// produceTo posts one message to target and decodes where it landed
+func produceTo(t *testing.T, b *Broker, target string) produceResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	b.produceHandler(w, httptest.NewRequest("POST", target, strings.NewReader("hello")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Produce to %s failed with status %d: %s", target, w.Code, w.Body.String())
+	}
+	var resp produceResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode produce response: %v", err)
+	}
+	return resp
+}
+
+func TestProduceWithoutPartitionRoundRobin(t *testing.T) {
+	b := newTestBroker(t)
+
+	counts := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		resp := produceTo(t, b, "/produce?topic=telemetry")
+		if resp.Partition != i%2 {
+			t.Errorf("Produce %d: expected round-robin partition %d, got %d", i, i%2, resp.Partition)
+		}
+		counts[resp.Partition]++
+	}
+
+	// Each partition was created on demand and holds the messages reported for it
+	for part, n := range counts {
+		p, err := b.getPartition("telemetry", part, false)
+		if err != nil {
+			t.Fatalf("Partition %d was not created: %v", part, err)
+		}
+		if len(p.queue) != n {
+			t.Errorf("Partition %d: expected %d queued messages, got %d", part, n, len(p.queue))
+		}
+	}
+	if counts[0] != 3 || counts[1] != 3 {
+		t.Errorf("Expected messages spread evenly over both partitions, got %v", counts)
+	}
+}
+
+func TestProduceWithoutPartitionByKey(t *testing.T) {
+	b := newTestBroker(t)
+
+	seen := make(map[int]bool)
+	for _, key := range []string{"gpu-0", "gpu-1", "gpu-2", "gpu-3", "gpu-4", "gpu-5"} {
+		first := produceTo(t, b, "/produce?topic=telemetry&key="+key)
+		for i := 0; i < 2; i++ {
+			if resp := produceTo(t, b, "/produce?topic=telemetry&key="+key); resp.Partition != first.Partition {
+				t.Errorf("Key %s: expected every produce on partition %d, got %d", key, first.Partition, resp.Partition)
+			}
+		}
+		seen[first.Partition] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected keys to spread over both partitions, got %v", seen)
+	}
+
+	// An explicit partition still wins over the key
+	if resp := produceTo(t, b, "/produce?topic=telemetry&partition=1&key=gpu-0"); resp.Partition != 1 {
+		t.Errorf("Expected explicit partition 1, got %d", resp.Partition)
+	}
+}
+
+func TestProduceWithoutPartitionUnknownTopic(t *testing.T) {
+	b := newTestBroker(t)
+
+	w := httptest.NewRecorder()
+	b.produceHandler(w, httptest.NewRequest("POST", "/produce?topic=orders", strings.NewReader("hello")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown topic, got %d", w.Code)
+	}
+}
+
+func TestMaxInFlightPerGroup(t *testing.T) {
+	t.Setenv("MAX_IN_FLIGHT_PER_GROUP", "2")
+	b := newTestBroker(t)
+	for i := 0; i < 5; i++ {
+		produceAt(t, b, 0, "")
+	}
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+
+	var held []Message
+	for i := 0; i < 2; i++ {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Fetch %d within the limit failed: %v", i, err)
+		}
+		held = append(held, msg)
+	}
+
+	// The group is at its limit, so the next fetch gets nothing
+	if _, err := p.fetchAndTrack("g1", 50*time.Millisecond); !errors.Is(err, errNoMessages) {
+		t.Fatalf("Expected a fetch over the limit to return errNoMessages, got %v", err)
+	}
+	// Other groups have their own limit
+	if _, err := p.fetchAndTrack("g2", time.Second); err != nil {
+		t.Fatalf("Expected another group to fetch despite g1 being at its limit, got %v", err)
+	}
+
+	// A blocked fetch resumes as soon as an ack frees a slot
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := p.fetchAndTrack("g1", 5*time.Second)
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		t.Fatalf("Fetch returned before an ack freed a slot: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !p.ack(held[0].ID, "g1") {
+		t.Fatal("Failed to ack held message")
+	}
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatalf("Expected the blocked fetch to get a message after the ack, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fetch stayed blocked after an ack freed a slot")
+	}
+
+	// Back at the limit until something else is acked
+	if _, err := p.fetchAndTrack("g1", 50*time.Millisecond); !errors.Is(err, errNoMessages) {
+		t.Errorf("Expected the group to be at its limit again, got %v", err)
+	}
+}
+
+func TestMaxInFlightReleasedOnRequeue(t *testing.T) {
+	t.Setenv("MAX_IN_FLIGHT_PER_GROUP", "1")
+	b := newTestBroker(t)
+	produceAt(t, b, 0, "")
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+
+	first, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	// An expired message goes back on the queue and no longer counts against the group
+	p.requeueExpired(time.Now().Add(2 * p.visTO))
+	again, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Expected the requeued message to be fetchable, got %v", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("Expected redelivery of %s, got %s", first.ID, again.ID)
+	}
+}
+
+func TestConsumeAckModes(t *testing.T) {
+	t.Setenv("MAX_IN_FLIGHT_PER_GROUP", "1")
+	tests := []struct {
+		mode            string
+		expectedPending int
+		// manual consumers stop at the in-flight limit of 1
+		expectedIDs int
+	}{
+		{"", 1, 1},
+		{ackModeManual, 1, 1},
+		{ackModeAuto, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run("ack_mode="+tt.mode, func(t *testing.T) {
+			b := newTestBroker(t)
+			produceAt(t, b, 0, "")
+			produceAt(t, b, 0, "")
+			p, err := b.getPartition("telemetry", 0, false)
+			if err != nil {
+				t.Fatalf("Failed to get partition: %v", err)
+			}
+			server := httptest.NewServer(http.HandlerFunc(b.consumeHandler))
+			defer server.Close()
+
+			target := server.URL + "/consume?topic=telemetry&partition=0&group=g1&max_wait=200ms"
+			if tt.mode != "" {
+				target += "&ack_mode=" + tt.mode
+			}
+			resp, err := http.Get(target)
+			if err != nil {
+				t.Fatalf("Consume request failed: %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if ids := strings.Count(string(body), "id: "); ids != tt.expectedIDs {
+				t.Errorf("Expected %d messages streamed, got %d", tt.expectedIDs, ids)
+			}
+			if st := p.state(); st.Pending != tt.expectedPending {
+				t.Errorf("Expected %d pending, got %d", tt.expectedPending, st.Pending)
+			}
+
+			// Once the visibility timeout passes only tracked messages come back
+			p.requeueExpired(time.Now().Add(2 * p.visTO))
+			st := p.state()
+			if st.Pending != 0 || st.QueueDepth != 2-tt.expectedIDs+tt.expectedPending {
+				t.Errorf("Expected %d queued after the timeout, got %+v", 2-tt.expectedIDs+tt.expectedPending, st)
+			}
+		})
+	}
+
+	b := newTestBroker(t)
+	if _, err := b.getPartition("telemetry", 0, true); err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	w := httptest.NewRecorder()
+	b.consumeHandler(w, httptest.NewRequest("GET", "/consume?topic=telemetry&partition=0&group=g1&ack_mode=sometimes", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown ack_mode, got %d", w.Code)
+	}
+}
+
+func TestMaxInFlightFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"", 0},
+		{"50", 50},
+		{"0", 0},
+		{"-1", 0},
+		{"lots", 0},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MAX_IN_FLIGHT_PER_GROUP", tt.value)
+		if got := getMaxInFlight(); got != tt.expected {
+			t.Errorf("MAX_IN_FLIGHT_PER_GROUP=%q: expected %d, got %d", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestMaxPendingBytesPerPartition(t *testing.T) {
+	// Room for two of produceAt's 5-byte payloads
+	t.Setenv("MAX_PENDING_BYTES_PER_PARTITION", "10")
+	b := newTestBroker(t)
+	for i := 0; i < 5; i++ {
+		produceAt(t, b, 0, "")
+	}
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+
+	var held []Message
+	for _, group := range []string{"g1", "g2"} {
+		msg, err := p.fetchAndTrack(group, time.Second)
+		if err != nil {
+			t.Fatalf("Fetch for %s under the byte cap failed: %v", group, err)
+		}
+		held = append(held, msg)
+	}
+	if st := p.state(); st.PendingBytes != 10 {
+		t.Errorf("Expected 10 pending bytes, got %d", st.PendingBytes)
+	}
+	if got := gaugeValue(t, metrics.BrokerPendingBytes, "telemetry", "0"); got != 10 {
+		t.Errorf("Expected broker_pending_bytes 10, got %v", got)
+	}
+
+	// The cap is shared by every group on the partition
+	for _, group := range []string{"g1", "g3"} {
+		if _, err := p.fetchAndTrack(group, 50*time.Millisecond); !errors.Is(err, errNoMessages) {
+			t.Fatalf("Expected a fetch for %s at the byte cap to return errNoMessages, got %v", group, err)
+		}
+	}
+
+	// A blocked fetch resumes once an ack brings the partition under the cap
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := p.fetchAndTrack("g3", 5*time.Second)
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		t.Fatalf("Fetch returned before an ack freed pending bytes: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !p.ack(held[0].ID, "g1") {
+		t.Fatal("Failed to ack held message")
+	}
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatalf("Expected the blocked fetch to get a message after the ack, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fetch stayed blocked after an ack freed pending bytes")
+	}
+	if _, err := p.fetchAndTrack("g1", 50*time.Millisecond); !errors.Is(err, errNoMessages) {
+		t.Errorf("Expected the partition to be at its byte cap again, got %v", err)
+	}
+
+	// Requeued messages no longer count
+	p.requeueExpired(time.Now().Add(2 * p.visTO))
+	if st := p.state(); st.PendingBytes != 0 {
+		t.Errorf("Expected no pending bytes after the requeue, got %d", st.PendingBytes)
+	}
+	if got := gaugeValue(t, metrics.BrokerPendingBytes, "telemetry", "0"); got != 0 {
+		t.Errorf("Expected broker_pending_bytes 0, got %v", got)
+	}
+	if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+		t.Errorf("Expected a fetch after the requeue to succeed, got %v", err)
+	}
+}
+
+func TestMaxPendingBytesFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+	}{
+		{"", 0},
+		{"1048576", 1048576},
+		{"0", 0},
+		{"-1", 0},
+		{"1MB", 0},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MAX_PENDING_BYTES_PER_PARTITION", tt.value)
+		if got := getMaxPendingBytes(); got != tt.expected {
+			t.Errorf("MAX_PENDING_BYTES_PER_PARTITION=%q: expected %d, got %d", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestAckBatch(t *testing.T) {
+	b := newTestBroker(t)
+	for i := 0; i < 3; i++ {
+		produceAt(t, b, 0, "")
+	}
+	p, _ := b.getPartition("telemetry", 0, false)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Expected a queued message: %v", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	// One unknown ID and a duplicate must not stop the valid ones from being acked
+	body, _ := json.Marshal(append(ids, "unknown", ids[0]))
+	w := httptest.NewRecorder()
+	b.ackBatchHandler(w, httptest.NewRequest("POST", "/ack/batch?topic=telemetry&partition=0&group=g1", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ackBatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Acked != 3 {
+		t.Errorf("Expected 3 acked IDs, got %d", resp.Acked)
+	}
+	if len(resp.Failed) != 2 || resp.Failed[0].ID != "unknown" || resp.Failed[1].ID != ids[0] {
+		t.Errorf("Expected the unknown and duplicate IDs to be reported, got %+v", resp.Failed)
+	}
+
+	p.pendingMu.Lock()
+	remaining := len(p.pending)
+	p.pendingMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected every acked message to leave pending, %d remain", remaining)
+	}
+}
+
+func TestAckBatchBadRequests(t *testing.T) {
+	b := newTestBroker(t)
+	tests := []struct {
+		name, method, target, body string
+		expected                   int
+	}{
+		{"wrong method", "GET", "/ack/batch?topic=telemetry&partition=0&group=g1", "", http.StatusMethodNotAllowed},
+		{"missing group", "POST", "/ack/batch?topic=telemetry&partition=0", `["a"]`, http.StatusBadRequest},
+		{"empty batch", "POST", "/ack/batch?topic=telemetry&partition=0&group=g1", `[]`, http.StatusBadRequest},
+		{"not an array", "POST", "/ack/batch?topic=telemetry&partition=0&group=g1", `{"id":"a"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			b.ackBatchHandler(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.expected {
+				t.Errorf("Expected %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// partitionStates fetches /partitions from b
+func partitionStates(t *testing.T, b *Broker) []partitionState {
+	t.Helper()
+	w := httptest.NewRecorder()
+	b.partitionsHandler(w, httptest.NewRequest("GET", "/partitions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var states []partitionState
+	if err := json.NewDecoder(w.Body).Decode(&states); err != nil {
+		t.Fatalf("Failed to decode partitions: %v", err)
+	}
+	return states
+}
+
+func TestPartitionsEndpoint(t *testing.T) {
+	b := newTestBroker(t)
+	if states := partitionStates(t, b); len(states) != 0 {
+		t.Fatalf("Expected no partitions before any produce, got %+v", states)
+	}
+
+	for i := 0; i < 5; i++ {
+		produceAt(t, b, 0, "")
+	}
+	produceAt(t, b, 1, "")
+
+	// Deliver two messages from partition 0 and ack one of them
+	p, _ := b.getPartition("telemetry", 0, false)
+	first, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Expected a queued message: %v", err)
+	}
+	if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+		t.Fatalf("Expected a queued message: %v", err)
+	}
+	before := time.Now()
+	if !p.ack(first.ID, "g1") {
+		t.Fatal("Expected the ack to succeed")
+	}
+
+	states := partitionStates(t, b)
+	if len(states) != 2 || states[0].Partition != 0 || states[1].Partition != 1 {
+		t.Fatalf("Expected partitions 0 and 1 in order, got %+v", states)
+	}
+
+	p0 := states[0]
+	if p0.Topic != "telemetry" || p0.QueueDepth != 3 || p0.Pending != 1 || p0.Produced != 5 || p0.NextOffset != 5 {
+		t.Errorf("Expected 3 queued, 1 pending and 5 produced on partition 0, got %+v", p0)
+	}
+	if p0.LastActivity == nil || p0.LastActivity.Before(before.Add(-time.Second)) {
+		t.Errorf("Expected partition 0's last activity to be the ack, got %v", p0.LastActivity)
+	}
+
+	p1 := states[1]
+	if p1.QueueDepth != 1 || p1.Pending != 0 || p1.Produced != 1 {
+		t.Errorf("Expected 1 queued message on partition 1, got %+v", p1)
+	}
+	if p1.LastActivity == nil || !p1.LastActivity.Before(*p0.LastActivity) {
+		t.Errorf("Expected partition 1 to have been active before partition 0's ack, got %v", p1.LastActivity)
+	}
+}
+
+func TestPrewarmPartitions(t *testing.T) {
+	t.Setenv("PREWARM_PARTITIONS", "true")
+	dir := t.TempDir()
+	cfg := BrokerConfig{
+		Topics:          map[string]int{"telemetry": 3, "events": 2},
+		BrokerCount:     1,
+		StorageDir:      dir,
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	for topic, count := range cfg.Topics {
+		for i := 0; i < count; i++ {
+			if _, err := b.getPartition(topic, i, false); err != nil {
+				t.Errorf("Expected %s-%d to exist before any produce: %v", topic, i, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, topic, fmt.Sprintf("partition-%d.log", i))); err != nil {
+				t.Errorf("Expected the log of %s-%d to exist: %v", topic, i, err)
+			}
+		}
+	}
+
+	states := partitionStates(t, b)
+	var listed []string
+	for _, st := range states {
+		listed = append(listed, fmt.Sprintf("%s-%d", st.Topic, st.Partition))
+	}
+	expected := []string{"events-0", "events-1", "telemetry-0", "telemetry-1", "telemetry-2"}
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected /partitions to list %v, got %v", expected, listed)
+	}
+
+	// Produces land on the prewarmed partitions instead of new ones
+	produceAt(t, b, 1, "")
+	p, _ := b.getPartition("telemetry", 1, false)
+	if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+		t.Errorf("Expected the produced message on the prewarmed partition: %v", err)
+	}
+	if got := len(partitionStates(t, b)); got != len(expected) {
+		t.Errorf("Expected %d partitions after a produce, got %d", len(expected), got)
+	}
+}
+
+func TestPrewarmOnlyOwnedPartitions(t *testing.T) {
+	t.Setenv("PREWARM_PARTITIONS", "true")
+	dir := t.TempDir()
+	cfg := BrokerConfig{
+		Topics:          map[string]int{"telemetry": 5},
+		BrokerIndex:     1,
+		BrokerCount:     2,
+		StorageDir:      dir,
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	var listed []string
+	for _, st := range partitionStates(t, b) {
+		listed = append(listed, fmt.Sprintf("%s-%d", st.Topic, st.Partition))
+	}
+	expected := []string{"telemetry-1", "telemetry-3"}
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected /partitions to list %v, got %v", expected, listed)
+	}
+	// Partitions owned by the other broker get no log
+	for _, i := range []int{0, 2, 4} {
+		if _, err := os.Stat(filepath.Join(dir, "telemetry", fmt.Sprintf("partition-%d.log", i))); !os.IsNotExist(err) {
+			t.Errorf("Expected no log for telemetry-%d, got %v", i, err)
+		}
+	}
+}
+
+func TestPrewarmPartitionsFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", false},
+		{"true", true},
+		{"1", true},
+		{"false", false},
+		{"yes", false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("PREWARM_PARTITIONS", tt.value)
+		if got := getPrewarmPartitions(); got != tt.expected {
+			t.Errorf("PREWARM_PARTITIONS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestMetadataEndpoint(t *testing.T) {
+	t.Setenv("TOPICS", "events:8,orders:4:500")
+	cfg, err := loadBrokerConfig([]string{"-storage-dir", t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	b, err := NewBroker(cfg, 45*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+	// Only one partition exists so far; metadata covers every configured one
+	if _, err := b.getPartition("orders", 0, true); err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	b.metadataHandler(w, httptest.NewRequest("GET", "/metadata", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var metadata struct {
+		Topics map[string]topicMetadata `json:"topics"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&metadata); err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+	expected := map[string]topicMetadata{
+		"events": {Partitions: 8, VisibilityTimeoutMs: 45000},
+		"orders": {Partitions: 4, VisibilityTimeoutMs: 45000},
+	}
+	if len(metadata.Topics) != len(expected) {
+		t.Fatalf("Expected topics %v, got %v", expected, metadata.Topics)
+	}
+	for topic, want := range expected {
+		if got := metadata.Topics[topic]; got != want {
+			t.Errorf("%s: expected %+v, got %+v", topic, want, got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	b.metadataHandler(w, httptest.NewRequest("POST", "/metadata", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestPartitionsEndpointMethod(t *testing.T) {
+	b := newTestBroker(t)
+	w := httptest.NewRecorder()
+	b.partitionsHandler(w, httptest.NewRequest("POST", "/partitions", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+}
+
+// consumeIDs opens a consume stream that ends after max_wait of idleness and
+// returns the IDs of the messages it delivered
+func consumeIDs(t *testing.T, serverURL string, partition int, group string) []string {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("%s/consume?topic=telemetry&partition=%d&group=%s&max_wait=200ms", serverURL, partition, group))
+	if err != nil {
+		t.Fatalf("Consume request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	var ids []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+	}
+	return ids
+}
+
+// listGroups fetches /groups for topic from b
+func listGroups(t *testing.T, b *Broker, topic string) []groupState {
+	t.Helper()
+	w := httptest.NewRecorder()
+	b.groupsHandler(w, httptest.NewRequest("GET", "/groups?topic="+topic, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Topic  string       `json:"topic"`
+		Groups []groupState `json:"groups"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode groups: %v", err)
+	}
+	return resp.Groups
+}
+
+func TestGroupsEndpoint(t *testing.T) {
+	b := newTestBroker(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consume", b.consumeHandler)
+	mux.HandleFunc("/ack", b.ackHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		produceAt(t, b, 0, "")
+	}
+	for i := 0; i < 2; i++ {
+		produceAt(t, b, 1, "")
+	}
+	if groups := listGroups(t, b, "telemetry"); len(groups) != 0 {
+		t.Fatalf("Expected no groups before any consumer, got %+v", groups)
+	}
+
+	// g1 takes all of partition 0 and acks nothing; g2 takes partition 1 and acks one
+	if ids := consumeIDs(t, server.URL, 0, "g1"); len(ids) != 3 {
+		t.Fatalf("Expected g1 to get 3 messages, got %v", ids)
+	}
+	ids := consumeIDs(t, server.URL, 1, "g2")
+	if len(ids) != 2 {
+		t.Fatalf("Expected g2 to get 2 messages, got %v", ids)
+	}
+	resp, err := http.Post(server.URL+"/ack?topic=telemetry&partition=1&group=g2", "application/json", strings.NewReader(`{"id":"`+ids[0]+`"}`))
+	if err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	resp.Body.Close()
+
+	groups := listGroups(t, b, "telemetry")
+	if len(groups) != 2 || groups[0].Group != "g1" || groups[1].Group != "g2" {
+		t.Fatalf("Expected groups g1 and g2, got %+v", groups)
+	}
+	if groups[0].Pending != 3 || groups[1].Pending != 1 {
+		t.Errorf("Expected 3 pending for g1 and 1 for g2, got %d and %d", groups[0].Pending, groups[1].Pending)
+	}
+	for _, g := range groups {
+		if g.OpenStreams != 0 || g.LastSeen.IsZero() {
+			t.Errorf("Expected %s to have closed its stream and have a last-seen time, got %+v", g.Group, g)
+		}
+	}
+}
+
+func TestGroupsEndpointBadRequests(t *testing.T) {
+	b := newTestBroker(t)
+	for _, tt := range []struct {
+		target string
+		status int
+	}{
+		{"/groups", http.StatusBadRequest},
+		{"/groups?topic=unknown", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		b.groupsHandler(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.target, tt.status, w.Code)
+		}
+	}
+}
+
+func TestGroupRegistryExpiry(t *testing.T) {
+	g := newGroupRegistry(time.Minute)
+	g.touch("telemetry", "idle")
+	closeStream := g.openStream("telemetry", "streaming")
+
+	// An open stream keeps its group listed however long it stays idle
+	later := time.Now().Add(2 * time.Minute)
+	groups := g.list("telemetry", later)
+	if len(groups) != 1 || groups[0].Group != "streaming" || groups[0].OpenStreams != 1 {
+		t.Fatalf("Expected only the streaming group to survive, got %+v", groups)
+	}
+
+	closeStream()
+	if groups := g.list("telemetry", time.Now()); len(groups) != 1 || groups[0].OpenStreams != 0 {
+		t.Errorf("Expected the group to stay listed right after its stream closes, got %+v", groups)
+	}
+	if groups := g.list("telemetry", later); len(groups) != 0 {
+		t.Errorf("Expected the group to expire once idle, got %+v", groups)
+	}
+
+	// With no timeout groups are kept forever
+	forever := newGroupRegistry(0)
+	forever.touch("telemetry", "g1")
+	if groups := forever.list("telemetry", time.Now().Add(24*time.Hour)); len(groups) != 1 {
+		t.Errorf("Expected a zero timeout to keep groups, got %+v", groups)
+	}
+}
+
+func TestGroupIdleTimeoutFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultGroupIdleTimeout},
+		{"5000", 5 * time.Second},
+		{"0", 0},
+		{"-1", defaultGroupIdleTimeout},
+		{"soon", defaultGroupIdleTimeout},
+	}
+	for _, tt := range tests {
+		t.Setenv("GROUP_IDLE_TIMEOUT_MS", tt.value)
+		if got := getGroupIdleTimeout(); got != tt.expected {
+			t.Errorf("GROUP_IDLE_TIMEOUT_MS=%q: expected %v, got %v", tt.value, tt.expected, got)
+		}
+	}
+}
+
+// resumeIDs consumes partition 0 as group, sending lastID as Last-Event-ID,
+// and returns the message IDs streamed
+func resumeIDs(t *testing.T, serverURL, group, lastID string) []string {
+	t.Helper()
+	req, err := http.NewRequest("GET", serverURL+"/consume?topic=telemetry&partition=0&group="+group+"&max_wait=200ms", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", lastID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Consume request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	var ids []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+	}
+	return ids
+}
+
+func TestConsumeResumesAfterLastEventID(t *testing.T) {
+	// Five messages; m0..m2 are delivered to g1 and only m0 is acked. The
+	// resumed stream resends the delivered messages after the named one, in
+	// offset order, then carries on with m3 and m4.
+	tests := []struct {
+		name   string
+		lastID func(ids []string) string
+		from   int // the stream should carry ids[from:]
+	}{
+		{"acked", func(ids []string) string { return ids[0] }, 1},
+		// m1 was processed but its ack never reached the broker
+		{"pending", func(ids []string) string { return ids[1] }, 2},
+		// m1 and m2 wait for their visibility timeout as usual
+		{"unknown", func(ids []string) string { return "no-such-message" }, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/consume", b.consumeHandler)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			var ids []string
+			for i := 0; i < 5; i++ {
+				ids = append(ids, produceAt(t, b, 0, "").ID)
+			}
+			p, err := b.getPartition("telemetry", 0, false)
+			if err != nil {
+				t.Fatalf("Failed to get partition: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+					t.Fatalf("Fetch failed: %v", err)
+				}
+			}
+			if !p.ack(ids[0], "g1") {
+				t.Fatal("Expected the first message to ack")
+			}
+
+			got := resumeIDs(t, server.URL, "g1", tt.lastID(ids))
+			if want := ids[tt.from:]; strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestConsumeResumeIgnoresOtherGroups(t *testing.T) {
+	b := newTestBroker(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consume", b.consumeHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	first := produceAt(t, b, 0, "").ID
+	produceAt(t, b, 0, "")
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+	}
+
+	// g2 naming g1's message must not be handed g1's pending messages
+	if ids := resumeIDs(t, server.URL, "g2", first); len(ids) != 0 {
+		t.Errorf("Expected nothing for another group, got %v", ids)
+	}
+}
+
+func TestConcurrentPartitionCreation(t *testing.T) {
+	const partitions = 16
+	b, err := NewBroker(BrokerConfig{
+		Topics:      map[string]int{"telemetry": partitions, "events": partitions},
+		BrokerCount: 1,
+		Port:        "8080",
+		StorageDir:  t.TempDir(),
+
+		MaxMessageBytes: defaultMaxMessageBytes,
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	// Readers list the partition maps while produces grow them
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for _, read := range []func(w http.ResponseWriter, r *http.Request){b.topicsHandler, b.healthHandler, b.partitionsHandler} {
+		readers.Add(1)
+		go func(read func(w http.ResponseWriter, r *http.Request)) {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				read(w, httptest.NewRequest("GET", "/", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected status 200 while partitions are created, got %d", w.Code)
+					return
+				}
+			}
+		}(read)
+	}
+
+	// Several producers race to create each partition
+	var producers sync.WaitGroup
+	for _, topic := range []string{"telemetry", "events"} {
+		for p := 0; p < partitions; p++ {
+			for i := 0; i < 3; i++ {
+				producers.Add(1)
+				go func(topic string, p int) {
+					defer producers.Done()
+					w := httptest.NewRecorder()
+					b.produceHandler(w, httptest.NewRequest("POST", fmt.Sprintf("/produce?topic=%s&partition=%d", topic, p), strings.NewReader("hello")))
+					if w.Code != http.StatusOK {
+						t.Errorf("Expected produce to %s-%d to succeed, got %d: %s", topic, p, w.Code, w.Body.String())
+					}
+				}(topic, p)
+			}
+		}
+	}
+	producers.Wait()
+	close(stop)
+	readers.Wait()
+
+	w := httptest.NewRecorder()
+	b.topicsHandler(w, httptest.NewRequest("GET", "/topics", nil))
+	var topics map[string][]int
+	if err := json.Unmarshal(w.Body.Bytes(), &topics); err != nil {
+		t.Fatalf("Failed to decode /topics: %v", err)
+	}
+	for _, topic := range []string{"telemetry", "events"} {
+		if len(topics[topic]) != partitions {
+			t.Errorf("Expected %d partitions of %s listed, got %v", partitions, topic, topics[topic])
+		}
+		for p := 0; p < partitions; p++ {
+			part, err := b.getPartition(topic, p, false)
+			if err != nil {
+				t.Fatalf("Expected %s-%d to exist: %v", topic, p, err)
+			}
+			// Each partition was created once, so it holds every produce to it
+			if n := len(part.queue); n != 3 {
+				t.Errorf("Expected 3 messages in %s-%d, got %d", topic, p, n)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	b.healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		OwnedPartitions int `json:"owned_partitions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to decode /health: %v", err)
+	}
+	if health.OwnedPartitions != 2*partitions {
+		t.Errorf("Expected %d owned partitions, got %d", 2*partitions, health.OwnedPartitions)
+	}
+
+	// Once the broker is closing, no partition is created that Close would miss
+	b.Close()
+	if _, err := b.createPartitionIfNotExists("telemetry", partitions); err != errPartitionClosed {
+		t.Errorf("Expected no partition created after Close, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Requeue modes for messages whose visibility timeout expired, selected with
+// REQUEUE_MODE.
+const (
+	requeueTail    = "tail"    // back of the queue, behind newer messages
+	requeueOrdered = "ordered" // ahead of the queue, lowest offset first
+)
+
+// getRequeueMode returns REQUEUE_MODE, or tail when unset or invalid
+func getRequeueMode() string {
+	if mode := strings.ToLower(strings.TrimSpace(os.Getenv("REQUEUE_MODE"))); mode != "" {
+		if mode == requeueTail || mode == requeueOrdered {
+			return mode
+		}
+		log.Printf("Invalid REQUEUE_MODE value '%s', using default: %s", mode, requeueTail)
+	}
+	return requeueTail
+}
+
+// offsetHeap is a min-heap of messages by offset
+type offsetHeap []Message
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i].Offset < h[j].Offset }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(Message)) }
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// requeueInOrder holds an expired message for redelivery ahead of the queue
+// and wakes fetches waiting on it. Unlike the queue it is not bounded, so the
+// requeue can't fail for lack of room. The caller must hold pendingMu.
+func (p *Partition) requeueInOrder(m Message) error {
+	if p.ctx.Err() != nil {
+		return errPartitionClosed
+	}
+	heap.Push(&p.redeliver, m)
+	close(p.redelivered)
+	p.redelivered = make(chan struct{})
+	return nil
+}
+
+// nextRedelivery pops the lowest-offset requeued message. When there is none
+// it returns a channel that is closed once one is requeued.
+func (p *Partition) nextRedelivery() (Message, bool, <-chan struct{}) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	if len(p.redeliver) == 0 {
+		return Message{}, false, p.redelivered
+	}
+	return heap.Pop(&p.redeliver).(Message), true, nil
+}
+
+// receive waits for the next message to deliver. In ordered mode requeued
+// messages go first, so a redelivery is never overtaken by a newer message
+// that is still waiting on the queue. It returns errNoMessages once timeout
+// fires and errPartitionClosed after Close.
+func (p *Partition) receive(timeout <-chan time.Time) (Message, error) {
+	for {
+		// A nil channel never fires, so tail mode only watches the queue
+		var requeued <-chan struct{}
+		if p.requeueMode == requeueOrdered {
+			msg, ok, wake := p.nextRedelivery()
+			if ok {
+				return msg, nil
+			}
+			requeued = wake
+		}
+		select {
+		case <-p.ctx.Done():
+			return Message{}, errPartitionClosed
+		case msg, ok := <-p.queue:
+			if !ok {
+				return Message{}, errPartitionClosed
+			}
+			return msg, nil
+		case <-requeued:
+		case <-timeout:
+			return Message{}, errNoMessages
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fetchOffsets takes n messages from p for group and returns their offsets
+func fetchOffsets(t *testing.T, p *Partition, group string, n int) []int64 {
+	t.Helper()
+	offsets := make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		msg, err := p.fetchAndTrack(group, time.Second)
+		if err != nil {
+			t.Fatalf("Fetch %d failed: %v", i, err)
+		}
+		offsets = append(offsets, msg.Offset)
+	}
+	return offsets
+}
+
+func TestRequeuePreservesOrder(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		// Tail requeues land behind the messages produced after them, in
+		// no particular order among themselves
+		{requeueTail, "[2 3 4 "},
+		{requeueOrdered, "[0 1 2 3 4]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv("REQUEUE_MODE", tt.mode)
+			b := newTestBroker(t)
+			for i := 0; i < 5; i++ {
+				produceAt(t, b, 0, "")
+			}
+			p, err := b.getPartition("telemetry", 0, false)
+			if err != nil {
+				t.Fatalf("Failed to get partition: %v", err)
+			}
+
+			// The first two deliveries are never acked and time out
+			if got := fmt.Sprint(fetchOffsets(t, p, "g1", 2)); got != "[0 1]" {
+				t.Fatalf("Expected the first deliveries in produce order, got %s", got)
+			}
+			p.requeueExpired(time.Now().Add(2 * p.visTO))
+			if st := p.state(); st.Pending != 0 || st.QueueDepth != 5 {
+				t.Fatalf("Expected all 5 messages waiting after the requeue, got %+v", st)
+			}
+
+			if got := fmt.Sprint(fetchOffsets(t, p, "g1", 5)); !strings.HasPrefix(got, tt.expected) {
+				t.Errorf("Expected delivery order %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestOrderedRequeueWakesWaitingFetch(t *testing.T) {
+	t.Setenv("REQUEUE_MODE", requeueOrdered)
+	b := newTestBroker(t)
+	produceAt(t, b, 0, "")
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+	first, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	// A fetch blocked on the empty queue picks up the redelivery
+	fetched := make(chan Message, 1)
+	go func() {
+		msg, err := p.fetchAndTrack("g2", 5*time.Second)
+		if err != nil {
+			t.Errorf("Waiting fetch failed: %v", err)
+		}
+		fetched <- msg
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.requeueExpired(time.Now().Add(2 * p.visTO))
+
+	select {
+	case msg := <-fetched:
+		if msg.ID != first.ID {
+			t.Errorf("Expected redelivery of %s, got %s", first.ID, msg.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Waiting fetch did not wake up for the requeued message")
+	}
+}
+
+func TestOrderedRequeueIgnoresFullQueue(t *testing.T) {
+	t.Setenv("REQUEUE_MODE", requeueOrdered)
+	b := newTestBroker(t)
+	produceAt(t, b, 0, "")
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatalf("Failed to get partition: %v", err)
+	}
+	first, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	for i := 0; p.trySend(Message{ID: fmt.Sprintf("fill-%d", i), Offset: int64(i + 1)}) == nil; i++ {
+	}
+
+	// The expired message doesn't need room on the queue, and still comes first
+	p.requeueExpired(time.Now().Add(2 * p.visTO))
+	if got := p.state().Pending; got != 0 {
+		t.Fatalf("Expected the message requeued despite the full queue, got %d pending", got)
+	}
+	msg, err := p.fetchAndTrack("g1", time.Second)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if msg.ID != first.ID {
+		t.Errorf("Expected redelivery of %s ahead of the queue, got %s", first.ID, msg.ID)
+	}
+}
+
+func TestRequeueModeFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", requeueTail},
+		{"tail", requeueTail},
+		{"Ordered", requeueOrdered},
+		{"fifo", requeueTail},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("REQUEUE_MODE", tt.value)
+		if got := getRequeueMode(); got != tt.expected {
+			t.Errorf("REQUEUE_MODE=%q: expected %s, got %s", tt.value, tt.expected, got)
+		}
+	}
+}
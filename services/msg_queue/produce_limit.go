@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// produceLimiter is a token bucket capping produces on one topic. Tokens
+// accrue at rate per second up to one second's worth (at least one), so a
+// producer may burst briefly but can't hold the topic above its rate.
+type produceLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newProduceLimiter(rate float64, now time.Time) *produceLimiter {
+	burst := math.Max(rate, 1)
+	return &produceLimiter{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// allow takes a token at now if one is available. Otherwise it reports how
+// long until the next token accrues; nothing is taken, so rejected produces
+// don't push back the producers that retry later.
+func (l *produceLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// newProduceLimiters creates a limiter for each topic with a rate limit
+func newProduceLimiters(limits map[string]float64) map[string]*produceLimiter {
+	limiters := make(map[string]*produceLimiter, len(limits))
+	now := time.Now()
+	for topic, rate := range limits {
+		limiters[topic] = newProduceLimiter(rate, now)
+	}
+	return limiters
+}
+
+// maxBackpressureWait is the Retry-After sent for a full partition queue;
+// queues above the high watermark but not full get a share of it in
+// proportion to how full they are
+const maxBackpressureWait = 10 * time.Second
+
+// aboveWatermark reports whether the partition's queue is filled beyond
+// watermark percent and, if so, how long producers should wait before
+// sending to it again. A watermark of 0 never holds producers back.
+func (p *Partition) aboveWatermark(watermark int) (bool, time.Duration) {
+	if watermark <= 0 || cap(p.queue) == 0 {
+		return false, 0
+	}
+	fill := float64(len(p.queue)) / float64(cap(p.queue))
+	if fill*100 < float64(watermark) {
+		return false, 0
+	}
+	return true, time.Duration(fill * float64(maxBackpressureWait))
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for a Retry-After header
+func retryAfterSeconds(wait time.Duration) int {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+func TestProduceRateLimitPerTopic(t *testing.T) {
+	cfg := BrokerConfig{
+		Topics:      map[string]int{"telemetry": 1, "events": 1},
+		BrokerCount: 1,
+		StorageDir:  t.TempDir(),
+
+		MaxMessageBytes: defaultMaxMessageBytes,
+		TopicRateLimits: map[string]float64{"telemetry": 3, "events": 1000},
+	}
+	b, err := NewBroker(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create broker: %v", err)
+	}
+	defer b.Close()
+
+	produce := func(topic string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		b.produceHandler(w, httptest.NewRequest("POST", "/produce?topic="+topic+"&partition=0", strings.NewReader("payload")))
+		return w
+	}
+
+	// A burst of one second's worth is allowed, then the topic is throttled
+	for i := 0; i < 3; i++ {
+		if w := produce("telemetry"); w.Code != http.StatusOK {
+			t.Fatalf("Produce %d: expected 200 within the limit, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	w := produce("telemetry")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 over the limit, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After: 1, got %q", got)
+	}
+
+	// Another topic under its own limit is unaffected
+	for i := 0; i < 10; i++ {
+		if w := produce("events"); w.Code != http.StatusOK {
+			t.Fatalf("Expected produces to events to succeed while telemetry is throttled, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if w := produce("telemetry"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected telemetry to stay throttled, got %d", w.Code)
+	}
+
+	// Throttled produces never reached the partition
+	p, err := b.getPartition("telemetry", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.queue); n != 3 {
+		t.Errorf("Expected 3 queued messages on telemetry, got %d", n)
+	}
+}
+
+func TestProduceLimiterRefills(t *testing.T) {
+	start := time.Now()
+	l := newProduceLimiter(2, start)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(start); !ok {
+			t.Fatalf("Expected token %d of the burst", i)
+		}
+	}
+	ok, wait := l.allow(start)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for the next token, got ok=%v wait=%v", ok, wait)
+	}
+	// Rejections don't take tokens, so a retry after the wait succeeds
+	if ok, _ := l.allow(start.Add(500 * time.Millisecond)); !ok {
+		t.Error("Expected a token after 500ms")
+	}
+	// An idle limiter refills to its burst and no further
+	later := start.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(later); !ok {
+			t.Fatalf("Expected token %d after a refill", i)
+		}
+	}
+	if ok, _ := l.allow(later); ok {
+		t.Error("Expected the refill to stop at the burst")
+	}
+
+	// Below one message a second the burst is still a single message
+	slow := newProduceLimiter(0.1, start)
+	if ok, _ := slow.allow(start); !ok {
+		t.Fatal("Expected the first produce to be allowed")
+	}
+	if ok, wait := slow.allow(start); ok || retryAfterSeconds(wait) != 10 {
+		t.Errorf("Expected Retry-After of 10s, got ok=%v wait=%v", ok, wait)
+	}
+}
+
+func TestParseTopicRateLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		topics   string
+		jsonMap  string
+		expected map[string]float64
+	}{
+		{"None", "events:8,orders:4", "", map[string]float64{}},
+		{"Topic list", "events:8:500,orders:4,telemetry:2:0.5", "", map[string]float64{"events": 500, "telemetry": 0.5}},
+		{"JSON map", "events:8", `{"events": 100, "orders": 20}`, map[string]float64{"events": 100, "orders": 20}},
+		{"JSON overrides topic list", "events:8:500,orders:4:50", `{"events": 100}`, map[string]float64{"events": 100, "orders": 50}},
+		{"Zero lifts a limit", "events:8:500", `{"events": 0}`, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits, err := parseTopicRateLimits(tt.topics, tt.jsonMap)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(limits) != len(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, limits)
+			}
+			for topic, rate := range tt.expected {
+				if limits[topic] != rate {
+					t.Errorf("Expected %s limited to %v, got %v", topic, rate, limits[topic])
+				}
+			}
+		})
+	}
+
+	for _, bad := range []struct{ topics, jsonMap string }{
+		{"events:8:fast", ""},
+		{"events:8:-1", ""},
+		{"events:8", `{"events": -5}`},
+		{"events:8", `events=5`},
+	} {
+		if _, err := parseTopicRateLimits(bad.topics, bad.jsonMap); err == nil {
+			t.Errorf("Expected an error for topics %q and map %q", bad.topics, bad.jsonMap)
+		}
+	}
+
+	// The topic list's rate field doesn't change its partition count
+	if topics := parseTopics("events:8:500,orders:4"); topics["events"] != 8 || topics["orders"] != 4 {
+		t.Errorf("Expected partition counts to parse alongside rate limits, got %v", topics)
+	}
+}
+
+func TestLoadBrokerConfigRateLimits(t *testing.T) {
+	t.Setenv("TOPICS", "telemetry:2:100")
+	t.Setenv("TOPIC_RATE_LIMITS", `{"events": 10}`)
+	cfg, err := loadBrokerConfig(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.TopicRateLimits["telemetry"] != 100 || cfg.TopicRateLimits["events"] != 10 {
+		t.Errorf("Expected limits from TOPICS and TOPIC_RATE_LIMITS, got %v", cfg.TopicRateLimits)
+	}
+
+	cfg, err = loadBrokerConfig([]string{`-topic-rate-limits={"telemetry": 5}`})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.TopicRateLimits["telemetry"] != 5 || len(cfg.TopicRateLimits) != 1 {
+		t.Errorf("Expected the flag to replace TOPIC_RATE_LIMITS, got %v", cfg.TopicRateLimits)
+	}
+
+	t.Setenv("TOPIC_RATE_LIMITS", "{")
+	if _, err := loadBrokerConfig(nil); err == nil {
+		t.Error("Expected an error for invalid TOPIC_RATE_LIMITS")
+	}
+}
+
+func TestProduceBackpressureAboveWatermark(t *testing.T) {
+	b := newTestBroker(t)
+	b.highWatermark = 50
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+
+	produce := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		b.produceHandler(w, httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader("payload")))
+		return w
+	}
+	fill := func(n int) {
+		for len(p.queue) < n {
+			if err := p.trySend(Message{ID: genID(), Topic: "telemetry"}); err != nil {
+				t.Fatalf("Failed to fill queue: %v", err)
+			}
+		}
+	}
+
+	// Below the watermark produces go through
+	fill(cap(p.queue)/2 - 1)
+	if w := produce(); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 below the watermark, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The suggested wait grows with how full the queue is
+	before := counterValue(t, metrics.BrokerProduceBackpressure, "telemetry", "0")
+	for _, tt := range []struct {
+		percent    int
+		retryAfter string
+	}{
+		{50, "5"},
+		{90, "9"},
+		{100, "10"},
+	} {
+		fill(cap(p.queue) * tt.percent / 100)
+		depth := len(p.queue)
+		w := produce()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%d%% full: expected 429, got %d: %s", tt.percent, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%d%% full: expected Retry-After: %s, got %q", tt.percent, tt.retryAfter, got)
+		}
+		if len(p.queue) != depth {
+			t.Errorf("%d%% full: expected the rejected produce not to be queued", tt.percent)
+		}
+	}
+	if got := counterValue(t, metrics.BrokerProduceBackpressure, "telemetry", "0") - before; got != 3 {
+		t.Errorf("Expected 3 produces counted as backpressure, got %v", got)
+	}
+
+	// Other partitions are unaffected
+	w := httptest.NewRecorder()
+	b.produceHandler(w, httptest.NewRequest("POST", "/produce?topic=telemetry&partition=1", strings.NewReader("payload")))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected produces to partition 1 to succeed, got %d", w.Code)
+	}
+}
+
+func TestQueueHighWatermarkFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected int
+	}{
+		{"", 0},
+		{"80", 80},
+		{"100", 100},
+		{"101", 0},
+		{"-5", 0},
+		{"high", 0},
+	} {
+		t.Run(fmt.Sprintf("%q", tt.value), func(t *testing.T) {
+			t.Setenv("QUEUE_HIGH_WATERMARK_PERCENT", tt.value)
+			if got := getQueueHighWatermark(); got != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// replay queues every message in the partition's log again for redelivery.
+// It returns how many were queued and how many were skipped because the queue
+// was full.
+func (p *Partition) replay() (queued, skipped int, err error) {
+	p.storeMu.Lock()
+	defer p.storeMu.Unlock()
+	// Close cancels the context before closing the store under storeMu
+	if p.ctx.Err() != nil {
+		return 0, 0, errPartitionClosed
+	}
+	err = p.store.Replay(func(m Message) error {
+		if err := p.trySend(m); err != nil {
+			if errors.Is(err, errQueueFull) {
+				skipped++
+				return nil
+			}
+			return err
+		}
+		queued++
+		return nil
+	})
+	return queued, skipped, err
+}
+
+// resetGroup forgets group's position in the partition: its last acked
+// message, so a resuming consumer doesn't skip anything, and its pending
+// messages, which a replay delivers again. It returns how many pending
+// messages were dropped.
+func (p *Partition) resetGroup(group string) int {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	delete(p.lastAcked, group)
+	dropped := 0
+	for id, pd := range p.pending {
+		if pd.group != group {
+			continue
+		}
+		p.untrackPending(id, pd)
+		if !pd.requeueFailed {
+			p.releaseSlot(group)
+		}
+		dropped++
+	}
+	return dropped
+}
+
+// replayHandler: POST /replay?topic=foo&partition=0[&group=g1&reset=true]
+// Queues the partition's logged messages again so consumers get them a second
+// time. With reset, group's position is cleared first. Only messages written
+// to the log are replayed: those produced with acks=persisted or persisted
+// when the queue was full.
+func (b *Broker) replayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	partStr := r.URL.Query().Get("partition")
+	group := r.URL.Query().Get("group")
+	reset := r.URL.Query().Get("reset") == "true"
+	if topic == "" || partStr == "" {
+		http.Error(w, "topic and partition required", http.StatusBadRequest)
+		return
+	}
+	if reset && group == "" {
+		http.Error(w, "group required to reset", http.StatusBadRequest)
+		return
+	}
+	part, err := strconv.Atoi(partStr)
+	if err != nil {
+		http.Error(w, "bad partition", http.StatusBadRequest)
+		return
+	}
+	p, err := b.getPartition(topic, part, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dropped := 0
+	if reset {
+		dropped = p.resetGroup(group)
+	}
+	queued, skipped, err := p.replay()
+	if err != nil {
+		if errors.Is(err, errPartitionClosed) {
+			http.Error(w, "replay failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "replay failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("partition %s-%d: replayed %d logged messages (%d skipped, queue full)", topic, part, queued, skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"topic":           topic,
+		"partition":       part,
+		"replayed":        queued,
+		"skipped":         skipped,
+		"reset":           reset,
+		"pending_dropped": dropped,
+	})
+}
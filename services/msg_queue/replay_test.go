@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/security"
+)
+
+// replayResponse is the body of a /replay response
+type replayResponse struct {
+	Replayed       int  `json:"replayed"`
+	Skipped        int  `json:"skipped"`
+	Reset          bool `json:"reset"`
+	PendingDropped int  `json:"pending_dropped"`
+}
+
+// postReplay sends a /replay request through the service auth middleware, as main does
+func postReplay(t *testing.T, b *Broker, method, query, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/replay?"+query, nil)
+	if token != "" {
+		req.Header.Set("X-Service-Token", token)
+	}
+	w := httptest.NewRecorder()
+	security.ServiceAuthMiddleware(http.HandlerFunc(b.replayHandler)).ServeHTTP(w, req)
+	return w
+}
+
+// openPartition creates partition 0 of telemetry and gives it time to load
+// its empty log, which it does in the background; a persisted produce that
+// beat the load would otherwise be queued twice
+func openPartition(t *testing.T, b *Broker) *Partition {
+	t.Helper()
+	p, err := b.getPartition("telemetry", 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return p
+}
+
+func TestReplayRedeliversLoggedMessages(t *testing.T) {
+	t.Setenv("SERVICE_TOKEN", "replay-secret")
+	b := newTestBroker(t)
+	p := openPartition(t, b)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, produceAt(t, b, 0, acksPersisted).ID)
+	}
+
+	// Consume and ack everything
+	for range ids {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if !p.ack(msg.ID, "g1") {
+			t.Fatalf("Ack of %s failed", msg.ID)
+		}
+	}
+	if _, err := p.fetchAndTrack("g1", 50*time.Millisecond); err != errNoMessages {
+		t.Fatalf("Expected the partition to be drained, got %v", err)
+	}
+
+	w := postReplay(t, b, "POST", "topic=telemetry&partition=0", "replay-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp replayResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Replayed != 3 || resp.Skipped != 0 {
+		t.Errorf("Expected 3 replayed and none skipped, got %+v", resp)
+	}
+
+	// The same messages come round again, in log order
+	for _, id := range ids {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Expected %s to be delivered again: %v", id, err)
+		}
+		if msg.ID != id {
+			t.Errorf("Expected %s, got %s", id, msg.ID)
+		}
+	}
+}
+
+func TestReplayResetsGroup(t *testing.T) {
+	t.Setenv("SERVICE_TOKEN", "replay-secret")
+	b := newTestBroker(t)
+	p := openPartition(t, b)
+	first := produceAt(t, b, 0, acksPersisted).ID
+	produceAt(t, b, 0, acksPersisted)
+
+	// g1 acks the first message and leaves the second pending
+	for i := 0; i < 2; i++ {
+		if _, err := p.fetchAndTrack("g1", time.Second); err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+	}
+	p.ack(first, "g1")
+
+	w := postReplay(t, b, "POST", "topic=telemetry&partition=0&group=g1&reset=true", "replay-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp replayResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !resp.Reset || resp.PendingDropped != 1 || resp.Replayed != 2 {
+		t.Errorf("Expected a reset dropping 1 pending message and 2 replayed, got %+v", resp)
+	}
+	if st := p.state(); st.Pending != 0 || st.QueueDepth != 2 {
+		t.Errorf("Expected nothing pending and both messages queued, got %+v", st)
+	}
+	if _, ok := p.lastAcked["g1"]; ok {
+		t.Error("Expected the group's last acked message to be forgotten")
+	}
+}
+
+func TestReplayRequests(t *testing.T) {
+	t.Setenv("SERVICE_TOKEN", "replay-secret")
+	b := newTestBroker(t)
+	openPartition(t, b)
+
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		token          string
+		expectedStatus int
+	}{
+		{"No token", "POST", "topic=telemetry&partition=0", "", http.StatusUnauthorized},
+		{"Wrong token", "POST", "topic=telemetry&partition=0", "guess", http.StatusUnauthorized},
+		{"Wrong method", "GET", "topic=telemetry&partition=0", "replay-secret", http.StatusMethodNotAllowed},
+		{"Missing partition", "POST", "topic=telemetry", "replay-secret", http.StatusBadRequest},
+		{"Reset without group", "POST", "topic=telemetry&partition=0&reset=true", "replay-secret", http.StatusBadRequest},
+		{"Unopened partition", "POST", "topic=telemetry&partition=1", "replay-secret", http.StatusBadRequest},
+		{"Unknown topic", "POST", "topic=nope&partition=0", "replay-secret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postReplay(t, b, tt.method, tt.query, tt.token)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// PartitionStore is the durable log behind a partition. Messages are appended
+// as they are persisted and replayed, oldest first, when the partition opens.
+// The partition serializes calls, so implementations need not be safe for
+// concurrent use.
+type PartitionStore interface {
+	// Append adds m to the end of the log
+	Append(m Message) error
+	// Replay calls fn for every logged message in order, stopping at the
+	// first error fn returns
+	Replay(fn func(Message) error) error
+	// Sync makes every appended message durable
+	Sync() error
+	// Close releases the store; logged messages are kept
+	Close() error
+}
+
+// storeFactory opens the store for one partition of a topic
+type storeFactory func(topic string, index int) (PartitionStore, error)
+
+// syncFile flushes a partition log to disk; swapped out in tests
+var syncFile = (*os.File).Sync
+
+// fileStore is the default PartitionStore: an append-only file with one JSON
+// message per line
+type fileStore struct {
+	f *os.File
+}
+
+// fileStoreFactory opens partition logs as <storageDir>/<topic>/partition-<index>.log
+func fileStoreFactory(storageDir string) storeFactory {
+	return func(topic string, index int) (PartitionStore, error) {
+		dir := filepath.Join(storageDir, topic)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		fpath := filepath.Join(dir, fmt.Sprintf("partition-%d.log", index))
+		f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileStore{f: f}, nil
+	}
+}
+
+func (s *fileStore) Append(m Message) error {
+	b, _ := json.Marshal(m)
+	_, err := s.f.Write(append(b, '\n'))
+	return err
+}
+
+// Replay reads the log from the start, skipping lines that don't decode
+func (s *fileStore) Replay(fn func(Message) error) error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(s.f)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("%s: skip bad line: %v", s.f.Name(), err)
+			continue
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if _, err := s.f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+func (s *fileStore) Sync() error {
+	return syncFile(s.f)
+}
+
+func (s *fileStore) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a PartitionStore that keeps its log in memory and survives
+// Close, so a partition can be reopened on it without touching disk
+type memoryStore struct {
+	mu     sync.Mutex
+	log    []Message
+	syncs  int
+	closed bool
+}
+
+func (s *memoryStore) Append(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("store closed")
+	}
+	s.log = append(s.log, m)
+	return nil
+}
+
+func (s *memoryStore) Replay(fn func(Message) error) error {
+	s.mu.Lock()
+	logged := append([]Message(nil), s.log...)
+	s.mu.Unlock()
+	for _, m := range logged {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// memoryStores hands out one memoryStore per partition, reopening the same
+// store each time a partition is created again
+type memoryStores struct {
+	mu     sync.Mutex
+	stores map[string]*memoryStore
+}
+
+func (ms *memoryStores) open(topic string, index int) (PartitionStore, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.stores == nil {
+		ms.stores = make(map[string]*memoryStore)
+	}
+	key := fmt.Sprintf("%s-%d", topic, index)
+	s := ms.stores[key]
+	if s == nil {
+		s = &memoryStore{}
+		ms.stores[key] = s
+	} else {
+		s.mu.Lock()
+		s.closed = false
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+func TestPartitionStoreAppendReplay(t *testing.T) {
+	stores := map[string]func(t *testing.T) storeFactory{
+		"file":   func(t *testing.T) storeFactory { return fileStoreFactory(t.TempDir()) },
+		"memory": func(t *testing.T) storeFactory { return (&memoryStores{}).open },
+	}
+	for name, newFactory := range stores {
+		t.Run(name, func(t *testing.T) {
+			open := newFactory(t)
+			s, err := open("telemetry", 0)
+			if err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := s.Append(Message{ID: fmt.Sprintf("m%d", i), Offset: int64(i)}); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+			if err := s.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// Reopened, the store replays every message in append order
+			s, err = open("telemetry", 0)
+			if err != nil {
+				t.Fatalf("Failed to reopen store: %v", err)
+			}
+			defer s.Close()
+			var ids []string
+			if err := s.Replay(func(m Message) error {
+				ids = append(ids, m.ID)
+				return nil
+			}); err != nil {
+				t.Fatalf("Replay failed: %v", err)
+			}
+			if fmt.Sprint(ids) != "[m0 m1 m2]" {
+				t.Errorf("Expected [m0 m1 m2], got %v", ids)
+			}
+
+			// An error from fn stops the replay and is returned
+			stop := errors.New("stop")
+			seen := 0
+			err = s.Replay(func(m Message) error {
+				seen++
+				return stop
+			})
+			if !errors.Is(err, stop) || seen != 1 {
+				t.Errorf("Expected replay to stop at the first error, got %v after %d messages", err, seen)
+			}
+
+			// Appends after a replay land at the end
+			if err := s.Append(Message{ID: "m3", Offset: 3}); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+			ids = nil
+			s.Replay(func(m Message) error {
+				ids = append(ids, m.ID)
+				return nil
+			})
+			if fmt.Sprint(ids) != "[m0 m1 m2 m3]" {
+				t.Errorf("Expected [m0 m1 m2 m3], got %v", ids)
+			}
+		})
+	}
+}
+
+func TestPartitionReopensFromStore(t *testing.T) {
+	t.Setenv("PERSIST_SYNC", syncAlways)
+	stores := &memoryStores{}
+
+	p, err := newPartition(stores.open, "telemetry", 0, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create partition: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.persist(Message{ID: fmt.Sprintf("m%d", i), Offset: p.assignOffset()}); err != nil {
+			t.Fatalf("persist failed: %v", err)
+		}
+	}
+	p.Close()
+	if s := stores.stores["telemetry-0"]; len(s.log) != 3 || s.syncs != 3 {
+		t.Fatalf("Expected 3 messages each synced under PERSIST_SYNC=always, got %d messages and %d syncs", len(s.log), s.syncs)
+	}
+
+	// A restarted partition resumes offsets and queues the logged messages
+	p, err = newPartition(stores.open, "telemetry", 0, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition: %v", err)
+	}
+	defer p.Close()
+	if next := p.assignOffset(); next != 3 {
+		t.Errorf("Expected offsets to resume at 3, got %d", next)
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := p.fetchAndTrack("g1", time.Second)
+		if err != nil {
+			t.Fatalf("Expected logged message %d to be queued: %v", i, err)
+		}
+		if want := fmt.Sprintf("m%d", i); msg.ID != want {
+			t.Errorf("Expected %s, got %s", want, msg.ID)
+		}
+	}
+}
+
+func TestBrokerUsesStoreFactory(t *testing.T) {
+	b := newTestBroker(t)
+	stores := &memoryStores{}
+	b.newStore = stores.open
+
+	resp := produceAt(t, b, 1, acksPersisted)
+	s := stores.stores["telemetry-1"]
+	if s == nil || len(s.log) != 1 || s.log[0].ID != resp.ID {
+		t.Fatalf("Expected the persisted produce in the partition's store, got %+v", s)
+	}
+}
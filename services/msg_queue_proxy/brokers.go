@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// brokerHealth is the body of a broker's /health response
+type brokerHealth struct {
+	Status          string `json:"status"`
+	BrokerIndex     int    `json:"broker_index"`
+	BrokerCount     int    `json:"broker_count"`
+	OwnedPartitions int    `json:"owned_partitions"`
+}
+
+// brokerReport is one broker's entry in the /brokers response
+type brokerReport struct {
+	Endpoint string `json:"endpoint"`
+	// Reachable is whether the broker answered at all, even with an error status
+	Reachable bool `json:"reachable"`
+	// ProxyHealthy is the proxy's view from its last periodic health check
+	ProxyHealthy bool    `json:"proxy_healthy"`
+	LatencyMs    float64 `json:"latency_ms"`
+	Error        string  `json:"error,omitempty"`
+	// Health is what the broker reported, set only when it answered /health
+	// successfully
+	Health *brokerHealth `json:"health,omitempty"`
+}
+
+// fetchBrokerHealth queries a broker's /health endpoint within the health
+// check timeout and reports what it said
+func (sp *SmartProxy) fetchBrokerHealth(endpoint string) brokerReport {
+	report := brokerReport{Endpoint: endpoint}
+	ctx, cancel := context.WithTimeout(context.Background(), sp.healthCheckTimeout())
+	defer cancel()
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/health", nil)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	resp, err := sp.client.Do(req)
+	report.LatencyMs = durationMs(time.Since(start))
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	defer resp.Body.Close()
+	report.Reachable = true
+
+	if resp.StatusCode != http.StatusOK {
+		report.Error = fmt.Sprintf("status %d", resp.StatusCode)
+		return report
+	}
+	var health brokerHealth
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		report.Error = fmt.Sprintf("bad health response: %v", err)
+		return report
+	}
+	report.Health = &health
+	return report
+}
+
+// brokersHandler: GET /brokers
+// Queries every broker's /health in parallel and returns one report with what
+// each broker says about itself next to the proxy's own view of its health.
+func (sp *SmartProxy) brokersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sp.mu.RLock()
+	endpoints := make([]string, len(sp.brokerEndpoints))
+	copy(endpoints, sp.brokerEndpoints)
+	sp.mu.RUnlock()
+
+	reports := make([]brokerReport, len(endpoints))
+	sp.forEachBroker(endpoints, func(i int, endpoint string) {
+		reports[i] = sp.fetchBrokerHealth(endpoint)
+	})
+
+	reachable, healthy := 0, 0
+	sp.mu.RLock()
+	for i := range reports {
+		reports[i].ProxyHealthy = sp.healthyBrokers[reports[i].Endpoint]
+		if reports[i].ProxyHealthy {
+			healthy++
+		}
+		if reports[i].Reachable {
+			reachable++
+		}
+	}
+	sp.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"brokers":           reports,
+		"brokers_total":     len(reports),
+		"brokers_reachable": reachable,
+		"brokers_healthy":   healthy,
+		"timestamp":         time.Now().UTC(),
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthBroker serves /health the way a broker does
+func healthBroker(t *testing.T, index, ownedPartitions int) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"healthy","broker_index":%d,"broker_count":4,"owned_partitions":%d}`, index, ownedPartitions)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestBrokersHandler(t *testing.T) {
+	initTestMetrics()
+	broker0 := healthBroker(t, 0, 3)
+	broker1 := healthBroker(t, 1, 5)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	sp := newTestProxy(ProxyConfig{HealthCheckTimeout: 200 * time.Millisecond},
+		broker0, broker1, failing.URL, hung.URL, down.URL)
+	// The proxy's last health check hasn't noticed broker1 is back yet
+	sp.healthyBrokers[broker1] = false
+	sp.healthyBrokers[down.URL] = false
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	sp.brokersHandler(w, httptest.NewRequest("GET", "/brokers", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hung broker to be bounded by the timeout, took %v", elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Brokers          []brokerReport `json:"brokers"`
+		BrokersTotal     int            `json:"brokers_total"`
+		BrokersReachable int            `json:"brokers_reachable"`
+		BrokersHealthy   int            `json:"brokers_healthy"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.BrokersTotal != 5 || resp.BrokersReachable != 3 || resp.BrokersHealthy != 3 {
+		t.Errorf("Expected 5 brokers, 3 reachable and 3 healthy to the proxy, got %d, %d and %d",
+			resp.BrokersTotal, resp.BrokersReachable, resp.BrokersHealthy)
+	}
+
+	reports := make(map[string]brokerReport)
+	for _, report := range resp.Brokers {
+		reports[report.Endpoint] = report
+	}
+	for endpoint, want := range map[string]struct {
+		index, partitions int
+		proxyHealthy      bool
+	}{
+		broker0: {0, 3, true},
+		broker1: {1, 5, false},
+	} {
+		got := reports[endpoint]
+		if !got.Reachable || got.Error != "" || got.Health == nil {
+			t.Errorf("Expected %s to report healthy, got %+v", endpoint, got)
+			continue
+		}
+		if got.Health.BrokerIndex != want.index || got.Health.OwnedPartitions != want.partitions || got.ProxyHealthy != want.proxyHealthy {
+			t.Errorf("Expected %s to be index %d owning %d partitions with proxy view %v, got %+v",
+				endpoint, want.index, want.partitions, want.proxyHealthy, got)
+		}
+	}
+
+	if got := reports[failing.URL]; !got.Reachable || got.Error != "status 503" || got.Health != nil {
+		t.Errorf("Expected the failing broker to be reachable with a 503, got %+v", got)
+	}
+	for _, endpoint := range []string{hung.URL, down.URL} {
+		if got := reports[endpoint]; got.Reachable || got.Error == "" || got.Health != nil {
+			t.Errorf("Expected %s to be unreachable, got %+v", endpoint, got)
+		}
+	}
+	if !reports[hung.URL].ProxyHealthy || reports[down.URL].ProxyHealthy {
+		t.Error("Expected each broker's proxy view to come from the last health check")
+	}
+}
+
+func TestBrokersHandlerMethod(t *testing.T) {
+	initTestMetrics()
+	sp := newTestProxy(ProxyConfig{}, "http://broker-0:8080")
+	w := httptest.NewRecorder()
+	sp.brokersHandler(w, httptest.NewRequest("POST", "/brokers", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+}
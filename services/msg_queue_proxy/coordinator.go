@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultConsumerSessionTimeout = 10 * time.Second
+
+// groupKey identifies a consumer group on one topic
+type groupKey struct {
+	topic string
+	group string
+}
+
+// groupMember is a consumer instance taking part in a group
+type groupMember struct {
+	// lastSeen is when the member last asked for a partition or closed a
+	// stream; a member without streams expires a session timeout after it
+	lastSeen time.Time
+	streams  map[uint64]memberStream
+}
+
+// memberStream is a consume stream the proxy is forwarding for a member
+type memberStream struct {
+	partition int
+	cancel    context.CancelFunc
+}
+
+// groupCoordinator shares the partitions of a topic between the consumer
+// instances of a group, so each partition is streamed by exactly one of them.
+// Members join by asking for a partition and leave once they have had no
+// stream open for the session timeout. Partition p belongs to the (p mod n)th
+// of the n members in ID order; when membership changes, streams whose
+// partition now belongs to another member are closed and that member takes
+// over on its next attempt. Messages the closed stream had delivered but not
+// acked are redelivered after the broker's visibility timeout.
+//
+// Membership is kept in memory, so consumers of a group must share a proxy
+// replica for the assignment to hold.
+type groupCoordinator struct {
+	sessionTimeout time.Duration
+
+	mu     sync.Mutex
+	nextID uint64
+	groups map[groupKey]map[string]*groupMember
+}
+
+func newGroupCoordinator(sessionTimeout time.Duration) *groupCoordinator {
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultConsumerSessionTimeout
+	}
+	return &groupCoordinator{
+		sessionTimeout: sessionTimeout,
+		groups:         make(map[groupKey]map[string]*groupMember),
+	}
+}
+
+// join registers member with the group and, if partition is assigned to it,
+// the stream that cancel closes. It returns the function to call when the
+// stream ends, or nil and the partition's owner if another member holds it.
+func (gc *groupCoordinator) join(topic, group, member string, partition int, cancel context.CancelFunc, now time.Time) (release func(), owner string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	key := groupKey{topic: topic, group: group}
+	members := gc.groups[key]
+	if members == nil {
+		members = make(map[string]*groupMember)
+		gc.groups[key] = members
+	}
+
+	changed := gc.expire(key, members, now)
+	m := members[member]
+	if m == nil {
+		m = &groupMember{streams: make(map[uint64]memberStream)}
+		members[member] = m
+		changed = true
+		log.Printf("Consumer %s joined group %s on topic %s (%d members)", member, group, topic, len(members))
+	}
+	m.lastSeen = now
+
+	ids := memberIDs(members)
+	if changed {
+		gc.rebalance(key, members, ids)
+	}
+	if owner := assignedMember(ids, partition); owner != member {
+		return nil, owner
+	}
+
+	gc.nextID++
+	id := gc.nextID
+	m.streams[id] = memberStream{partition: partition, cancel: cancel}
+	return func() {
+		gc.mu.Lock()
+		defer gc.mu.Unlock()
+		delete(m.streams, id)
+		m.lastSeen = time.Now()
+	}, member
+}
+
+// expire removes members with no open stream that haven't been seen for the
+// session timeout, reporting whether any were removed
+func (gc *groupCoordinator) expire(key groupKey, members map[string]*groupMember, now time.Time) bool {
+	expired := false
+	for id, m := range members {
+		if len(m.streams) == 0 && now.Sub(m.lastSeen) > gc.sessionTimeout {
+			delete(members, id)
+			expired = true
+			log.Printf("Consumer %s left group %s on topic %s (%d members)", id, key.group, key.topic, len(members))
+		}
+	}
+	return expired
+}
+
+// rebalance closes the streams of partitions no longer assigned to the member
+// holding them
+func (gc *groupCoordinator) rebalance(key groupKey, members map[string]*groupMember, ids []string) {
+	for memberID, m := range members {
+		for id, s := range m.streams {
+			if assignedMember(ids, s.partition) != memberID {
+				log.Printf("Revoking partition %d of %s from consumer %s of group %s", s.partition, key.topic, memberID, key.group)
+				s.cancel()
+				delete(m.streams, id)
+			}
+		}
+	}
+}
+
+func memberIDs(members map[string]*groupMember) []string {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// assignedMember returns the member of the sorted ids that partition belongs to
+func assignedMember(ids []string, partition int) string {
+	return ids[partition%len(ids)]
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// claim asks gc for every partition on behalf of member, returning the
+// partitions it was given and the cancel flags of their streams
+func claim(gc *groupCoordinator, member string, partitions int, now time.Time) (got []int, cancelled map[int]*bool) {
+	cancelled = make(map[int]*bool)
+	for p := 0; p < partitions; p++ {
+		flag := new(bool)
+		if release, _ := gc.join("telemetry", "g1", member, p, func() { *flag = true }, now); release != nil {
+			got = append(got, p)
+			cancelled[p] = flag
+		}
+	}
+	return got, cancelled
+}
+
+func TestGroupCoordinatorSplitsPartitions(t *testing.T) {
+	gc := newGroupCoordinator(time.Minute)
+	now := time.Now()
+
+	// Alone in the group, a consumer gets every partition
+	aGot, aCancelled := claim(gc, "collector-a", 4, now)
+	if len(aGot) != 4 {
+		t.Fatalf("Expected the only member to get all 4 partitions, got %v", aGot)
+	}
+
+	// A second member takes over half, and the first loses those streams
+	bGot, _ := claim(gc, "collector-b", 4, now)
+	if len(bGot) != 2 {
+		t.Fatalf("Expected the second member to get 2 partitions, got %v", bGot)
+	}
+	var aKept []int
+	for p, cancelled := range aCancelled {
+		if !*cancelled {
+			aKept = append(aKept, p)
+		}
+	}
+	sort.Ints(aKept)
+	owners := make(map[int]int)
+	for _, p := range append(aKept, bGot...) {
+		owners[p]++
+	}
+	for p := 0; p < 4; p++ {
+		if owners[p] != 1 {
+			t.Errorf("Expected partition %d to be streamed by exactly one member, got %d (a kept %v, b got %v)", p, owners[p], aKept, bGot)
+		}
+	}
+
+	// Asking again doesn't move anything
+	if again, _ := claim(gc, "collector-a", 4, now); fmt.Sprint(again) != fmt.Sprint(aKept) {
+		t.Errorf("Expected collector-a to keep %v, got %v", aKept, again)
+	}
+
+	// Another group on the same topic is assigned independently
+	if release, _ := gc.join("telemetry", "g2", "collector-b", aKept[0], func() {}, now); release == nil {
+		t.Error("Expected a member of another group to get the partition")
+	}
+}
+
+func TestGroupCoordinatorRebalancesWhenMemberLeaves(t *testing.T) {
+	gc := newGroupCoordinator(time.Second)
+	now := time.Now()
+
+	var releases []func()
+	for p := 0; p < 4; p++ {
+		gc.join("telemetry", "g1", "collector-a", p, func() {}, now)
+		if release, _ := gc.join("telemetry", "g1", "collector-b", p, func() {}, now); release != nil {
+			releases = append(releases, release)
+		}
+	}
+	if len(releases) != 2 {
+		t.Fatalf("Expected collector-b to hold 2 partitions, got %d", len(releases))
+	}
+
+	// While collector-b's streams are open, or it was seen recently, its
+	// partitions stay with it
+	release, owner := gc.join("telemetry", "g1", "collector-a", 1, func() {}, now.Add(time.Hour))
+	if release != nil || owner != "collector-b" {
+		t.Fatalf("Expected partition 1 to stay with collector-b while it streams, got owner %q", owner)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if release, _ := gc.join("telemetry", "g1", "collector-a", 1, func() {}, time.Now()); release != nil {
+		t.Fatal("Expected partition 1 to stay with collector-b within the session timeout")
+	}
+
+	// Once its session times out collector-a takes every partition
+	got, _ := claim(gc, "collector-a", 4, time.Now().Add(2*time.Second))
+	if len(got) != 4 {
+		t.Errorf("Expected collector-a to take over all 4 partitions, got %v", got)
+	}
+}
+
+// partitionBroker answers /consume with an SSE stream that stays open until
+// the proxy hangs up, reporting the partition of each stream it opens
+func partitionBroker(t *testing.T) (url string, opened chan int) {
+	t.Helper()
+	opened = make(chan int, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+		opened <- partition
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, opened
+}
+
+func TestConsumeHandlerSharesPartitionsInGroup(t *testing.T) {
+	initTestMetrics()
+	brokerURL, opened := partitionBroker(t)
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 4, RequestTimeout: time.Minute}, brokerURL)
+	proxy := httptest.NewServer(http.HandlerFunc(sp.consumeHandler))
+	t.Cleanup(proxy.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// consume opens a stream for consumer; ended receives once it closes,
+	// status receives the response status
+	type stream struct {
+		status chan int
+		ended  chan struct{}
+	}
+	consume := func(consumer string, partition int) stream {
+		s := stream{status: make(chan int, 1), ended: make(chan struct{})}
+		go func() {
+			defer close(s.ended)
+			req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/consume?topic=telemetry&partition=%d&group=g1&consumer=%s", proxy.URL, partition, consumer), nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				s.status <- 0
+				return
+			}
+			defer resp.Body.Close()
+			s.status <- resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+		}()
+		return s
+	}
+	// waitOpened returns the partitions of the next n streams to reach the
+	// broker. The proxy doesn't flush a stream's headers until the broker
+	// sends data, so streams are observed here rather than by their status.
+	waitOpened := func(n int) []int {
+		t.Helper()
+		var partitions []int
+		for i := 0; i < n; i++ {
+			select {
+			case p := <-opened:
+				partitions = append(partitions, p)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for stream %d of %d to reach the broker", i+1, n)
+			}
+		}
+		sort.Ints(partitions)
+		return partitions
+	}
+
+	aStreams := make([]stream, 4)
+	for p := range aStreams {
+		aStreams[p] = consume("collector-a", p)
+	}
+	if got := waitOpened(4); len(got) != 4 {
+		t.Fatalf("Expected collector-a to stream all 4 partitions, got %v", got)
+	}
+
+	bStreams := make([]stream, 4)
+	for p := range bStreams {
+		bStreams[p] = consume("collector-b", p)
+	}
+	bGot := waitOpened(2)
+	for p, s := range bStreams {
+		if containsInt(bGot, p) {
+			continue
+		}
+		if code := <-s.status; code != http.StatusConflict {
+			t.Errorf("Expected 409 for collector-b on partition %d, got %d", p, code)
+		}
+	}
+
+	// collector-a's streams for the partitions collector-b took are closed;
+	// the others stay open
+	for _, p := range bGot {
+		select {
+		case <-aStreams[p].ended:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected collector-a's stream for partition %d to be closed", p)
+		}
+	}
+	for p, s := range aStreams {
+		if containsInt(bGot, p) {
+			continue
+		}
+		select {
+		case <-s.ended:
+			t.Errorf("Expected collector-a to keep streaming partition %d", p)
+		default:
+		}
+	}
+
+	// collector-a is now turned away from the partitions it lost
+	if code := <-consume("collector-a", bGot[0]).status; code != http.StatusConflict {
+		t.Errorf("Expected 409 for collector-a on partition %d, got %d", bGot[0], code)
+	}
+
+	// Consumers that don't identify themselves aren't coordinated
+	consume("", bGot[0])
+	if got := waitOpened(1); got[0] != bGot[0] {
+		t.Errorf("Expected a consumer without an ID to stream partition %d, got %v", bGot[0], got)
+	}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Layout of latencyHistogram: every power-of-two range of microseconds is
+// split into latencySubBuckets equal buckets, so a reported percentile is
+// within about 1/(2*latencySubBuckets) of the true value. Latencies beyond
+// 2^latencyMagnitudes µs (about 71 minutes) land in the last bucket.
+const (
+	latencySubBucketBits = 4
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyMagnitudes    = 32
+	latencyBuckets       = (latencyMagnitudes - latencySubBucketBits + 1) * latencySubBuckets
+)
+
+// latencyHistogram counts request latencies in fixed log-linear buckets, in
+// the style of an HDR histogram. Recording is a single atomic add, so the
+// request path never takes a lock; memory stays constant however many
+// requests are recorded.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+}
+
+// record adds one observation of d
+func (h *latencyHistogram) record(d time.Duration) {
+	atomic.AddUint64(&h.counts[latencyBucket(d)], 1)
+}
+
+// percentiles returns the latency at each quantile in qs (0 < q <= 1), or
+// zeros when nothing has been recorded. Concurrent records may or may not be
+// included.
+func (h *latencyHistogram) percentiles(qs ...float64) []time.Duration {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+
+	result := make([]time.Duration, len(qs))
+	if total == 0 {
+		return result
+	}
+	for i, q := range qs {
+		rank := uint64(math.Ceil(q * float64(total)))
+		if rank < 1 {
+			rank = 1
+		}
+		var seen uint64
+		for bucket, count := range counts {
+			seen += count
+			if seen >= rank {
+				result[i] = latencyBucketValue(bucket)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// latencyBucket returns the bucket index for d. Below latencySubBuckets µs
+// every microsecond has its own bucket; above, the sub-bucket is taken from
+// the latencySubBucketBits bits after the leading one.
+func latencyBucket(d time.Duration) int {
+	us := d.Microseconds()
+	if us < latencySubBuckets {
+		if us < 0 {
+			return 0
+		}
+		return int(us)
+	}
+	shift := bits.Len64(uint64(us)) - 1 - latencySubBucketBits
+	index := (shift+1)*latencySubBuckets + int(us>>uint(shift)) - latencySubBuckets
+	if index >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return index
+}
+
+// latencyBucketValue returns the midpoint of a bucket's range
+func latencyBucketValue(index int) time.Duration {
+	if index < latencySubBuckets {
+		return time.Duration(index) * time.Microsecond
+	}
+	shift := index/latencySubBuckets - 1
+	low := int64(index%latencySubBuckets+latencySubBuckets) << uint(shift)
+	width := int64(1) << uint(shift)
+	return time.Duration(low+width/2) * time.Microsecond
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withinTolerance reports whether got is within tol (a fraction) of want
+func withinTolerance(got, want time.Duration, tol float64) bool {
+	return math.Abs(float64(got-want)) <= tol*float64(want)
+}
+
+func TestLatencyPercentilesUniform(t *testing.T) {
+	var h latencyHistogram
+	// 1ms..1000ms, once each
+	for ms := 1; ms <= 1000; ms++ {
+		h.record(time.Duration(ms) * time.Millisecond)
+	}
+
+	got := h.percentiles(0.5, 0.9, 0.99)
+	want := []time.Duration{500 * time.Millisecond, 900 * time.Millisecond, 990 * time.Millisecond}
+	for i, q := range []string{"p50", "p90", "p99"} {
+		if !withinTolerance(got[i], want[i], 0.05) {
+			t.Errorf("Expected %s near %v, got %v", q, want[i], got[i])
+		}
+	}
+}
+
+func TestLatencyPercentilesShowTail(t *testing.T) {
+	var h latencyHistogram
+	rng := rand.New(rand.NewSource(1))
+	// 98% fast requests around 2ms, 2% slow ones around 800ms: the mean hides
+	// the tail but p99 must not
+	for i := 0; i < 10000; i++ {
+		if i%50 == 0 {
+			h.record(time.Duration(750+rng.Intn(100)) * time.Millisecond)
+		} else {
+			h.record(time.Duration(1500+rng.Intn(1000)) * time.Microsecond)
+		}
+	}
+
+	got := h.percentiles(0.5, 0.9, 0.99)
+	if !withinTolerance(got[0], 2*time.Millisecond, 0.3) {
+		t.Errorf("Expected p50 near 2ms, got %v", got[0])
+	}
+	if !withinTolerance(got[1], 2*time.Millisecond, 0.3) {
+		t.Errorf("Expected p90 near 2ms, got %v", got[1])
+	}
+	if got[2] < 700*time.Millisecond || got[2] > 900*time.Millisecond {
+		t.Errorf("Expected p99 in the slow tail, got %v", got[2])
+	}
+}
+
+func TestLatencyPercentilesEdges(t *testing.T) {
+	var h latencyHistogram
+	if got := h.percentiles(0.5, 0.99); got[0] != 0 || got[1] != 0 {
+		t.Errorf("Expected zero percentiles with no data, got %v", got)
+	}
+
+	h.record(3 * time.Microsecond)
+	if got := h.percentiles(0.5)[0]; got != 3*time.Microsecond {
+		t.Errorf("Expected small latencies to be exact, got %v", got)
+	}
+
+	// Latencies past the histogram's range are clamped rather than lost
+	h.record(3 * time.Hour)
+	if got := h.percentiles(1)[0]; got < time.Hour {
+		t.Errorf("Expected a huge latency to land in the last bucket, got %v", got)
+	}
+	h.record(-time.Millisecond)
+	if got := h.percentiles(0.01)[0]; got != 0 {
+		t.Errorf("Expected a negative latency to count as zero, got %v", got)
+	}
+}
+
+func TestLatencyBucketsAreOrdered(t *testing.T) {
+	prev := -1
+	for us := int64(0); us < 1<<24; us = us*9/8 + 1 {
+		d := time.Duration(us) * time.Microsecond
+		bucket := latencyBucket(d)
+		if bucket < prev {
+			t.Fatalf("Bucket for %v (%d) is below the previous bucket %d", d, bucket, prev)
+		}
+		prev = bucket
+		if value := latencyBucketValue(bucket); !withinTolerance(value, d, 1.0/latencySubBuckets) {
+			t.Errorf("Bucket value %v too far from %v", value, d)
+		}
+	}
+}
+
+func TestLatencyHistogramConcurrent(t *testing.T) {
+	var h latencyHistogram
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				h.record(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total uint64
+	for _, count := range h.counts {
+		total += count
+	}
+	if total != 8000 {
+		t.Errorf("Expected 8000 recorded latencies, got %d", total)
+	}
+}
+
+func TestStatsReportsLatencyPercentiles(t *testing.T) {
+	initTestMetrics()
+	sp := newTestProxy(ProxyConfig{}, "http://broker-0:8080")
+	for ms := 1; ms <= 100; ms++ {
+		sp.recordRequest("produce", "telemetry", "http://broker-0:8080", time.Duration(ms)*time.Millisecond, true)
+	}
+
+	w := httptest.NewRecorder()
+	sp.statsHandler(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		Percentiles map[string]float64 `json:"latency_percentiles_ms"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+
+	want := map[string]float64{"p50": 50, "p90": 90, "p99": 99}
+	for q, ms := range want {
+		if got, ok := stats.Percentiles[q]; !ok || math.Abs(got-ms) > ms*0.05 {
+			t.Errorf("Expected %s near %vms, got %v", q, ms, got)
+		}
+	}
+}
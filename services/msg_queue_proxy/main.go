@@ -8,37 +8,98 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/example/telemetry/internal/buildinfo"
 	consistenthash "github.com/example/telemetry/internal/consistent_hash"
 	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/reqlog"
+	"github.com/example/telemetry/internal/security"
 )
 
+// Defaults for broker health probes when the configured values are unset
+const (
+	defaultHealthCheckTimeout = 5 * time.Second
+	defaultHealthCheckWorkers = 10
+)
+
+// Default broker endpoints: StatefulSet pods have predictable DNS names,
+// <pod-name>.<headless-service>.<namespace>.svc.cluster.local
+const (
+	defaultBrokerEndpointTemplate = "http://{service}-{index}.{service}-headless.{namespace}.svc.cluster.local:{port}"
+	defaultBrokerPort             = 8080
+)
+
+// owningBrokerHeader tells clients which broker serves a topic-partition so
+// they can cache the assignment. The proxy reports the endpoint it routed to
+// in place of the broker's own advertised address.
+const owningBrokerHeader = "X-Owning-Broker"
+
 // ProxyConfig holds configuration for the smart proxy
 type ProxyConfig struct {
 	Port              string
 	BrokerService     string // Kubernetes service name for brokers
 	BrokerCount       int
 	VirtualNodes      int
+	RingHash          string // Hash ring hash function: fnv1a or sha512
 	MaxPartitions     int
 	HealthInterval    time.Duration
 	RequestTimeout    time.Duration
 	ConnectionTimeout time.Duration
+	KnownTopics       []string // Topics that get their own metrics label
+	MaxMessageBytes   int64    // Maximum request body size forwarded to brokers
+
+	// Broker health probes: each is cut off after HealthCheckTimeout and at
+	// most HealthCheckWorkers run at once
+	HealthCheckTimeout time.Duration
+	HealthCheckWorkers int
+
+	// BrokerEndpointTemplate builds each broker's URL from {service},
+	// {index}, {namespace} and {port} (BrokerPort)
+	BrokerEndpointTemplate string
+	BrokerPort             int
+
+	// Broker connection pool sizes; MaxConnsPerHost 0 means unlimited
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// ConsumerSessionTimeout is how long a group member with no open consume
+	// stream keeps its partitions
+	ConsumerSessionTimeout time.Duration
 }
 
 // SmartProxy routes requests to appropriate brokers using consistent hashing
 type SmartProxy struct {
-	config          ProxyConfig
+	config      ProxyConfig
+	knownTopics map[string]bool
+	client      *http.Client
+	conns       *connTracker
+	streams     *streamTracker
+	groups      *groupCoordinator
+
+	// mu guards the ring, the broker list, broker health, the topic
+	// partition counts and the config fields a reload can change
+	// (VirtualNodes, MaxPartitions, HealthInterval)
+	mu              sync.RWMutex
 	consistentHash  *consistenthash.ConsistentHash
 	brokerEndpoints []string
 	healthyBrokers  map[string]bool
-	mu              sync.RWMutex
-	client          *http.Client
+
+	// topicPartitions is each topic's partition count as reported by the
+	// brokers; topics not in it are routed within MaxPartitions
+	topicPartitions map[string]int
+
+	// healthReset carries a new health check interval to healthCheckLoop
+	healthReset chan time.Duration
 
 	// Metrics tracking
 	stats     ProxyStats
@@ -58,9 +119,10 @@ type ProxyStats struct {
 	SuccessfulRequests int64
 	FailedRequests     int64
 
-	// Latency tracking
+	// Latency tracking; Latency holds the distribution for percentiles
 	TotalLatencyMs int64
 	RequestCount   int64
+	Latency        latencyHistogram
 
 	// Per-broker request distribution
 	BrokerRequestCounts map[string]int64
@@ -75,21 +137,29 @@ type ProxyStats struct {
 
 // NewSmartProxy creates a new smart proxy instance
 func NewSmartProxy(config ProxyConfig) *SmartProxy {
+	knownTopics := make(map[string]bool)
+	for _, topic := range config.KnownTopics {
+		knownTopics[topic] = true
+	}
+
+	conns := newConnTracker()
+
 	return &SmartProxy{
 		config:         config,
 		healthyBrokers: make(map[string]bool),
+		healthReset:    make(chan time.Duration, 1),
+		knownTopics:    knownTopics,
 		startTime:      time.Now(),
 		stats: ProxyStats{
 			BrokerRequestCounts: make(map[string]int64),
 			BrokerErrors:        make(map[string]int64),
 		},
+		conns:   conns,
+		streams: newStreamTracker(),
+		groups:  newGroupCoordinator(config.ConsumerSessionTimeout),
 		client: &http.Client{
-			Timeout: config.RequestTimeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     config.ConnectionTimeout,
-			},
+			Timeout:   config.RequestTimeout,
+			Transport: newBrokerTransport(config, conns),
 		},
 	}
 }
@@ -111,18 +181,35 @@ func (sp *SmartProxy) Start() error {
 	// Initialize broker metrics maps
 	sp.initBrokerMetrics()
 
+	// Route each topic within the partition count its brokers report
+	if err := sp.reconcileTopics(); err != nil {
+		log.Printf("Routing every topic within MAX_PARTITIONS=%d until a broker reports its topics: %v", sp.config.MaxPartitions, err)
+		go sp.reconcileTopicsUntilDone(topicReconcileRetry)
+	}
+
 	// Start health checking
 	go sp.healthCheckLoop()
 
+	// Apply config changes on SIGHUP without restarting the server
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go sp.watchReload(reload)
+
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/produce", sp.produceHandler)
 	mux.HandleFunc("/consume", sp.consumeHandler)
 	mux.HandleFunc("/ack", sp.ackHandler)
+	mux.HandleFunc("/ack/batch", sp.ackBatchHandler)
 	mux.HandleFunc("/topics", sp.topicsHandler)
+	mux.HandleFunc("/topics/", sp.topicInfoHandler)
 	mux.HandleFunc("/health", sp.healthHandler)
 	mux.HandleFunc("/status", sp.statusHandler)
 	mux.HandleFunc("/stats", sp.statsHandler)
+	mux.HandleFunc("/ring", sp.ringHandler)
+	mux.HandleFunc("/route", sp.routeHandler)
+	mux.HandleFunc("/brokers", sp.brokersHandler)
+	mux.HandleFunc("/version", buildinfo.Handler("msg-queue-proxy"))
 
 	// Add Prometheus metrics endpoint
 	mux.Handle("/metrics", metrics.MetricsHandler())
@@ -133,17 +220,34 @@ func (sp *SmartProxy) Start() error {
 
 	server := &http.Server{
 		Addr:         ":" + sp.config.Port,
-		Handler:      mux,
+		Handler:      reqlog.Middleware(log.Default(), reqlog.SampleRateFromEnv(), mux),
 		ReadTimeout:  sp.config.RequestTimeout,
 		WriteTimeout: sp.config.RequestTimeout,
 	}
 
-	return server.ListenAndServe()
+	return security.ListenAndServe(server)
 }
 
 // discoverBrokers discovers broker endpoints from Kubernetes service
 func (sp *SmartProxy) discoverBrokers() error {
-	sp.brokerEndpoints = make([]string, 0, sp.config.BrokerCount)
+	endpoints := brokerEndpoints(sp.config)
+
+	sp.mu.Lock()
+	sp.brokerEndpoints = endpoints
+	for _, endpoint := range endpoints {
+		sp.healthyBrokers[endpoint] = true // Assume healthy initially
+	}
+	sp.mu.Unlock()
+
+	log.Printf("Discovered %d broker endpoints: %v", len(endpoints), endpoints)
+	return nil
+}
+
+// brokerEndpoints returns the endpoints of the config's brokers by expanding
+// BrokerEndpointTemplate for each index. A template without {index} can only
+// name one broker, so with more the default StatefulSet template is used.
+func brokerEndpoints(config ProxyConfig) []string {
+	endpoints := make([]string, 0, config.BrokerCount)
 
 	// Get namespace from environment or use default
 	namespace := os.Getenv("NAMESPACE")
@@ -151,18 +255,82 @@ func (sp *SmartProxy) discoverBrokers() error {
 		namespace = "telemetry" // Default to telemetry namespace
 	}
 
-	// Use proper StatefulSet DNS resolution for individual pods
-	serviceName := strings.Split(sp.config.BrokerService, ".")[0]
-	headlessServiceName := serviceName + "-headless" // StatefulSet uses headless service
-	for i := 0; i < sp.config.BrokerCount; i++ {
-		// StatefulSet pods have predictable DNS names: <pod-name>.<headless-service>.<namespace>.svc.cluster.local
-		endpoint := fmt.Sprintf("http://%s-%d.%s.%s.svc.cluster.local:8080", serviceName, i, headlessServiceName, namespace)
-		sp.brokerEndpoints = append(sp.brokerEndpoints, endpoint)
-		sp.healthyBrokers[endpoint] = true // Assume healthy initially
+	template := config.BrokerEndpointTemplate
+	if template == "" {
+		template = defaultBrokerEndpointTemplate
+	} else if config.BrokerCount > 1 && !strings.Contains(template, "{index}") {
+		log.Printf("Invalid BROKER_ENDPOINT_TEMPLATE value '%s' for %d brokers, using default: %s", template, config.BrokerCount, defaultBrokerEndpointTemplate)
+		template = defaultBrokerEndpointTemplate
+	}
+	port := config.BrokerPort
+	if port <= 0 {
+		port = defaultBrokerPort
 	}
 
-	log.Printf("Discovered %d broker endpoints: %v", len(sp.brokerEndpoints), sp.brokerEndpoints)
-	return nil
+	serviceName := strings.Split(config.BrokerService, ".")[0]
+	for i := 0; i < config.BrokerCount; i++ {
+		endpoint := strings.NewReplacer(
+			"{service}", serviceName,
+			"{index}", strconv.Itoa(i),
+			"{namespace}", namespace,
+			"{port}", strconv.Itoa(port),
+		).Replace(template)
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// setBrokers replaces the broker list and rebuilds the ring. Consume streams
+// to brokers that were removed are closed so their clients reconnect and get
+// routed to the partition's new owner instead of waiting on a broker that no
+// longer receives traffic. Callers hold mu.
+func (sp *SmartProxy) setBrokers(endpoints []string) {
+	current := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		current[endpoint] = true
+		if _, known := sp.healthyBrokers[endpoint]; !known {
+			sp.healthyBrokers[endpoint] = true // Assume healthy until probed
+		}
+	}
+
+	var removed []string
+	for _, endpoint := range sp.brokerEndpoints {
+		if !current[endpoint] {
+			removed = append(removed, endpoint)
+			delete(sp.healthyBrokers, endpoint)
+			metrics.ProxyBrokerHealth.DeleteLabelValues("msg-queue-proxy", endpoint)
+		}
+	}
+
+	sp.brokerEndpoints = endpoints
+	sp.consistentHash = consistenthash.NewConsistentHashWithHasher(endpoints, sp.config.VirtualNodes, ringHasher(sp.config.RingHash))
+
+	sp.stats.mu.Lock()
+	for _, endpoint := range endpoints {
+		if _, ok := sp.stats.BrokerRequestCounts[endpoint]; !ok {
+			sp.stats.BrokerRequestCounts[endpoint] = 0
+			sp.stats.BrokerErrors[endpoint] = 0
+		}
+	}
+	sp.stats.mu.Unlock()
+
+	for _, endpoint := range removed {
+		if closed := sp.streams.closeBroker(endpoint); closed > 0 {
+			log.Printf("Broker %s removed, closed %d consume streams so clients reconnect", endpoint, closed)
+		}
+	}
+}
+
+// hasBroker reports whether endpoint is still one of the proxy's brokers
+func (sp *SmartProxy) hasBroker(endpoint string) bool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	for _, broker := range sp.brokerEndpoints {
+		if broker == endpoint {
+			return true
+		}
+	}
+	return false
 }
 
 // initConsistentHash initializes the consistent hash ring
@@ -170,9 +338,20 @@ func (sp *SmartProxy) initConsistentHash() {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
-	sp.consistentHash = consistenthash.NewConsistentHash(sp.brokerEndpoints, sp.config.VirtualNodes)
+	sp.consistentHash = consistenthash.NewConsistentHashWithHasher(sp.brokerEndpoints, sp.config.VirtualNodes, ringHasher(sp.config.RingHash))
+	sp.logPartitionDistribution()
+}
+
+// ringHasher returns the hash ring's hash function for a RING_HASH value
+func ringHasher(name string) consistenthash.Hasher {
+	if name == "sha512" {
+		return consistenthash.SHA512
+	}
+	return consistenthash.FNV1a
+}
 
-	// Log partition distribution
+// logPartitionDistribution logs which partitions each broker owns; callers hold mu
+func (sp *SmartProxy) logPartitionDistribution() {
 	distribution := sp.consistentHash.GetPartitionDistribution(sp.config.MaxPartitions)
 	for broker, partitions := range distribution {
 		log.Printf("Broker %s owns partitions: %v", broker, partitions)
@@ -184,18 +363,8 @@ func (sp *SmartProxy) getBrokerForTopicPartition(topic string, partition int) st
 	sp.mu.RLock()
 	defer sp.mu.RUnlock()
 
-	broker := sp.consistentHash.GetBrokerByTopicPartition(topic, partition)
-
-	// If broker is unhealthy, find next healthy broker
-	if !sp.healthyBrokers[broker] {
-		for _, endpoint := range sp.brokerEndpoints {
-			if sp.healthyBrokers[endpoint] {
-				return endpoint
-			}
-		}
-	}
-
-	return broker
+	// Falls back to the next healthy broker while the ring's choice is unhealthy
+	return sp.routeTopicPartition(topic, partition).Broker
 }
 
 // assignPartition assigns a partition for a given topic/key
@@ -214,17 +383,33 @@ func (sp *SmartProxy) getBrokerForTopicPartition(topic string, partition int) st
 
 // initBrokerMetrics initializes broker-specific metrics maps
 func (sp *SmartProxy) initBrokerMetrics() {
+	sp.mu.RLock()
+	endpoints := sp.brokerEndpoints
+	sp.mu.RUnlock()
+
 	sp.stats.mu.Lock()
 	defer sp.stats.mu.Unlock()
 
-	for _, endpoint := range sp.brokerEndpoints {
+	for _, endpoint := range endpoints {
 		sp.stats.BrokerRequestCounts[endpoint] = 0
 		sp.stats.BrokerErrors[endpoint] = 0
 	}
 }
 
+// topicLabel returns the metrics label for a topic. Only configured topics
+// get their own label so that arbitrary client input can't blow up cardinality.
+func (sp *SmartProxy) topicLabel(topic string) string {
+	if topic == "" {
+		return "none"
+	}
+	if sp.knownTopics[topic] {
+		return topic
+	}
+	return "other"
+}
+
 // recordRequest tracks request metrics in both internal stats and Prometheus
-func (sp *SmartProxy) recordRequest(requestType string, broker string, latency time.Duration, success bool) {
+func (sp *SmartProxy) recordRequest(requestType string, topic string, broker string, latency time.Duration, success bool) {
 	// Internal counters for /stats endpoint
 	atomic.AddInt64(&sp.stats.TotalRequests, 1)
 
@@ -252,6 +437,7 @@ func (sp *SmartProxy) recordRequest(requestType string, broker string, latency t
 	// Track latency
 	atomic.AddInt64(&sp.stats.TotalLatencyMs, latency.Milliseconds())
 	atomic.AddInt64(&sp.stats.RequestCount, 1)
+	sp.stats.Latency.record(latency)
 
 	// Track per-broker stats
 	sp.stats.mu.Lock()
@@ -267,14 +453,31 @@ func (sp *SmartProxy) recordRequest(requestType string, broker string, latency t
 	metrics.ProxyRequestsTotal.WithLabelValues(serviceName, requestType, status).Inc()
 	metrics.ProxyRequestDuration.WithLabelValues(serviceName, requestType).Observe(latency.Seconds())
 	metrics.ProxyBrokerRequests.WithLabelValues(serviceName, broker, status).Inc()
+
+	topicLabel := sp.topicLabel(topic)
+	metrics.ProxyTopicRequestsTotal.WithLabelValues(serviceName, requestType, topicLabel, status).Inc()
+	metrics.ProxyTopicRequestDuration.WithLabelValues(serviceName, requestType, topicLabel).Observe(latency.Seconds())
+}
+
+// parsePartition parses and range-checks a partition of topic so out-of-range
+// requests are rejected at the proxy instead of after a round trip to a broker
+func (sp *SmartProxy) parsePartition(topic, partStr string) (int, error) {
+	partition, err := strconv.Atoi(partStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid partition")
+	}
+	sp.mu.RLock()
+	maxPartitions := sp.partitionCount(topic)
+	sp.mu.RUnlock()
+	if partition < 0 || partition >= maxPartitions {
+		return 0, fmt.Errorf("partition %d out of range for topic %s (0-%d)", partition, topic, maxPartitions-1)
+	}
+	return partition, nil
 }
 
 // produceHandler handles message production
 func (sp *SmartProxy) produceHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received produce request: method=%s, url=%s", r.Method, r.URL.String())
-
 	if r.Method != http.MethodPost {
-		log.Printf("Rejecting non-POST request: %s", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -282,19 +485,14 @@ func (sp *SmartProxy) produceHandler(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
 	partStr := r.URL.Query().Get("partition")
 
-	log.Printf("Produce request params: topic=%s, partition=%s", topic, partStr)
-
 	if topic == "" || partStr == "" {
 		http.Error(w, "topic and partition required", http.StatusBadRequest)
 		return
 	}
 
-	var partition int
-	var err error
-
-	partition, err = strconv.Atoi(partStr)
+	partition, err := sp.parsePartition(topic, partStr)
 	if err != nil {
-		http.Error(w, "invalid partition", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -306,8 +504,11 @@ func (sp *SmartProxy) produceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Forward request to target broker
+	w.Header().Set(owningBrokerHeader, targetBroker)
 	targetURL := fmt.Sprintf("%s/produce?topic=%s&partition=%d", targetBroker, topic, partition)
-	log.Printf("Forwarding to broker: %s", targetURL)
+	if acks := r.URL.Query().Get("acks"); acks != "" {
+		targetURL += "&acks=" + url.QueryEscape(acks)
+	}
 	sp.forwardRequest(w, r, targetURL, "produce")
 }
 
@@ -327,12 +528,27 @@ func (sp *SmartProxy) consumeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "topic, partition and group required", http.StatusBadRequest)
 		return
 	}
-	partition, err := strconv.Atoi(partStr)
+	partition, err := sp.parsePartition(topic, partStr)
 	if err != nil {
-		http.Error(w, "invalid partition", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Consumers that send their instance ID share the group's partitions:
+	// only the member a partition is assigned to may stream it, and its
+	// stream is closed if a rebalance moves the partition elsewhere
+	if consumer := r.URL.Query().Get("consumer"); consumer != "" {
+		release, owner := sp.groups.join(topic, group, consumer, partition, cancel, time.Now())
+		if release == nil {
+			http.Error(w, fmt.Sprintf("partition %d of %s is assigned to consumer %s of group %s", partition, topic, owner, group), http.StatusConflict)
+			return
+		}
+		defer release()
+	}
+
 	// Get target broker using topic-partition combination
 	targetBroker := sp.getBrokerForTopicPartition(topic, partition)
 	if targetBroker == "" {
@@ -343,11 +559,40 @@ func (sp *SmartProxy) consumeHandler(w http.ResponseWriter, r *http.Request) {
 	// Forward request to target broker
 	targetURL := fmt.Sprintf("%s/consume?topic=%s&partition=%d&group=%s",
 		targetBroker, topic, partition, group)
-	sp.forwardRequest(w, r, targetURL, "consume")
+	if maxWait := r.URL.Query().Get("max_wait"); maxWait != "" {
+		targetURL += "&max_wait=" + url.QueryEscape(maxWait)
+	}
+	if ackMode := r.URL.Query().Get("ack_mode"); ackMode != "" {
+		targetURL += "&ack_mode=" + url.QueryEscape(ackMode)
+	}
+	if missing := r.URL.Query().Get("missing"); missing != "" {
+		targetURL += "&missing=" + url.QueryEscape(missing)
+	}
+
+	// Track the stream so it is closed if its broker leaves the ring. A
+	// broker removed since it was picked is caught by the check after
+	// registering, as setBrokers updates the list before closing streams.
+	defer sp.streams.add(targetBroker, cancel)()
+	if !sp.hasBroker(targetBroker) {
+		http.Error(w, "broker removed, retry", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(owningBrokerHeader, targetBroker)
+	sp.forwardRequest(w, r.WithContext(ctx), targetURL, "consume")
 }
 
 // ackHandler handles message acknowledgment
 func (sp *SmartProxy) ackHandler(w http.ResponseWriter, r *http.Request) {
+	sp.forwardAck(w, r, "/ack", "ack")
+}
+
+// ackBatchHandler forwards a batch of acks to the broker owning the partition
+func (sp *SmartProxy) ackBatchHandler(w http.ResponseWriter, r *http.Request) {
+	sp.forwardAck(w, r, "/ack/batch", "ack_batch")
+}
+
+// forwardAck sends an ack request to path on the broker owning its topic-partition
+func (sp *SmartProxy) forwardAck(w http.ResponseWriter, r *http.Request, path, requestType string) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -362,9 +607,9 @@ func (sp *SmartProxy) ackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	partition, err := strconv.Atoi(partStr)
+	partition, err := sp.parsePartition(topic, partStr)
 	if err != nil {
-		http.Error(w, "invalid partition", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -376,9 +621,9 @@ func (sp *SmartProxy) ackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Forward request to target broker
-	targetURL := fmt.Sprintf("%s/ack?topic=%s&partition=%d&group=%s",
-		targetBroker, topic, partition, group)
-	sp.forwardRequest(w, r, targetURL, "ack")
+	targetURL := fmt.Sprintf("%s%s?topic=%s&partition=%d&group=%s",
+		targetBroker, path, topic, partition, group)
+	sp.forwardRequest(w, r, targetURL, requestType)
 }
 
 // topicsHandler handles topics listing
@@ -389,15 +634,92 @@ func (sp *SmartProxy) topicsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Forward to any healthy broker (they should all have the same topics)
-	for endpoint := range sp.healthyBrokers {
+	endpoint := sp.anyHealthyBroker()
+	if endpoint == "" {
+		http.Error(w, "no healthy brokers available", http.StatusServiceUnavailable)
+		return
+	}
+
+	targetURL := fmt.Sprintf("%s/topics", endpoint)
+	sp.forwardRequest(w, r, targetURL, "topics")
+}
+
+// topicInfoHandler: GET /topics/{topic}
+// Asks a healthy broker for the topic's partition count and reports it capped
+// at the most partitions of the topic this proxy routes, so clients only use
+// partitions they can actually reach through it.
+func (sp *SmartProxy) topicInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+	if topic == "" || strings.Contains(topic, "/") {
+		http.Error(w, "bad topic", http.StatusBadRequest)
+		return
+	}
+
+	endpoint := sp.anyHealthyBroker()
+	if endpoint == "" {
+		http.Error(w, "no healthy brokers available", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sp.healthCheckTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/topics/"+url.PathEscape(topic), nil)
+	if err != nil {
+		http.Error(w, "failed to create request", http.StatusInternalServerError)
+		return
+	}
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("broker request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		http.Error(w, strings.TrimSpace(string(body)), resp.StatusCode)
+		return
+	}
+	var info struct {
+		Partitions int `json:"partitions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		http.Error(w, fmt.Sprintf("bad broker response: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	sp.mu.RLock()
+	maxPartitions := sp.partitionCount(topic)
+	sp.mu.RUnlock()
+	partitions := info.Partitions
+	if partitions > maxPartitions {
+		log.Printf("Topic %s has %d partitions on the broker but the proxy routes %d; reporting %d",
+			topic, info.Partitions, maxPartitions, maxPartitions)
+		partitions = maxPartitions
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"topic":             topic,
+		"partitions":        partitions,
+		"broker_partitions": info.Partitions,
+	})
+}
+
+// anyHealthyBroker returns the first healthy broker, or "" if there is none
+func (sp *SmartProxy) anyHealthyBroker() string {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	for _, endpoint := range sp.brokerEndpoints {
 		if sp.healthyBrokers[endpoint] {
-			targetURL := fmt.Sprintf("%s/topics", endpoint)
-			sp.forwardRequest(w, r, targetURL, "topics")
-			return
+			return endpoint
 		}
 	}
-
-	http.Error(w, "no healthy brokers available", http.StatusServiceUnavailable)
+	return ""
 }
 
 // healthHandler returns proxy health status
@@ -422,6 +744,50 @@ func (sp *SmartProxy) healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+// ringHandler returns the consistent hash ring layout and partition ownership for debugging.
+// With ?topic= ownership is computed the way produce/consume route that topic.
+func (sp *SmartProxy) ringHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	type partitionOwner struct {
+		Partition int    `json:"partition"`
+		Broker    string `json:"broker"`
+		Healthy   bool   `json:"healthy"`
+	}
+	count := sp.config.MaxPartitions
+	if topic != "" {
+		count = sp.partitionCount(topic)
+	}
+	partitions := make([]partitionOwner, 0, count)
+	for i := 0; i < count; i++ {
+		var broker string
+		if topic != "" {
+			broker = sp.consistentHash.GetBrokerByTopicPartition(topic, i)
+		} else {
+			broker = sp.consistentHash.GetBroker(i)
+		}
+		partitions = append(partitions, partitionOwner{Partition: i, Broker: broker, Healthy: sp.healthyBrokers[broker]})
+	}
+
+	ring := map[string]interface{}{
+		"brokers":       sp.consistentHash.GetBrokers(),
+		"virtual_nodes": sp.config.VirtualNodes,
+		"ring":          sp.consistentHash.ExportRing(),
+		"topic":         topic,
+		"partitions":    partitions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ring)
+}
+
 // statusHandler returns detailed proxy status
 func (sp *SmartProxy) statusHandler(w http.ResponseWriter, r *http.Request) {
 	sp.mu.RLock()
@@ -471,6 +837,7 @@ func (sp *SmartProxy) statsHandler(w http.ResponseWriter, r *http.Request) {
 	if requestCount > 0 {
 		avgLatencyMs = float64(totalLatencyMs) / float64(requestCount)
 	}
+	percentiles := sp.stats.Latency.percentiles(0.5, 0.9, 0.99)
 
 	if totalRequests > 0 {
 		successRate = float64(successfulRequests) / float64(totalRequests) * 100
@@ -512,6 +879,11 @@ func (sp *SmartProxy) statsHandler(w http.ResponseWriter, r *http.Request) {
 		"success_rate_percent": successRate,
 		"requests_per_second":  requestsPerSecond,
 		"average_latency_ms":   avgLatencyMs,
+		"latency_percentiles_ms": map[string]float64{
+			"p50": durationMs(percentiles[0]),
+			"p90": durationMs(percentiles[1]),
+			"p99": durationMs(percentiles[2]),
+		},
 
 		"request_breakdown": map[string]int64{
 			"produce": produceRequests,
@@ -542,20 +914,33 @@ func (sp *SmartProxy) statsHandler(w http.ResponseWriter, r *http.Request) {
 // forwardRequest forwards HTTP request to target broker with metrics tracking
 func (sp *SmartProxy) forwardRequest(w http.ResponseWriter, r *http.Request, targetURL string, requestType string) {
 	startTime := time.Now()
-	log.Printf("Forwarding %s request to: %s", requestType, targetURL)
+	topic := r.URL.Query().Get("topic")
 
 	// Create new request
-	body, err := io.ReadAll(r.Body)
+	// Read one byte past the limit so an oversized body is noticed
+	var bodyReader io.Reader = r.Body
+	if sp.config.MaxMessageBytes > 0 {
+		bodyReader = io.LimitReader(r.Body, sp.config.MaxMessageBytes+1)
+	}
+	body, err := io.ReadAll(bodyReader)
 	if err != nil {
 		log.Printf("Failed to read request body: %v", err)
-		sp.recordRequest(requestType, targetURL, time.Since(startTime), false)
+		sp.recordRequest(requestType, topic, targetURL, time.Since(startTime), false)
 		http.Error(w, "failed to read request body", http.StatusBadRequest)
 		return
 	}
+	if sp.config.MaxMessageBytes > 0 && int64(len(body)) > sp.config.MaxMessageBytes {
+		sp.recordRequest(requestType, topic, targetURL, time.Since(startTime), false)
+		http.Error(w, fmt.Sprintf("message exceeds maximum size of %d bytes", sp.config.MaxMessageBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if requestType == "produce" {
+		metrics.RecordProxyMessageBytes("msg-queue-proxy", sp.topicLabel(topic), len(body))
+	}
 
 	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, bytes.NewBuffer(body))
 	if err != nil {
-		sp.recordRequest(requestType, targetURL, time.Since(startTime), false)
+		sp.recordRequest(requestType, topic, targetURL, time.Since(startTime), false)
 		http.Error(w, "failed to create request", http.StatusInternalServerError)
 		return
 	}
@@ -570,7 +955,7 @@ func (sp *SmartProxy) forwardRequest(w http.ResponseWriter, r *http.Request, tar
 	// Execute request
 	resp, err := sp.client.Do(req)
 	if err != nil {
-		sp.recordRequest(requestType, targetURL, time.Since(startTime), false)
+		sp.recordRequest(requestType, topic, targetURL, time.Since(startTime), false)
 		log.Printf("Failed to forward request to %s: %v", targetURL, err)
 		http.Error(w, "broker unavailable", http.StatusBadGateway)
 		return
@@ -579,6 +964,9 @@ func (sp *SmartProxy) forwardRequest(w http.ResponseWriter, r *http.Request, tar
 
 	// Copy response headers
 	for key, values := range resp.Header {
+		if key == owningBrokerHeader {
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
@@ -592,92 +980,167 @@ func (sp *SmartProxy) forwardRequest(w http.ResponseWriter, r *http.Request, tar
 
 	// Record successful request
 	success := resp.StatusCode >= 200 && resp.StatusCode < 400
-	sp.recordRequest(requestType, targetURL, time.Since(startTime), success)
+	sp.recordRequest(requestType, topic, targetURL, time.Since(startTime), success)
 
-	if success {
-		log.Printf("Successfully forwarded %s request to %s (status: %d)", requestType, targetURL, resp.StatusCode)
-	} else {
+	if !success {
 		log.Printf("Forward request failed with status %d for %s", resp.StatusCode, targetURL)
 	}
 }
 
-// healthCheckLoop periodically checks broker health
+// durationMs converts d to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// healthCheckLoop periodically checks broker health. A reload can change the
+// interval through healthReset.
 func (sp *SmartProxy) healthCheckLoop() {
-	ticker := time.NewTicker(sp.config.HealthInterval)
+	sp.mu.RLock()
+	interval := sp.config.HealthInterval
+	sp.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			sp.checkBrokerHealth()
+		case interval := <-sp.healthReset:
+			ticker.Reset(interval)
 		}
 	}
 }
 
-// checkBrokerHealth checks health of all brokers
+// checkBrokerHealth checks health of all brokers. Brokers are probed in
+// parallel, up to HealthCheckWorkers at a time and each bounded by
+// HealthCheckTimeout, so one slow broker doesn't hold up the rest. The probes
+// run without holding sp.mu so that routing isn't blocked behind slow
+// brokers; the results are applied under the lock once all are in.
 func (sp *SmartProxy) checkBrokerHealth() {
 	atomic.AddInt64(&sp.stats.HealthCheckCount, 1)
 	metrics.ProxyHealthChecks.WithLabelValues("msg-queue-proxy").Inc()
 
+	sp.mu.RLock()
+	endpoints := make([]string, len(sp.brokerEndpoints))
+	copy(endpoints, sp.brokerEndpoints)
+	sp.mu.RUnlock()
+
+	results := make([]error, len(endpoints))
+	sp.forEachBroker(endpoints, func(i int, endpoint string) {
+		results[i] = sp.probeBroker(endpoint)
+	})
+
+	sp.setBrokerHealth(endpoints, results)
+}
+
+// forEachBroker calls fn for every endpoint in parallel, at most
+// HealthCheckWorkers at a time, and returns once all calls are done
+func (sp *SmartProxy) forEachBroker(endpoints []string, fn func(i int, endpoint string)) {
+	workers := sp.config.HealthCheckWorkers
+	if workers <= 0 {
+		workers = defaultHealthCheckWorkers
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i, endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+}
+
+// healthCheckTimeout bounds each request to a broker's /health endpoint
+func (sp *SmartProxy) healthCheckTimeout() time.Duration {
+	if sp.config.HealthCheckTimeout <= 0 {
+		return defaultHealthCheckTimeout
+	}
+	return sp.config.HealthCheckTimeout
+}
+
+// probeBroker calls a broker's /health endpoint and returns nil if it is healthy
+func (sp *SmartProxy) probeBroker(endpoint string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sp.healthCheckTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/health", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setBrokerHealth records the outcome of a round of health probes, where
+// probeErrs[i] is the result for endpoints[i]. Brokers removed from the ring
+// while they were being probed are skipped.
+func (sp *SmartProxy) setBrokerHealth(endpoints []string, probeErrs []error) {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
-	for _, endpoint := range sp.brokerEndpoints {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/health", nil)
-
-		if err != nil {
-			if sp.healthyBrokers[endpoint] {
-				atomic.AddInt64(&sp.stats.BrokerFailures, 1)
-				log.Printf("Broker %s became unhealthy: %v", endpoint, err)
-			}
-			sp.healthyBrokers[endpoint] = false
-			metrics.ProxyBrokerHealth.WithLabelValues("msg-queue-proxy", endpoint).Set(0)
-			cancel()
+	for i, endpoint := range endpoints {
+		wasHealthy, known := sp.healthyBrokers[endpoint]
+		if !known {
 			continue
 		}
 
-		resp, err := sp.client.Do(req)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			if sp.healthyBrokers[endpoint] {
+		if probeErr := probeErrs[i]; probeErr != nil {
+			if wasHealthy {
 				atomic.AddInt64(&sp.stats.BrokerFailures, 1)
-				log.Printf("Broker %s became unhealthy: status %d", endpoint, getStatusCode(resp))
+				log.Printf("Broker %s became unhealthy: %v", endpoint, probeErr)
 			}
 			sp.healthyBrokers[endpoint] = false
 			metrics.ProxyBrokerHealth.WithLabelValues("msg-queue-proxy", endpoint).Set(0)
-		} else {
-			if !sp.healthyBrokers[endpoint] {
-				log.Printf("Broker %s recovered and is now healthy", endpoint)
-			}
-			sp.healthyBrokers[endpoint] = true
-			metrics.ProxyBrokerHealth.WithLabelValues("msg-queue-proxy", endpoint).Set(1)
+			continue
 		}
 
-		if resp != nil {
-			resp.Body.Close()
+		if !wasHealthy {
+			log.Printf("Broker %s recovered and is now healthy", endpoint)
 		}
-		cancel()
+		sp.healthyBrokers[endpoint] = true
+		metrics.ProxyBrokerHealth.WithLabelValues("msg-queue-proxy", endpoint).Set(1)
 	}
 }
 
-// Helper function to safely get status code
-func getStatusCode(resp *http.Response) int {
-	if resp != nil {
-		return resp.StatusCode
-	}
-	return 0
-}
-
 func loadConfig() ProxyConfig {
 	config := ProxyConfig{
 		Port:              getEnv("PORT", "8080"),
 		BrokerService:     getEnv("BROKER_SERVICE", "msg-queue"),
 		BrokerCount:       getEnvInt("BROKER_COUNT", 2),
 		VirtualNodes:      getEnvInt("VIRTUAL_NODES", 150),
+		RingHash:          getRingHash(),
 		MaxPartitions:     getEnvInt("MAX_PARTITIONS", 2),
 		HealthInterval:    time.Duration(getEnvInt("HEALTH_INTERVAL_SECONDS", 30)) * time.Second,
 		RequestTimeout:    time.Duration(getEnvInt("REQUEST_TIMEOUT_SECONDS", 60)) * time.Second,
 		ConnectionTimeout: time.Duration(getEnvInt("CONNECTION_TIMEOUT_SECONDS", 10)) * time.Second,
+		KnownTopics:       getEnvList("KNOWN_TOPICS", "telemetry"),
+		MaxMessageBytes:   int64(getEnvInt("MAX_MESSAGE_BYTES", 1<<20)),
+
+		HealthCheckTimeout: time.Duration(getEnvInt("HEALTH_CHECK_TIMEOUT_SECONDS", 5)) * time.Second,
+		HealthCheckWorkers: getEnvInt("HEALTH_CHECK_WORKERS", defaultHealthCheckWorkers),
+
+		BrokerEndpointTemplate: getEnv("BROKER_ENDPOINT_TEMPLATE", defaultBrokerEndpointTemplate),
+		BrokerPort:             getEnvInt("BROKER_PORT", defaultBrokerPort),
+
+		MaxIdleConns:        getEnvInt("MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxIdleConnsPerHost: getEnvInt("MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:     getEnvInt("MAX_CONNS_PER_HOST", 0),
+
+		ConsumerSessionTimeout: time.Duration(getEnvInt("CONSUMER_SESSION_TIMEOUT_MS", int(defaultConsumerSessionTimeout/time.Millisecond))) * time.Millisecond,
 	}
 
 	log.Printf("Proxy configuration: %+v", config)
@@ -691,6 +1154,31 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getRingHash reads RING_HASH; sha512 keeps the partition placement used
+// before fnv1a became the default
+func getRingHash() string {
+	switch name := os.Getenv("RING_HASH"); name {
+	case "", "fnv1a":
+		return "fnv1a"
+	case "sha512":
+		return name
+	default:
+		log.Printf("Invalid RING_HASH value '%s', using default: fnv1a", name)
+		return "fnv1a"
+	}
+}
+
+// getEnvList parses a comma-separated environment variable into a list
+func getEnvList(key, defaultValue string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
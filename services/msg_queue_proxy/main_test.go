@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consistenthash "github.com/example/telemetry/internal/consistent_hash"
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var initMetricsOnce sync.Once
+
+// initTestMetrics registers the Prometheus metrics once per test binary
+func initTestMetrics() {
+	initMetricsOnce.Do(func() {
+		metrics.InitMetrics("msg-queue-proxy")
+	})
+}
+
+// newTestProxy builds a proxy routing to the given broker endpoints without
+// going through Kubernetes discovery
+func newTestProxy(config ProxyConfig, brokers ...string) *SmartProxy {
+	if config.VirtualNodes == 0 {
+		config.VirtualNodes = 10
+	}
+	if config.MaxPartitions == 0 {
+		config.MaxPartitions = 2
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 5 * time.Second
+	}
+	if config.BrokerCount == 0 {
+		config.BrokerCount = len(brokers)
+	}
+
+	sp := NewSmartProxy(config)
+	sp.brokerEndpoints = brokers
+	for _, broker := range brokers {
+		sp.healthyBrokers[broker] = true
+	}
+	sp.consistentHash = consistenthash.NewConsistentHash(brokers, config.VirtualNodes)
+	sp.initBrokerMetrics()
+	return sp
+}
+
+// scrapeMetrics returns the text exposition of the default Prometheus registry
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestTopicLabel(t *testing.T) {
+	sp := NewSmartProxy(ProxyConfig{KnownTopics: []string{"telemetry", "events"}})
+
+	tests := []struct {
+		topic    string
+		expected string
+	}{
+		{"telemetry", "telemetry"},
+		{"events", "events"},
+		{"random-topic-123", "other"},
+		{"", "none"},
+	}
+
+	for _, tt := range tests {
+		if got := sp.topicLabel(tt.topic); got != tt.expected {
+			t.Errorf("topicLabel(%q) = %q, expected %q", tt.topic, got, tt.expected)
+		}
+	}
+}
+
+func TestPerTopicMetrics(t *testing.T) {
+	initTestMetrics()
+
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer broker.Close()
+
+	sp := newTestProxy(ProxyConfig{KnownTopics: []string{"telemetry"}}, broker.URL)
+
+	for _, topic := range []string{"telemetry", "unlisted"} {
+		req := httptest.NewRequest("POST", "/produce?topic="+topic+"&partition=0", bytes.NewBufferString(`{"payload":"x"}`))
+		w := httptest.NewRecorder()
+		sp.produceHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for topic %s, got %d", topic, w.Code)
+		}
+	}
+
+	body := scrapeMetrics(t)
+	for _, expected := range []string{
+		`proxy_topic_requests_total{request_type="produce",service="msg-queue-proxy",status="success",topic="telemetry"}`,
+		`proxy_topic_requests_total{request_type="produce",service="msg-queue-proxy",status="success",topic="other"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics output to contain %s", expected)
+		}
+	}
+	if strings.Contains(body, `topic="unlisted"`) {
+		t.Errorf("Unknown topic should not get its own label")
+	}
+}
+
+func TestProxyMetricsRegistered(t *testing.T) {
+	initTestMetrics()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recording proxy metrics panicked: %v", r)
+		}
+	}()
+
+	sp := NewSmartProxy(ProxyConfig{KnownTopics: []string{"telemetry"}})
+	sp.recordRequest("produce", "telemetry", "http://broker-0:8080", 10*time.Millisecond, true)
+	sp.recordRequest("consume", "telemetry", "http://broker-0:8080", 10*time.Millisecond, false)
+	metrics.ProxyHealthChecks.WithLabelValues("msg-queue-proxy").Inc()
+	metrics.ProxyBrokerHealth.WithLabelValues("msg-queue-proxy", "http://broker-0:8080").Set(1)
+
+	body := scrapeMetrics(t)
+	for _, name := range []string{
+		"proxy_requests_total",
+		"proxy_request_duration_seconds",
+		"proxy_broker_requests_total",
+		"proxy_health_checks_total",
+		"proxy_broker_health",
+		"proxy_topic_requests_total",
+		"proxy_topic_request_duration_seconds",
+	} {
+		if !strings.Contains(body, "# TYPE "+name+" ") {
+			t.Errorf("Expected metric %s to be registered", name)
+		}
+	}
+}
+
+func TestForwardMaxMessageSize(t *testing.T) {
+	var brokerCalls int
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokerCalls++
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer broker.Close()
+
+	sp := newTestProxy(ProxyConfig{MaxMessageBytes: 64}, broker.URL)
+
+	tests := []struct {
+		name           string
+		size           int
+		expectedStatus int
+		expectedCalls  int
+	}{
+		{"At limit", 64, http.StatusOK, 1},
+		{"Above limit", 65, http.StatusRequestEntityTooLarge, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokerCalls = 0
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader(strings.Repeat("x", tt.size)))
+			w := httptest.NewRecorder()
+
+			sp.produceHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if brokerCalls != tt.expectedCalls {
+				t.Errorf("Expected %d broker calls, got %d", tt.expectedCalls, brokerCalls)
+			}
+		})
+	}
+}
+
+func TestForwardRecordsMessageBytes(t *testing.T) {
+	initTestMetrics()
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer broker.Close()
+	sp := newTestProxy(ProxyConfig{KnownTopics: []string{"sizes"}}, broker.URL)
+
+	// One body in each of the 64B, 4KB and 4MB buckets; consumes aren't counted
+	for _, size := range []int{50, 3000, 3000000} {
+		req := httptest.NewRequest("POST", "/produce?topic=sizes&partition=0", strings.NewReader(strings.Repeat("x", size)))
+		sp.produceHandler(httptest.NewRecorder(), req)
+	}
+	sp.consumeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/consume?topic=sizes&partition=0&group=g1", nil))
+
+	m := &dto.Metric{}
+	if err := metrics.ProxyMessageBytes.WithLabelValues("msg-queue-proxy", "sizes").(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("Expected 3 observations, got %d", got)
+	}
+	// Bucket counts are cumulative
+	expected := map[float64]uint64{16: 0, 64: 1, 1024: 1, 4096: 2, 1048576: 2, 4194304: 3}
+	for _, b := range m.GetHistogram().GetBucket() {
+		if want, ok := expected[b.GetUpperBound()]; ok && b.GetCumulativeCount() != want {
+			t.Errorf("Bucket le=%v: expected %d, got %d", b.GetUpperBound(), want, b.GetCumulativeCount())
+		}
+	}
+}
+
+func TestConsumeForwardsOptions(t *testing.T) {
+	initTestMetrics()
+	var query string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	sp := newTestProxy(ProxyConfig{}, broker.URL)
+
+	sp.consumeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/consume?topic=telemetry&partition=0&group=g1&max_wait=1s&ack_mode=auto", nil))
+	if query != "topic=telemetry&partition=0&group=g1&max_wait=1s&ack_mode=auto" {
+		t.Errorf("Expected max_wait and ack_mode to reach the broker, got %q", query)
+	}
+}
+
+func TestConsumeForwardsMissing(t *testing.T) {
+	initTestMetrics()
+	var query string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	sp := newTestProxy(ProxyConfig{}, broker.URL)
+
+	sp.consumeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/consume?topic=telemetry&partition=0&group=g1&missing=wait", nil))
+	if query != "topic=telemetry&partition=0&group=g1&missing=wait" {
+		t.Errorf("Expected missing=wait to reach the broker, got %q", query)
+	}
+}
+
+func TestPartitionValidation(t *testing.T) {
+	var brokerCalls int
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokerCalls++
+		w.Write([]byte("ok"))
+	}))
+	defer broker.Close()
+
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 2}, broker.URL)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"Produce in range", "POST", "/produce?topic=telemetry&partition=1", sp.produceHandler, http.StatusOK},
+		{"Produce out of range", "POST", "/produce?topic=telemetry&partition=999", sp.produceHandler, http.StatusBadRequest},
+		{"Produce negative", "POST", "/produce?topic=telemetry&partition=-1", sp.produceHandler, http.StatusBadRequest},
+		{"Produce at max", "POST", "/produce?topic=telemetry&partition=2", sp.produceHandler, http.StatusBadRequest},
+		{"Consume out of range", "GET", "/consume?topic=telemetry&partition=999&group=g", sp.consumeHandler, http.StatusBadRequest},
+		{"Ack out of range", "POST", "/ack?topic=telemetry&partition=5&group=g", sp.ackHandler, http.StatusBadRequest},
+		{"Ack non-numeric", "POST", "/ack?topic=telemetry&partition=abc&group=g", sp.ackHandler, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokerCalls = 0
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"id":"x"}`))
+			w := httptest.NewRecorder()
+
+			tt.handler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus == http.StatusBadRequest && brokerCalls != 0 {
+				t.Errorf("Expected rejected request not to reach a broker, got %d calls", brokerCalls)
+			}
+		})
+	}
+}
+
+func TestTopicInfoHandler(t *testing.T) {
+	initTestMetrics()
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/topics/events":
+			w.Write([]byte(`{"topic":"events","partitions":8}`))
+		case "/topics/orders":
+			w.Write([]byte(`{"topic":"orders","partitions":4}`))
+		default:
+			http.Error(w, "unknown topic", http.StatusNotFound)
+		}
+	}))
+	defer broker.Close()
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 6}, broker.URL)
+
+	tests := []struct {
+		path             string
+		expectedStatus   int
+		expectedCount    int
+		expectedOnBroker int
+	}{
+		{"/topics/orders", http.StatusOK, 4, 4},
+		// Capped at the proxy's MAX_PARTITIONS, which it can't route past
+		{"/topics/events", http.StatusOK, 6, 8},
+		{"/topics/nope", http.StatusNotFound, 0, 0},
+		{"/topics/", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sp.topicInfoHandler(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var info struct {
+				Partitions       int `json:"partitions"`
+				BrokerPartitions int `json:"broker_partitions"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if info.Partitions != tt.expectedCount || info.BrokerPartitions != tt.expectedOnBroker {
+				t.Errorf("Expected %d partitions (%d on the broker), got %+v", tt.expectedCount, tt.expectedOnBroker, info)
+			}
+		})
+	}
+
+	sp.healthyBrokers[broker.URL] = false
+	w := httptest.NewRecorder()
+	sp.topicInfoHandler(w, httptest.NewRequest("GET", "/topics/events", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a healthy broker, got %d", w.Code)
+	}
+}
+
+func TestRingHandler(t *testing.T) {
+	brokers := []string{"http://broker-0:8080", "http://broker-1:8080"}
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 4, VirtualNodes: 5}, brokers...)
+	sp.healthyBrokers["http://broker-1:8080"] = false
+
+	for _, topic := range []string{"", "telemetry"} {
+		req := httptest.NewRequest("GET", "/ring?topic="+topic, nil)
+		w := httptest.NewRecorder()
+		sp.ringHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		var response struct {
+			Ring       []consistenthash.RingEntry `json:"ring"`
+			Partitions []struct {
+				Partition int    `json:"partition"`
+				Broker    string `json:"broker"`
+				Healthy   bool   `json:"healthy"`
+			} `json:"partitions"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		if len(response.Ring) != 10 {
+			t.Errorf("Expected 10 ring entries, got %d", len(response.Ring))
+		}
+		if len(response.Partitions) != 4 {
+			t.Fatalf("Expected 4 partitions, got %d", len(response.Partitions))
+		}
+		for _, p := range response.Partitions {
+			expected := sp.consistentHash.GetBroker(p.Partition)
+			if topic != "" {
+				expected = sp.consistentHash.GetBrokerByTopicPartition(topic, p.Partition)
+			}
+			if p.Broker != expected {
+				t.Errorf("topic=%q partition %d: expected owner %s, got %s", topic, p.Partition, expected, p.Broker)
+			}
+			if p.Healthy != (p.Broker == "http://broker-0:8080") {
+				t.Errorf("topic=%q partition %d: unexpected health %v for %s", topic, p.Partition, p.Healthy, p.Broker)
+			}
+		}
+	}
+}
+
+func TestConcurrentHealthFlips(t *testing.T) {
+	initTestMetrics()
+
+	// Each broker's health is toggled by the test while requests are in flight
+	var healthy [2]int32
+	var servers []*httptest.Server
+	for i := range healthy {
+		flag := &healthy[i]
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				if atomic.LoadInt32(flag) == 0 {
+					http.Error(w, "down", http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			case "/topics":
+				w.Write([]byte(`{"topics":[]}`))
+			default:
+				w.Write([]byte(`{"status":"ok"}`))
+			}
+		}))
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 4, KnownTopics: []string{"telemetry"}}, servers[0].URL, servers[1].URL)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					fn()
+				}
+			}
+		}()
+	}
+
+	run(func() {
+		for i := range healthy {
+			atomic.StoreInt32(&healthy[i], 1-atomic.LoadInt32(&healthy[i]))
+		}
+		sp.checkBrokerHealth()
+	})
+	run(func() { sp.statsHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)) })
+	run(func() { sp.statusHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/status", nil)) })
+	run(func() { sp.topicsHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/topics", nil)) })
+	run(func() {
+		req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=1", strings.NewReader(`{"payload":"x"}`))
+		sp.produceHandler(httptest.NewRecorder(), req)
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if atomic.LoadInt64(&sp.stats.HealthCheckCount) == 0 {
+		t.Error("Expected at least one health check to run")
+	}
+	if atomic.LoadInt64(&sp.stats.ProduceRequests) == 0 {
+		t.Error("Expected at least one produce request to be forwarded")
+	}
+}
+
+func TestAckBatchForwarded(t *testing.T) {
+	var gotPath, gotQuery, gotBody string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotQuery, gotBody = r.URL.Path, r.URL.RawQuery, string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"acked":2,"failed":[]}`))
+	}))
+	defer broker.Close()
+
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 2}, broker.URL)
+	w := httptest.NewRecorder()
+	sp.ackBatchHandler(w, httptest.NewRequest("POST", "/ack/batch?topic=telemetry&partition=1&group=g", strings.NewReader(`["a","b"]`)))
+
+	if w.Code != http.StatusOK || w.Body.String() != `{"acked":2,"failed":[]}` {
+		t.Errorf("Expected the broker's response to be relayed, got %d %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/ack/batch" || gotQuery != "topic=telemetry&partition=1&group=g" || gotBody != `["a","b"]` {
+		t.Errorf("Unexpected forwarded request %s?%s with body %s", gotPath, gotQuery, gotBody)
+	}
+
+	w = httptest.NewRecorder()
+	sp.ackBatchHandler(w, httptest.NewRequest("POST", "/ack/batch?topic=telemetry&partition=7&group=g", strings.NewReader(`["a"]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an out of range partition to be rejected, got %d", w.Code)
+	}
+}
+
+func TestGetRingHash(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", "fnv1a"},
+		{"fnv1a", "fnv1a"},
+		{"sha512", "sha512"},
+		{"md5", "fnv1a"},
+	}
+	for _, tt := range tests {
+		t.Setenv("RING_HASH", tt.value)
+		if got := getRingHash(); got != tt.expected {
+			t.Errorf("RING_HASH=%q: expected %s, got %s", tt.value, tt.expected, got)
+		}
+	}
+
+	// sha512 keeps the placement of rings built before the hasher was pluggable
+	brokers := []string{"broker-0", "broker-1", "broker-2"}
+	legacy := consistenthash.NewConsistentHashWithHasher(brokers, 150, ringHasher("sha512"))
+	explicit := consistenthash.NewConsistentHashWithHasher(brokers, 150, consistenthash.SHA512)
+	for p := 0; p < 12; p++ {
+		if got, want := legacy.GetBroker(p), explicit.GetBroker(p); got != want {
+			t.Errorf("Partition %d: expected %s, got %s", p, want, got)
+		}
+	}
+}
+
+func TestHealthChecksRunInParallel(t *testing.T) {
+	initTestMetrics()
+	var active, maxActive int32
+	newBroker := func(slow bool) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				peak := atomic.LoadInt32(&maxActive)
+				if n <= peak || atomic.CompareAndSwapInt32(&maxActive, peak, n) {
+					break
+				}
+			}
+			if slow {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	slow := []string{newBroker(true), newBroker(true), newBroker(true)}
+	fast := []string{newBroker(false), newBroker(false), newBroker(false)}
+	timeout := 300 * time.Millisecond
+	sp := newTestProxy(ProxyConfig{HealthCheckTimeout: timeout, HealthCheckWorkers: 4}, append(slow, fast...)...)
+
+	start := time.Now()
+	sp.checkBrokerHealth()
+	elapsed := time.Since(start)
+
+	// Probed one after another the three slow brokers would take 3 timeouts
+	if elapsed > 2*timeout {
+		t.Errorf("Expected the health check to take about one probe timeout (%v), took %v", timeout, elapsed)
+	}
+	if got := atomic.LoadInt32(&maxActive); got > 4 {
+		t.Errorf("Expected at most 4 probes at once, got %d", got)
+	}
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	for _, broker := range slow {
+		if sp.healthyBrokers[broker] {
+			t.Errorf("Expected slow broker %s to be marked unhealthy", broker)
+		}
+	}
+	for _, broker := range fast {
+		if !sp.healthyBrokers[broker] {
+			t.Errorf("Expected broker %s to stay healthy", broker)
+		}
+	}
+}
+
+func TestHealthCheckSkipsRemovedBrokers(t *testing.T) {
+	initTestMetrics()
+	sp := newTestProxy(ProxyConfig{}, "http://broker-0:8080")
+
+	sp.setBrokerHealth([]string{"http://broker-0:8080", "http://gone:8080"}, []error{nil, nil})
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	if _, ok := sp.healthyBrokers["http://gone:8080"]; ok {
+		t.Error("Expected a probe result for a removed broker to be ignored")
+	}
+}
+
+func TestBrokerEndpoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ProxyConfig
+		expected []string
+	}{
+		{
+			name:   "default StatefulSet layout",
+			config: ProxyConfig{BrokerService: "msg-queue.telemetry.svc", BrokerCount: 2},
+			expected: []string{
+				"http://msg-queue-0.msg-queue-headless.telemetry.svc.cluster.local:8080",
+				"http://msg-queue-1.msg-queue-headless.telemetry.svc.cluster.local:8080",
+			},
+		},
+		{
+			name: "custom template and port",
+			config: ProxyConfig{
+				BrokerService:          "broker",
+				BrokerCount:            3,
+				BrokerEndpointTemplate: "https://{service}-{index}.{service}.{namespace}:{port}",
+				BrokerPort:             9443,
+			},
+			expected: []string{
+				"https://broker-0.broker.telemetry:9443",
+				"https://broker-1.broker.telemetry:9443",
+				"https://broker-2.broker.telemetry:9443",
+			},
+		},
+		{
+			name:     "single broker behind a service",
+			config:   ProxyConfig{BrokerService: "msg-queue", BrokerCount: 1, BrokerEndpointTemplate: "http://{service}:{port}"},
+			expected: []string{"http://msg-queue:8080"},
+		},
+		{
+			name:   "template without index for several brokers",
+			config: ProxyConfig{BrokerService: "msg-queue", BrokerCount: 2, BrokerEndpointTemplate: "http://{service}:{port}"},
+			expected: []string{
+				"http://msg-queue-0.msg-queue-headless.telemetry.svc.cluster.local:8080",
+				"http://msg-queue-1.msg-queue-headless.telemetry.svc.cluster.local:8080",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NAMESPACE", "")
+			got := brokerEndpoints(tt.config)
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBrokerEndpointTemplateFromEnv(t *testing.T) {
+	t.Setenv("BROKER_SERVICE", "queue")
+	t.Setenv("BROKER_COUNT", "2")
+	t.Setenv("NAMESPACE", "prod")
+	t.Setenv("BROKER_ENDPOINT_TEMPLATE", "http://{service}-{index}.{namespace}.example.com:{port}")
+	t.Setenv("BROKER_PORT", "7000")
+
+	got := brokerEndpoints(loadConfig())
+	expected := []string{"http://queue-0.prod.example.com:7000", "http://queue-1.prod.example.com:7000"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestOwningBrokerHeader(t *testing.T) {
+	initTestMetrics()
+	// Every broker advertises its own address, which the proxy replaces with
+	// the endpoint it routed to
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(owningBrokerHeader, "http://advertised:8080")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	var brokers []string
+	for i := 0; i < 3; i++ {
+		broker := httptest.NewServer(handler)
+		defer broker.Close()
+		brokers = append(brokers, broker.URL)
+	}
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 8}, brokers...)
+
+	for partition := 0; partition < 8; partition++ {
+		expected := sp.consistentHash.GetBrokerByTopicPartition("telemetry", partition)
+
+		w := httptest.NewRecorder()
+		sp.produceHandler(w, httptest.NewRequest("POST", fmt.Sprintf("/produce?topic=telemetry&partition=%d", partition), nil))
+		if got := w.Header().Values(owningBrokerHeader); len(got) != 1 || got[0] != expected {
+			t.Errorf("Produce to partition %d: expected %s %s, got %v", partition, owningBrokerHeader, expected, got)
+		}
+
+		w = httptest.NewRecorder()
+		sp.consumeHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/consume?topic=telemetry&partition=%d&group=g1", partition), nil))
+		if got := w.Header().Values(owningBrokerHeader); len(got) != 1 || got[0] != expected {
+			t.Errorf("Consume from partition %d: expected %s %s, got %v", partition, owningBrokerHeader, expected, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	consistenthash "github.com/example/telemetry/internal/consistent_hash"
+)
+
+// watchReload re-reads the environment each time a signal arrives on sig and
+// applies whatever can change at runtime
+func (sp *SmartProxy) watchReload(sig <-chan os.Signal) {
+	for range sig {
+		log.Println("Received SIGHUP, reloading configuration")
+		sp.reloadConfig(loadConfig())
+		if err := sp.reconcileTopics(); err != nil {
+			log.Printf("Keeping the current topic partition counts: %v", err)
+		}
+	}
+}
+
+// reloadConfig applies the runtime-safe parts of config: the virtual node
+// count (rebuilding the ring), the partition count, the health check interval
+// and the broker count (rediscovering brokers and closing consume streams to
+// removed ones). Other settings only take effect on restart. Invalid values
+// are ignored and the current ones kept.
+func (sp *SmartProxy) reloadConfig(config ProxyConfig) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	ringChanged := false
+	if config.VirtualNodes != sp.config.VirtualNodes {
+		if config.VirtualNodes > 0 {
+			log.Printf("Virtual nodes changed from %d to %d, rebuilding hash ring", sp.config.VirtualNodes, config.VirtualNodes)
+			sp.config.VirtualNodes = config.VirtualNodes
+			sp.consistentHash = consistenthash.NewConsistentHashWithHasher(sp.brokerEndpoints, config.VirtualNodes, ringHasher(sp.config.RingHash))
+			ringChanged = true
+		} else {
+			log.Printf("Ignoring invalid VIRTUAL_NODES %d on reload", config.VirtualNodes)
+		}
+	}
+
+	if config.MaxPartitions != sp.config.MaxPartitions {
+		if config.MaxPartitions > 0 {
+			log.Printf("Max partitions changed from %d to %d", sp.config.MaxPartitions, config.MaxPartitions)
+			sp.config.MaxPartitions = config.MaxPartitions
+			ringChanged = true
+		} else {
+			log.Printf("Ignoring invalid MAX_PARTITIONS %d on reload", config.MaxPartitions)
+		}
+	}
+
+	if config.HealthInterval != sp.config.HealthInterval {
+		if config.HealthInterval > 0 {
+			log.Printf("Health check interval changed from %v to %v", sp.config.HealthInterval, config.HealthInterval)
+			sp.config.HealthInterval = config.HealthInterval
+			// Replace any interval healthCheckLoop hasn't picked up yet
+			select {
+			case <-sp.healthReset:
+			default:
+			}
+			sp.healthReset <- config.HealthInterval
+		} else {
+			log.Printf("Ignoring invalid HEALTH_INTERVAL_SECONDS %v on reload", config.HealthInterval)
+		}
+	}
+
+	if config.BrokerCount != sp.config.BrokerCount {
+		if config.BrokerCount > 0 {
+			log.Printf("Broker count changed from %d to %d, rediscovering brokers", sp.config.BrokerCount, config.BrokerCount)
+			sp.config.BrokerCount = config.BrokerCount
+			sp.setBrokers(brokerEndpoints(sp.config))
+			ringChanged = true
+		} else {
+			log.Printf("Ignoring invalid BROKER_COUNT %d on reload", config.BrokerCount)
+		}
+	}
+
+	if ringChanged {
+		sp.logPartitionDistribution()
+	}
+
+	if config.BrokerService != sp.config.BrokerService || config.Port != sp.config.Port {
+		log.Println("Broker service and port changes require a restart and were not applied")
+	}
+}
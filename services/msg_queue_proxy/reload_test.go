@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ringLayout fetches /ring and returns the reported virtual node count and ring size
+func ringLayout(t *testing.T, sp *SmartProxy) (virtualNodes, ringSize, partitions int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sp.ringHandler(w, httptest.NewRequest("GET", "/ring", nil))
+
+	var ring struct {
+		VirtualNodes int               `json:"virtual_nodes"`
+		Ring         []json.RawMessage `json:"ring"`
+		Partitions   []json.RawMessage `json:"partitions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&ring); err != nil {
+		t.Fatalf("Failed to decode ring: %v", err)
+	}
+	return ring.VirtualNodes, len(ring.Ring), len(ring.Partitions)
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	sp := newTestProxy(ProxyConfig{VirtualNodes: 10, MaxPartitions: 2, HealthInterval: 30 * time.Second},
+		"http://broker-0:8080", "http://broker-1:8080")
+	if vnodes, size, _ := ringLayout(t, sp); vnodes != 10 || size != 20 {
+		t.Fatalf("Expected 10 virtual nodes per broker before reload, got %d (ring size %d)", vnodes, size)
+	}
+
+	t.Setenv("VIRTUAL_NODES", "25")
+	t.Setenv("MAX_PARTITIONS", "4")
+	t.Setenv("HEALTH_INTERVAL_SECONDS", "5")
+
+	sig := make(chan os.Signal, 1)
+	defer close(sig)
+	go sp.watchReload(sig)
+	sig <- syscall.SIGHUP
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		vnodes, size, partitions := ringLayout(t, sp)
+		if vnodes == 25 && size == 50 && partitions == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Ring not rebuilt after reload: %d virtual nodes, ring size %d, %d partitions", vnodes, size, partitions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case interval := <-sp.healthReset:
+		if interval != 5*time.Second {
+			t.Errorf("Expected the health interval to be reset to 5s, got %v", interval)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a new health interval to be sent")
+	}
+
+	// The new partition count is enforced right away
+	if _, err := sp.parsePartition("telemetry", "3"); err != nil {
+		t.Errorf("Expected partition 3 to be accepted after reload, got %v", err)
+	}
+}
+
+func TestReloadIgnoresInvalidValues(t *testing.T) {
+	sp := newTestProxy(ProxyConfig{VirtualNodes: 10, MaxPartitions: 2, HealthInterval: 30 * time.Second}, "http://broker-0:8080")
+
+	sp.reloadConfig(ProxyConfig{VirtualNodes: 0, MaxPartitions: -1, HealthInterval: 0})
+
+	if vnodes, size, partitions := ringLayout(t, sp); vnodes != 10 || size != 10 || partitions != 2 {
+		t.Errorf("Expected the ring to be unchanged, got %d virtual nodes, ring size %d, %d partitions", vnodes, size, partitions)
+	}
+	select {
+	case interval := <-sp.healthReset:
+		t.Errorf("Expected no health interval reset, got %v", interval)
+	default:
+	}
+}
+
+func TestHealthIntervalReset(t *testing.T) {
+	var probes int32
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	t.Cleanup(broker.Close)
+
+	sp := newTestProxy(ProxyConfig{HealthInterval: time.Hour}, broker.URL)
+	go sp.healthCheckLoop()
+
+	sp.reloadConfig(ProxyConfig{VirtualNodes: 10, MaxPartitions: 2, HealthInterval: 20 * time.Millisecond})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&probes) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected health checks at the new interval, got %d probes", atomic.LoadInt32(&probes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// routeBroker is a broker in a /route response with the proxy's view of its health
+type routeBroker struct {
+	Endpoint string `json:"endpoint"`
+	Healthy  bool   `json:"healthy"`
+}
+
+// partitionRoute explains where requests for a topic-partition are sent
+type partitionRoute struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	// Primary is the broker the hash ring assigns the topic-partition to
+	Primary routeBroker `json:"primary"`
+	// Fallback is the broker used while the primary is unhealthy: the first
+	// healthy broker other than the primary, or nil if there is none
+	Fallback *routeBroker `json:"fallback"`
+	// Broker is where requests for the topic-partition go right now
+	Broker string `json:"broker"`
+}
+
+// routeTopicPartition works out the route for a topic-partition; callers hold mu
+func (sp *SmartProxy) routeTopicPartition(topic string, partition int) partitionRoute {
+	primary := sp.consistentHash.GetBrokerByTopicPartition(topic, partition)
+	route := partitionRoute{
+		Topic:     topic,
+		Partition: partition,
+		Primary:   routeBroker{Endpoint: primary, Healthy: sp.healthyBrokers[primary]},
+		Broker:    primary,
+	}
+	for _, endpoint := range sp.brokerEndpoints {
+		if endpoint != primary && sp.healthyBrokers[endpoint] {
+			route.Fallback = &routeBroker{Endpoint: endpoint, Healthy: true}
+			break
+		}
+	}
+	if !route.Primary.Healthy && route.Fallback != nil {
+		route.Broker = route.Fallback.Endpoint
+	}
+	return route
+}
+
+// routeHandler: GET /route?topic=<topic>&partition=<partition>
+// Reports which broker produce and consume requests for the topic-partition
+// are sent to, and why: the hash ring's choice, the fallback used while that
+// broker is unhealthy, and the health of both.
+func (sp *SmartProxy) routeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	partStr := r.URL.Query().Get("partition")
+	if topic == "" || partStr == "" {
+		http.Error(w, "topic and partition required", http.StatusBadRequest)
+		return
+	}
+	partition, err := sp.parsePartition(topic, partStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sp.mu.RLock()
+	route := sp.routeTopicPartition(topic, partition)
+	sp.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route)
+}
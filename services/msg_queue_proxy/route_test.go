@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getRoute calls /route for a topic-partition and decodes the answer
+func getRoute(t *testing.T, sp *SmartProxy, topic string, partition int) partitionRoute {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sp.routeHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/route?topic=%s&partition=%d", topic, partition), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var route partitionRoute
+	if err := json.NewDecoder(w.Body).Decode(&route); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return route
+}
+
+func TestRouteMatchesHashRing(t *testing.T) {
+	brokers := []string{"http://broker-0:8080", "http://broker-1:8080", "http://broker-2:8080"}
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 8}, brokers...)
+
+	for partition := 0; partition < 8; partition++ {
+		route := getRoute(t, sp, "telemetry", partition)
+		expected := sp.consistentHash.GetBrokerByTopicPartition("telemetry", partition)
+		if route.Primary.Endpoint != expected || !route.Primary.Healthy {
+			t.Errorf("Partition %d: expected healthy primary %s, got %+v", partition, expected, route.Primary)
+		}
+		if route.Broker != expected || route.Broker != sp.getBrokerForTopicPartition("telemetry", partition) {
+			t.Errorf("Partition %d: expected requests routed to %s, got %s", partition, expected, route.Broker)
+		}
+		if route.Fallback == nil || route.Fallback.Endpoint == expected {
+			t.Errorf("Partition %d: expected a fallback other than the primary, got %+v", partition, route.Fallback)
+		}
+	}
+}
+
+func TestRouteUnhealthyPrimary(t *testing.T) {
+	brokers := []string{"http://broker-0:8080", "http://broker-1:8080", "http://broker-2:8080"}
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 8}, brokers...)
+
+	primary := sp.consistentHash.GetBrokerByTopicPartition("telemetry", 3)
+	sp.healthyBrokers[primary] = false
+	// The first healthy broker in endpoint order takes over
+	var fallback string
+	for _, broker := range brokers {
+		if broker != primary {
+			fallback = broker
+			break
+		}
+	}
+
+	route := getRoute(t, sp, "telemetry", 3)
+	if route.Primary.Endpoint != primary || route.Primary.Healthy {
+		t.Errorf("Expected unhealthy primary %s, got %+v", primary, route.Primary)
+	}
+	if route.Fallback == nil || route.Fallback.Endpoint != fallback || !route.Fallback.Healthy {
+		t.Fatalf("Expected healthy fallback %s, got %+v", fallback, route.Fallback)
+	}
+	if route.Broker != fallback || sp.getBrokerForTopicPartition("telemetry", 3) != fallback {
+		t.Errorf("Expected requests routed to the fallback %s, got %s", fallback, route.Broker)
+	}
+
+	// With no healthy broker left requests still go to the primary
+	for _, broker := range brokers {
+		sp.healthyBrokers[broker] = false
+	}
+	route = getRoute(t, sp, "telemetry", 3)
+	if route.Fallback != nil || route.Broker != primary {
+		t.Errorf("Expected no fallback and the primary kept, got fallback %+v and broker %s", route.Fallback, route.Broker)
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 4}, "http://broker-0:8080")
+
+	tests := []struct {
+		method, target string
+		expected       int
+	}{
+		{"GET", "/route?partition=1", http.StatusBadRequest},
+		{"GET", "/route?topic=telemetry", http.StatusBadRequest},
+		{"GET", "/route?topic=telemetry&partition=x", http.StatusBadRequest},
+		{"GET", "/route?topic=telemetry&partition=4", http.StatusBadRequest},
+		{"POST", "/route?topic=telemetry&partition=1", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sp.routeHandler(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.target, tt.expected, w.Code)
+		}
+	}
+}
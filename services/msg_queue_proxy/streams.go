@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// streamTracker keeps a cancel function for every consume stream the proxy is
+// forwarding, keyed by broker, so the streams to a broker that leaves the ring
+// can be closed and their clients made to reconnect
+type streamTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	streams map[string]map[uint64]context.CancelFunc
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{streams: make(map[string]map[uint64]context.CancelFunc)}
+}
+
+// add registers a stream to broker and returns the function that unregisters it
+func (st *streamTracker) add(broker string, cancel context.CancelFunc) (remove func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.nextID++
+	id := st.nextID
+	if st.streams[broker] == nil {
+		st.streams[broker] = make(map[uint64]context.CancelFunc)
+	}
+	st.streams[broker][id] = cancel
+
+	return func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		delete(st.streams[broker], id)
+		if len(st.streams[broker]) == 0 {
+			delete(st.streams, broker)
+		}
+	}
+}
+
+// closeBroker cancels every stream to broker and returns how many there were
+func (st *streamTracker) closeBroker(broker string) int {
+	st.mu.Lock()
+	streams := st.streams[broker]
+	delete(st.streams, broker)
+	st.mu.Unlock()
+
+	for _, cancel := range streams {
+		cancel()
+	}
+	return len(streams)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// streamingBroker answers /consume with an SSE stream that stays open until
+// the proxy hangs up, reporting when each stream opens and closes
+func streamingBroker(t *testing.T) (url string, opened, closed chan struct{}) {
+	t.Helper()
+	opened = make(chan struct{}, 1)
+	closed = make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id: m1\ndata: payload\n\n")
+		w.(http.Flusher).Flush()
+		opened <- struct{}{}
+		<-r.Context().Done()
+		closed <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, opened, closed
+}
+
+// partitionOwnedBy returns a partition the proxy routes to broker
+func partitionOwnedBy(t *testing.T, sp *SmartProxy, broker string) int {
+	t.Helper()
+	for p := 0; p < sp.config.MaxPartitions; p++ {
+		if sp.getBrokerForTopicPartition("telemetry", p) == broker {
+			return p
+		}
+	}
+	t.Fatalf("No partition routed to %s", broker)
+	return 0
+}
+
+func TestBrokerRemovalClosesConsumeStreams(t *testing.T) {
+	initTestMetrics()
+	removedURL, removedOpened, removedClosed := streamingBroker(t)
+	keptURL, keptOpened, keptClosed := streamingBroker(t)
+
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 16}, removedURL, keptURL)
+	proxy := httptest.NewServer(http.HandlerFunc(sp.consumeHandler))
+	t.Cleanup(proxy.Close)
+
+	consume := func(partition int) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("%s/consume?topic=telemetry&partition=%d&group=g1", proxy.URL, partition))
+			if err != nil {
+				done <- err
+				return
+			}
+			defer resp.Body.Close()
+			_, err = io.ReadAll(resp.Body)
+			done <- err
+		}()
+		return done
+	}
+
+	removedStream := consume(partitionOwnedBy(t, sp, removedURL))
+	keptPartition := partitionOwnedBy(t, sp, keptURL)
+	keptStream := consume(keptPartition)
+	for _, opened := range []chan struct{}{removedOpened, keptOpened} {
+		select {
+		case <-opened:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the consume streams to open")
+		}
+	}
+
+	sp.mu.Lock()
+	sp.setBrokers([]string{keptURL})
+	sp.mu.Unlock()
+
+	select {
+	case err := <-removedStream:
+		if err != nil {
+			t.Errorf("Expected the proxied stream to end cleanly so the client reconnects, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the consume stream to the removed broker to be closed")
+	}
+	select {
+	case <-removedClosed:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the upstream connection to the removed broker to be closed")
+	}
+
+	// Streams to brokers still in the ring are left alone
+	select {
+	case <-keptStream:
+		t.Error("Expected the stream to the remaining broker to stay open")
+	case <-keptClosed:
+		t.Error("Expected the upstream connection to the remaining broker to stay open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A reconnecting client is routed to the remaining broker
+	if broker := sp.getBrokerForTopicPartition("telemetry", 0); broker != keptURL {
+		t.Errorf("Expected partitions to move to %s, got %s", keptURL, broker)
+	}
+	if sp.streams.closeBroker(removedURL) != 0 {
+		t.Error("Expected no streams left registered for the removed broker")
+	}
+	proxy.CloseClientConnections()
+}
+
+func TestSetBrokersScaleUp(t *testing.T) {
+	initTestMetrics()
+	sp := newTestProxy(ProxyConfig{}, "http://broker-0:8080")
+	sp.healthyBrokers["http://broker-0:8080"] = false
+
+	sp.mu.Lock()
+	sp.setBrokers([]string{"http://broker-0:8080", "http://broker-1:8080"})
+	sp.mu.Unlock()
+
+	if !sp.hasBroker("http://broker-1:8080") {
+		t.Fatal("Expected the new broker to be added")
+	}
+	if !sp.healthyBrokers["http://broker-1:8080"] {
+		t.Error("Expected a new broker to be assumed healthy until probed")
+	}
+	if sp.healthyBrokers["http://broker-0:8080"] {
+		t.Error("Expected an existing broker to keep its health state")
+	}
+	if vnodes, size, _ := ringLayout(t, sp); size != 2*vnodes {
+		t.Errorf("Expected the ring to include both brokers, got ring size %d", size)
+	}
+}
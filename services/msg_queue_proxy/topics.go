@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// topicReconcileRetry is how often the proxy asks the brokers for their topics
+// again when no broker answered at startup
+const topicReconcileRetry = 10 * time.Second
+
+// errNoTopicMetadata is returned when no broker reported its topics
+var errNoTopicMetadata = errors.New("no broker reported its topics")
+
+// partitionCount returns how many partitions of topic the proxy routes: the
+// count the brokers reported, or MaxPartitions for topics they didn't report.
+// Callers hold mu.
+func (sp *SmartProxy) partitionCount(topic string) int {
+	if count, ok := sp.topicPartitions[topic]; ok {
+		return count
+	}
+	return sp.config.MaxPartitions
+}
+
+// fetchTopicCounts asks a broker for the partition count of each of its topics
+func (sp *SmartProxy) fetchTopicCounts(endpoint string) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sp.healthCheckTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var metadata struct {
+		Topics map[string]struct {
+			Partitions int `json:"partitions"`
+		} `json:"topics"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("bad metadata: %w", err)
+	}
+	counts := make(map[string]int, len(metadata.Topics))
+	for topic, info := range metadata.Topics {
+		counts[topic] = info.Partitions
+	}
+	return counts, nil
+}
+
+// mergeTopicCounts combines the topic partition counts reported by brokers,
+// where counts[i] came from endpoints[i] and is nil if that broker didn't
+// answer. A topic the brokers disagree on gets the smallest count, since
+// partitions past it would be rejected by some broker, and is logged.
+func mergeTopicCounts(endpoints []string, counts []map[string]int) map[string]int {
+	merged := make(map[string]int)
+	reported := make(map[string][]string)
+	for i, topics := range counts {
+		for topic, count := range topics {
+			if count <= 0 {
+				continue
+			}
+			reported[topic] = append(reported[topic], fmt.Sprintf("%s=%d", endpoints[i], count))
+			if current, ok := merged[topic]; !ok || count < current {
+				merged[topic] = count
+			}
+		}
+	}
+	for topic, count := range merged {
+		for _, topics := range counts {
+			if topics != nil && topics[topic] != count {
+				sort.Strings(reported[topic])
+				log.Printf("WARNING: brokers disagree on the partition count of topic %s (%v); routing %d partitions",
+					topic, reported[topic], count)
+				break
+			}
+		}
+	}
+	return merged
+}
+
+// reconcileTopics asks every broker for its topics' partition counts and
+// routes each topic within its own count from then on, instead of the global
+// MaxPartitions. If no broker answers the current counts are kept and
+// errNoTopicMetadata is returned.
+func (sp *SmartProxy) reconcileTopics() error {
+	sp.mu.RLock()
+	endpoints := append([]string(nil), sp.brokerEndpoints...)
+	sp.mu.RUnlock()
+
+	counts := make([]map[string]int, len(endpoints))
+	sp.forEachBroker(endpoints, func(i int, endpoint string) {
+		topics, err := sp.fetchTopicCounts(endpoint)
+		if err != nil {
+			log.Printf("Failed to fetch topic metadata from %s: %v", endpoint, err)
+			return
+		}
+		counts[i] = topics
+	})
+
+	answered := 0
+	for _, topics := range counts {
+		if topics != nil {
+			answered++
+		}
+	}
+	if answered == 0 {
+		return errNoTopicMetadata
+	}
+	merged := mergeTopicCounts(endpoints, counts)
+
+	sp.mu.Lock()
+	sp.topicPartitions = merged
+	maxPartitions := sp.config.MaxPartitions
+	sp.mu.Unlock()
+
+	topics := make([]string, 0, len(merged))
+	for topic := range merged {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if merged[topic] != maxPartitions {
+			log.Printf("Topic %s has %d partitions on the brokers; routing it within those instead of MAX_PARTITIONS=%d",
+				topic, merged[topic], maxPartitions)
+		}
+	}
+	log.Printf("Reconciled partition counts of %d topics with %d of %d brokers", len(merged), answered, len(endpoints))
+	return nil
+}
+
+// reconcileTopicsUntilDone retries reconcileTopics every interval until a
+// broker answers, for a proxy that started before its brokers
+func (sp *SmartProxy) reconcileTopicsUntilDone(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := sp.reconcileTopics(); err == nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// metadataBroker is a fake broker reporting topics from /metadata and
+// rejecting produces past a topic's partition count, as a real broker does
+func metadataBroker(t *testing.T, topics map[string]int) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var produced []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			var parts []string
+			for topic, count := range topics {
+				parts = append(parts, fmt.Sprintf(`%q:{"partitions":%d,"visibility_timeout_ms":30000}`, topic, count))
+			}
+			fmt.Fprintf(w, `{"broker_index":0,"topics":{%s}}`, strings.Join(parts, ","))
+		case "/produce":
+			topic := r.URL.Query().Get("topic")
+			partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+			if partition >= topics[topic] {
+				http.Error(w, "partition out of range", http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			produced = append(produced, fmt.Sprintf("%s-%d", topic, partition))
+			mu.Unlock()
+			w.Write([]byte("ok"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &produced
+}
+
+func TestReconcileTopicsRoutesWithinEachTopic(t *testing.T) {
+	initTestMetrics()
+	topics := map[string]int{"events": 8, "orders": 4}
+	b0, produced0 := metadataBroker(t, topics)
+	b1, produced1 := metadataBroker(t, topics)
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 12}, b0.URL, b1.URL)
+
+	if err := sp.reconcileTopics(); err != nil {
+		t.Fatalf("reconcileTopics failed: %v", err)
+	}
+
+	for topic, count := range topics {
+		for partition := 0; partition < 12; partition++ {
+			w := httptest.NewRecorder()
+			target := fmt.Sprintf("/produce?topic=%s&partition=%d", topic, partition)
+			sp.produceHandler(w, httptest.NewRequest("POST", target, strings.NewReader("data")))
+			if partition < count && w.Code != http.StatusOK {
+				t.Errorf("%s-%d: expected the produce to be routed, got %d: %s", topic, partition, w.Code, w.Body.String())
+			}
+			if partition >= count && w.Code != http.StatusBadRequest {
+				t.Errorf("%s-%d: expected the proxy to reject the produce, got %d", topic, partition, w.Code)
+			}
+		}
+	}
+	// Every accepted produce reached a broker that took it
+	if got := len(*produced0) + len(*produced1); got != 12 {
+		t.Errorf("Expected 12 produces on the brokers, got %d", got)
+	}
+
+	// Topics the brokers didn't report still fall back to MAX_PARTITIONS
+	if _, err := sp.parsePartition("telemetry", "11"); err != nil {
+		t.Errorf("Expected an unreported topic to use MAX_PARTITIONS, got %v", err)
+	}
+
+	// The ring reports ownership for the topic's own partitions
+	w := httptest.NewRecorder()
+	sp.ringHandler(w, httptest.NewRequest("GET", "/ring?topic=orders", nil))
+	if strings.Count(w.Body.String(), `"partition":`) != 4 {
+		t.Errorf("Expected 4 partitions of orders in the ring, got %s", w.Body.String())
+	}
+}
+
+func TestReconcileTopicsMismatch(t *testing.T) {
+	b0, _ := metadataBroker(t, map[string]int{"orders": 4, "events": 8})
+	b1, _ := metadataBroker(t, map[string]int{"orders": 6, "events": 8})
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 12}, b0.URL, b1.URL, "http://127.0.0.1:1")
+
+	if err := sp.reconcileTopics(); err != nil {
+		t.Fatalf("reconcileTopics failed: %v", err)
+	}
+	// The brokers disagree on orders, so only the partitions both have are routed
+	sp.mu.RLock()
+	orders, events := sp.partitionCount("orders"), sp.partitionCount("events")
+	sp.mu.RUnlock()
+	if orders != 4 || events != 8 {
+		t.Errorf("Expected orders:4 and events:8, got orders:%d events:%d", orders, events)
+	}
+}
+
+func TestReconcileTopicsWithoutBrokers(t *testing.T) {
+	sp := newTestProxy(ProxyConfig{MaxPartitions: 3}, "http://127.0.0.1:1")
+	if err := sp.reconcileTopics(); err != errNoTopicMetadata {
+		t.Fatalf("Expected errNoTopicMetadata, got %v", err)
+	}
+	if _, err := sp.parsePartition("orders", "2"); err != nil {
+		t.Errorf("Expected MAX_PARTITIONS to apply until a broker answers, got %v", err)
+	}
+	if _, err := sp.parsePartition("orders", "3"); err == nil {
+		t.Error("Expected partition 3 to be rejected with MAX_PARTITIONS=3")
+	}
+}
+
+func TestMergeTopicCounts(t *testing.T) {
+	endpoints := []string{"http://b0", "http://b1", "http://b2"}
+	merged := mergeTopicCounts(endpoints, []map[string]int{
+		{"events": 8, "orders": 4},
+		nil, // didn't answer
+		{"events": 8, "orders": 2, "audit": 1},
+	})
+	expected := map[string]int{"events": 8, "orders": 2, "audit": 1}
+	if len(merged) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, merged)
+	}
+	for topic, count := range expected {
+		if merged[topic] != count {
+			t.Errorf("%s: expected %d, got %d", topic, count, merged[topic])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+
+	"github.com/example/telemetry/internal/metrics"
+)
+
+// Default broker connection pool sizes
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+)
+
+// connTracker counts open and in-use connections per broker address and
+// publishes them as Prometheus gauges. Idle connections are the open ones
+// that aren't carrying a request.
+type connTracker struct {
+	mu    sync.Mutex
+	open  map[string]int
+	inUse map[string]int
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		open:  make(map[string]int),
+		inUse: make(map[string]int),
+	}
+}
+
+// update applies deltas for addr and refreshes its gauges
+func (ct *connTracker) update(addr string, openDelta, inUseDelta int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.open[addr] += openDelta
+	ct.inUse[addr] += inUseDelta
+	open, inUse := ct.open[addr], ct.inUse[addr]
+
+	metrics.ProxyBrokerConnsInUse.WithLabelValues("msg-queue-proxy", addr).Set(float64(inUse))
+	// A reused connection can be handed out before its previous response
+	// body is closed, so in-use may briefly exceed open
+	idle := open - inUse
+	if idle < 0 {
+		idle = 0
+	}
+	metrics.ProxyBrokerConnsIdle.WithLabelValues("msg-queue-proxy", addr).Set(float64(idle))
+}
+
+// counts returns the open and in-use connection counts for addr
+func (ct *connTracker) counts(addr string) (open, inUse int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.open[addr], ct.inUse[addr]
+}
+
+// trackedConn decrements the open count for its address once closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// dialContext wraps dial so that every connection it opens is counted
+func (ct *connTracker) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ct.update(addr, 1, 0)
+		return &trackedConn{Conn: conn, onClose: func() { ct.update(addr, -1, 0) }}, nil
+	}
+}
+
+// trackingTransport marks a connection in use from the moment the transport
+// hands it to a request until the response body is closed
+type trackingTransport struct {
+	base    http.RoundTripper
+	tracker *connTracker
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := canonicalAddr(req)
+	acquired := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			acquired = true
+			t.tracker.update(addr, 0, 1)
+			metrics.ProxyBrokerConnsAcquired.WithLabelValues("msg-queue-proxy", addr, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if acquired {
+			t.tracker.update(addr, 0, -1)
+		}
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { t.tracker.update(addr, 0, -1) }}
+	return resp, nil
+}
+
+// releaseBody runs release the first time the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// canonicalAddr returns the host:port the transport dials for req
+func canonicalAddr(req *http.Request) string {
+	if req.URL.Port() != "" {
+		return req.URL.Host
+	}
+	port := "80"
+	if req.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// newBrokerTransport builds the pooled transport used to reach brokers, with
+// connection pool usage reported through tracker. Unset idle pool sizes fall
+// back to the defaults.
+func newBrokerTransport(config ProxyConfig, tracker *connTracker) http.RoundTripper {
+	maxIdle, maxIdlePerHost := config.MaxIdleConns, config.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = defaultMaxIdleConnsPerHost
+	}
+
+	dialer := &net.Dialer{}
+	base := &http.Transport{
+		DialContext:         tracker.dialContext(dialer.DialContext),
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdlePerHost,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		IdleConnTimeout:     config.ConnectionTimeout,
+	}
+	return &trackingTransport{base: base, tracker: tracker}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue reads the current value of a gauge in a vector
+func gaugeValue(t *testing.T, vec *prometheus.GaugeVec, labels ...string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatalf("Failed to read gauge: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// counterValue reads the current value of a counter in a vector
+func counterValue(t *testing.T, vec *prometheus.CounterVec, labels ...string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// waitForGauge polls a gauge until it reaches want or the timeout expires
+func waitForGauge(t *testing.T, vec *prometheus.GaugeVec, want float64, labels ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if gaugeValue(t, vec, labels...) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected gauge %v to reach %v, got %v", labels, want, gaugeValue(t, vec, labels...))
+}
+
+func TestConnectionPoolGauges(t *testing.T) {
+	initTestMetrics()
+
+	// The broker holds every produce until released so the connections stay busy
+	release := make(chan struct{})
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"id":"x"}`))
+	}))
+	t.Cleanup(broker.Close)
+
+	sp := newTestProxy(ProxyConfig{MaxIdleConnsPerHost: 2}, broker.URL)
+	addr := strings.TrimPrefix(broker.URL, "http://")
+
+	const concurrent = 4
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader("payload"))
+			w := httptest.NewRecorder()
+			sp.produceHandler(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", w.Code)
+			}
+		}()
+	}
+
+	waitForGauge(t, metrics.ProxyBrokerConnsInUse, concurrent, "msg-queue-proxy", addr)
+	if idle := gaugeValue(t, metrics.ProxyBrokerConnsIdle, "msg-queue-proxy", addr); idle != 0 {
+		t.Errorf("Expected no idle connections while all are busy, got %v", idle)
+	}
+
+	close(release)
+	wg.Wait()
+
+	waitForGauge(t, metrics.ProxyBrokerConnsInUse, 0, "msg-queue-proxy", addr)
+	// Only MaxIdleConnsPerHost connections are kept; the rest are closed
+	waitForGauge(t, metrics.ProxyBrokerConnsIdle, 2, "msg-queue-proxy", addr)
+	if open, inUse := sp.conns.counts(addr); open != 2 || inUse != 0 {
+		t.Errorf("Expected 2 open and 0 in-use connections, got %d and %d", open, inUse)
+	}
+
+	// A follow-up request reuses a pooled connection instead of dialing
+	before := counterValue(t, metrics.ProxyBrokerConnsAcquired, "msg-queue-proxy", addr, "true")
+	req := httptest.NewRequest("POST", "/produce?topic=telemetry&partition=0", strings.NewReader("payload"))
+	sp.produceHandler(httptest.NewRecorder(), req)
+	if after := counterValue(t, metrics.ProxyBrokerConnsAcquired, "msg-queue-proxy", addr, "true"); after != before+1 {
+		t.Errorf("Expected a reused connection, reuse count went from %v to %v", before, after)
+	}
+}
+
+func TestCanonicalAddr(t *testing.T) {
+	tests := map[string]string{
+		"http://broker-0:8080/produce": "broker-0:8080",
+		"http://broker-0/produce":      "broker-0:80",
+		"https://broker-0/produce":     "broker-0:443",
+	}
+	for raw, expected := range tests {
+		u, _ := url.Parse(raw)
+		if got := canonicalAddr(&http.Request{URL: u}); got != expected {
+			t.Errorf("canonicalAddr(%s) = %s, expected %s", raw, got, expected)
+		}
+	}
+}
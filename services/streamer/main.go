@@ -5,18 +5,34 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/example/telemetry/config"
+	"github.com/example/telemetry/internal/buildinfo"
+	"github.com/example/telemetry/internal/health"
 	"github.com/example/telemetry/internal/metrics"
 	"github.com/example/telemetry/internal/shared"
+	"github.com/example/telemetry/internal/telemetry"
 )
 
 type StreamerService struct {
 	queue  shared.MessageQueue
 	logger *log.Logger
 	config config.Config
+
+	// ready is set once the HTTP server and queue client are up
+	ready health.Readiness
+
+	// pusher sends metrics to a Pushgateway on shutdown; nil unless
+	// PUSHGATEWAY_URL is set
+	pusher *metrics.Pusher
+
+	// serializer encodes rows as TelemetryRecords; nil sends them as JSON
+	// arrays, the default MESSAGE_FORMAT
+	serializer telemetry.Serializer
 }
 
 func NewStreamerService() *StreamerService {
@@ -66,11 +82,63 @@ func NewStreamerService() *StreamerService {
 		logger.Printf("Using Redis stream queue at %s, stream=%s, group=%s, name=%s", redisAddr, stream, group, name)
 	}
 
+	serializer, err := telemetry.NewSerializer(cfg.MessageFormat)
+	if err != nil {
+		logger.Fatalf("Invalid MESSAGE_FORMAT: %v", err)
+	}
+	if serializer.Format() == telemetry.FormatJSON {
+		serializer = nil
+	} else {
+		serializer = telemetry.QueueSerializer(serializer)
+		logger.Printf("Publishing records as %s", serializer.Format())
+	}
+
+	pusher := metrics.NewPusherFromEnv("streamer-service")
+	if pusher != nil {
+		logger.Printf("Pushing metrics to pushgateway at %s", os.Getenv("PUSHGATEWAY_URL"))
+	}
+
 	return &StreamerService{
 		queue:  queue,
 		logger: logger,
 		config: cfg,
+		pusher: pusher,
+
+		serializer: serializer,
+	}
+}
+
+// getCSVRate returns the CSV publish rate in records per second and the burst size.
+// CSV_RATE sets the rate directly; otherwise it is derived from CSV_DELAY_MS (default
+// one record per second). CSV_BURST defaults to 1.
+func getCSVRate() (float64, int) {
+	delay := 1 * time.Second
+	if d := os.Getenv("CSV_DELAY_MS"); d != "" {
+		if ms, err := strconv.Atoi(d); err == nil {
+			delay = time.Duration(ms) * time.Millisecond
+		}
+	}
+	var rate float64
+	if delay > 0 {
+		rate = float64(time.Second) / float64(delay)
+	}
+	if r := os.Getenv("CSV_RATE"); r != "" {
+		if parsed, err := strconv.ParseFloat(r, 64); err == nil && parsed > 0 {
+			rate = parsed
+		} else {
+			log.Printf("Invalid CSV_RATE value '%s', using default: %.2f", r, rate)
+		}
 	}
+
+	burst := 1
+	if b := os.Getenv("CSV_BURST"); b != "" {
+		if parsed, err := strconv.Atoi(b); err == nil && parsed > 0 {
+			burst = parsed
+		} else {
+			log.Printf("Invalid CSV_BURST value '%s', using default: %d", b, burst)
+		}
+	}
+	return rate, burst
 }
 
 func (ps *StreamerService) healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -80,6 +148,8 @@ func (ps *StreamerService) healthHandler(w http.ResponseWriter, r *http.Request)
 
 func (ps *StreamerService) Start() {
 	http.HandleFunc("/health", metrics.HTTPMiddleware("streamer-service", ps.healthHandler))
+	http.HandleFunc("/ready", ps.ready.Handler())
+	http.HandleFunc("/version", buildinfo.Handler("streamer-service"))
 
 	// Add Prometheus metrics endpoint
 	http.Handle("/metrics", metrics.MetricsHandler())
@@ -93,6 +163,8 @@ func (ps *StreamerService) Start() {
 	ps.logger.Printf("Endpoints:")
 	ps.logger.Printf("  POST /telemetry - Publish telemetry data")
 	ps.logger.Printf("  GET  /health    - Health check")
+	ps.logger.Printf("  GET  /ready     - Readiness check")
+	ps.logger.Printf("  GET  /version   - Build information")
 	ps.logger.Printf("  GET  /stats     - Queue statistics")
 
 	// Start HTTP server in a goroutine so health checks work
@@ -104,30 +176,38 @@ func (ps *StreamerService) Start() {
 
 	// Give server time to start
 	time.Sleep(1 * time.Second)
+	ps.ready.SetReady(true)
+	ps.pusher.Start()
 
 	// If CSV_PATH env var is set, stream from CSV but keep server running
 	csvPath := os.Getenv("CSV_PATH")
 	if csvPath != "" {
-		delay := 1 * time.Second
-		if d := os.Getenv("CSV_DELAY_MS"); d != "" {
-			if ms, err := strconv.Atoi(d); err == nil {
-				delay = time.Duration(ms) * time.Millisecond
-			}
+		rate, burst := getCSVRate()
+		if ps.config.CSVDryRun {
+			ps.logger.Printf("Validating telemetry CSV without publishing (dry run): %s", csvPath)
+		} else {
+			ps.logger.Printf("Streaming telemetry from CSV: %s", csvPath)
 		}
-		ps.logger.Printf("Streaming telemetry from CSV: %s", csvPath)
-		if err := ps.StreamCSV(csvPath, delay); err != nil {
+		if err := ps.StreamCSVAtRate(csvPath, rate, burst); err != nil {
 			ps.logger.Printf("CSV streaming failed: %v (service continues running)", err)
 		} else {
 			ps.logger.Println("CSV streaming complete. HTTP server continues running...")
 		}
 	}
 
-	// Keep the main goroutine alive for HTTP server
-	select {}
+	// Keep serving HTTP until asked to stop
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	ps.logger.Println("Shutting down streamer service...")
 }
 
+// Close closes the queue and pushes the final metrics when a pushgateway is configured
 func (ss *StreamerService) Close() {
 	ss.queue.Close()
+	if err := ss.pusher.Stop(); err != nil {
+		ss.logger.Printf("Failed to push metrics to pushgateway: %v", err)
+	}
 }
 
 func main() {
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/example/telemetry/config"
+	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/shared"
+	"github.com/example/telemetry/internal/telemetry"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // MockMessageQueue implements the MessageQueue interface for testing
@@ -465,3 +475,366 @@ func TestMockMessageQueue(t *testing.T) {
 		}
 	})
 }
+
+func TestStreamCSVDryRun(t *testing.T) {
+	csvContent := `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,85.5,"version=535.129.03"
+2023-07-18T20:42:35Z,DCGM_FI_DEV_MEM_COPY_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,72.3,"version=535.129.03"
+2023-07-18T20:42:36Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1
+yesterday,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,85.5,"version=535.129.03"
+2023-07-18T20:42:37Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,high,"version=535.129.03"
+2023-07-18T20:42:38Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA "H100",host,,pod,default,85.5,"version=535.129.03"
+2023-07-18T20:42:39Z,DCGM_FI_DEV_GPU_UTIL,1,nvidia1,GPU-2,NVIDIA H100 80GB HBM3,host,,pod,default,90,"version=535.129.03"
+`
+	tmpFile, err := ioutil.TempFile("", "dry_run_*.csv")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(csvContent); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	var logs bytes.Buffer
+	mockQueue := NewMockMessageQueue()
+	service := &StreamerService{
+		queue:  mockQueue,
+		logger: log.New(&logs, "", 0),
+		config: config.Config{CSVDryRun: true},
+	}
+
+	summary, err := service.validateCSV(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Valid != 3 || summary.Invalid != 4 {
+		t.Errorf("Expected 3 valid and 4 invalid records, got %d and %d", summary.Valid, summary.Invalid)
+	}
+
+	// Dry run returns once the file has been read instead of looping
+	done := make(chan error, 1)
+	go func() {
+		done <- service.StreamCSV(tmpFile.Name(), time.Millisecond)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dry run did not return")
+	}
+
+	if !strings.Contains(logs.String(), "3 valid, 4 invalid records") {
+		t.Errorf("Expected a summary in the logs, got:\n%s", logs.String())
+	}
+	if len(mockQueue.messages) != 0 {
+		t.Errorf("Expected nothing to be published, got %v", mockQueue.messages)
+	}
+}
+
+func TestClosePushesMetrics(t *testing.T) {
+	pushed := make(chan string, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case pushed <- r.Method + " " + r.URL.Path:
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(gateway.Close)
+	t.Setenv("PUSHGATEWAY_URL", gateway.URL)
+
+	mockQueue := NewMockMessageQueue()
+	service := &StreamerService{
+		queue:  mockQueue,
+		logger: log.New(ioutil.Discard, "", 0),
+		pusher: metrics.NewPusherFromEnv("streamer-service"),
+	}
+	service.Close()
+
+	if !mockQueue.closed {
+		t.Error("Expected the queue to be closed")
+	}
+	select {
+	case got := <-pushed:
+		if !strings.HasPrefix(got, "PUT /metrics/job/streamer-service") {
+			t.Errorf("Expected a push for the streamer-service job, got %s", got)
+		}
+	default:
+		t.Fatal("Expected Close to push metrics to the pushgateway")
+	}
+}
+
+// writeTempCSV writes content to a temporary file removed when the test ends
+func writeTempCSV(t *testing.T, content string) string {
+	t.Helper()
+	tmpFile, err := ioutil.TempFile(t.TempDir(), "export_*.csv")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	if _, err := tmpFile.WriteString(content); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+	tmpFile.Close()
+	return tmpFile.Name()
+}
+
+func TestCSVTabDelimited(t *testing.T) {
+	rows := []string{
+		"timestamp\tmetric_name\tgpu_id\tdevice\tuuid\tmodelName\tHostname\tcontainer\tpod\tnamespace\tvalue\tlabels_raw",
+		"2023-07-18T20:42:34Z\tDCGM_FI_DEV_GPU_UTIL\t0\tnvidia0\tGPU-1\tNVIDIA H100 80GB HBM3\thost\t\tpod\tdefault\t85.5\tversion=535.129.03,driver=1",
+		"2023-07-18T20:42:35Z\tDCGM_FI_DEV_GPU_UTIL\t1\tnvidia1\tGPU-2\tNVIDIA H100 80GB HBM3\thost\t\tpod\tdefault\t90\tversion=535.129.03",
+	}
+	path := writeTempCSV(t, strings.Join(rows, "\n")+"\n")
+
+	service := &StreamerService{
+		queue:  NewMockMessageQueue(),
+		logger: log.New(ioutil.Discard, "", 0),
+		config: config.Config{CSVDelimiter: '\t'},
+	}
+	summary, err := service.validateCSV(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Valid != 2 || summary.Invalid != 0 {
+		t.Errorf("Expected 2 valid and 0 invalid records, got %d and %d", summary.Valid, summary.Invalid)
+	}
+
+	// Commas inside a tab-separated field are kept as data
+	rec, err := service.newCSVReader(strings.NewReader(rows[1])).Read()
+	if err != nil {
+		t.Fatalf("Failed to read record: %v", err)
+	}
+	if len(rec) != 12 || rec[10] != "85.5" || rec[11] != "version=535.129.03,driver=1" {
+		t.Errorf("Unexpected tab-delimited record: %q", rec)
+	}
+}
+
+func TestCSVLazyQuotes(t *testing.T) {
+	path := writeTempCSV(t, `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA "H100",host,,pod,default,85.5,"version=535.129.03"
+2023-07-18T20:42:35Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100,host,,pod,default,72.3,"version "535""
+`)
+
+	strict := &StreamerService{logger: log.New(ioutil.Discard, "", 0)}
+	summary, err := strict.validateCSV(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Valid != 0 || summary.Invalid != 2 {
+		t.Errorf("Expected irregular quoting to be rejected by default, got %d valid and %d invalid", summary.Valid, summary.Invalid)
+	}
+
+	lazy := &StreamerService{logger: log.New(ioutil.Discard, "", 0), config: config.Config{CSVLazyQuotes: true}}
+	summary, err = lazy.validateCSV(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Valid != 2 || summary.Invalid != 0 {
+		t.Errorf("Expected lazy quotes to accept both records, got %d valid and %d invalid", summary.Valid, summary.Invalid)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open CSV: %v", err)
+	}
+	defer f.Close()
+	records, err := lazy.newCSVReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	if got := records[1][5]; got != `NVIDIA "H100"` {
+		t.Errorf("Expected the bare quotes to be kept, got %q", got)
+	}
+}
+
+func TestCSVDelimiterFromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected rune
+	}{
+		{"", ','},
+		{";", ';'},
+		{`\t`, '\t'},
+		{"tab", '\t'},
+		{"|", '|'},
+		{";;", ','},
+		{`"`, ','},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("CSV_DELIMITER", tt.value)
+		if got := config.Load().CSVDelimiter; got != tt.expected {
+			t.Errorf("CSV_DELIMITER=%q: expected %q, got %q", tt.value, tt.expected, got)
+		}
+	}
+}
+
+// skippedRecords reads the streamer's skipped-row counter for reason
+func skippedRecords(t *testing.T, reason string) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.StreamerRecordsSkipped.WithLabelValues(reason).Write(m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// stoppingQueue records published messages and cancels the stream once it has
+// seen the expected number
+type stoppingQueue struct {
+	MockMessageQueue
+	want   int
+	cancel context.CancelFunc
+}
+
+func (q *stoppingQueue) Publish(topic string, message []byte) error {
+	q.MockMessageQueue.Publish(topic, message)
+	if len(q.messages[topic]) == q.want {
+		q.cancel()
+	}
+	return nil
+}
+
+func TestStreamCSVSkipsMalformedRows(t *testing.T) {
+	path := writeTempCSV(t, `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100,host,,pod,default,85.5,a=1
+2023-07-18T20:42:35Z,DCGM_FI_DEV_GPU_UTIL,1,nvidia1,GPU-2,NVIDIA "H100",host,,pod,default,90,a=1
+2023-07-18T20:42:36Z,DCGM_FI_DEV_GPU_UTIL,2,nvidia2,GPU-3
+2023-07-18T20:42:37Z,DCGM_FI_DEV_GPU_UTIL,3,nvidia3,GPU-4,NVIDIA H100,host,,pod,default,70,a=1
+2023-07-18T20:42:38Z,DCGM_FI_DEV_GPU_UTIL,4,nvidia4,GPU-5,NVIDIA H100,host,,pod,default,60,a=1
+`)
+	malformed := skippedRecords(t, "malformed")
+	incomplete := skippedRecords(t, "incomplete")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := &stoppingQueue{MockMessageQueue: *NewMockMessageQueue(), want: 3, cancel: cancel}
+	service := &StreamerService{queue: queue, logger: log.New(ioutil.Discard, "", 0)}
+
+	done := make(chan error, 1)
+	go func() { done <- service.streamCSV(ctx, path, newTokenBucket(0, 1)) }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Expected the stream to run until cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the stream to publish the valid rows")
+	}
+
+	var gpus []string
+	for _, body := range queue.messages["telemetry"] {
+		var rec []string
+		if err := json.Unmarshal(body, &rec); err != nil {
+			t.Fatalf("Failed to decode published record: %v", err)
+		}
+		gpus = append(gpus, rec[4])
+	}
+	if strings.Join(gpus, ",") != "GPU-1,GPU-4,GPU-5" {
+		t.Errorf("Expected the rows around the bad ones to be published, got %v", gpus)
+	}
+
+	if got := skippedRecords(t, "malformed") - malformed; got != 1 {
+		t.Errorf("Expected 1 malformed row to be counted, got %v", got)
+	}
+	if got := skippedRecords(t, "incomplete") - incomplete; got != 1 {
+		t.Errorf("Expected 1 incomplete row to be counted, got %v", got)
+	}
+}
+
+func TestStreamCSVHonorsRetryAfter(t *testing.T) {
+	path := writeTempCSV(t, `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100,host,,pod,default,85.5,a=1
+`)
+	// The broker's partition is above its high watermark for the first publish
+	var produces int32
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/produce" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt32(&produces, 1) == 1 {
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "partition telemetry-0 is above its high watermark, slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"abc","partition":0,"offset":0}`))
+	}))
+	defer broker.Close()
+	queue, err := shared.NewHTTPMessageQueue(broker.URL, "telemetry", "group", "retry-after-test")
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	defer queue.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var waits []time.Duration
+	origSleep := retrySleep
+	retrySleep = func(d time.Duration) {
+		waits = append(waits, d)
+		cancel()
+	}
+	t.Cleanup(func() { retrySleep = origSleep })
+
+	service := &StreamerService{queue: queue, logger: log.New(ioutil.Discard, "", 0)}
+	if err := service.streamCSV(ctx, path, newTokenBucket(0, 1)); err != context.Canceled {
+		t.Fatalf("Expected the stream to run until cancelled, got %v", err)
+	}
+
+	if len(waits) != 1 || waits[0] != 7*time.Second {
+		t.Errorf("Expected one retry after the broker's 7s, got %v", waits)
+	}
+	if n := atomic.LoadInt32(&produces); n != 2 {
+		t.Errorf("Expected the record to be published on the retry, got %d produces", n)
+	}
+}
+
+func TestStreamCSVProtobufFormat(t *testing.T) {
+	path := writeTempCSV(t, `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100,host,ctr,pod,default,85.5,a=1
+2023-07-18T20:42:35Z,DCGM_FI_DEV_GPU_UTIL,1,nvidia1,GPU-2,NVIDIA H100,host,ctr,pod,default,n/a,a=1
+2023-07-18T20:42:36Z,DCGM_FI_DEV_GPU_UTIL,2,nvidia2,GPU-3,NVIDIA H100,host,ctr,pod,default,70,a=1
+`)
+	invalid := skippedRecords(t, "invalid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := &stoppingQueue{MockMessageQueue: *NewMockMessageQueue(), want: 2, cancel: cancel}
+	service := &StreamerService{queue: queue, logger: log.New(ioutil.Discard, "", 0), serializer: telemetry.QueueSerializer(telemetry.ProtobufSerializer{})}
+
+	done := make(chan error, 1)
+	go func() { done <- service.streamCSV(ctx, path, newTokenBucket(0, 1)) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the stream to publish the valid rows")
+	}
+
+	var records []telemetry.TelemetryRecord
+	for _, body := range queue.messages["telemetry"] {
+		var record telemetry.TelemetryRecord
+		if err := telemetry.QueueSerializer(telemetry.ProtobufSerializer{}).Unmarshal(body, &record); err != nil {
+			t.Fatalf("Failed to decode published record: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].UUID != "GPU-1" || records[1].UUID != "GPU-3" {
+		t.Fatalf("Expected GPU-1 and GPU-3 to be published, got %+v", records)
+	}
+	want := telemetry.TelemetryRecord{
+		DeviceID: "nvidia0", Metric: "DCGM_FI_DEV_GPU_UTIL", Value: 85.5,
+		Time:  time.Date(2023, 7, 18, 20, 42, 34, 0, time.UTC),
+		GPUID: "0", UUID: "GPU-1", ModelName: "NVIDIA H100", Hostname: "host",
+		Container: "ctr", Pod: "pod", Namespace: "default", LabelsRaw: "a=1",
+	}
+	if records[0] != want {
+		t.Errorf("Expected fields mapped by position:\n got %+v\nwant %+v", records[0], want)
+	}
+	if got := skippedRecords(t, "invalid") - invalid; got != 1 {
+		t.Errorf("Expected 1 invalid row to be counted, got %v", got)
+	}
+}
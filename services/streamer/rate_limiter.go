@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket paces work to a steady rate. Tokens accrue at rate per second up
+// to burst, and each Wait takes one, blocking until it is available. Because the
+// bucket tracks elapsed time rather than sleeping a fixed amount, time spent
+// between calls (such as a slow publish) counts towards the next token.
+type tokenBucket struct {
+	rate  float64 // tokens per second; 0 or less disables limiting
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket. A burst below 1 is treated as 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token at time now and returns how long the caller must wait
+// before using it. Tokens may go negative, which queues later callers behind it.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available or ctx is done
+func (tb *tokenBucket) Wait(ctx context.Context) error {
+	wait := tb.reserve(time.Now())
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
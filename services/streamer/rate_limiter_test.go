@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb := newTokenBucket(10, 2) // one token every 100ms, bursts of 2
+	start := tb.last
+
+	// The bucket starts full, so the first burst goes out immediately
+	for i := 0; i < 2; i++ {
+		if wait := tb.reserve(start); wait != 0 {
+			t.Fatalf("Reservation %d: expected no wait within the burst, got %v", i, wait)
+		}
+	}
+
+	// Further reservations queue up 100ms apart
+	if wait := tb.reserve(start); wait != 100*time.Millisecond {
+		t.Errorf("Expected a 100ms wait, got %v", wait)
+	}
+	if wait := tb.reserve(start); wait != 200*time.Millisecond {
+		t.Errorf("Expected a 200ms wait, got %v", wait)
+	}
+
+	// Time spent elsewhere pays down the debt
+	if wait := tb.reserve(start.Add(250 * time.Millisecond)); wait != 50*time.Millisecond {
+		t.Errorf("Expected a 50ms wait after 250ms elapsed, got %v", wait)
+	}
+
+	// A long idle period refills at most burst tokens
+	later := start.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if wait := tb.reserve(later); wait != 0 {
+			t.Errorf("Reservation %d after idling: expected no wait, got %v", i, wait)
+		}
+	}
+	if wait := tb.reserve(later); wait != 100*time.Millisecond {
+		t.Errorf("Expected the burst to be capped, got a %v wait", wait)
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	tb := newTokenBucket(0, 1)
+	for i := 0; i < 100; i++ {
+		if wait := tb.reserve(time.Now()); wait != 0 {
+			t.Fatalf("Expected no wait without a rate, got %v", wait)
+		}
+	}
+}
+
+func TestTokenBucketWaitCancelled(t *testing.T) {
+	tb := newTokenBucket(1, 1)
+	tb.Wait(context.Background()) // use up the initial token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tb.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Wait took %v after its context expired", elapsed)
+	}
+}
+
+// slowQueue records publish times and takes latency to publish each message
+type slowQueue struct {
+	latency time.Duration
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (q *slowQueue) Publish(topic string, body []byte) error {
+	time.Sleep(q.latency)
+	q.mu.Lock()
+	q.times = append(q.times, time.Now())
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *slowQueue) Subscribe(handler func(topic string, body []byte, id string) error) error {
+	return nil
+}
+
+func (q *slowQueue) Close() error { return nil }
+
+func TestStreamCSVRateWithSlowPublish(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "telemetry.csv")
+	csvContent := `timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
+2023-07-18T20:42:34Z,DCGM_FI_DEV_GPU_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,85.5,"version=535.129.03"
+2023-07-18T20:42:35Z,DCGM_FI_DEV_MEM_COPY_UTIL,0,nvidia0,GPU-1,NVIDIA H100 80GB HBM3,host,,pod,default,72.3,"version=535.129.03"
+`
+	if err := os.WriteFile(csvPath, []byte(csvContent), 0o644); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+
+	// Each publish takes 15ms; a fixed 25ms sleep would drift to one every 40ms
+	const rate = 40.0
+	queue := &slowQueue{latency: 15 * time.Millisecond}
+	service := &StreamerService{queue: queue, logger: log.New(io.Discard, "", 0)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	if err := service.streamCSV(ctx, csvPath, newTokenBucket(rate, 1)); err != context.DeadlineExceeded {
+		t.Fatalf("Expected streaming to stop at the deadline, got %v", err)
+	}
+
+	queue.mu.Lock()
+	times := queue.times
+	queue.mu.Unlock()
+	if len(times) < 10 {
+		t.Fatalf("Expected at least 10 publishes, got %d", len(times))
+	}
+
+	interval := times[len(times)-1].Sub(times[0]) / time.Duration(len(times)-1)
+	target := time.Duration(float64(time.Second) / rate)
+	if interval < target*8/10 || interval > target*12/10 {
+		t.Errorf("Expected an average interval near %v, got %v over %d publishes", target, interval, len(times))
+	}
+}
+
+func TestGetCSVRate(t *testing.T) {
+	tests := []struct {
+		name          string
+		delay, r, b   string
+		expectedRate  float64
+		expectedBurst int
+	}{
+		{"defaults", "", "", "", 1, 1},
+		{"from delay", "20", "", "", 50, 1},
+		{"rate overrides delay", "20", "200", "5", 200, 5},
+		{"invalid values", "", "fast", "-1", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CSV_DELAY_MS", tt.delay)
+			t.Setenv("CSV_RATE", tt.r)
+			t.Setenv("CSV_BURST", tt.b)
+			rate, burst := getCSVRate()
+			if rate != tt.expectedRate || burst != tt.expectedBurst {
+				t.Errorf("Expected rate %v burst %d, got %v and %d", tt.expectedRate, tt.expectedBurst, rate, burst)
+			}
+		})
+	}
+}
@@ -1,26 +1,177 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/example/telemetry/internal/metrics"
+	"github.com/example/telemetry/internal/shared"
+	"github.com/example/telemetry/internal/telemetry"
 )
 
-// StreamCSV reads telemetry data from a CSV file and publishes the entire CSV record to the queue.
+// retrySleep pauses between publish attempts; tests replace it
+var retrySleep = time.Sleep
+
+// StreamCSV reads telemetry data from a CSV file and publishes the entire CSV record to the queue,
+// one record per delay on average.
 // CSV format: timestamp,metric_name,gpu_id,device,uuid,modelName,Hostname,container,pod,namespace,value,labels_raw
 func (ss *StreamerService) StreamCSV(filePath string, delay time.Duration) error {
+	var rate float64
+	if delay > 0 {
+		rate = float64(time.Second) / float64(delay)
+	}
+	return ss.StreamCSVAtRate(filePath, rate, 1)
+}
+
+// StreamCSVAtRate streams a CSV file like StreamCSV, pacing publishes with a token bucket of
+// rate records per second that allows bursts of up to burst records. Time spent publishing
+// counts towards the pacing, so slow publishes don't lower the overall rate. A rate of 0
+// or less publishes as fast as possible.
+//
+// In dry-run mode (CSV_DRY_RUN) the file is validated once instead, nothing is published
+// and the function returns after logging a summary.
+func (ss *StreamerService) StreamCSVAtRate(filePath string, rate float64, burst int) error {
+	if ss.config.CSVDryRun {
+		summary, err := ss.validateCSV(filePath)
+		if err != nil {
+			return err
+		}
+		ss.logger.Printf("CSV dry run complete: %d valid, %d invalid records", summary.Valid, summary.Invalid)
+		return nil
+	}
+	return ss.streamCSV(context.Background(), filePath, newTokenBucket(rate, burst))
+}
+
+// newCSVReader reads r with the configured delimiter (CSV_DELIMITER) and quoting
+// (CSV_LAZY_QUOTES). Rows may have any number of fields; callers check the
+// count themselves so a short row is skipped rather than failing the read.
+func (ss *StreamerService) newCSVReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	if ss.config.CSVDelimiter != 0 {
+		reader.Comma = ss.config.CSVDelimiter
+	}
+	reader.LazyQuotes = ss.config.CSVLazyQuotes
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// csvSummary counts the records checked by a dry run
+type csvSummary struct {
+	Valid   int
+	Invalid int
+}
+
+// validateRecord checks that a record has every field and that its timestamp and value parse
+func validateRecord(rec []string) error {
+	if len(rec) < 12 {
+		return fmt.Errorf("expected 12 fields, got %d", len(rec))
+	}
+	if _, err := time.Parse(time.RFC3339, rec[0]); err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", rec[0])
+	}
+	if _, err := strconv.ParseFloat(rec[10], 64); err != nil {
+		return fmt.Errorf("invalid value '%s'", rec[10])
+	}
+	return nil
+}
+
+// encodeRow encodes a row for the queue. With the default JSON format the row
+// is sent as a JSON array of its fields, which every collector reads; other
+// formats send it parsed into a TelemetryRecord.
+func (ss *StreamerService) encodeRow(rec []string) ([]byte, error) {
+	if ss.serializer == nil {
+		return json.Marshal(rec)
+	}
+	record, err := recordFromRow(rec)
+	if err != nil {
+		return nil, err
+	}
+	return ss.serializer.Marshal(record)
+}
+
+// recordFromRow maps the fields of a CSV row to a TelemetryRecord
+func recordFromRow(rec []string) (telemetry.TelemetryRecord, error) {
+	if err := validateRecord(rec); err != nil {
+		return telemetry.TelemetryRecord{}, err
+	}
+	timestamp, _ := time.Parse(time.RFC3339, rec[0])
+	value, _ := strconv.ParseFloat(rec[10], 64)
+	return telemetry.TelemetryRecord{
+		DeviceID:  rec[3],
+		Metric:    rec[1],
+		Value:     value,
+		Time:      timestamp,
+		GPUID:     rec[2],
+		UUID:      rec[4],
+		ModelName: rec[5],
+		Hostname:  rec[6],
+		Container: rec[7],
+		Pod:       rec[8],
+		Namespace: rec[9],
+		LabelsRaw: rec[11],
+	}, nil
+}
+
+// validateCSV reads filePath once, checking every record after the header
+func (ss *StreamerService) validateCSV(filePath string) (csvSummary, error) {
+	var summary csvSummary
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+
+	r := ss.newCSVReader(f)
+
+	if _, err := r.Read(); err != nil {
+		if err == io.EOF {
+			return summary, nil
+		}
+		return summary, err
+	}
+
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			// Parse errors already carry the line number
+			summary.Invalid++
+			ss.logger.Printf("Invalid record: %v", err)
+			continue
+		}
+		if err := validateRecord(rec); err != nil {
+			line, _ := r.FieldPos(0)
+			summary.Invalid++
+			ss.logger.Printf("Invalid record at line %d: %v", line, err)
+			continue
+		}
+		summary.Valid++
+	}
+}
+
+// streamCSV publishes records from filePath until ctx is cancelled or reading
+// fails. Malformed and incomplete rows are logged, counted and skipped; only
+// errors reading the file itself stop the stream.
+func (ss *StreamerService) streamCSV(ctx context.Context, filePath string, limiter *tokenBucket) error {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	r := csv.NewReader(f)
+	r := ss.newCSVReader(f)
 	recordCount := 0
-	ss.logger.Printf("Starting CSV streaming with %v delay between records", delay)
+	ss.logger.Printf("Starting CSV streaming at %.2f records/sec (burst %.0f)", limiter.rate, limiter.burst)
 
 	// Skip the header row on first read
 	skipHeader := true
@@ -32,10 +183,18 @@ func (ss *StreamerService) StreamCSV(filePath string, delay time.Duration) error
 			if err.Error() == "EOF" {
 				ss.logger.Printf("Reached end of CSV file, restarting from beginning (processed %d records so far)", recordCount)
 				f.Seek(0, 0)
-				r = csv.NewReader(f)
+				r = ss.newCSVReader(f)
 				skipHeader = true // Reset header skip flag when restarting
 				continue
 			}
+			// The reader resumes at the next row after a parse error
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				ss.logger.Printf("Skipping malformed record: %v", err)
+				metrics.RecordStreamerRecordSkipped("malformed")
+				skipHeader = false
+				continue
+			}
 			return err
 		}
 
@@ -48,16 +207,22 @@ func (ss *StreamerService) StreamCSV(filePath string, delay time.Duration) error
 
 		if len(rec) < 12 {
 			ss.logger.Printf("Skipping incomplete record (only %d fields)", len(rec))
+			metrics.RecordStreamerRecordSkipped("incomplete")
 			continue
 		}
 
-		// Send the entire CSV record as JSON array
-		msgBody, err := json.Marshal(rec)
+		msgBody, err := ss.encodeRow(rec)
 		if err != nil {
-			ss.logger.Printf("Failed to marshal record %d: %v", recordCount, err)
+			ss.logger.Printf("Skipping record that can't be encoded: %v", err)
+			metrics.RecordStreamerRecordSkipped("invalid")
 			continue
 		}
 
+		// Wait for the rate limiter before publishing
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
 		recordCount++
 
 		// Retry publish with exponential backoff
@@ -69,8 +234,12 @@ func (ss *StreamerService) StreamCSV(filePath string, delay time.Duration) error
 					ss.logger.Printf("Failed to publish record %d after %d attempts: %v (skipping)", recordCount, maxRetries, err)
 				} else {
 					retryDelay := time.Duration(attempt+1) * time.Second
+					// A throttled publish says how long the broker wants us to back off
+					if wait := shared.RetryAfter(err); wait > 0 {
+						retryDelay = wait
+					}
 					ss.logger.Printf("Failed to publish record %d (attempt %d/%d): %v (retrying in %v)", recordCount, attempt+1, maxRetries, err, retryDelay)
-					time.Sleep(retryDelay)
+					retrySleep(retryDelay)
 				}
 			} else {
 				published = true
@@ -88,8 +257,6 @@ func (ss *StreamerService) StreamCSV(filePath string, delay time.Duration) error
 			ss.logger.Printf("Published record %d: GPU ID=%s, Metric=%s, Timestamp=%s",
 				recordCount, rec[2], rec[1], rec[0])
 		}
-
-		time.Sleep(delay)
 	}
 	// Note: This function runs an infinite loop, so this return is never reached
 }